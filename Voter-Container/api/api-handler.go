@@ -1,200 +1,3492 @@
 package api
 
 import (
-	"log"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
+	"reflect"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"drexel.edu/voter/db"
+	"drexel.edu/voter/events"
+	"drexel.edu/voter/logging"
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+	"github.com/gorilla/websocket"
+	"github.com/redis/go-redis/v9"
 )
 
 // The api package creates and maintains a reference to the data handler
 // this is a good design practice
 type VoterAPI struct {
 	db *db.VoterList
+
+	//bookkeeping reported by the health check, errorsByType breaks
+	//errorCount down for GET /stats/errors
+	startTime    time.Time
+	errorCount   atomic.Int64
+	errorsByType [numErrorTypes]atomic.Int64
+
+	//latencyThreshold is how slow a redis PING may be before the health
+	//check reports the service as degraded
+	latencyThreshold time.Duration
+
+	//voterCount is the count the health check last took and countedAt
+	//when, so probes in quick succession do not each scan every voter
+	countMu    sync.Mutex
+	voterCount int
+	countedAt  time.Time
+
+	//votes fans the votes the voter list records out to the clients
+	//streaming them from /ws/votes, stopVotes ends the subscription to the
+	//redis votes channel when there is one
+	votes     *events.Broker
+	stopVotes context.CancelFunc
 }
 
+// DefaultLatencyThreshold is the redis PING latency above which the health
+// check reports the service as degraded
+const DefaultLatencyThreshold = 100 * time.Millisecond
+
+// healthCountMaxAge is how long the health check reuses a voter count
+// before counting again, GET /stats always counts afresh
+const healthCountMaxAge = 30 * time.Second
+
 func New() (*VoterAPI, error) {
 	dbHandler, err := db.New()
 	if err != nil {
 		return nil, err
 	}
 
-	return &VoterAPI{db: dbHandler}, nil
+	return newVoterAPI(dbHandler), nil
+}
+
+// NewWithCacheInstance creates the API against the redis instance at the
+// provided location rather than the one configured in the environment
+func NewWithCacheInstance(location string) (*VoterAPI, error) {
+	dbHandler, err := db.NewWithCacheInstance(location)
+	if err != nil {
+		return nil, err
+	}
+
+	return newVoterAPI(dbHandler), nil
+}
+
+// NewWithFallback is New, except that when redis cannot be reached the
+// voters are kept in process memory instead, see db.NewInMemory.  Any other
+// error, such as a bad REDIS_URL, is still returned.
+func NewWithFallback() (*VoterAPI, error) {
+	dbHandler, err := db.New()
+	if errors.Is(err, db.ErrUnreachable) {
+		slog.Warn("Redis is unreachable, keeping voters in memory, nothing will be saved when the server stops", "error", err)
+		dbHandler, err = db.NewInMemory()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return newVoterAPI(dbHandler), nil
+}
+
+// InMemory reports whether the voters are kept in process memory rather
+// than in redis
+func (v *VoterAPI) InMemory() bool {
+	return v.db.InMemory()
+}
+
+func newVoterAPI(dbHandler *db.VoterList) *VoterAPI {
+	votes := events.New(events.DefaultBuffer)
+	dbHandler.SetVoteHook(votes.Publish)
+
+	return &VoterAPI{
+		db:               dbHandler,
+		startTime:        time.Now(),
+		latencyThreshold: DefaultLatencyThreshold,
+		votes:            votes,
+	}
+}
+
+// SetLatencyThreshold changes how slow a redis PING may be before the
+// health check reports the service as degraded, values less than 1 restore
+// the default
+func (v *VoterAPI) SetLatencyThreshold(threshold time.Duration) {
+	if threshold < 1 {
+		threshold = DefaultLatencyThreshold
+	}
+	v.latencyThreshold = threshold
+}
+
+// SetMaxVoteHistory caps how many votes a voter can have, see
+// db.VoterList.SetMaxVoteHistory.  New reads the cap from MAX_VOTE_HISTORY
+// already, this is for an API made with NewWithCacheInstance.
+func (v *VoterAPI) SetMaxVoteHistory(limit int, policy db.VoteHistoryPolicy) error {
+	return v.db.SetMaxVoteHistory(limit, policy)
+}
+
+// SetVotesChannel shares votes through the redis pub/sub channel, so the
+// clients streaming votes from this instance also see the votes made
+// through every other instance using the same redis and channel.  It
+// should be called once, before serving requests.
+func (v *VoterAPI) SetVotesChannel(channel string) error {
+	if channel == "" {
+		return nil
+	}
+
+	v.db.SetVotesChannel(channel)
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := v.db.SubscribeVotes(ctx, v.votes.Publish); err != nil {
+		cancel()
+		v.db.SetVotesChannel("")
+		return err
+	}
+	//Votes made here come back through the channel too, handing them to
+	//the broker directly as well would send them twice
+	v.db.SetVoteHook(nil)
+	v.stopVotes = cancel
+	return nil
+}
+
+// Close shuts down the data handler, releasing the redis connection
+func (v *VoterAPI) Close() error {
+	if v.stopVotes != nil {
+		v.stopVotes()
+	}
+	return v.db.Close()
+}
+
+// dbFor returns the voter list bound to the request's context, so redis
+// commands are dropped if the client goes away and their errors are logged
+// with the request id
+func (v *VoterAPI) dbFor(c *gin.Context) *db.VoterList {
+	return v.db.WithContext(c.Request.Context())
+}
+
+// dbForQuery is dbFor, but with ?includeDeleted=true the voter list also
+// returns soft deleted voters.  An invalid flag aborts with 400.
+func (v *VoterAPI) dbForQuery(c *gin.Context) (*db.VoterList, bool) {
+	includeDeleted, err := strconv.ParseBool(c.DefaultQuery("includeDeleted", "false"))
+	if err != nil {
+		logger(c).Warn("Invalid includeDeleted flag", "error", err)
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "includeDeleted must be true or false")
+		return nil, false
+	}
+	if includeDeleted {
+		return v.dbFor(c).IncludeDeleted(), true
+	}
+	return v.dbFor(c), true
+}
+
+// logger returns the structured logger for the request, tagged with its
+// request id
+func logger(c *gin.Context) *slog.Logger {
+	return logging.FromContext(c.Request.Context())
+}
+
+// AddRedisHook installs a go-redis hook on the underlying redis client
+func (v *VoterAPI) AddRedisHook(hook redis.Hook) {
+	v.db.AddHook(hook)
+}
+
+// CountVoters returns how many voters are stored
+func (v *VoterAPI) CountVoters() (int, error) {
+	return v.db.CountVoters()
+}
+
+// TotalCountHeader carries the number of stored voters on list responses,
+// whichever page of them is returned, for clients that page through them
+const TotalCountHeader = "X-Total-Count"
+
+// MissingIdsHeader lists the ids asked for with GET /voter?ids= that have
+// no voter, comma separated
+const MissingIdsHeader = "X-Missing-Ids"
+
+// ServerTimeHeader carries the time the server read the vote history,
+// which a client syncing with GET /voter/:id/polls?since= sends as the next
+// since
+const ServerTimeHeader = "X-Server-Time"
+
+// SkippedVotersHeader says how many stored voters were left out of a list
+// because they could not be read, it is only sent when there are some
+const SkippedVotersHeader = "X-Skipped-Voters"
+
+// setSkippedHeader sets the SkippedVotersHeader when the lists made with
+// voters left any out
+func setSkippedHeader(c *gin.Context, voters *db.VoterList) {
+	if skipped := voters.Skipped(); skipped > 0 {
+		c.Header(SkippedVotersHeader, strconv.Itoa(skipped))
+	}
+}
+
+// maxVoterIds is how many ids GET /voter?ids= takes at once
+const maxVoterIds = 500
+
+// defaultPageLimit is used when a client asks for a page by offset only
+const defaultPageLimit = 50
+
+// VoterPage wraps a page of voters with the information a client needs to
+// request the next one
+type VoterPage struct {
+	Voters []db.Voter `json:"voters"`
+	Total  int        `json:"total"`
+	Offset int        `json:"offset"`
+	Limit  int        `json:"limit"`
+	Count  int        `json:"count"`
 }
 
+// ListAllVoters returns the voters ordered by ?sort=id|name|polls, polls
+// being the number of votes cast, and ?order=asc|desc.  The default is
+// ascending by id.  ?fields=VoterId,Name returns only those fields of each
+// voter.  ?ids=1,2,3 returns just those voters, in that order, and can not
+// be combined with sorting or paging.  ?tz= sends the vote dates in that
+// time zone, see tzQuery.
+//
+// @Summary  List voters
+// @Tags     voters
+// @Produce  json
+// @Param    sort query string false "Sort by" Enums(id, name, polls)
+// @Param    order query string false "Sort order" Enums(asc, desc)
+// @Param    offset query int false "Voters to skip, turns on paging"
+// @Param    limit query int false "Voters per page, turns on paging"
+// @Param    includeDeleted query bool false "Also list soft deleted voters"
+// @Param    fields query string false "Comma separated fields to return, such as VoterId,Name"
+// @Param    ids query string false "Comma separated ids of the voters to return"
+// @Param    tz query string false "IANA time zone to send vote dates in, such as America/New_York"
+// @Description With offset or limit the answer is a VoterPage rather than an array
+// @Success  200 {array} db.Voter
+// @Header   200 {integer} X-Total-Count "Number of stored voters"
+// @Header   200 {string} X-Missing-Ids "Ids asked for with no voter"
+// @Header   200 {integer} X-Skipped-Voters "Stored voters that could not be read"
+// @Failure  400 {object} ErrorBody
+// @Failure  503 {object} ErrorBody
+// @Router   /voter [get]
+// @Security ApiKeyAuth
 func (v *VoterAPI) ListAllVoters(c *gin.Context) {
 
-	voterList, err := v.db.GetAllVoters()
+	sortBy, desc, ok := sortParams(c)
+	if !ok {
+		return
+	}
+	voters, ok := v.dbForQuery(c)
+	if !ok {
+		return
+	}
+	fields, ok := fieldsParam(c, db.Voter{})
+	if !ok {
+		return
+	}
+	loc, ok := tzQuery(c)
+	if !ok {
+		return
+	}
+
+	_, hasLimit := c.GetQuery("limit")
+	_, hasOffset := c.GetQuery("offset")
+	if _, hasIds := c.GetQuery("ids"); hasIds {
+		_, hasSort := c.GetQuery("sort")
+		_, hasOrder := c.GetQuery("order")
+		if hasSort || hasOrder || hasLimit || hasOffset {
+			respondError(c, http.StatusBadRequest, CodeBadRequest, "ids can not be combined with sort, order, offset or limit")
+			return
+		}
+		v.listVotersByIds(c, voters, fields, loc)
+		return
+	}
+
+	//Paging is opt in, without limit or offset the full list is returned
+	//as a plain array like it always has been
+	if hasLimit || hasOffset {
+		v.listVotersPaged(c, voters, sortBy, desc, fields, loc)
+		return
+	}
+
+	voterList, err := voters.GetAllVotersSorted(sortBy, desc)
 	if err != nil {
-		log.Println("Error Getting All Items: ", err)
-		c.AbortWithStatus(http.StatusNotFound)
+		logger(c).Error("Error Getting All Items", "error", err)
+		abortWithDbError(c, err)
 		return
 	}
 
 	if voterList == nil {
 		voterList = make([]db.Voter, 0)
 	}
+	votersIn(voterList, loc)
+
+	resp, err := projectVoters(voterList, fields)
+	if err != nil {
+		logger(c).Error("Error projecting voters", "error", err)
+		respondError(c, http.StatusInternalServerError, CodeInternal, "internal server error")
+		return
+	}
+
+	c.Header(TotalCountHeader, strconv.Itoa(len(voterList)))
+	setSkippedHeader(c, voters)
+	c.JSON(http.StatusOK, resp)
+}
 
+// ListInactiveVoters returns the voters who have not voted in any poll
+//
+// @Summary  List voters who have not voted
+// @Tags     voters
+// @Produce  json
+// @Success  200 {array} db.Voter
+// @Failure  503 {object} ErrorBody
+// @Router   /voter/inactive [get]
+// @Security ApiKeyAuth
+func (v *VoterAPI) ListInactiveVoters(c *gin.Context) {
+	voters := v.dbFor(c)
+	voterList, err := voters.GetInactiveVoters()
+	if err != nil {
+		logger(c).Error("Error getting inactive voters", "error", err)
+		abortWithDbError(c, err)
+		return
+	}
+	setSkippedHeader(c, voters)
 	c.JSON(http.StatusOK, voterList)
 }
 
-func (v *VoterAPI) GetVoter(c *gin.Context) {
+// ListSelectVoters is the v2 version of ListAllVoters, it narrows the list
+// with optional query filters that can be combined:
+//
+//	?name=     voters whose name contains the value, ignoring case
+//	?email=    voters with exactly this email
+//	?minPolls= voters who have voted in at least this many polls
+//
+// v2 is additive, GET /voter in v1 keeps returning every voter.
+//
+// @Summary  List voters matching filters
+// @Tags     voters
+// @Produce  json
+// @Param    name query string false "Name contains, ignoring case"
+// @Param    email query string false "Email, ignoring case"
+// @Param    minPolls query int false "Voted in at least this many polls"
+// @Success  200 {array} db.Voter
+// @Failure  400 {object} ErrorBody
+// @Failure  503 {object} ErrorBody
+// @Router   /v2/voter [get]
+// @Security ApiKeyAuth
+func (v *VoterAPI) ListSelectVoters(c *gin.Context) {
+	name := strings.ToLower(c.Query("name"))
+	//Emails are stored normalized, so one typed in another case still matches
+	email := db.NormalizeEmail(c.Query("email"))
 
-	idStr := c.Param("id")
-	id, err := strconv.ParseInt(idStr, 10, 32)
-	if err != nil {
-		log.Println("Error converting id to int64: ", err)
-		c.AbortWithStatus(http.StatusBadRequest)
+	minPolls, err := strconv.Atoi(c.DefaultQuery("minPolls", "0"))
+	if err != nil || minPolls < 0 {
+		logger(c).Warn("Invalid minPolls", "minPolls", c.Query("minPolls"))
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "minPolls must be a number that is not negative")
 		return
 	}
 
-	voter, err := v.db.GetVoter(int(id))
+	//Filtering in go is fine while the number of voters is small, the
+	//whole list is loaded either way
+	voters := v.dbFor(c)
+	voterList, err := voters.GetAllVoters()
 	if err != nil {
-		log.Println("Item not found: ", err)
-		c.AbortWithStatus(http.StatusNotFound)
+		logger(c).Error("Error Getting All Items", "error", err)
+		abortWithDbError(c, err)
 		return
 	}
 
-	c.JSON(http.StatusOK, voter)
+	selected := make([]db.Voter, 0, len(voterList))
+	for _, voter := range voterList {
+		if name != "" && !strings.Contains(strings.ToLower(voter.Name), name) {
+			continue
+		}
+		if email != "" && db.NormalizeEmail(voter.Email) != email {
+			continue
+		}
+		if len(voter.VoteHistory) < minPolls {
+			continue
+		}
+		selected = append(selected, voter)
+	}
+
+	setSkippedHeader(c, voters)
+	c.JSON(http.StatusOK, selected)
 }
 
-func (v *VoterAPI) GetPollHistoryFromVoter(c *gin.Context) {
-	idStr := c.Param("id")
-	id, err := strconv.Atoi(idStr)
+// sortParams reads ?sort= and ?order=, anything unrecognised aborts the
+// request with 400 and ok is false
+func sortParams(c *gin.Context) (by db.SortField, desc bool, ok bool) {
+	by = db.SortField(c.DefaultQuery("sort", string(db.SortById)))
+	switch by {
+	case db.SortById, db.SortByName, db.SortByPolls:
+	default:
+		logger(c).Warn("Invalid sort", "sort", by)
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "sort must be id, name or polls")
+		return "", false, false
+	}
+
+	switch order := c.DefaultQuery("order", "asc"); order {
+	case "asc":
+	case "desc":
+		desc = true
+	default:
+		logger(c).Warn("Invalid order", "order", order)
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "order must be asc or desc")
+		return "", false, false
+	}
+
+	return by, desc, true
+}
+
+// historySortParams reads ?sort=date|poll and ?order=asc|desc for a vote
+// history, a history is sorted by date and newest first unless they say
+// otherwise.  Anything unrecognised aborts the request with 400 and ok is
+// false.
+func historySortParams(c *gin.Context) (by db.HistorySortField, desc bool, ok bool) {
+	by = db.HistorySortField(c.DefaultQuery("sort", string(db.SortVotesByDate)))
+	switch by {
+	case db.SortVotesByDate, db.SortVotesByPoll:
+	default:
+		logger(c).Warn("Invalid sort", "sort", by)
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "sort must be date or poll")
+		return "", false, false
+	}
+
+	switch order := c.DefaultQuery("order", "desc"); order {
+	case "asc":
+	case "desc":
+		desc = true
+	default:
+		logger(c).Warn("Invalid order", "order", order)
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "order must be asc or desc")
+		return "", false, false
+	}
+
+	return by, desc, true
+}
+
+// listVotersByIds answers GET /voter?ids=, the ids that have no voter are
+// left out of the list and named in the MissingIdsHeader
+func (v *VoterAPI) listVotersByIds(c *gin.Context, voters *db.VoterList, fields []string, loc *time.Location) {
+	var ids []int
+	for _, param := range strings.Split(c.Query("ids"), ",") {
+		id, err := strconv.Atoi(strings.TrimSpace(param))
+		if err != nil || id < 1 {
+			respondError(c, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("invalid id %q in ids", param))
+			return
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) > maxVoterIds {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("at most %d ids can be asked for at once", maxVoterIds))
+		return
+	}
+
+	voterList, err := voters.GetVotersByIds(ids)
 	if err != nil {
-		c.AbortWithStatus(http.StatusBadRequest)
+		logger(c).Error("Error getting voters by id", "error", err)
+		abortWithDbError(c, err)
+		return
+	}
+
+	found := make(map[int]bool, len(voterList))
+	for _, voter := range voterList {
+		found[int(voter.VoterId)] = true
 	}
+	var missing []string
+	for _, id := range ids {
+		if !found[id] {
+			found[id] = true
+			missing = append(missing, strconv.Itoa(id))
+		}
+	}
+	votersIn(voterList, loc)
 
-	voterHistory, err := v.db.GetVoteHistory(id)
+	resp, err := projectVoters(voterList, fields)
 	if err != nil {
-		log.Println("Item not found:", err)
-		c.AbortWithStatus(http.StatusBadRequest)
+		logger(c).Error("Error projecting voters", "error", err)
+		respondError(c, http.StatusInternalServerError, CodeInternal, "internal server error")
+		return
 	}
-	c.JSON(http.StatusOK, voterHistory)
+
+	if len(missing) > 0 {
+		c.Header(MissingIdsHeader, strings.Join(missing, ","))
+	}
+	c.Header(TotalCountHeader, strconv.Itoa(len(voterList)))
+	setSkippedHeader(c, voters)
+	c.JSON(http.StatusOK, resp)
 }
 
-func (v *VoterAPI) GetSinglePollFromVoter(c *gin.Context) {
-	voterIdStr := c.Param("id")
-	pollIdStr := c.Param("pollid")
+func (v *VoterAPI) listVotersPaged(c *gin.Context, voters *db.VoterList, sortBy db.SortField, desc bool, fields []string, loc *time.Location) {
+	offset, limit, ok := pageQuery(c)
+	if !ok {
+		return
+	}
 
-	voterid, err := strconv.Atoi(voterIdStr)
+	voterList, total, err := voters.GetVotersPagedSorted(offset, limit, sortBy, desc)
 	if err != nil {
-		c.AbortWithStatus(http.StatusBadRequest)
+		logger(c).Error("Error Getting Voter Page", "error", err)
+		abortWithDbError(c, err)
+		return
 	}
+	votersIn(voterList, loc)
 
-	pollid, err := strconv.Atoi(pollIdStr)
-	if err != nil {
-		c.AbortWithStatus(http.StatusBadRequest)
+	c.Header(TotalCountHeader, strconv.Itoa(total))
+	setSkippedHeader(c, voters)
+	page := VoterPage{
+		Voters: voterList,
+		Total:  total,
+		Offset: offset,
+		Limit:  limit,
+		Count:  len(voterList),
+	}
+	if len(fields) == 0 {
+		c.JSON(http.StatusOK, page)
+		return
 	}
 
-	poll, err := v.db.GetSingleVoteHistory(int(voterid), uint(pollid))
+	projected, err := projectVoters(voterList, fields)
 	if err != nil {
-		log.Println("Item not found:", err)
-		c.AbortWithStatus(http.StatusBadRequest)
+		logger(c).Error("Error projecting voters", "error", err)
+		respondError(c, http.StatusInternalServerError, CodeInternal, "internal server error")
+		return
 	}
-	c.JSON(http.StatusOK, poll)
+	//The outer Voters hides the one of the embedded page when encoded
+	c.JSON(http.StatusOK, struct {
+		VoterPage
+		Voters any `json:"voters"`
+	}{page, projected})
 }
 
-func (v *VoterAPI) AddSinglePollToVoter(c *gin.Context) {
+// csvHeader is the first row of a CSV export, an import expects the same
+// columns
+var csvHeader = []string{"VoterId", "Name", "Email", "PollCount"}
+
+// ExportVoters handles GET /voter/export.  With ?format=csv the voters are
+// streamed as CSV, one row per voter, without building the whole file in
+// memory.  Without a format it returns the same JSON list as GET /voter.
+//
+// @Summary  Export all voters
+// @Tags     voters
+// @Produce  json,text/csv
+// @Param    format query string false "Export format" Enums(json, csv)
+// @Success  200 {array} db.Voter
+// @Failure  400 {object} ErrorBody
+// @Failure  503 {object} ErrorBody
+// @Router   /voter/export [get]
+// @Security ApiKeyAuth
+func (v *VoterAPI) ExportVoters(c *gin.Context) {
+	switch format := c.DefaultQuery("format", "json"); format {
+	case "json":
+		v.ListAllVoters(c)
+	case "csv":
+		v.exportVotersCSV(c)
+	default:
+		logger(c).Warn("Invalid export format", "format", format)
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "format must be json or csv")
+	}
+}
+
+func (v *VoterAPI) exportVotersCSV(c *gin.Context) {
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", `attachment; filename="voters.csv"`)
+
+	w := csv.NewWriter(c.Writer)
+	started := false
+	err := v.dbFor(c).EachVoter(func(voter db.Voter) error {
+		if !started {
+			started = true
+			c.Status(http.StatusOK)
+			if err := w.Write(csvHeader); err != nil {
+				return err
+			}
+		}
+		w.Write([]string{
+			strconv.FormatUint(uint64(voter.VoterId), 10),
+			voter.Name,
+			voter.Email,
+			strconv.Itoa(len(voter.VoteHistory)),
+		})
+		return w.Error()
+	})
 
-	idStr := c.Param("id")
-	id, err := strconv.ParseInt(idStr, 10, 32)
 	if err != nil {
-		c.AbortWithStatus(http.StatusBadRequest)
+		logger(c).Error("Error exporting voters", "error", err)
+		//Once rows have gone out the status can not be changed, the
+		//truncated file is all the client will get
+		if !started {
+			abortWithDbError(c, err)
+			return
+		}
+		c.Abort()
 		return
 	}
 
-	var poll db.VoterHistory
+	if !started {
+		c.Status(http.StatusOK)
+		w.Write(csvHeader)
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		logger(c).Error("Error writing csv", "error", err)
+	}
+}
+
+// ImportResult summarises a POST /voter/import.  Skipped voters already
+// existed, failed ones were malformed or invalid, Errors explains each of
+// them by the index of the item in the upload, not counting a CSV header.
+type ImportResult struct {
+	Created int              `json:"created"`
+	Skipped int              `json:"skipped"`
+	Failed  int              `json:"failed"`
+	Errors  []BatchItemError `json:"errors"`
+}
+
+// ImportVoters handles POST /voter/import.  The body is either a JSON array
+// of voters or, with a text/csv Content-Type, a CSV file with the columns
+// of an export.  Every voter is attempted, a bad row is reported in the
+// response rather than failing the whole import.  PollCount in a CSV is
+// ignored, imported voters start without any votes.
+//
+// @Summary  Import voters from CSV or JSON
+// @Tags     voters
+// @Accept   json,text/csv
+// @Produce  json
+// @Param    voters body []db.Voter true "Voters to import"
+// @Success  200 {object} ImportResult
+// @Failure  400 {object} ErrorBody
+// @Failure  415 {object} ErrorBody
+// @Failure  503 {object} ErrorBody
+// @Router   /voter/import [post]
+// @Security ApiKeyAuth
+func (v *VoterAPI) ImportVoters(c *gin.Context) {
+	var voters []db.Voter
+	var indexes []int
+	result := ImportResult{Errors: make([]BatchItemError, 0)}
 
-	if err := c.ShouldBindJSON(&poll); err != nil {
-		log.Println("Error binding JSON: ", err)
-		c.AbortWithStatus(http.StatusBadRequest)
+	switch c.ContentType() {
+	case "application/json":
+		//Every voter is validated on its own so one bad row does not
+		//reject the whole upload
+		if !decodeJSON(c, &voters) {
+			return
+		}
+		for i := range voters {
+			indexes = append(indexes, i)
+		}
+	case "text/csv":
+		var rowErrs []BatchItemError
+		var err error
+		voters, indexes, rowErrs, err = readVotersCSV(c.Request.Body)
+		if abortIfBodyTooLarge(c, err) {
+			return
+		}
+		if err != nil {
+			logger(c).Warn("Error reading CSV", "error", err)
+			respondError(c, http.StatusBadRequest, CodeBadRequest, "could not read the CSV: "+err.Error())
+			return
+		}
+		result.Failed += len(rowErrs)
+		result.Errors = append(result.Errors, rowErrs...)
+	default:
+		logger(c).Warn("Unsupported import content type", "content_type", c.ContentType())
+		respondError(c, http.StatusUnsupportedMediaType, CodeUnsupportedMedia, "the body must be application/json or text/csv")
+		return
 	}
 
-	if _, err := v.db.AddPoll(int(id), poll); err != nil {
-		log.Println("Failed to add poll to voter:", err)
-		c.AbortWithStatus(http.StatusNotFound)
+	added, errs := v.dbFor(c).AddVoters(voters)
+	result.Created = added
+	for _, err := range errs {
+		item := newBatchItemError(err)
+		//AddVoters counts from the start of what it was given, which skips
+		//the rows that could not be parsed
+		if item.Index >= 0 {
+			item.Index = indexes[item.Index]
+		}
+		if errors.Is(err, db.ErrVoterExists) {
+			result.Skipped++
+		} else {
+			result.Failed++
+		}
+		result.Errors = append(result.Errors, item)
 	}
 
-	c.JSON(http.StatusOK, id)
+	sort.Slice(result.Errors, func(i, j int) bool {
+		return result.Errors[i].Index < result.Errors[j].Index
+	})
+	c.JSON(http.StatusOK, result)
 }
 
-func (v *VoterAPI) AddVoter(c *gin.Context) {
-	var voter db.Voter
+// readVotersCSV parses an uploaded CSV.  Rows that can not be turned into a
+// voter are returned as errors, indexes holds the row number of each voter
+// returned.  Only a missing or unusable header fails the whole file.
+func readVotersCSV(body io.Reader) (voters []db.Voter, indexes []int, rowErrs []BatchItemError, err error) {
+	r := csv.NewReader(body)
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
 
-	if err := c.ShouldBindJSON(&voter); err != nil {
-		log.Println("Error binding JSON: ", err)
-		c.AbortWithStatus(http.StatusBadRequest)
+	header, err := r.Read()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("reading header: %w", err)
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.TrimSpace(name)] = i
+	}
+	for _, required := range csvHeader[:3] {
+		if _, ok := columns[required]; !ok {
+			return nil, nil, nil, fmt.Errorf("missing %s column", required)
+		}
 	}
 
-	if err := v.db.AddVoter(&voter); err != nil {
-		log.Println("Error adding item: ", err)
-		c.AbortWithStatus(http.StatusConflict)
-		return
+	for row := 0; ; row++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			rowErrs = append(rowErrs, BatchItemError{Index: row, Error: parseErr.Err.Error()})
+			continue
+		}
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		field := func(name string) string {
+			if i := columns[name]; i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+
+		var id uint64
+		if raw := field("VoterId"); raw != "" {
+			id, err = strconv.ParseUint(raw, 10, 32)
+			if err != nil {
+				rowErrs = append(rowErrs, BatchItemError{Index: row, Error: fmt.Sprintf("invalid VoterId %q", raw)})
+				continue
+			}
+		}
+
+		voters = append(voters, db.Voter{
+			VoterId: uint(id),
+			Name:    field("Name"),
+			Email:   field("Email"),
+		})
+		indexes = append(indexes, row)
 	}
 
-	c.JSON(http.StatusOK, voter)
+	return voters, indexes, rowErrs, nil
 }
 
-func (v *VoterAPI) UpdateVoter(c *gin.Context) {
-	var voter db.Voter
-	if err := c.ShouldBindJSON(&voter); err != nil {
-		log.Println("Error binding JSON: ", err)
-		c.AbortWithStatus(http.StatusBadRequest)
+// GetVoterByEmail handles GET /voter/by-email?email=, the email is matched
+// ignoring case
+//
+// @Summary  Get a voter by email
+// @Tags     voters
+// @Produce  json
+// @Param    email query string true "Email of the voter"
+// @Success  200 {object} db.Voter
+// @Failure  400 {object} ErrorBody
+// @Failure  404 {object} ErrorBody
+// @Failure  503 {object} ErrorBody
+// @Router   /voter/by-email [get]
+// @Security ApiKeyAuth
+func (v *VoterAPI) GetVoterByEmail(c *gin.Context) {
+	email := c.Query("email")
+	if email == "" {
+		logger(c).Warn("Missing email query parameter")
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "the email query parameter is required")
+		return
 	}
 
-	if err := v.db.UpdateVoter(voter); err != nil {
-		log.Println("Error updating voter: ", err)
-		c.AbortWithStatus(http.StatusBadRequest)
+	voter, err := v.dbFor(c).GetVoterByEmail(email)
+	if err != nil {
+		logger(c).Error("Error getting voter by email", "error", err)
+		abortWithDbError(c, err)
+		return
 	}
 
 	c.JSON(http.StatusOK, voter)
 }
 
-func (v *VoterAPI) DeleteVoter(c *gin.Context) {
-	idStr := c.Param("id")
-	id, _ := strconv.ParseInt(idStr, 10, 32)
+// GetVoterCount returns {"count": N} with the number of voters, only the
+// keys are counted so it stays cheap with a lot of voters
+//
+// @Summary  Count voters
+// @Tags     voters
+// @Produce  json
+// @Success  200 {object} map[string]int
+// @Failure  503 {object} ErrorBody
+// @Router   /voter/count [get]
+// @Security ApiKeyAuth
+func (v *VoterAPI) GetVoterCount(c *gin.Context) {
+	count, err := v.dbFor(c).CountVoters()
+	if err != nil {
+		logger(c).Error("Error counting voters", "error", err)
+		abortWithDbError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"count": count})
+}
+
+// VoterWithPollCount is the voter returned by GET /voter/:id?include=pollCount,
+// PollCount is worked out for the response and never stored
+type VoterWithPollCount struct {
+	db.Voter
+	PollCount int `json:"PollCount"`
+}
+
+// GetVoter returns the voter with an ETag, a client that sends the same
+// ETag back in If-None-Match gets 304 Not Modified with no body while the
+// voter is unchanged.  ?include=pollCount adds the number of polls the
+// voter took part in and ?fields=VoterId,Name returns only those fields.
+// ?tz= sends the vote dates in that time zone, see tzQuery.
+//
+// @Summary  Get a voter
+// @Tags     voters
+// @Produce  json
+// @Param    id path int true "Voter id"
+// @Param    include query string false "Extra computed fields" Enums(pollCount)
+// @Param    includeDeleted query bool false "Also return a soft deleted voter"
+// @Param    fields query string false "Comma separated fields to return, such as VoterId,Name"
+// @Param    tz query string false "IANA time zone to send vote dates in, such as America/New_York"
+// @Param    If-None-Match header string false "ETag from an earlier response"
+// @Description With include=pollCount the answer is a VoterWithPollCount
+// @Success  200 {object} db.Voter
+// @Success  304
+// @Failure  400 {object} ErrorBody
+// @Failure  404 {object} ErrorBody
+// @Failure  503 {object} ErrorBody
+// @Router   /voter/{id} [get]
+// @Security ApiKeyAuth
+func (v *VoterAPI) GetVoter(c *gin.Context) {
+
+	id, ok := voterIdParam(c)
+	if !ok {
+		return
+	}
 
-	if err := v.db.DeleteVoter(int(id)); err != nil {
-		log.Println("Error deleting item: ", err)
-		c.AbortWithStatus(http.StatusBadRequest)
+	includePollCount := false
+	switch include := c.Query("include"); include {
+	case "":
+	case "pollCount":
+		includePollCount = true
+	default:
+		logger(c).Warn("Invalid include", "include", include)
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "include must be pollCount")
+		return
 	}
 
-	c.Status(http.StatusOK)
+	voters, ok := v.dbForQuery(c)
+	if !ok {
+		return
+	}
+
+	//PollCount can only be picked when it is included
+	var fields []string
+	if includePollCount {
+		fields, ok = fieldsParam(c, VoterWithPollCount{})
+	} else {
+		fields, ok = fieldsParam(c, db.Voter{})
+	}
+	if !ok {
+		return
+	}
+	loc, ok := tzQuery(c)
+	if !ok {
+		return
+	}
+
+	voter, err := voters.GetVoter(id)
+	if err != nil {
+		logger(c).Error("Error getting voter", "error", err)
+		abortWithDbError(c, err)
+		return
+	}
+	votesIn(voter.VoteHistory, loc)
+
+	var resp any = voter
+	if includePollCount {
+		resp = VoterWithPollCount{Voter: voter, PollCount: len(voter.VoteHistory)}
+	}
+	resp, err = project(resp, fields)
+	if err != nil {
+		logger(c).Error("Error projecting voter", "error", err)
+		respondError(c, http.StatusInternalServerError, CodeInternal, "internal server error")
+		return
+	}
+
+	body, err := json.Marshal(resp)
+	if err != nil {
+		logger(c).Error("Error marshaling voter", "error", err)
+		respondError(c, http.StatusInternalServerError, CodeInternal, "internal server error")
+		return
+	}
+
+	etag := etagFor(body)
+	c.Header("ETag", etag)
+	if etagMatches(c.GetHeader("If-None-Match"), etag) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	c.Data(http.StatusOK, "application/json; charset=utf-8", body)
 }
 
-func (v *VoterAPI) DeleteAllVoters(c *gin.Context) {
+// HeadVoter answers HEAD /voter/:id, 200 if the voter exists and 404 if it
+// does not, without sending the voter itself
+//
+// @Summary  Check that a voter exists
+// @Tags     voters
+// @Param    id path int true "Voter id"
+// @Success  200
+// @Failure  400 {object} ErrorBody
+// @Failure  404 {object} ErrorBody
+// @Failure  503 {object} ErrorBody
+// @Router   /voter/{id} [head]
+// @Security ApiKeyAuth
+func (v *VoterAPI) HeadVoter(c *gin.Context) {
+
+	id, ok := voterIdParam(c)
+	if !ok {
+		return
+	}
 
-	if err := v.db.DeleteAll(); err != nil {
-		log.Println("Error deleting all items: ", err)
-		c.AbortWithStatus(http.StatusBadRequest)
+	if _, err := v.dbFor(c).GetVoter(id); err != nil {
+		logger(c).Error("Error getting voter", "error", err)
+		abortWithDbError(c, err)
 		return
 	}
 
+	c.Header("Content-Length", "0")
 	c.Status(http.StatusOK)
 }
 
-/*   SPECIAL HANDLERS FOR DEMONSTRATION - CRASH SIMULATION AND HEALTH CHECK */
+// etagFor returns a strong ETag for a response body
+func etagFor(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
 
-func (v *VoterAPI) CrashSim(c *gin.Context) error {
-	//panic() is go's version of throwing an exception
-	//note with recover middleware this will not end program
-	panic("Simulating an unexpected crash")
+// etagMatches reports whether an If-None-Match header names the etag, the
+// header can list several etags or be * to match any
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		//A weak validator is fine for a GET, compare without the W/ prefix
+		candidate = strings.TrimPrefix(candidate, "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
 }
 
-// implementation of GET /health. It is a good practice to build in a
-// health check for your API.  Below the results are just hard coded
-// but in a real API you can provide detailed information about the
-// health of your API with a Health Check
-func (v *VoterAPI) HealthCheck(c *gin.Context) {
-	c.JSON(http.StatusOK,
-		gin.H{
-			"status":             "ok",
-			"version":            "1.0.0",
-			"uptime":             100,
-			"users_processed":    1000,
-			"errors_encountered": 10,
+// VotePage wraps a page of a voter's votes like VoterPage does voters
+type VotePage struct {
+	Votes  []db.VoterHistory `json:"votes"`
+	Total  int               `json:"total"`
+	Offset int               `json:"offset"`
+	Limit  int               `json:"limit"`
+	Count  int               `json:"count"`
+}
+
+// GetPollHistoryFromVoter returns the votes of a voter.  For syncing,
+// ?since= returns only the votes cast after it and the ServerTimeHeader
+// says what to send as since next time.  Like GET /voter, paging is opt in
+// with ?limit= or ?offset=, which return a VotePage instead of the full
+// history.  The votes come newest first, ?sort=date|poll&order=asc|desc
+// orders them otherwise.
+//
+// @Summary  Get the vote history of a voter
+// @Tags     polls
+// @Produce  json
+// @Param    id path int true "Voter id"
+// @Param    from query string false "Only votes cast at or after this RFC3339 time"
+// @Param    to query string false "Only votes cast at or before this RFC3339 time"
+// @Param    since query string false "Only votes cast after this RFC3339 time, can not be combined with from or to"
+// @Param    tz query string false "IANA time zone to send vote dates in, such as America/New_York"
+// @Param    offset query int false "Votes to skip, returns a VotePage"
+// @Param    limit query int false "Votes per page, returns a VotePage" default(50)
+// @Param    sort query string false "Order votes by date or poll" Enums(date, poll) default(date)
+// @Param    order query string false "asc or desc" Enums(asc, desc) default(desc)
+// @Success  200 {array} db.VoterHistory
+// @Header   200 {string} X-Server-Time "When the history was read, the next since"
+// @Header   200 {integer} X-Total-Count "Number of votes returned, or of the voter when paging"
+// @Failure  400 {object} ErrorBody
+// @Failure  404 {object} ErrorBody
+// @Failure  503 {object} ErrorBody
+// @Router   /voter/{id}/polls [get]
+// @Security ApiKeyAuth
+func (v *VoterAPI) GetPollHistoryFromVoter(c *gin.Context) {
+	id, ok := voterIdParam(c)
+	if !ok {
+		return
+	}
+
+	//?from= and ?to= narrow the history to votes cast in that range, either
+	//one may be left out
+	from, ok := timeQuery(c, "from")
+	if !ok {
+		return
+	}
+	to, ok := timeQuery(c, "to")
+	if !ok {
+		return
+	}
+	//?since= is for syncing, it only returns the votes cast after it
+	since, ok := timeQuery(c, "since")
+	if !ok {
+		return
+	}
+	if !since.IsZero() && (!from.IsZero() || !to.IsZero()) {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "since can not be combined with from or to")
+		return
+	}
+	loc, ok := tzQuery(c)
+	if !ok {
+		return
+	}
+	sortBy, desc, ok := historySortParams(c)
+	if !ok {
+		return
+	}
+
+	//Taken before the read, a vote stored while it is under way is then
+	//sent again on the next sync rather than missed
+	serverTime := time.Now().UTC()
+
+	_, hasLimit := c.GetQuery("limit")
+	_, hasOffset := c.GetQuery("offset")
+	if hasLimit || hasOffset {
+		if !since.IsZero() || !from.IsZero() || !to.IsZero() {
+			respondError(c, http.StatusBadRequest, CodeBadRequest, "offset and limit can not be combined with from, to or since")
+			return
+		}
+		offset, limit, ok := pageQuery(c)
+		if !ok {
+			return
+		}
+		votes, total, err := v.dbFor(c).GetVoteHistoryPagedSorted(id, offset, limit, sortBy, desc)
+		if err != nil {
+			logger(c).Error("Error getting vote history page", "error", err)
+			abortWithDbError(c, err)
+			return
+		}
+		votesIn(votes, loc)
+		c.Header(ServerTimeHeader, serverTime.Format(time.RFC3339Nano))
+		c.Header(TotalCountHeader, strconv.Itoa(total))
+		c.JSON(http.StatusOK, VotePage{
+			Votes:  votes,
+			Total:  total,
+			Offset: offset,
+			Limit:  limit,
+			Count:  len(votes),
 		})
+		return
+	}
+
+	var voterHistory []db.VoterHistory
+	var err error
+	switch {
+	case !since.IsZero():
+		voterHistory, err = v.dbFor(c).GetVoteHistorySince(id, since)
+	case from.IsZero() && to.IsZero():
+		voterHistory, err = v.dbFor(c).GetVoteHistory(id)
+	default:
+		voterHistory, err = v.dbFor(c).GetVoteHistoryInRange(id, from, to)
+	}
+	if err != nil {
+		logger(c).Error("Error getting vote history", "error", err)
+		abortWithDbError(c, err)
+		return
+	}
+	//from, to and since are applied before the sort
+	if err := db.SortVoteHistory(voterHistory, sortBy, desc); err != nil {
+		logger(c).Error("Error sorting vote history", "error", err)
+		respondError(c, http.StatusInternalServerError, CodeInternal, "internal server error")
+		return
+	}
+	votesIn(voterHistory, loc)
+	c.Header(ServerTimeHeader, serverTime.Format(time.RFC3339Nano))
+	c.Header(TotalCountHeader, strconv.Itoa(len(voterHistory)))
+	c.JSON(http.StatusOK, voterHistory)
+}
+
+// pageQuery reads ?offset=, 0 by default, and ?limit=, defaultPageLimit by
+// default.  Invalid values abort the request with 400 and ok is false.
+func pageQuery(c *gin.Context) (offset, limit int, ok bool) {
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		logger(c).Warn("Invalid offset", "offset", c.Query("offset"))
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "offset must be a number that is not negative")
+		return 0, 0, false
+	}
+
+	limit, err = strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultPageLimit)))
+	if err != nil || limit <= 0 {
+		logger(c).Warn("Invalid limit", "limit", c.Query("limit"))
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "limit must be a positive number")
+		return 0, 0, false
+	}
+	return offset, limit, true
+}
+
+// timeQuery parses an optional RFC3339 query parameter, a missing one gives
+// the zero time.  An unparseable value aborts the request with 400 and ok is
+// false.
+func timeQuery(c *gin.Context, name string) (t time.Time, ok bool) {
+	raw := c.Query(name)
+	if raw == "" {
+		return time.Time{}, true
+	}
+	t, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		logger(c).Warn("Invalid timestamp", name, raw)
+		respondError(c, http.StatusBadRequest, CodeBadRequest, name+" must be an RFC3339 timestamp")
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// tzQuery reads ?tz=, an IANA time zone such as America/New_York to send
+// vote dates in.  Without it loc is nil and the dates are sent as they are
+// stored, in UTC.  An unknown zone aborts the request with 400 and ok is
+// false.
+func tzQuery(c *gin.Context) (loc *time.Location, ok bool) {
+	name := c.Query("tz")
+	if name == "" {
+		return nil, true
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		logger(c).Warn("Invalid tz", "tz", name, "error", err)
+		respondError(c, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("unknown time zone %q, tz must be an IANA time zone such as America/New_York", name))
+		return nil, false
+	}
+	return loc, true
+}
+
+// votesIn converts the VoteDate of every vote in history to loc, a nil loc
+// leaves them as they are
+func votesIn(history []db.VoterHistory, loc *time.Location) {
+	if loc == nil {
+		return
+	}
+	for i := range history {
+		history[i].VoteDate = history[i].VoteDate.In(loc)
+	}
+}
+
+// votersIn is votesIn for the votes of every voter
+func votersIn(voters []db.Voter, loc *time.Location) {
+	for _, voter := range voters {
+		votesIn(voter.VoteHistory, loc)
+	}
+}
+
+// GetVoterField returns just the JSON at a path in the voter, such as
+// /voter/1/field/.Email or /voter/1/field/.VoteHistory[0].  The leading dot
+// may be left out.  Only that part of the voter is read from redis.
+//
+// @Summary  Get one field of a voter
+// @Tags     voters
+// @Produce  json
+// @Param    id path int true "Voter id"
+// @Param    path path string true "ReJSON path such as .Email or .VoteHistory[0]"
+// @Param    includeDeleted query bool false "Also read a soft deleted voter"
+// @Success  200 {object} any
+// @Failure  400 {object} ErrorBody
+// @Failure  404 {object} ErrorBody
+// @Failure  503 {object} ErrorBody
+// @Router   /voter/{id}/field/{path} [get]
+// @Security ApiKeyAuth
+func (v *VoterAPI) GetVoterField(c *gin.Context) {
+	id, ok := voterIdParam(c)
+	if !ok {
+		return
+	}
+
+	path := strings.TrimPrefix(c.Param("path"), "/")
+	if path != "" && path[0] != '.' && path[0] != '[' {
+		path = "." + path
+	}
+	if !db.ValidFieldPath(path) {
+		logger(c).Warn("Invalid field path", "path", path)
+		respondError(c, http.StatusBadRequest, CodeBadRequest, db.ErrBadPath.Error())
+		return
+	}
+
+	voters, ok := v.dbForQuery(c)
+	if !ok {
+		return
+	}
+	raw, err := voters.GetVoterField(id, path)
+	if errors.Is(err, db.ErrFieldNotFound) {
+		respondError(c, http.StatusNotFound, CodeNotFound, fmt.Sprintf("path %s does not exist in the voter", path))
+		return
+	}
+	if err != nil {
+		logger(c).Error("Error getting voter field", "path", path, "error", err)
+		abortWithDbError(c, err)
+		return
+	}
+	c.Data(http.StatusOK, "application/json; charset=utf-8", raw)
+}
+
+// GetVoteCount returns {"count": N} with the number of polls the voter has
+// voted in, without loading the rest of the voter
+//
+// @Summary  Count the polls a voter voted in
+// @Tags     polls
+// @Produce  json
+// @Param    id path int true "Voter id"
+// @Success  200 {object} map[string]int
+// @Failure  400 {object} ErrorBody
+// @Failure  404 {object} ErrorBody
+// @Failure  503 {object} ErrorBody
+// @Router   /voter/{id}/polls/count [get]
+// @Security ApiKeyAuth
+func (v *VoterAPI) GetVoteCount(c *gin.Context) {
+	id, ok := voterIdParam(c)
+	if !ok {
+		return
+	}
+
+	count, err := v.dbFor(c).GetVoteCount(id)
+	if err != nil {
+		logger(c).Error("Error counting votes", "error", err)
+		abortWithDbError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"count": count})
+}
+
+// @Summary  Get one vote of a voter
+// @Tags     polls
+// @Produce  json
+// @Param    id path int true "Voter id"
+// @Param    pollid path int true "Poll id"
+// @Param    tz query string false "IANA time zone to send the vote date in, such as America/New_York"
+// @Success  200 {object} db.VoterHistory
+// @Failure  400 {object} ErrorBody
+// @Failure  404 {object} ErrorBody
+// @Failure  503 {object} ErrorBody
+// @Router   /voter/{id}/polls/{pollid} [get]
+// @Security ApiKeyAuth
+func (v *VoterAPI) GetSinglePollFromVoter(c *gin.Context) {
+	voterid, ok := voterIdParam(c)
+	if !ok {
+		return
+	}
+
+	pollid, err := strconv.ParseUint(c.Param("pollid"), 10, 0)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "poll id must be a number that is not negative")
+		return
+	}
+	loc, ok := tzQuery(c)
+	if !ok {
+		return
+	}
+
+	poll, err := v.dbFor(c).GetSingleVoteHistory(voterid, uint(pollid))
+	if err != nil {
+		logger(c).Error("Error getting poll", "error", err)
+		if errors.Is(err, db.ErrPollNotFound) {
+			respondError(c, http.StatusNotFound, CodeNotFound, err.Error())
+			return
+		}
+		abortWithDbError(c, err)
+		return
+	}
+	if loc != nil {
+		poll.VoteDate = poll.VoteDate.In(loc)
+	}
+	c.JSON(http.StatusOK, poll)
+}
+
+// HeadSinglePollFromVoter answers HEAD /voter/:id/polls/:pollid, 200 if the
+// voter voted in the poll and 404 if they did not or the voter does not
+// exist.  No body is written, not even for an error.
+//
+// @Summary  Check that a voter voted in a poll
+// @Tags     polls
+// @Param    id path int true "Voter id"
+// @Param    pollid path int true "Poll id"
+// @Success  200
+// @Failure  400
+// @Failure  404
+// @Failure  503
+// @Router   /voter/{id}/polls/{pollid} [head]
+// @Security ApiKeyAuth
+func (v *VoterAPI) HeadSinglePollFromVoter(c *gin.Context) {
+	c.Writer = &bodyDiscarder{c.Writer}
+
+	voterid, ok := voterIdParam(c)
+	if !ok {
+		return
+	}
+	pollid, err := strconv.ParseUint(c.Param("pollid"), 10, 0)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "poll id must be a number that is not negative")
+		return
+	}
+
+	if _, err := v.dbFor(c).GetSingleVoteHistory(voterid, uint(pollid)); err != nil {
+		if errors.Is(err, db.ErrPollNotFound) {
+			respondError(c, http.StatusNotFound, CodeNotFound, err.Error())
+			return
+		}
+		logger(c).Error("Error getting poll", "error", err)
+		abortWithDbError(c, err)
+		return
+	}
+
+	c.Header("Content-Length", "0")
+	c.Status(http.StatusOK)
+}
+
+// bodyDiscarder drops the body of a response, for HEAD handlers that share
+// the error handling of the GET ones
+type bodyDiscarder struct {
+	gin.ResponseWriter
+}
+
+func (d *bodyDiscarder) Write(b []byte) (int, error) {
+	d.WriteHeaderNow()
+	return len(b), nil
+}
+
+func (d *bodyDiscarder) WriteString(s string) (int, error) {
+	d.WriteHeaderNow()
+	return len(s), nil
+}
+
+// GetMissingPolls returns the poll ids from ?active=1,2,3 that the voter
+// has not voted in yet, so they can be nudged to complete them
+//
+// @Summary  List active polls the voter has not voted in
+// @Tags     polls
+// @Produce  json
+// @Param    id path int true "Voter id"
+// @Param    active query string false "Comma separated poll ids"
+// @Success  200 {array} int
+// @Failure  400 {object} ErrorBody
+// @Failure  404 {object} ErrorBody
+// @Failure  503 {object} ErrorBody
+// @Router   /voter/{id}/polls/missing [get]
+// @Security ApiKeyAuth
+func (v *VoterAPI) GetMissingPolls(c *gin.Context) {
+	id, ok := voterIdParam(c)
+	if !ok {
+		return
+	}
+
+	active, ok := pollIdsQuery(c, "active")
+	if !ok {
+		return
+	}
+
+	missing, err := v.dbFor(c).GetMissingPolls(id, active)
+	if err != nil {
+		logger(c).Error("Error getting missing polls", "error", err)
+		abortWithDbError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, missing)
+}
+
+// pollIdsQuery reads a comma separated list of poll ids from the query
+// parameter name, a missing parameter gives an empty list.  Anything that
+// is not a poll id aborts the request with 400 and ok is false.
+func pollIdsQuery(c *gin.Context, name string) (pollIds []uint, ok bool) {
+	pollIds = []uint{}
+	for _, raw := range strings.Split(c.Query(name), ",") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		pollId, err := strconv.ParseUint(raw, 10, 0)
+		if err != nil {
+			respondError(c, http.StatusBadRequest, CodeBadRequest, name+" must be a comma separated list of poll ids")
+			return nil, false
+		}
+		pollIds = append(pollIds, uint(pollId))
+	}
+	return pollIds, true
+}
+
+// PollResults is the response for GET /polls/:pollid/results, Votes maps
+// each VoteId to the number of voters who picked it
+type PollResults struct {
+	PollId        uint         `json:"pollId"`
+	Votes         map[uint]int `json:"votes"`
+	VotersSampled int          `json:"votersSampled"`
+}
+
+// GetPollResults returns the distribution of votes for a poll across all
+// voters.  A poll nobody has voted in is not an error, it just has no votes.
+//
+// @Summary  Tally the votes of a poll
+// @Tags     polls
+// @Produce  json
+// @Param    pollid path int true "Poll id"
+// @Success  200 {object} PollResults
+// @Failure  400 {object} ErrorBody
+// @Failure  500 {object} ErrorBody
+// @Failure  503 {object} ErrorBody
+// @Router   /polls/{pollid}/results [get]
+// @Security ApiKeyAuth
+func (v *VoterAPI) GetPollResults(c *gin.Context) {
+	pollid, err := strconv.ParseUint(c.Param("pollid"), 10, 0)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "poll id must be a number that is not negative")
+		return
+	}
+
+	votes, sampled, err := v.dbFor(c).GetPollResultsSampled(uint(pollid))
+	if err != nil {
+		logger(c).Error("Error tallying poll results", "error", err)
+		abortWithDbError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, PollResults{
+		PollId:        uint(pollid),
+		Votes:         votes,
+		VotersSampled: sampled,
+	})
+}
+
+// GetPollVoters lists the ids of the voters who took part in a poll, for
+// auditing who voted without exposing how they voted
+//
+// @Summary  List the voters who voted in a poll
+// @Tags     polls
+// @Produce  json
+// @Param    pollid path int true "Poll id"
+// @Success  200 {array} int
+// @Failure  400 {object} ErrorBody
+// @Failure  503 {object} ErrorBody
+// @Router   /polls/{pollid}/voters [get]
+// @Security ApiKeyAuth
+func (v *VoterAPI) GetPollVoters(c *gin.Context) {
+	pollid, err := strconv.ParseUint(c.Param("pollid"), 10, 0)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "poll id must be a number that is not negative")
+		return
+	}
+
+	ids, err := v.dbFor(c).GetVotersForPoll(uint(pollid))
+	if err != nil {
+		logger(c).Error("Error listing poll voters", "error", err)
+		abortWithDbError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, ids)
+}
+
+// GetVotersInAllPolls lists the ids of the voters who voted in every poll
+// of ?ids=1,2,3, for analysis across polls
+//
+// @Summary  List the voters who voted in all of a set of polls
+// @Tags     polls
+// @Produce  json
+// @Param    ids query string true "Comma separated poll ids"
+// @Success  200 {array} int
+// @Failure  400 {object} ErrorBody
+// @Failure  503 {object} ErrorBody
+// @Router   /polls/intersection [get]
+// @Security ApiKeyAuth
+func (v *VoterAPI) GetVotersInAllPolls(c *gin.Context) {
+	pollIds, ok := pollIdsQuery(c, "ids")
+	if !ok {
+		return
+	}
+	if len(pollIds) == 0 {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "ids must list at least one poll id")
+		return
+	}
+
+	ids, err := v.dbFor(c).GetVotersInAllPolls(pollIds)
+	if err != nil {
+		logger(c).Error("Error listing voters in all polls", "error", err)
+		abortWithDbError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, ids)
+}
+
+// abortPollClosed refuses a vote in a poll that is not open with 403
+func abortPollClosed(c *gin.Context, pollId uint) {
+	respondError(c, http.StatusForbidden, CodePollClosed, fmt.Sprintf("poll %d is not open", pollId))
+}
+
+// PollStatus is the response for POST /polls/:pollid/open and
+// /polls/:pollid/close
+type PollStatus struct {
+	PollId uint `json:"pollId"`
+	Open   bool `json:"open"`
+}
+
+// OpenPoll marks a poll as open.  Once any poll has been opened or closed
+// only votes in open polls are accepted, before that every vote is.
+//
+// @Summary  Open a poll for voting
+// @Tags     polls
+// @Produce  json
+// @Param    pollid path int true "Poll id"
+// @Success  200 {object} PollStatus
+// @Failure  400 {object} ErrorBody
+// @Failure  503 {object} ErrorBody
+// @Router   /polls/{pollid}/open [post]
+// @Security ApiKeyAuth
+func (v *VoterAPI) OpenPoll(c *gin.Context) {
+	v.setPollOpen(c, true)
+}
+
+// ClosePoll marks a poll as closed, the votes already recorded in it are
+// kept but no more are accepted
+//
+// @Summary  Close a poll
+// @Tags     polls
+// @Produce  json
+// @Param    pollid path int true "Poll id"
+// @Success  200 {object} PollStatus
+// @Failure  400 {object} ErrorBody
+// @Failure  503 {object} ErrorBody
+// @Router   /polls/{pollid}/close [post]
+// @Security ApiKeyAuth
+func (v *VoterAPI) ClosePoll(c *gin.Context) {
+	v.setPollOpen(c, false)
+}
+
+func (v *VoterAPI) setPollOpen(c *gin.Context, open bool) {
+	pollid, err := strconv.ParseUint(c.Param("pollid"), 10, 0)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "poll id must be a number that is not negative")
+		return
+	}
+
+	voters := v.dbFor(c)
+	if open {
+		err = voters.OpenPoll(uint(pollid))
+	} else {
+		err = voters.ClosePoll(uint(pollid))
+	}
+	if err != nil {
+		logger(c).Error("Error changing poll status", "error", err, "open", open)
+		abortWithDbError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, PollStatus{PollId: uint(pollid), Open: open})
+}
+
+// PollBatchItemError explains why one vote of a batch was skipped
+type PollBatchItemError struct {
+	Index  int    `json:"index"`
+	PollId uint   `json:"PollId"`
+	Error  string `json:"error"`
+}
+
+// PollBatchResult is the response to POST /voter/:id/polls/batch, Voter is
+// the voter with its history as it was stored
+type PollBatchResult struct {
+	Added   int                  `json:"added"`
+	Skipped []PollBatchItemError `json:"skipped"`
+	Voter   db.Voter             `json:"voter"`
+}
+
+// AddPollsToVoter handles POST /voter/:id/polls/batch, it records a JSON
+// array of votes in one write, for backfilling a history.  Votes for a
+// poll the voter already voted in, or that comes up twice in the batch,
+// are skipped and listed in the response like invalid votes and votes in
+// closed polls, the rest of the batch is still added.
+//
+// @Summary  Record many votes
+// @Tags     polls
+// @Accept   json
+// @Produce  json
+// @Param    id    path     int               true "Voter id"
+// @Param    votes body     []db.VoterHistory true "Votes to record"
+// @Success  200   {object} PollBatchResult
+// @Failure  400   {object} ErrorBody
+// @Failure  404   {object} ErrorBody
+// @Failure  409   {object} ErrorBody
+// @Failure  503   {object} ErrorBody
+// @Router   /voter/{id}/polls/batch [post]
+// @Security ApiKeyAuth
+func (v *VoterAPI) AddPollsToVoter(c *gin.Context) {
+	id, ok := voterIdParam(c)
+	if !ok {
+		return
+	}
+
+	//Every vote is validated on its own so one bad vote does not reject
+	//the whole batch
+	var polls []db.VoterHistory
+	if !decodeJSON(c, &polls) {
+		return
+	}
+	if len(polls) == 0 {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "the batch must have at least one vote")
+		return
+	}
+
+	voter, errs, err := v.dbFor(c).AddPolls(id, polls)
+	if err != nil {
+		logger(c).Error("Error adding votes", "error", err)
+		if errors.Is(err, db.ErrVersionConflict) {
+			respondError(c, http.StatusConflict, CodeVersionConflict, "the voter changed while adding the votes, try again")
+			return
+		}
+		abortWithDbError(c, err)
+		return
+	}
+
+	result := PollBatchResult{Added: len(polls) - len(errs), Skipped: make([]PollBatchItemError, 0, len(errs)), Voter: voter}
+	for _, err := range errs {
+		item := PollBatchItemError{Index: -1, Error: err.Error()}
+		var batchErr *db.PollBatchError
+		if errors.As(err, &batchErr) {
+			item.Index = batchErr.Index
+			item.PollId = batchErr.PollId
+			item.Error = batchErr.Err.Error()
+		}
+		result.Skipped = append(result.Skipped, item)
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// AddSinglePollToVoter records a vote and answers 201 with the vote as it
+// was stored, including the VoteDate it was given
+//
+// @Summary  Record a vote
+// @Tags     polls
+// @Accept   json
+// @Produce  json
+// @Param    id path int true "Voter id"
+// @Param    overwrite query bool false "Replace an earlier vote in the same poll"
+// @Param    servertime query bool false "Stamp the vote with the server time"
+// @Param    sorted query bool false "Keep the vote history in VoteDate order"
+// @Param    vote body db.VoterHistory true "The vote"
+// @Success  201 {object} db.VoterHistory
+// @Header   201 {string} Location "Path of the vote"
+// @Failure  400 {object} ErrorBody
+// @Failure  403 {object} ErrorBody
+// @Failure  404 {object} ErrorBody
+// @Failure  409 {object} ErrorBody
+// @Failure  503 {object} ErrorBody
+// @Router   /voter/{id} [post]
+// @Security ApiKeyAuth
+func (v *VoterAPI) AddSinglePollToVoter(c *gin.Context) {
+
+	id, ok := voterIdParam(c)
+	if !ok {
+		return
+	}
+
+	//?overwrite=true replaces an existing vote for the same poll rather
+	//than rejecting it as a duplicate
+	overwrite, err := strconv.ParseBool(c.DefaultQuery("overwrite", "false"))
+	if err != nil {
+		logger(c).Warn("Invalid overwrite flag", "error", err)
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "overwrite must be true or false")
+		return
+	}
+
+	//?servertime=true ignores any VoteDate sent by the client and uses the
+	//server's clock instead
+	serverTime, err := strconv.ParseBool(c.DefaultQuery("servertime", "false"))
+	if err != nil {
+		logger(c).Warn("Invalid servertime flag", "error", err)
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "servertime must be true or false")
+		return
+	}
+
+	//?sorted=true files the vote by its VoteDate rather than at the end of
+	//the history
+	sorted, err := strconv.ParseBool(c.DefaultQuery("sorted", "false"))
+	if err != nil {
+		logger(c).Warn("Invalid sorted flag", "error", err)
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "sorted must be true or false")
+		return
+	}
+
+	var poll db.VoterHistory
+
+	if !bindJSON(c, &poll) {
+		return
+	}
+
+	opts := db.PollOptions{Overwrite: overwrite, ServerTime: serverTime, Sorted: sorted}
+	history, err := v.dbFor(c).AddPoll(id, poll, opts)
+	if abortIfInvalidVote(c, err) {
+		return
+	}
+	if err != nil {
+		logger(c).Error("Failed to add poll to voter", "error", err)
+		if errors.Is(err, db.ErrDuplicatePoll) {
+			respondError(c, http.StatusConflict, CodeDuplicateVote, err.Error())
+			return
+		}
+		if errors.Is(err, db.ErrVoteHistoryFull) {
+			respondError(c, http.StatusConflict, CodeVoteHistoryFull, err.Error())
+			return
+		}
+		if errors.Is(err, db.ErrPollClosed) {
+			abortPollClosed(c, poll.PollId)
+			return
+		}
+		abortWithDbError(c, err)
+		return
+	}
+
+	//The history holds the vote as stored, with the date it was given
+	for _, vote := range history {
+		if vote.PollId == poll.PollId {
+			poll = vote
+			break
+		}
+	}
+	c.Header("Location", fmt.Sprintf("%s/polls/%d", voterLocation(uint(id)), poll.PollId))
+	c.JSON(http.StatusCreated, poll)
+}
+
+// UpdateSinglePollForVoter replaces the voter's vote in a poll, or records
+// it when the voter has not voted in that poll yet, so the request can be
+// repeated safely
+//
+// @Summary  Replace or record a vote
+// @Tags     polls
+// @Accept   json
+// @Produce  json
+// @Param    id path int true "Voter id"
+// @Param    pollid path int true "Poll id"
+// @Param    vote body db.VoterHistory true "The vote"
+// @Success  200 {object} db.VoterHistory
+// @Success  201 {object} db.VoterHistory
+// @Failure  400 {object} ErrorBody
+// @Failure  403 {object} ErrorBody
+// @Failure  404 {object} ErrorBody
+// @Failure  409 {object} ErrorBody
+// @Failure  503 {object} ErrorBody
+// @Router   /voter/{id}/polls/{pollid} [put]
+// @Security ApiKeyAuth
+func (v *VoterAPI) UpdateSinglePollForVoter(c *gin.Context) {
+	voterid, ok := voterIdParam(c)
+	if !ok {
+		return
+	}
+
+	pollid, err := strconv.ParseUint(c.Param("pollid"), 10, 0)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "poll id must be a number that is not negative")
+		return
+	}
+
+	var poll db.VoterHistory
+	if !bindJSON(c, &poll) {
+		return
+	}
+
+	//The poll in the path and the body have to agree, otherwise it is not
+	//clear which vote the client meant to change
+	if poll.PollId != uint(pollid) {
+		logger(c).Warn("Poll id in path does not match body", "path_pollid", pollid, "body_pollid", poll.PollId)
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "PollId in the body does not match the poll id in the path")
+		return
+	}
+
+	created, err := v.dbFor(c).UpsertPoll(voterid, poll)
+	if abortIfInvalidVote(c, err) {
+		return
+	}
+	if err != nil {
+		logger(c).Error("Error updating poll", "error", err)
+		if errors.Is(err, db.ErrPollClosed) {
+			abortPollClosed(c, poll.PollId)
+			return
+		}
+		if errors.Is(err, db.ErrVoteHistoryFull) {
+			respondError(c, http.StatusConflict, CodeVoteHistoryFull, err.Error())
+			return
+		}
+		abortWithDbError(c, err)
+		return
+	}
+
+	//Answer with the vote as stored, with the date it was given
+	stored, err := v.dbFor(c).GetSingleVoteHistory(voterid, poll.PollId)
+	if err != nil {
+		logger(c).Error("Error getting poll", "error", err)
+		if errors.Is(err, db.ErrPollNotFound) {
+			respondError(c, http.StatusNotFound, CodeNotFound, err.Error())
+			return
+		}
+		abortWithDbError(c, err)
+		return
+	}
+	if created {
+		c.JSON(http.StatusCreated, stored)
+		return
+	}
+	c.JSON(http.StatusOK, stored)
+}
+
+// ClearPollsFromVoter removes all of a voter's votes, the voter itself is
+// kept
+//
+// @Summary  Remove every vote of a voter
+// @Tags     polls
+// @Param    id path int true "Voter id"
+// @Success  200
+// @Failure  400 {object} ErrorBody
+// @Failure  404 {object} ErrorBody
+// @Failure  503 {object} ErrorBody
+// @Router   /voter/{id}/polls [delete]
+// @Security ApiKeyAuth
+func (v *VoterAPI) ClearPollsFromVoter(c *gin.Context) {
+	id, ok := voterIdParam(c)
+	if !ok {
+		return
+	}
+
+	if err := v.dbFor(c).ClearVoteHistory(id); err != nil {
+		logger(c).Error("Error clearing vote history", "error", err)
+		abortWithDbError(c, err)
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// @Summary  Remove a vote
+// @Tags     polls
+// @Param    id path int true "Voter id"
+// @Param    pollid path int true "Poll id"
+// @Success  200
+// @Failure  400 {object} ErrorBody
+// @Failure  404 {object} ErrorBody
+// @Failure  503 {object} ErrorBody
+// @Router   /voter/{id}/polls/{pollid} [delete]
+// @Security ApiKeyAuth
+func (v *VoterAPI) DeleteSinglePollFromVoter(c *gin.Context) {
+	voterid, ok := voterIdParam(c)
+	if !ok {
+		return
+	}
+
+	pollid, err := strconv.ParseUint(c.Param("pollid"), 10, 0)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "poll id must be a number that is not negative")
+		return
+	}
+
+	if err := v.dbFor(c).DeletePoll(voterid, uint(pollid)); err != nil {
+		logger(c).Error("Error deleting poll", "error", err)
+		if errors.Is(err, db.ErrPollNotFound) {
+			respondError(c, http.StatusNotFound, CodeNotFound, err.Error())
+			return
+		}
+		abortWithDbError(c, err)
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// AddVoter creates a voter, a missing or zero VoterId asks the server to
+// assign one and the response body carries the id that was used.  An
+// optional ?ttl=<seconds> makes the voter expire, 0 (the default) keeps the
+// voter until it is deleted.
+//
+// @Summary  Add a voter
+// @Tags     voters
+// @Accept   json
+// @Produce  json
+// @Param    ttl query int false "Seconds until the voter expires"
+// @Param    upsert query bool false "Replace the voter if it exists"
+// @Param    voter body db.Voter true "The voter, VoterId 0 assigns one"
+// @Success  201 {object} db.Voter
+// @Success  200 {object} db.Voter "Replaced by an upsert"
+// @Header   201 {string} Location "Path of the new voter"
+// @Failure  400 {object} ErrorBody
+// @Failure  409 {object} ErrorBody
+// @Failure  422 {object} ErrorBody
+// @Router   /voter [post]
+// @Security ApiKeyAuth
+func (v *VoterAPI) AddVoter(c *gin.Context) {
+	var voter db.Voter
+
+	ttlSeconds, err := strconv.ParseInt(c.DefaultQuery("ttl", "0"), 10, 64)
+	if err != nil || ttlSeconds < 0 {
+		logger(c).Warn("Invalid ttl", "ttl", c.Query("ttl"))
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "ttl must be a number of seconds that is not negative")
+		return
+	}
+
+	//?upsert=true replaces an existing voter instead of answering 409, so a
+	//client can safely resend an add
+	upsert, err := strconv.ParseBool(c.DefaultQuery("upsert", "false"))
+	if err != nil || (upsert && ttlSeconds > 0) {
+		logger(c).Warn("Invalid upsert", "upsert", c.Query("upsert"), "ttl", ttlSeconds)
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "upsert must be true or false and can not be combined with ttl")
+		return
+	}
+
+	if !bindJSON(c, &voter) {
+		return
+	}
+
+	if upsert {
+		v.upsertVoter(c, &voter)
+		return
+	}
+
+	ttl := time.Duration(ttlSeconds) * time.Second
+	if err := v.dbFor(c).AddVoterWithTTL(&voter, ttl); err != nil {
+		logger(c).Error("Error adding item", "error", err)
+		if abortIfInvalid(c, err) || abortIfEmailTaken(c, err) {
+			return
+		}
+		if errors.Is(err, db.ErrVoterExists) {
+			respondError(c, http.StatusConflict, CodeVoterExists, err.Error())
+			return
+		}
+		abortWithDbError(c, err)
+		return
+	}
+
+	c.Header("Location", voterLocation(voter.VoterId))
+	c.JSON(http.StatusCreated, voter)
+}
+
+// voterLocation is the path of a voter, sent in the Location header when
+// a voter is created
+func voterLocation(id uint) string {
+	return "/voter/" + strconv.FormatUint(uint64(id), 10)
+}
+
+// upsertVoter answers 201 when the voter was created and 200 when an
+// existing voter was replaced
+func (v *VoterAPI) upsertVoter(c *gin.Context, voter *db.Voter) {
+	created, err := v.dbFor(c).UpsertVoter(voter)
+	if err != nil {
+		logger(c).Error("Error upserting voter", "error", err)
+		if abortIfInvalid(c, err) || abortIfEmailTaken(c, err) {
+			return
+		}
+		abortWithDbError(c, err)
+		return
+	}
+
+	status := http.StatusOK
+	if created {
+		c.Header("Location", voterLocation(voter.VoterId))
+		status = http.StatusCreated
+	}
+	c.JSON(status, voter)
+}
+
+// BatchItemError explains why one voter of a batch was skipped
+type BatchItemError struct {
+	Index   int    `json:"index"`
+	VoterId uint   `json:"VoterId"`
+	Error   string `json:"error"`
+}
+
+// BatchResult is the response to a bulk voter import
+type BatchResult struct {
+	Added   int              `json:"added"`
+	Skipped []BatchItemError `json:"skipped"`
+}
+
+// AddVoters handles POST /voter/batch, it accepts a JSON array of voters and
+// adds them in one go.  Voters that already exist or are invalid are skipped
+// and listed in the response, the rest of the batch is still added.
+//
+// @Summary  Add many voters
+// @Tags     voters
+// @Accept   json
+// @Produce  json
+// @Param    voters body []db.Voter true "Voters to add"
+// @Success  200 {object} BatchResult
+// @Failure  400 {object} ErrorBody
+// @Failure  503 {object} ErrorBody
+// @Router   /voter/batch [post]
+// @Security ApiKeyAuth
+func (v *VoterAPI) AddVoters(c *gin.Context) {
+	var voters []db.Voter
+
+	//Every voter is validated on its own so one bad voter does not reject
+	//the whole batch
+	if !decodeJSON(c, &voters) {
+		return
+	}
+
+	added, errs := v.dbFor(c).AddVoters(voters)
+	c.JSON(http.StatusOK, newBatchResult(added, errs))
+}
+
+func newBatchResult(added int, errs []error) BatchResult {
+	result := BatchResult{Added: added, Skipped: make([]BatchItemError, 0, len(errs))}
+	for _, err := range errs {
+		result.Skipped = append(result.Skipped, newBatchItemError(err))
+	}
+	return result
+}
+
+func newBatchItemError(err error) BatchItemError {
+	item := BatchItemError{Index: -1, Error: err.Error()}
+
+	var batchErr *db.BatchError
+	if errors.As(err, &batchErr) {
+		item.Index = batchErr.Index
+		item.VoterId = batchErr.VoterId
+		item.Error = batchErr.Err.Error()
+	}
+	return item
+}
+
+// updateVoterRequest is the body of PUT /voter/:id.  VoteHistory is a
+// pointer so that a client leaving it out keeps the stored history, only
+// an explicit array, even an empty one, replaces it.
+type updateVoterRequest struct {
+	VoterId     uint               `json:"VoterId"`
+	Name        string             `json:"Name" binding:"required"`
+	Email       string             `json:"Email" binding:"required"`
+	VoteHistory *[]db.VoterHistory `json:"VoteHistory" binding:"omitempty,dive"`
+	Version     uint               `json:"Version"`
+
+	//Deleted and DeletedAt are accepted so a voter can be sent back the way
+	//it was read, they are ignored since only a soft delete or a restore
+	//changes them
+	Deleted   bool      `json:"Deleted"`
+	DeletedAt time.Time `json:"DeletedAt"`
+}
+
+func (r updateVoterRequest) voter() db.Voter {
+	voter := db.Voter{
+		VoterId: r.VoterId,
+		Name:    r.Name,
+		Email:   r.Email,
+		Version: r.Version,
+	}
+	//db.UpdateVoter keeps the stored history for a nil VoteHistory
+	if r.VoteHistory != nil {
+		voter.VoteHistory = append([]db.VoterHistory{}, *r.VoteHistory...)
+	}
+	return voter
+}
+
+// UpdateVoter replaces the voter at /voter/:id.  The body may leave out the
+// VoterId, if it has one it must match the id in the path.  A body with a
+// Version is only applied if the voter is still at that version, otherwise
+// the answer is 409 and the client should reload the voter.
+// @Summary  Replace a voter
+// @Tags     voters
+// @Accept   json
+// @Produce  json
+// @Param    id path int true "Voter id"
+// @Param    voter body updateVoterRequest true "The voter, a missing VoteHistory is kept"
+// @Success  200 {object} db.Voter
+// @Failure  400 {object} ErrorBody
+// @Failure  404 {object} ErrorBody
+// @Failure  409 {object} ErrorBody
+// @Failure  422 {object} ErrorBody
+// @Failure  503 {object} ErrorBody
+// @Router   /voter/{id} [put]
+// @Security ApiKeyAuth
+func (v *VoterAPI) UpdateVoter(c *gin.Context) {
+	id, ok := voterIdParam(c)
+	if !ok {
+		return
+	}
+
+	var req updateVoterRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+	voter := req.voter()
+
+	if voter.VoterId == 0 {
+		voter.VoterId = uint(id)
+	}
+	if voter.VoterId != uint(id) {
+		logger(c).Warn("Voter id in path does not match body", "path_id", id, "body_id", voter.VoterId)
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "VoterId in the body does not match the id in the path")
+		return
+	}
+
+	if err := v.dbFor(c).UpdateVoter(&voter); err != nil {
+		logger(c).Error("Error updating voter", "error", err)
+		if abortIfInvalid(c, err) || abortIfEmailTaken(c, err) {
+			return
+		}
+		if errors.Is(err, db.ErrVersionConflict) {
+			respondError(c, http.StatusConflict, CodeVersionConflict, err.Error())
+			return
+		}
+		abortWithDbError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, voter)
+}
+
+// PatchVoter changes only the fields sent in the body, anything left out,
+// such as the vote history, is kept
+//
+// @Summary  Change some fields of a voter
+// @Tags     voters
+// @Accept   json
+// @Produce  json
+// @Param    id path int true "Voter id"
+// @Param    patch body db.VoterPatch true "Fields to change"
+// @Success  200 {object} db.Voter
+// @Failure  400 {object} ErrorBody
+// @Failure  404 {object} ErrorBody
+// @Failure  409 {object} ErrorBody
+// @Failure  422 {object} ErrorBody
+// @Failure  503 {object} ErrorBody
+// @Router   /voter/{id} [patch]
+// @Security ApiKeyAuth
+func (v *VoterAPI) PatchVoter(c *gin.Context) {
+	id, ok := voterIdParam(c)
+	if !ok {
+		return
+	}
+
+	var patch db.VoterPatch
+	if !bindJSON(c, &patch) {
+		return
+	}
+
+	voter, err := v.dbFor(c).PatchVoter(id, patch)
+	if err != nil {
+		logger(c).Error("Error patching voter", "error", err)
+		if abortIfInvalid(c, err) || abortIfEmailTaken(c, err) {
+			return
+		}
+		if errors.Is(err, db.ErrVersionConflict) {
+			respondError(c, http.StatusConflict, CodeVersionConflict, err.Error())
+			return
+		}
+		abortWithDbError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, voter)
+}
+
+// DeleteVoter removes the voter, with ?soft=true it is only marked as
+// deleted and can be brought back with POST /voter/:id/restore
+//
+// @Summary  Delete a voter
+// @Tags     voters
+// @Param    id path int true "Voter id"
+// @Param    soft query bool false "Mark the voter as deleted instead of removing it"
+// @Success  200
+// @Failure  400 {object} ErrorBody
+// @Failure  404 {object} ErrorBody
+// @Failure  409 {object} ErrorBody
+// @Failure  503 {object} ErrorBody
+// @Router   /voter/{id} [delete]
+// @Security ApiKeyAuth
+func (v *VoterAPI) DeleteVoter(c *gin.Context) {
+	id, ok := voterIdParam(c)
+	if !ok {
+		return
+	}
+
+	soft, err := strconv.ParseBool(c.DefaultQuery("soft", "false"))
+	if err != nil {
+		logger(c).Warn("Invalid soft flag", "error", err)
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "soft must be true or false")
+		return
+	}
+
+	if soft {
+		err = v.dbFor(c).SoftDeleteVoter(id)
+	} else {
+		err = v.dbFor(c).DeleteVoter(id)
+	}
+	if err != nil {
+		logger(c).Error("Error deleting item", "error", err, "soft", soft)
+		if errors.Is(err, db.ErrVersionConflict) {
+			respondError(c, http.StatusConflict, CodeVersionConflict, err.Error())
+			return
+		}
+		abortWithDbError(c, err)
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// RestoreVoter brings back a voter removed with DELETE /voter/:id?soft=true,
+// restoring a voter that is not deleted changes nothing
+//
+// @Summary  Restore a soft deleted voter
+// @Tags     voters
+// @Produce  json
+// @Param    id path int true "Voter id"
+// @Success  200 {object} db.Voter
+// @Failure  400 {object} ErrorBody
+// @Failure  404 {object} ErrorBody
+// @Failure  409 {object} ErrorBody
+// @Failure  503 {object} ErrorBody
+// @Router   /voter/{id}/restore [post]
+// @Security ApiKeyAuth
+func (v *VoterAPI) RestoreVoter(c *gin.Context) {
+	id, ok := voterIdParam(c)
+	if !ok {
+		return
+	}
+
+	if err := v.dbFor(c).RestoreVoter(id); err != nil {
+		logger(c).Error("Error restoring voter", "error", err)
+		if errors.Is(err, db.ErrVersionConflict) {
+			respondError(c, http.StatusConflict, CodeVersionConflict, err.Error())
+			return
+		}
+		abortWithDbError(c, err)
+		return
+	}
+
+	voter, err := v.dbFor(c).GetVoter(id)
+	if err != nil {
+		logger(c).Error("Error getting voter", "error", err)
+		abortWithDbError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, voter)
+}
+
+// MergeVoters folds the voter :otherid into :id, for duplicates of the
+// same person.  :id keeps its name and email and gets the votes of both,
+// for a poll both voted in the later vote is kept.  :otherid is deleted.
+//
+// @Summary  Merge a duplicate voter into another
+// @Tags     voters
+// @Produce  json
+// @Param    id      path     int true "Voter id to keep"
+// @Param    otherid path     int true "Voter id to merge in and delete"
+// @Success  200     {object} db.Voter
+// @Failure  400     {object} ErrorBody
+// @Failure  404     {object} ErrorBody
+// @Failure  409     {object} ErrorBody
+// @Failure  503     {object} ErrorBody
+// @Router   /voter/{id}/merge/{otherid} [post]
+// @Security ApiKeyAuth
+func (v *VoterAPI) MergeVoters(c *gin.Context) {
+	id, ok := voterIdParam(c)
+	if !ok {
+		return
+	}
+	otherId, ok := voterIdParamNamed(c, "otherid")
+	if !ok {
+		return
+	}
+
+	voter, err := v.dbFor(c).MergeVoters(id, otherId)
+	if err != nil {
+		logger(c).Error("Error merging voters", "error", err)
+		switch {
+		case errors.Is(err, db.ErrMergeSameVoter):
+			respondError(c, http.StatusBadRequest, CodeBadRequest, err.Error())
+		case errors.Is(err, db.ErrVersionConflict):
+			respondError(c, http.StatusConflict, CodeVersionConflict, "one of the voters changed while merging, try again")
+		default:
+			abortWithDbError(c, err)
+		}
+		return
+	}
+	c.JSON(http.StatusOK, voter)
+}
+
+// deleteVotersRequest is the body of POST /voter/delete
+type deleteVotersRequest struct {
+	Ids []int `json:"ids"`
+}
+
+// DeleteVoters removes the voters listed in the body and reports how many
+// of them existed, unknown ids are not an error
+//
+// @Summary  Delete voters by id
+// @Tags     voters
+// @Accept   json
+// @Produce  json
+// @Param    ids body deleteVotersRequest true "Ids to delete"
+// @Success  200 {object} map[string]int
+// @Failure  400 {object} ErrorBody
+// @Failure  503 {object} ErrorBody
+// @Router   /voter/delete [post]
+// @Security ApiKeyAuth
+func (v *VoterAPI) DeleteVoters(c *gin.Context) {
+
+	var req deleteVotersRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+	for _, id := range req.Ids {
+		if id < 0 {
+			respondError(c, http.StatusBadRequest, CodeBadRequest, "ids must not be negative")
+			return
+		}
+	}
+
+	deleted, err := v.dbFor(c).DeleteVoters(req.Ids)
+	if err != nil {
+		logger(c).Error("Error deleting voters", "error", err)
+		abortWithDbError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"deleted": deleted})
+}
+
+// DeleteAllPreview is the response to DELETE /voter?dryRun=true, it lists
+// the voters a real delete would remove
+type DeleteAllPreview struct {
+	DryRun bool   `json:"dryRun"`
+	Count  int    `json:"count"`
+	Ids    []uint `json:"ids"`
+}
+
+// DeleteAllVoters removes every voter.  ?dryRun=true only reports which
+// voters would go and leaves them in place, ?confirm=true asks for the real
+// delete explicitly, the two can not be combined.
+//
+// @Summary  Delete every voter
+// @Tags     voters
+// @Produce  json
+// @Param    dryRun query bool false "Only list the voters that would be deleted"
+// @Param    confirm query bool false "Delete for real, the default"
+// @Success  200 {object} DeleteAllPreview "Only for a dry run"
+// @Failure  400 {object} ErrorBody
+// @Failure  503 {object} ErrorBody
+// @Router   /voter [delete]
+// @Security ApiKeyAuth
+func (v *VoterAPI) DeleteAllVoters(c *gin.Context) {
+
+	dryRun, err := strconv.ParseBool(c.DefaultQuery("dryRun", "false"))
+	if err != nil {
+		logger(c).Warn("Invalid dryRun flag", "error", err)
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "dryRun must be true or false")
+		return
+	}
+	confirm, err := strconv.ParseBool(c.DefaultQuery("confirm", "false"))
+	if err != nil || (confirm && dryRun) {
+		logger(c).Warn("Invalid confirm flag", "confirm", c.Query("confirm"), "dryRun", dryRun)
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "confirm must be true or false and can not be combined with dryRun")
+		return
+	}
+
+	if dryRun {
+		//Soft deleted voters are removed too, so they are listed
+		ids, err := v.dbFor(c).IncludeDeleted().GetVoterIds()
+		if err != nil {
+			logger(c).Error("Error listing voters", "error", err)
+			abortWithDbError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, DeleteAllPreview{DryRun: true, Count: len(ids), Ids: ids})
+		return
+	}
+
+	if err := v.dbFor(c).DeleteAll(); err != nil {
+		logger(c).Error("Error deleting all items", "error", err)
+		abortWithDbError(c, err)
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// jsonFieldNames returns the JSON names of the fields of struct type t,
+// including those of embedded structs
+func jsonFieldNames(t reflect.Type) map[string]bool {
+	names := make(map[string]bool)
+	for _, f := range reflect.VisibleFields(t) {
+		if !f.IsExported() || f.Anonymous {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		switch name {
+		case "-":
+			continue
+		case "":
+			name = f.Name
+		}
+		names[name] = true
+	}
+	return names
+}
+
+// fieldsParam reads ?fields=VoterId,Name, the fields of obj's type a
+// response should be cut down to.  No fields means the whole object, a
+// field obj does not have aborts with 400.
+func fieldsParam(c *gin.Context, obj any) (fields []string, ok bool) {
+	raw := c.Query("fields")
+	if raw == "" {
+		return nil, true
+	}
+
+	known := jsonFieldNames(reflect.TypeOf(obj))
+	for _, field := range strings.Split(raw, ",") {
+		field = strings.TrimSpace(field)
+		if !known[field] {
+			logger(c).Warn("Invalid fields", "fields", raw, "field", field)
+			respondError(c, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("unknown field %q", field))
+			return nil, false
+		}
+		fields = append(fields, field)
+	}
+	return fields, true
+}
+
+// project encodes obj keeping only the given JSON fields, with no fields
+// it is kept whole
+func project(obj any, fields []string) (any, error) {
+	if len(fields) == 0 {
+		return obj, nil
+	}
+
+	raw, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &all); err != nil {
+		return nil, err
+	}
+
+	projected := make(map[string]json.RawMessage, len(fields))
+	for _, field := range fields {
+		projected[field] = all[field]
+	}
+	return projected, nil
+}
+
+// projectVoters is project for every voter of a list
+func projectVoters(voterList []db.Voter, fields []string) (any, error) {
+	if len(fields) == 0 {
+		return voterList, nil
+	}
+
+	projected := make([]any, len(voterList))
+	for i, voter := range voterList {
+		var err error
+		if projected[i], err = project(voter, fields); err != nil {
+			return nil, err
+		}
+	}
+	return projected, nil
+}
+
+// voterIdParam parses the :id path parameter, non-numeric and negative ids
+// abort the request with 400 and ok is false
+func voterIdParam(c *gin.Context) (id int, ok bool) {
+	return voterIdParamNamed(c, "id")
+}
+
+// voterIdParamNamed is voterIdParam for a voter id in the named path
+// parameter
+func voterIdParamNamed(c *gin.Context, name string) (id int, ok bool) {
+	id64, err := strconv.ParseInt(c.Param(name), 10, 32)
+	if err != nil || id64 < 0 {
+		logger(c).Warn("Invalid voter id", "id", c.Param(name))
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "voter id must be a number that is not negative")
+		return 0, false
+	}
+	return int(id64), true
+}
+
+// ErrorBody is the body of every error response
+type ErrorBody struct {
+	Error ErrorDetail `json:"error"`
+}
+
+// ErrorDetail says what went wrong.  Code is one of the Code constants, for
+// clients to act on, and Message is meant for people.  Fields names the
+// offending fields of a request body when there are any.
+type ErrorDetail struct {
+	Code    string            `json:"code"`
+	Message string            `json:"message"`
+	Fields  map[string]string `json:"fields,omitempty"`
+}
+
+// The codes sent in ErrorDetail.Code
+const (
+	CodeBadRequest           = "bad_request"
+	CodeInvalidBody          = "invalid_body"
+	CodeValidationFailed     = "validation_failed"
+	CodeNotFound             = "not_found"
+	CodePollClosed           = "poll_closed"
+	CodeVoterExists          = "voter_exists"
+	CodeEmailTaken           = "email_taken"
+	CodeDuplicateVote        = "duplicate_vote"
+	CodeVoteHistoryFull      = "vote_history_full"
+	CodeVersionConflict      = "version_conflict"
+	CodeRequestInProgress    = "request_in_progress"
+	CodeIdempotencyKeyReused = "idempotency_key_reused"
+	CodeBodyTooLarge         = "body_too_large"
+	CodeUnsupportedMedia     = "unsupported_media_type"
+	CodeMethodNotAllowed     = "method_not_allowed"
+	CodeInternal             = "internal_error"
+	CodeUnexpectedReply      = "unexpected_reply"
+	CodeUnavailable          = "unavailable"
+	CodeTimeout              = "timeout"
+)
+
+// errorCodeKey is the gin context key respondError keeps the code under,
+// for CountErrors
+const errorCodeKey = "api.errorCode"
+
+// respondError aborts the request with status and an ErrorBody
+func respondError(c *gin.Context, status int, code, message string) {
+	respondErrorFields(c, status, code, message, nil)
+}
+
+// respondErrorFields is respondError for a request body with offending
+// fields, fields maps each of them to what is wrong with it
+func respondErrorFields(c *gin.Context, status int, code, message string, fields map[string]string) {
+	c.Set(errorCodeKey, code)
+	c.AbortWithStatusJSON(status, ErrorBody{Error: ErrorDetail{Code: code, Message: message, Fields: fields}})
+}
+
+// errorType is the kind of error a request failed with, GET /stats/errors
+// counts the requests of each kind
+type errorType int
+
+const (
+	errorTypeOther errorType = iota
+	errorTypeNotFound
+	errorTypeConflict
+	errorTypeValidation
+	errorTypeRedis
+	numErrorTypes
+)
+
+// errorTypes sorts the error codes, codes missing from it are
+// errorTypeOther
+var errorTypes = map[string]errorType{
+	CodeNotFound:             errorTypeNotFound,
+	CodeVoterExists:          errorTypeConflict,
+	CodeEmailTaken:           errorTypeConflict,
+	CodeDuplicateVote:        errorTypeConflict,
+	CodeVoteHistoryFull:      errorTypeConflict,
+	CodeVersionConflict:      errorTypeConflict,
+	CodeRequestInProgress:    errorTypeConflict,
+	CodeBadRequest:           errorTypeValidation,
+	CodeInvalidBody:          errorTypeValidation,
+	CodeValidationFailed:     errorTypeValidation,
+	CodeIdempotencyKeyReused: errorTypeValidation,
+	CodeBodyTooLarge:         errorTypeValidation,
+	CodeUnsupportedMedia:     errorTypeValidation,
+	CodeMethodNotAllowed:     errorTypeValidation,
+	CodeUnavailable:          errorTypeRedis,
+	CodeTimeout:              errorTypeRedis,
+	CodeUnexpectedReply:      errorTypeRedis,
+}
+
+// errorTypeOf is the type of error an aborted request failed with.  The
+// code respondError sent decides it, the few aborts made without it, such
+// as by the API key check, are sorted by status.
+func errorTypeOf(c *gin.Context) errorType {
+	if code := c.GetString(errorCodeKey); code != "" {
+		return errorTypes[code]
+	}
+	switch c.Writer.Status() {
+	case http.StatusNotFound:
+		return errorTypeNotFound
+	case http.StatusConflict:
+		return errorTypeConflict
+	case http.StatusBadRequest, http.StatusUnprocessableEntity:
+		return errorTypeValidation
+	case http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return errorTypeRedis
+	}
+	return errorTypeOther
+}
+
+// abortWithDbError aborts with 404 when the voter does not exist, 409 when
+// it kept changing while being written and 500 when what is stored for it
+// is not a voter or redis answered with a reply the db layer can not
+// decode.  Any other error from the db layer means redis could not answer,
+// which is reported as 503 so clients can tell an outage apart from a
+// missing record.
+func abortWithDbError(c *gin.Context, err error) {
+	if errors.Is(err, db.ErrVoterNotFound) {
+		respondError(c, http.StatusNotFound, CodeNotFound, err.Error())
+		return
+	}
+	if errors.Is(err, db.ErrVersionConflict) {
+		respondError(c, http.StatusConflict, CodeVersionConflict, "the voter kept changing while it was written, try again")
+		return
+	}
+	//Redis answered, what it holds for the voter is the problem
+	if errors.Is(err, db.ErrCorruptVoter) {
+		respondError(c, http.StatusInternalServerError, CodeInternal, db.ErrCorruptVoter.Error())
+		return
+	}
+	var replyErr *db.ReplyTypeError
+	if errors.As(err, &replyErr) {
+		respondError(c, http.StatusInternalServerError, CodeUnexpectedReply, "redis answered with a reply the server can not read")
+		return
+	}
+	//A redis call cut short by the request deadline does not always come
+	//back as DeadlineExceeded, so the request context is checked as well
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(c.Request.Context().Err(), context.DeadlineExceeded) {
+		respondError(c, http.StatusGatewayTimeout, CodeTimeout, "redis did not answer in time")
+		return
+	}
+	respondError(c, http.StatusServiceUnavailable, CodeUnavailable, "redis is unavailable")
+}
+
+// decodeJSON decodes the request body into obj, a body with fields obj
+// does not have is refused rather than silently ignored.  On failure the
+// request is aborted with 400 and ok is false.
+func decodeJSON(c *gin.Context, obj any) (ok bool) {
+	if c.Request.Body == nil {
+		logger(c).Warn("Error binding JSON", "error", "missing request body")
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "the request body is missing")
+		return false
+	}
+
+	dec := json.NewDecoder(c.Request.Body)
+	dec.DisallowUnknownFields()
+	err := dec.Decode(obj)
+	if err == nil {
+		return true
+	}
+	if abortIfBodyTooLarge(c, err) {
+		return false
+	}
+	logger(c).Warn("Error binding JSON", "error", err)
+
+	//Name the unexpected field so a typo in the client is easy to spot,
+	//anything that is not valid JSON at all gets a bare 400 as before
+	if msg := strings.TrimPrefix(err.Error(), "json: "); strings.HasPrefix(msg, "unknown field ") {
+		respondError(c, http.StatusBadRequest, CodeInvalidBody, msg)
+		return false
+	}
+	respondError(c, http.StatusBadRequest, CodeInvalidBody, "the request body is not valid JSON")
+	return false
+}
+
+// bindJSON is decodeJSON followed by the checks in obj's binding tags, a
+// body missing a required field is refused with 400 and a message for each
+// offending field
+func bindJSON(c *gin.Context, obj any) (ok bool) {
+	if !decodeJSON(c, obj) {
+		return false
+	}
+
+	err := binding.Validator.ValidateStruct(obj)
+	if err == nil {
+		return true
+	}
+	logger(c).Warn("Invalid request body", "error", err)
+
+	var fieldErrs validator.ValidationErrors
+	if !errors.As(err, &fieldErrs) {
+		respondError(c, http.StatusBadRequest, CodeInvalidBody, err.Error())
+		return false
+	}
+	fields := make(map[string]string, len(fieldErrs))
+	for _, fieldErr := range fieldErrs {
+		//Namespace keeps the position of a field inside a list, e.g.
+		//Voter.VoteHistory[0].PollId, without the name of the struct
+		_, name, _ := strings.Cut(fieldErr.Namespace(), ".")
+		if fieldErr.Tag() == "required" {
+			fields[name] = "is required"
+		} else {
+			fields[name] = "failed the " + fieldErr.Tag() + " check"
+		}
+	}
+	respondErrorFields(c, http.StatusBadRequest, CodeInvalidBody, "invalid request body", fields)
+	return false
+}
+
+// abortIfEmailTaken aborts with 409 and a body saying why when err is
+// db.ErrEmailTaken, it reports whether the request was aborted
+func abortIfEmailTaken(c *gin.Context, err error) bool {
+	if !errors.Is(err, db.ErrEmailTaken) {
+		return false
+	}
+	respondError(c, http.StatusConflict, CodeEmailTaken, db.ErrEmailTaken.Error())
+	return true
+}
+
+// abortIfInvalid aborts with 422 and a body naming the offending field when
+// err is a validation failure, it reports whether the request was aborted
+func abortIfInvalid(c *gin.Context, err error) bool {
+	var validationErr *db.ValidationError
+	if !errors.As(err, &validationErr) {
+		return false
+	}
+
+	respondErrorFields(c, http.StatusUnprocessableEntity, CodeValidationFailed, validationErr.Message,
+		map[string]string{validationErr.Field: validationErr.Message})
+	return true
+}
+
+// abortIfInvalidVote is abortIfInvalid for a vote, whose checks are about
+// fields missing from the request body, so it aborts with 400
+func abortIfInvalidVote(c *gin.Context, err error) bool {
+	var validationErr *db.ValidationError
+	if !errors.As(err, &validationErr) {
+		return false
+	}
+
+	logger(c).Warn("Invalid vote", "error", err)
+	respondErrorFields(c, http.StatusBadRequest, CodeInvalidBody, validationErr.Message,
+		map[string]string{validationErr.Field: validationErr.Message})
+	return true
+}
+
+/*   SPECIAL HANDLERS FOR DEMONSTRATION - CRASH SIMULATION AND HEALTH CHECK */
+
+// @Summary  Simulate a crash
+// @Tags     admin
+// @Produce  json
+// @Failure  500 {object} ErrorBody
+// @Router   /crash [get]
+// @Security ApiKeyAuth
+func (v *VoterAPI) CrashSim(c *gin.Context) {
+	//panic() is go's version of throwing an exception
+	//note with recover middleware this will not end program
+	panic("Simulating an unexpected crash")
+}
+
+// Recover is used with gin's recovery middleware, it turns a panic in a
+// handler into a 500 with a JSON body so the server keeps running
+func Recover(c *gin.Context, recovered any) {
+	logger(c).Error("Recovered from panic", "panic", recovered)
+	respondError(c, http.StatusInternalServerError, CodeInternal, "internal server error")
+}
+
+// NoRoute answers requests for a path the API does not have with a 404 in
+// the usual error body instead of gin's plain text one
+func NoRoute(c *gin.Context) {
+	respondError(c, http.StatusNotFound, CodeNotFound, fmt.Sprintf("no route for %s %s", c.Request.Method, c.Request.URL.Path))
+}
+
+// NoMethod answers requests for a path the API has with a method it does
+// not take with a 405 in the usual error body, it needs the engine's
+// HandleMethodNotAllowed set
+func NoMethod(c *gin.Context) {
+	respondError(c, http.StatusMethodNotAllowed, CodeMethodNotAllowed, fmt.Sprintf("%s is not allowed on %s", c.Request.Method, c.Request.URL.Path))
+}
+
+// CountErrors is middleware that counts every request a handler aborted,
+// the total is reported by the health check and the count of each type of
+// error by GET /stats/errors
+func (v *VoterAPI) CountErrors(c *gin.Context) {
+	c.Next()
+	if c.IsAborted() {
+		v.errorCount.Add(1)
+		v.errorsByType[errorTypeOf(c)].Add(1)
+	}
+}
+
+// RequestTimeout is middleware that gives every request a deadline, the
+// redis calls made for the request give up once it passes or the client
+// goes away.  A timeout of zero leaves requests without a deadline, as do
+// the exempt paths, such as streams that stay open for as long as the
+// client wants.
+func RequestTimeout(timeout time.Duration, exempt ...string) gin.HandlerFunc {
+	exemptPaths := make(map[string]bool, len(exempt))
+	for _, path := range exempt {
+		exemptPaths[path] = true
+	}
+
+	return func(c *gin.Context) {
+		if timeout <= 0 || exemptPaths[c.Request.URL.Path] {
+			c.Next()
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+		defer cancel()
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
+
+// LimitBody is middleware that refuses request bodies larger than limit
+// bytes with 413.  perRoute gives some routes, keyed by their path as
+// registered such as "/voter/batch", a limit of their own.  A limit of zero
+// or less leaves bodies unlimited.
+func LimitBody(limit int64, perRoute map[string]int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		max := limit
+		if routeLimit, ok := perRoute[c.FullPath()]; ok {
+			max = routeLimit
+		}
+		if max <= 0 || c.Request.Body == nil {
+			c.Next()
+			return
+		}
+
+		//A body that announces its size up front can be refused without
+		//reading any of it, anything else is cut off once it gets too big
+		if c.Request.ContentLength > max {
+			abortBodyTooLarge(c, max)
+			return
+		}
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, max)
+		c.Next()
+	}
+}
+
+// IdempotencyKeyHeader lets a client retry a POST safely, a repeat with the
+// same key gets the first response back instead of running again
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// IdempotentReplayedHeader marks a response that was kept from an earlier
+// request with the same Idempotency-Key
+const IdempotentReplayedHeader = "Idempotent-Replayed"
+
+// maxIdempotencyKeyLength keeps the redis keys built from the header sane
+const maxIdempotencyKeyLength = 255
+
+// idempotencyPendingTTL is how long a key is held for a request that is
+// still running, should its response never be saved the key frees up again
+// after this rather than after the full ttl
+const idempotencyPendingTTL = time.Minute
+
+// replayedHeaders are the response headers kept with an idempotent response
+var replayedHeaders = []string{"Content-Type", "Location", "ETag"}
+
+// bodyRecorder passes a response through while keeping a copy of its body
+type bodyRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (r *bodyRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *bodyRecorder) WriteString(s string) (int, error) {
+	r.body.WriteString(s)
+	return r.ResponseWriter.WriteString(s)
+}
+
+// Idempotency is middleware that honours the Idempotency-Key header.  The
+// first request with a key runs as usual and its response is kept in redis
+// for ttl, repeats get that response back with Idempotent-Replayed set
+// rather than running again.  Reusing a key for a different request, one
+// with another method, path, query or body, is refused with 422, and a
+// repeat that arrives while the first request is still running with 409.
+// Responses with a 5xx status are not kept, nor are requests that panicked,
+// so the request can be retried.  A ttl of zero or less turns the header
+// off.
+func (v *VoterAPI) Idempotency(ttl time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(IdempotencyKeyHeader)
+		if ttl <= 0 || key == "" {
+			c.Next()
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			logger(c).Warn("Invalid idempotency key", "length", len(key))
+			respondError(c, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("%s is longer than %d characters", IdempotencyKeyHeader, maxIdempotencyKeyLength))
+			return
+		}
+
+		//The query and the body are part of the fingerprint, the body is put
+		//back for the handler
+		var body []byte
+		if c.Request.Body != nil {
+			var err error
+			body, err = io.ReadAll(c.Request.Body)
+			if err != nil {
+				logger(c).Warn("Error reading request body", "error", err)
+				if !abortIfBodyTooLarge(c, err) {
+					respondError(c, http.StatusBadRequest, CodeBadRequest, "could not read the request body")
+				}
+				return
+			}
+			c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		sum := sha256.Sum256([]byte(c.Request.Method + " " + c.Request.URL.RequestURI() + "\n" + string(body)))
+		fingerprint := hex.EncodeToString(sum[:])
+
+		stored, err := v.dbFor(c).ClaimIdempotencyKey(key, fingerprint, min(ttl, idempotencyPendingTTL))
+		if err != nil {
+			logger(c).Error("Error claiming idempotency key", "error", err)
+			abortWithDbError(c, err)
+			return
+		}
+		switch {
+		case stored == nil:
+		case stored.Fingerprint != fingerprint:
+			logger(c).Warn("Idempotency key reused for another request", "key", key)
+			respondError(c, http.StatusUnprocessableEntity, CodeIdempotencyKeyReused, IdempotencyKeyHeader+" was already used for a different request")
+			return
+		case stored.Status == 0:
+			respondError(c, http.StatusConflict, CodeRequestInProgress, "the first request with this "+IdempotencyKeyHeader+" is still being handled")
+			return
+		default:
+			for name, value := range stored.Header {
+				c.Header(name, value)
+			}
+			c.Header(IdempotentReplayedHeader, "true")
+			c.Data(stored.Status, stored.Header["Content-Type"], stored.Body)
+			c.Abort()
+			return
+		}
+
+		//The outcome is recorded even when the request ran out of time
+		voters := v.db.WithContext(context.WithoutCancel(c.Request.Context()))
+
+		//Unless the response is kept the key is released so the request can
+		//be retried, in a defer so that happens after a panic too
+		saved := false
+		defer func() {
+			if saved {
+				return
+			}
+			if err := voters.ReleaseIdempotencyKey(key); err != nil {
+				logger(c).Error("Error releasing idempotency key", "error", err)
+			}
+		}()
+
+		rec := &bodyRecorder{ResponseWriter: c.Writer}
+		c.Writer = rec
+		c.Next()
+
+		status := rec.Status()
+		if status >= http.StatusInternalServerError {
+			return
+		}
+
+		resp := db.IdempotentResponse{Fingerprint: fingerprint, Status: status, Header: make(map[string]string), Body: rec.body.Bytes()}
+		for _, name := range replayedHeaders {
+			if value := rec.Header().Get(name); value != "" {
+				resp.Header[name] = value
+			}
+		}
+		if err := voters.SaveIdempotentResponse(key, resp, ttl); err != nil {
+			logger(c).Error("Error saving idempotent response", "error", err)
+			return
+		}
+		saved = true
+	}
+}
+
+// Audit is middleware that records every request that may change the
+// voters, anything but GET, HEAD and OPTIONS, in the audit log kept in
+// redis.  The log holds the newest max entries, a max below 1 turns
+// auditing off.  The entry is written once the response is, failing to
+// write it is only logged.
+func (v *VoterAPI) Audit(max int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			c.Next()
+			return
+		}
+		if max < 1 {
+			c.Next()
+			return
+		}
+
+		start := time.Now()
+		c.Next()
+
+		entry := db.AuditEntry{
+			Method:  c.Request.Method,
+			Path:    c.Request.URL.Path,
+			VoterId: auditVoterId(c),
+			Time:    start.UTC(),
+			Status:  c.Writer.Status(),
+		}
+		//Recorded even when the request ran out of time
+		voters := v.db.WithContext(context.WithoutCancel(c.Request.Context()))
+		if err := voters.AddAuditEntry(entry, max); err != nil {
+			logger(c).Error("Error writing audit entry", "error", err)
+		}
+	}
+}
+
+// auditVoterId is the voter a request was about, taken from the id in its
+// path or, for a new voter, the Location of the response.  It is zero for
+// requests about many voters.
+func auditVoterId(c *gin.Context) uint {
+	id := c.Param("id")
+	if id == "" {
+		id = strings.TrimPrefix(c.Writer.Header().Get("Location"), "/voter/")
+	}
+	voterId, err := strconv.ParseUint(id, 10, 0)
+	if err != nil {
+		return 0
+	}
+	return uint(voterId)
+}
+
+// abortIfBodyTooLarge answers 413 when err is from reading past the limit
+// LimitBody put on the body, it reports whether it did
+func abortIfBodyTooLarge(c *gin.Context, err error) bool {
+	var tooLarge *http.MaxBytesError
+	if !errors.As(err, &tooLarge) {
+		return false
+	}
+	abortBodyTooLarge(c, tooLarge.Limit)
+	return true
+}
+
+func abortBodyTooLarge(c *gin.Context, limit int64) {
+	logger(c).Warn("Request body too large", "limit", limit)
+	respondError(c, http.StatusRequestEntityTooLarge, CodeBodyTooLarge, fmt.Sprintf("request body is larger than %d bytes", limit))
+}
+
+// Stats is the response for GET /stats
+type Stats struct {
+	Voters               int     `json:"voters"`
+	TotalVotes           int     `json:"totalVotes"`
+	AverageVotesPerVoter float64 `json:"averageVotesPerVoter"`
+}
+
+// GetStats reports how many voters there are and how many votes they have
+// cast between them
+//
+// @Summary  Voter and vote totals
+// @Tags     admin
+// @Produce  json
+// @Success  200 {object} Stats
+// @Failure  503 {object} ErrorBody
+// @Router   /stats [get]
+// @Security ApiKeyAuth
+func (v *VoterAPI) GetStats(c *gin.Context) {
+	voters, err := v.dbFor(c).CountVoters()
+	if err != nil {
+		logger(c).Error("Error counting voters", "error", err)
+		abortWithDbError(c, err)
+		return
+	}
+
+	totalVotes, err := v.dbFor(c).CountTotalVotes()
+	if err != nil {
+		logger(c).Error("Error counting votes", "error", err)
+		abortWithDbError(c, err)
+		return
+	}
+
+	stats := Stats{Voters: voters, TotalVotes: totalVotes}
+	//No voters means no average rather than a division by zero
+	if voters > 0 {
+		stats.AverageVotesPerVoter = float64(totalVotes) / float64(voters)
+	}
+	c.JSON(http.StatusOK, stats)
+}
+
+// ErrorStats is the response for GET /stats/errors, Total is the sum of
+// the others
+type ErrorStats struct {
+	Total      int64 `json:"total"`
+	NotFound   int64 `json:"notFound"`
+	Conflict   int64 `json:"conflict"`
+	Validation int64 `json:"validation"`
+	Redis      int64 `json:"redis"`
+	Other      int64 `json:"other"`
+}
+
+// GetErrorStats reports how many requests failed since the server started,
+// by type of error.  Validation covers malformed requests, redis the ones
+// redis could not answer in time or at all, and other anything else, such
+// as a missing API key or a crash.
+//
+// @Summary  Failed request counts by type
+// @Tags     admin
+// @Produce  json
+// @Success  200 {object} ErrorStats
+// @Router   /stats/errors [get]
+// @Security ApiKeyAuth
+func (v *VoterAPI) GetErrorStats(c *gin.Context) {
+	c.JSON(http.StatusOK, ErrorStats{
+		Total:      v.errorCount.Load(),
+		NotFound:   v.errorsByType[errorTypeNotFound].Load(),
+		Conflict:   v.errorsByType[errorTypeConflict].Load(),
+		Validation: v.errorsByType[errorTypeValidation].Load(),
+		Redis:      v.errorsByType[errorTypeRedis].Load(),
+		Other:      v.errorsByType[errorTypeOther].Load(),
+	})
+}
+
+// maxAuditLimit is the most audit entries GET /audit returns at once
+const maxAuditLimit = 1000
+
+// GetAuditLog returns the newest entries of the audit log, newest first.
+// limit defaults to 50 and can be at most 1000.  The log is empty when the
+// server runs without -audit-max.
+//
+// @Summary  Recent changes to the voters
+// @Tags     admin
+// @Produce  json
+// @Param    limit query    int false "Number of entries, at most 1000" default(50)
+// @Success  200   {array}  db.AuditEntry
+// @Failure  400   {object} ErrorBody
+// @Failure  503   {object} ErrorBody
+// @Router   /audit [get]
+// @Security ApiKeyAuth
+func (v *VoterAPI) GetAuditLog(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultPageLimit)))
+	if err != nil || limit <= 0 || limit > maxAuditLimit {
+		logger(c).Warn("Invalid limit", "limit", c.Query("limit"))
+		respondError(c, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("limit must be a number from 1 to %d", maxAuditLimit))
+		return
+	}
+
+	entries, err := v.dbFor(c).GetAuditEntries(limit)
+	if err != nil {
+		logger(c).Error("Error Getting Audit Log", "error", err)
+		abortWithDbError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, entries)
+}
+
+// VoteTotal is the response for GET /stats/votes
+type VoteTotal struct {
+	TotalVotes int `json:"totalVotes"`
+}
+
+// GetVoteTotal reports the running total of votes.  It is a single read
+// rather than the scan behind GET /stats, which makes it cheap enough for
+// a dashboard to poll.
+//
+// @Summary  Running vote total
+// @Tags     admin
+// @Produce  json
+// @Success  200 {object} VoteTotal
+// @Failure  503 {object} ErrorBody
+// @Router   /stats/votes [get]
+// @Security ApiKeyAuth
+func (v *VoterAPI) GetVoteTotal(c *gin.Context) {
+	total, err := v.dbFor(c).GetVoteTotal()
+	if err != nil {
+		logger(c).Error("Error getting vote total", "error", err)
+		abortWithDbError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, VoteTotal{TotalVotes: total})
+}
+
+// ReconcileVoteTotal recounts every vote and resets the running total to
+// the result, for when the total has drifted from GET /stats
+//
+// @Summary  Recount the running vote total
+// @Tags     admin
+// @Produce  json
+// @Success  200 {object} VoteTotal
+// @Failure  503 {object} ErrorBody
+// @Router   /stats/votes/reconcile [post]
+// @Security ApiKeyAuth
+func (v *VoterAPI) ReconcileVoteTotal(c *gin.Context) {
+	total, err := v.dbFor(c).ReconcileVoteTotal()
+	if err != nil {
+		logger(c).Error("Error reconciling vote total", "error", err)
+		abortWithDbError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, VoteTotal{TotalVotes: total})
+}
+
+// RebuildIndexes rebuilds the email index and the id counter from the
+// stored voters, for when they have drifted from them
+//
+// @Summary  Rebuild the email index and id counter
+// @Tags     admin
+// @Success  200
+// @Failure  503 {object} ErrorBody
+// @Router   /admin/reindex [post]
+// @Security ApiKeyAuth
+func (v *VoterAPI) RebuildIndexes(c *gin.Context) {
+	if err := v.dbFor(c).RebuildIndexes(); err != nil {
+		logger(c).Error("Error rebuilding indexes", "error", err)
+		abortWithDbError(c, err)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+const (
+	//wsWriteWait is how long a single message to a vote stream may take
+	wsWriteWait = 10 * time.Second
+	//wsPongWait is how long a vote stream may go without hearing from the
+	//client, pings are sent often enough that a live client always answers
+	wsPongWait     = 60 * time.Second
+	wsPingInterval = wsPongWait * 9 / 10
+)
+
+var upgrader = websocket.Upgrader{
+	//Origins are checked by the CORS middleware before the handler runs
+	CheckOrigin: func(*http.Request) bool { return true },
+}
+
+// StreamVotes upgrades the connection to a WebSocket and sends every new
+// vote to the client as a JSON message, as soon as it is recorded.  Votes
+// are sent as they happen, nothing recorded before the client connected is
+// replayed.  A client that reads too slowly misses votes rather than
+// holding up the others.  Anything the client sends is ignored.
+//
+// @Summary  Stream new votes over a WebSocket
+// @Tags     polls
+// @Produce  json
+// @Success  101 {object} db.VoteEvent
+// @Failure  400 {object} ErrorBody
+// @Router   /ws/votes [get]
+// @Security ApiKeyAuth
+func (v *VoterAPI) StreamVotes(c *gin.Context) {
+	//Subscribing first means a client sees every vote recorded once its
+	//handshake has completed
+	votes := v.votes.Subscribe()
+	defer v.votes.Unsubscribe(votes)
+
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		//The upgrader has already answered with 400
+		logger(c).Warn("Error upgrading vote stream", "error", err)
+		return
+	}
+	defer conn.Close()
+
+	//Reading is the only way to notice the client closing the connection,
+	//and it handles the pongs that keep the connection alive
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		conn.SetReadLimit(512)
+		conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		})
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case <-closed:
+			return
+		case vote, ok := <-votes:
+			if !ok {
+				//The server is shutting down
+				conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), time.Now().Add(wsWriteWait))
+				return
+			}
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := conn.WriteJSON(vote.VoteEvent); err != nil {
+				logger(c).Warn("Error sending vote to stream", "error", err)
+				return
+			}
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// sseKeepAlive is how often a comment is sent on an idle event stream, so
+// proxies do not close it and a client that has gone away is noticed
+const sseKeepAlive = 15 * time.Second
+
+// LastEventIDHeader is sent by a client reconnecting to an event stream,
+// with the id of the last event it received
+const LastEventIDHeader = "Last-Event-ID"
+
+// StreamVoteEvents sends every new vote as a server-sent event, a lighter
+// alternative to the WebSocket at /ws/votes.  Each event carries an id and
+// a client that reconnects with it in Last-Event-ID first gets the votes it
+// missed, as long as they are among the latest ones this instance has
+// kept.  The ids are numbered by each instance, so behind a load balancer
+// the missed votes are only sent when the client reconnects to the same
+// instance.
+//
+// @Summary  Stream new votes as server-sent events
+// @Tags     polls
+// @Produce  text/event-stream
+// @Param    Last-Event-ID header string false "Id of the last event received"
+// @Success  200 {object} db.VoteEvent
+// @Failure  400 {object} ErrorBody
+// @Router   /events/votes [get]
+// @Security ApiKeyAuth
+func (v *VoterAPI) StreamVoteEvents(c *gin.Context) {
+	var lastID uint64
+	if header := c.GetHeader(LastEventIDHeader); header != "" {
+		id, err := strconv.ParseUint(header, 10, 64)
+		if err != nil {
+			respondError(c, http.StatusBadRequest, CodeBadRequest, "invalid "+LastEventIDHeader)
+			return
+		}
+		lastID = id
+	}
+
+	votes, missed := v.votes.SubscribeSince(lastID)
+	defer v.votes.Unsubscribe(votes)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	//Stops nginx from buffering the stream
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	send := func(vote events.Vote) error {
+		data, err := json.Marshal(vote.VoteEvent)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(c.Writer, "id: %d\ndata: %s\n\n", vote.ID, data)
+		return err
+	}
+	for _, vote := range missed {
+		if err := send(vote); err != nil {
+			return
+		}
+	}
+	c.Writer.Flush()
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case vote, ok := <-votes:
+			//A closed channel means the server is shutting down
+			if !ok {
+				return
+			}
+			if err := send(vote); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := io.WriteString(c.Writer, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		}
+		c.Writer.Flush()
+	}
+}
+
+// EndStreams ends every vote stream, the WebSockets and the server-sent
+// events.  The server does not wait on streams when shutting down, so this
+// should be called when it starts to.
+func (v *VoterAPI) EndStreams() {
+	v.votes.Close()
+}
+
+// ReadinessCheck answers GET /readyz, the readiness probe.  Unlike the
+// health check, which only says the process is alive, it answers 503 while
+// redis cannot be reached so no traffic is sent to this instance.
+//
+// @Summary Readiness probe
+// @Tags    admin
+// @Produce json
+// @Success 200 {object} map[string]string
+// @Failure 503 {object} map[string]string
+// @Router  /readyz [get]
+func (v *VoterAPI) ReadinessCheck(c *gin.Context) {
+	if err := v.dbFor(c).Ping(); err != nil {
+		logger(c).Error("Readiness check could not reach redis", "error", err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "unavailable"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ready"})
+}
+
+// implementation of GET /health. It is a good practice to build in a
+// health check for your API.  The check reports how long the process has
+// been up, how many voters are stored, how many requests failed and how
+// long a redis PING took in milliseconds.  Counting the voters scans them
+// all, so the count is taken at most every healthCountMaxAge and may lag.  If redis cannot be reached, or
+// the PING is slower than the latency threshold, the status is "degraded".
+// So is it when the voters are kept in memory, redis is then "in-memory".
+// When redis is down the voter count is left out, the rest of the report is
+// still returned.
+//
+// @Summary Health check
+// @Tags    admin
+// @Produce json
+// @Success 200 {object} map[string]any
+// @Router  /health [get]
+func (v *VoterAPI) HealthCheck(c *gin.Context) {
+	health := gin.H{
+		"status":             "ok",
+		"version":            "1.0.0",
+		"uptime":             int64(time.Since(v.startTime).Seconds()),
+		"errors_encountered": v.errorCount.Load(),
+	}
+
+	start := time.Now()
+	if err := v.dbFor(c).Ping(); err != nil {
+		logger(c).Error("Health check could not reach redis", "error", err)
+		health["status"] = "degraded"
+		health["redis"] = "down"
+		c.JSON(http.StatusOK, health)
+		return
+	}
+	latency := time.Since(start)
+	health["redis"] = "up"
+	if v.db.InMemory() {
+		//Nothing survives a restart, which is worth flagging
+		health["status"] = "degraded"
+		health["redis"] = "in-memory"
+	}
+	health["redis_latency_ms"] = float64(latency.Microseconds()) / 1000
+	if latency > v.latencyThreshold {
+		logger(c).Warn("Health check found redis slow", "latency", latency, "threshold", v.latencyThreshold)
+		health["status"] = "degraded"
+	}
+
+	count, err := v.cachedVoterCount(c)
+	if err != nil {
+		logger(c).Error("Health check could not count voters", "error", err)
+		health["status"] = "degraded"
+	} else {
+		health["users_processed"] = count
+	}
+
+	c.JSON(http.StatusOK, health)
+}
+
+// cachedVoterCount returns the voter count taken within the last
+// healthCountMaxAge, counting the voters again when there is none
+func (v *VoterAPI) cachedVoterCount(c *gin.Context) (int, error) {
+	v.countMu.Lock()
+	defer v.countMu.Unlock()
+
+	if !v.countedAt.IsZero() && time.Since(v.countedAt) < healthCountMaxAge {
+		return v.voterCount, nil
+	}
+	count, err := v.dbFor(c).CountVoters()
+	if err != nil {
+		return 0, err
+	}
+	v.voterCount, v.countedAt = count, time.Now()
+	return count, nil
 }
@@ -0,0 +1,49 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// APIKey returns middleware that only lets a request through when its
+// Authorization header carries key, either as "Bearer <key>" or on its own.
+// Requests for the exempt paths, such as a health check that a load
+// balancer has to reach, are let through without a key.
+func APIKey(key string, exempt ...string) gin.HandlerFunc {
+	exemptPaths := make(map[string]bool, len(exempt))
+	for _, path := range exempt {
+		exemptPaths[path] = true
+	}
+
+	return func(c *gin.Context) {
+		if exemptPaths[c.Request.URL.Path] {
+			c.Next()
+			return
+		}
+
+		if !validKey(c.GetHeader("Authorization"), key) {
+			c.Header("WWW-Authenticate", `Bearer realm="voter-api"`)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": gin.H{"code": "unauthorized", "message": "missing or invalid API key"}})
+			return
+		}
+
+		c.Next()
+	}
+}
+
+func validKey(header, key string) bool {
+	provided := strings.TrimSpace(header)
+	if scheme, token, ok := strings.Cut(provided, " "); ok && strings.EqualFold(scheme, "Bearer") {
+		provided = strings.TrimSpace(token)
+	}
+	if provided == "" {
+		return false
+	}
+
+	//Compare in constant time so the key can not be guessed a byte at a
+	//time from how long the comparison takes
+	return subtle.ConstantTimeCompare([]byte(provided), []byte(key)) == 1
+}
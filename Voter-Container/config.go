@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// config is the part of the server's configuration that can be kept in a
+// file given with -config.  Environment variables take precedence over the
+// file and flags given on the command line over both.
+type config struct {
+	Host           string      `yaml:"host"`
+	Port           uint        `yaml:"port"`
+	LogLevel       string      `yaml:"logLevel"`
+	AllowedOrigins []string    `yaml:"allowedOrigins"`
+	Redis          redisConfig `yaml:"redis"`
+}
+
+// redisConfig holds the redis settings, which the db package reads from
+// the REDIS_ environment variables, see setRedisEnv
+type redisConfig struct {
+	URL          string        `yaml:"url"`
+	PoolSize     int           `yaml:"poolSize"`
+	DialTimeout  time.Duration `yaml:"dialTimeout"`
+	ReadTimeout  time.Duration `yaml:"readTimeout"`
+	WriteTimeout time.Duration `yaml:"writeTimeout"`
+}
+
+// loadConfigFile reads a YAML config file, JSON is fine as well since it
+// is valid YAML.  Unknown settings are refused so a typo does not go
+// unnoticed.
+func loadConfigFile(path string) (config, error) {
+	var cfg config
+	f, err := os.Open(path)
+	if err != nil {
+		return cfg, err
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	//An empty file is an empty config
+	if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		return cfg, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	cfg.AllowedOrigins = trimmedOrigins(cfg.AllowedOrigins)
+	return cfg, nil
+}
+
+// resolveConfig works out the configuration from the file at path, which
+// may be empty for none, the environment and the flags in fs.  Flags only
+// win when they were given, the defaults of -h, -p and -log-level are used
+// for what nothing else sets.  PORT is left to listenAddr.
+func resolveConfig(path string, fs *flag.FlagSet) (config, error) {
+	var cfg config
+	if path != "" {
+		var err error
+		if cfg, err = loadConfigFile(path); err != nil {
+			return cfg, err
+		}
+	}
+
+	if env := os.Getenv("LOG_LEVEL"); env != "" {
+		cfg.LogLevel = env
+	}
+	if origins := allowedOriginsFromEnv(); len(origins) > 0 {
+		cfg.AllowedOrigins = origins
+	}
+	if env := os.Getenv("REDIS_URL"); env != "" {
+		cfg.Redis.URL = env
+	}
+	if env := os.Getenv("REDIS_POOL_SIZE"); env != "" {
+		size, err := strconv.Atoi(env)
+		if err != nil || size < 1 {
+			return cfg, fmt.Errorf("invalid REDIS_POOL_SIZE %q", env)
+		}
+		cfg.Redis.PoolSize = size
+	}
+	timeouts := []struct {
+		env   string
+		value *time.Duration
+	}{
+		{"REDIS_DIAL_TIMEOUT", &cfg.Redis.DialTimeout},
+		{"REDIS_READ_TIMEOUT", &cfg.Redis.ReadTimeout},
+		{"REDIS_WRITE_TIMEOUT", &cfg.Redis.WriteTimeout},
+	}
+	for _, timeout := range timeouts {
+		if env := os.Getenv(timeout.env); env != "" {
+			d, err := time.ParseDuration(env)
+			if err != nil || d <= 0 {
+				return cfg, fmt.Errorf("invalid %s %q, expected a duration like 3s", timeout.env, env)
+			}
+			*timeout.value = d
+		}
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	value := func(name string) string {
+		return fs.Lookup(name).Value.String()
+	}
+	if set["h"] || cfg.Host == "" {
+		cfg.Host = value("h")
+	}
+	if set["p"] || cfg.Port == 0 {
+		port, err := strconv.ParseUint(value("p"), 10, 0)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid port %q", value("p"))
+		}
+		cfg.Port = uint(port)
+	}
+	if set["log-level"] || cfg.LogLevel == "" {
+		cfg.LogLevel = value("log-level")
+	}
+	return cfg, nil
+}
+
+// setRedisEnv hands the redis settings to the db package through the
+// environment variables it reads, settings that are not set are left out
+func setRedisEnv(redisCfg redisConfig) {
+	env := map[string]string{"REDIS_URL": redisCfg.URL}
+	if redisCfg.PoolSize > 0 {
+		env["REDIS_POOL_SIZE"] = strconv.Itoa(redisCfg.PoolSize)
+	}
+	for name, d := range map[string]time.Duration{
+		"REDIS_DIAL_TIMEOUT":  redisCfg.DialTimeout,
+		"REDIS_READ_TIMEOUT":  redisCfg.ReadTimeout,
+		"REDIS_WRITE_TIMEOUT": redisCfg.WriteTimeout,
+	} {
+		if d > 0 {
+			env[name] = d.String()
+		}
+	}
+	for name, value := range env {
+		if value != "" {
+			os.Setenv(name, value)
+		}
+	}
+}
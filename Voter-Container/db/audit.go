@@ -0,0 +1,64 @@
+package db
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisAuditKey is appended to the prefix to name the audit log, a list of
+// AuditEntry with the newest first
+const RedisAuditKey = "audit"
+
+// AuditEntry records one request that changed, or tried to change, the
+// voters.  VoterId is zero when the request was not about a single voter.
+type AuditEntry struct {
+	Method  string    `json:"method"`
+	Path    string    `json:"path"`
+	VoterId uint      `json:"voterId,omitempty"`
+	Time    time.Time `json:"time"`
+	Status  int       `json:"status"`
+}
+
+func (v *VoterList) auditKey() string {
+	return v.keyPrefix + RedisAuditKey
+}
+
+// AddAuditEntry puts entry at the head of the audit log and trims the log
+// to the newest max entries
+func (v *VoterList) AddAuditEntry(entry AuditEntry, max int64) error {
+	raw, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = v.cacheClient.TxPipelined(v.context, func(pipe redis.Pipeliner) error {
+		pipe.LPush(v.context, v.auditKey(), raw)
+		pipe.LTrim(v.context, v.auditKey(), 0, max-1)
+		return nil
+	})
+	return err
+}
+
+// GetAuditEntries returns up to limit of the newest audit entries, newest
+// first.  Entries that can not be decoded are left out.
+func (v *VoterList) GetAuditEntries(limit int) ([]AuditEntry, error) {
+	var raws []string
+	err := v.withRetry(func() (err error) {
+		raws, err = v.cacheClient.LRange(v.context, v.auditKey(), 0, int64(limit)-1).Result()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]AuditEntry, 0, len(raws))
+	for _, raw := range raws {
+		var entry AuditEntry
+		if err := json.Unmarshal([]byte(raw), &entry); err != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
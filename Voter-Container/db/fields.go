@@ -0,0 +1,85 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrBadPath is returned by GetVoterField for a path it does not accept
+var ErrBadPath = errors.New("path must be a ReJSON path of field names and array indexes, such as .Email or .VoteHistory[0]")
+
+// ErrFieldNotFound is returned by GetVoterField when the voter has nothing
+// at the path
+var ErrFieldNotFound = errors.New("path does not exist in the voter")
+
+// fieldPath matches the legacy ReJSON paths GetVoterField accepts, one or
+// more field names and array indexes, negative indexes count from the end
+var fieldPath = regexp.MustCompile(`^(\.[A-Za-z_][A-Za-z0-9_]*|\[-?[0-9]+\])+$`)
+
+// ValidFieldPath reports whether GetVoterField accepts path
+func ValidFieldPath(path string) bool {
+	return fieldPath.MatchString(path)
+}
+
+// isMissingPathError reports whether err is redis saying there is nothing
+// at a JSON path, rather than the voter itself being missing
+func isMissingPathError(err error) bool {
+	var replyErr redis.Error
+	if !errors.As(err, &replyErr) {
+		return false
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "does not exist") || strings.Contains(msg, "out of range")
+}
+
+// GetVoterField returns the JSON at path in the voter with the id, path
+// is a legacy ReJSON path such as .Email or .VoteHistory[0].PollId.  Only
+// that part of the voter is read from redis.  A path that is not valid is
+// refused with ErrBadPath and one the voter has nothing at with
+// ErrFieldNotFound.  Like GetVoter a soft deleted voter is reported as
+// ErrVoterNotFound.
+func (v *VoterList) GetVoterField(id int, path string) (json.RawMessage, error) {
+	if !ValidFieldPath(path) {
+		return nil, ErrBadPath
+	}
+	key := v.redisKeyFromId(id)
+
+	if !v.includeDeleted {
+		deleted, err := v.getVoterPath(key, ".Deleted")
+		//Voters stored before soft deletes were added have no flag
+		if err != nil && !errors.Is(err, ErrFieldNotFound) {
+			return nil, err
+		}
+		if string(deleted) == "true" {
+			return nil, ErrVoterNotFound
+		}
+	}
+
+	return v.getVoterPath(key, path)
+}
+
+// getVoterPath reads the JSON at path in the voter stored at key
+func (v *VoterList) getVoterPath(key, path string) (json.RawMessage, error) {
+	var res any
+	err := v.withRetry(func() (err error) {
+		res, err = v.jsonHelper.JSONGet(key, path)
+		return err
+	})
+	switch {
+	case isRedisNilError(err):
+		return nil, ErrVoterNotFound
+	case isMissingPathError(err):
+		return nil, ErrFieldNotFound
+	case err != nil:
+		return nil, err
+	}
+	raw, err := replyBytes(key, res)
+	if err != nil {
+		return nil, err
+	}
+	return json.RawMessage(raw), nil
+}
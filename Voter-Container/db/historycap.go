@@ -0,0 +1,87 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+)
+
+// VoteHistoryPolicy says what happens to a vote that would take a voter
+// past the maximum vote history length, see SetMaxVoteHistory
+type VoteHistoryPolicy string
+
+const (
+	//RejectVote refuses the vote with ErrVoteHistoryFull
+	RejectVote VoteHistoryPolicy = "reject"
+
+	//EvictOldestVote makes room by dropping the voter's votes with the
+	//earliest VoteDate
+	EvictOldestVote VoteHistoryPolicy = "evict-oldest"
+)
+
+// ErrVoteHistoryFull is returned by AddPoll when the voter already has the
+// maximum number of votes and the policy is RejectVote
+var ErrVoteHistoryFull = errors.New("voter has reached the maximum number of votes")
+
+// SetMaxVoteHistory caps how many votes a voter can have, a limit of zero
+// or less means no cap.  policy says what a vote past the cap does, an empty
+// policy is RejectVote.  Voters that already have more votes keep them
+// until they vote again.
+func (v *VoterList) SetMaxVoteHistory(limit int, policy VoteHistoryPolicy) error {
+	switch policy {
+	case "":
+		policy = RejectVote
+	case RejectVote, EvictOldestVote:
+	default:
+		return fmt.Errorf("unknown vote history policy %q, expected %s or %s", policy, RejectVote, EvictOldestVote)
+	}
+	v.maxVoteHistory = max(limit, 0)
+	v.historyPolicy = policy
+	return nil
+}
+
+// setMaxVoteHistoryFromEnv reads the cap from MAX_VOTE_HISTORY and the
+// policy from MAX_VOTE_HISTORY_POLICY, both are optional
+func (v *VoterList) setMaxVoteHistoryFromEnv() error {
+	limit := 0
+	if env := os.Getenv("MAX_VOTE_HISTORY"); env != "" {
+		var err error
+		if limit, err = strconv.Atoi(env); err != nil || limit < 0 {
+			return fmt.Errorf("invalid MAX_VOTE_HISTORY %q, expected a number of votes, 0 for no limit", env)
+		}
+	}
+	if err := v.SetMaxVoteHistory(limit, VoteHistoryPolicy(os.Getenv("MAX_VOTE_HISTORY_POLICY"))); err != nil {
+		return fmt.Errorf("invalid MAX_VOTE_HISTORY_POLICY: %w", err)
+	}
+	return nil
+}
+
+// evictOldest returns history without its n votes with the earliest
+// VoteDate, the votes that are kept stay in their order
+func evictOldest(history []VoterHistory, n int) []VoterHistory {
+	if n <= 0 {
+		return history
+	}
+	if n >= len(history) {
+		return []VoterHistory{}
+	}
+
+	byDate := slices.Clone(history)
+	slices.SortStableFunc(byDate, func(a, b VoterHistory) int {
+		return a.VoteDate.Compare(b.VoteDate)
+	})
+	evicted := make(map[uint]bool, n)
+	for _, vote := range byDate[:n] {
+		evicted[vote.PollId] = true
+	}
+
+	kept := make([]VoterHistory, 0, len(history)-n)
+	for _, vote := range history {
+		if !evicted[vote.PollId] {
+			kept = append(kept, vote)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,74 @@
+package db
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// RedisIdempotencyKey is appended to the prefix, followed by the key a
+// client sent, to name where the response to that request is kept
+const RedisIdempotencyKey = "idempotency:"
+
+// IdempotentResponse is what is kept for a request sent with an
+// Idempotency-Key.  Fingerprint identifies the request so the same key can
+// not be reused for a different one.  A zero Status means the request is
+// still being handled.
+type IdempotentResponse struct {
+	Fingerprint string            `json:"fingerprint"`
+	Status      int               `json:"status"`
+	Header      map[string]string `json:"header,omitempty"`
+	Body        []byte            `json:"body,omitempty"`
+}
+
+func (v *VoterList) idempotencyKey(key string) string {
+	return v.keyPrefix + RedisIdempotencyKey + key
+}
+
+// ClaimIdempotencyKey reserves key for the request with the given
+// fingerprint for ttl.  When the key is new it returns nil and the caller
+// handles the request, then stores the outcome with SaveIdempotentResponse.
+// Otherwise it returns what is stored for the key, which may be a request
+// still in progress.
+func (v *VoterList) ClaimIdempotencyKey(key, fingerprint string, ttl time.Duration) (*IdempotentResponse, error) {
+	pending, err := json.Marshal(IdempotentResponse{Fingerprint: fingerprint})
+	if err != nil {
+		return nil, err
+	}
+
+	redisKey := v.idempotencyKey(key)
+	claimed, err := v.cacheClient.SetNX(v.context, redisKey, pending, ttl).Result()
+	if err != nil || claimed {
+		return nil, err
+	}
+
+	raw, err := v.cacheClient.Get(v.context, redisKey).Bytes()
+	if isRedisNilError(err) {
+		//Expired since the SETNX, try to claim it again
+		return v.ClaimIdempotencyKey(key, fingerprint, ttl)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var stored IdempotentResponse
+	if err := json.Unmarshal(raw, &stored); err != nil {
+		return nil, err
+	}
+	return &stored, nil
+}
+
+// SaveIdempotentResponse stores the response to the request that claimed
+// key, it is kept for ttl
+func (v *VoterList) SaveIdempotentResponse(key string, resp IdempotentResponse, ttl time.Duration) error {
+	raw, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	return v.cacheClient.Set(v.context, v.idempotencyKey(key), raw, ttl).Err()
+}
+
+// ReleaseIdempotencyKey drops key so the request can be sent again, for a
+// request that failed without doing anything
+func (v *VoterList) ReleaseIdempotencyKey(key string) error {
+	return v.cacheClient.Del(v.context, v.idempotencyKey(key)).Err()
+}
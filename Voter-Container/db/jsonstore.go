@@ -0,0 +1,45 @@
+package db
+
+import (
+	"context"
+
+	"github.com/nitishm/go-rejson/v4"
+	"github.com/nitishm/go-rejson/v4/rjs"
+	"github.com/redis/go-redis/v9"
+)
+
+// JSONStore is the part of the ReJSON API the voter list sends as single
+// commands: reading voters and their fields, and creating a voter with NX.
+// The default is backed by go-rejson on the voter list's redis client,
+// SetJSONStore swaps in another one, such as a fake in tests.
+//
+// Every other write changes a voter inside a WATCH/MULTI transaction, so
+// it goes to redis on the transaction's connection, which go-rejson can
+// not queue commands on.  Those writes need redis, or memredis in tests.
+//
+// Replies follow go-rejson: JSONGet returns the document as []byte and a
+// missing key is reported as redis.Nil.
+type JSONStore interface {
+	JSONGet(key, path string, opts ...rjs.GetOption) (res any, err error)
+	JSONSet(key, path string, obj any, opts ...rjs.SetOption) (res any, err error)
+	JSONArrLen(key, path string) (res any, err error)
+	JSONType(key, path string) (res any, err error)
+
+	//WithContext returns a store that sends its commands with ctx
+	WithContext(ctx context.Context) JSONStore
+}
+
+// rejsonStore is the go-rejson backed JSONStore
+type rejsonStore struct {
+	*rejson.Handler
+}
+
+func newRejsonStore(ctx context.Context, client *redis.Client) rejsonStore {
+	handler := rejson.NewReJSONHandler()
+	handler.SetGoRedisClientWithContext(ctx, client)
+	return rejsonStore{handler}
+}
+
+func (s rejsonStore) WithContext(ctx context.Context) JSONStore {
+	return rejsonStore{s.Handler.SetContext(ctx)}
+}
@@ -0,0 +1,217 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/nitishm/go-rejson/v4/rjs"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeJSONStore is an in-memory JSONStore.  It only understands the root
+// path and top level fields such as .VoteHistory, which is all the voter
+// list asks for.  err, when set, is returned by every call and replyAs,
+// when set, turns the JSON JSONGet returns into the reply it hands back.
+type fakeJSONStore struct {
+	mu      sync.Mutex
+	docs    map[string]map[string]any
+	err     error
+	replyAs func([]byte) any
+}
+
+func newFakeJSONStore() *fakeJSONStore {
+	return &fakeJSONStore{docs: make(map[string]map[string]any)}
+}
+
+func toJSONValue(obj any) (any, error) {
+	raw, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	var v any
+	return v, json.Unmarshal(raw, &v)
+}
+
+func fieldOf(path string) (string, bool) {
+	if path == "." {
+		return "", true
+	}
+	field := strings.TrimPrefix(path, ".")
+	return field, field != path && !strings.ContainsAny(field, ".[")
+}
+
+func (f *fakeJSONStore) JSONGet(key, path string, _ ...rjs.GetOption) (any, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	doc, ok := f.docs[key]
+	if !ok {
+		return nil, redis.Nil
+	}
+	field, ok := fieldOf(path)
+	if !ok {
+		return nil, errors.New("fake: unsupported path " + path)
+	}
+	var value any = doc
+	if field != "" {
+		value = doc[field]
+	}
+	raw, err := json.Marshal(value)
+	if err != nil || f.replyAs == nil {
+		return raw, err
+	}
+	return f.replyAs(raw), nil
+}
+
+func (f *fakeJSONStore) JSONSet(key, path string, obj any, opts ...rjs.SetOption) (any, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	_, exists := f.docs[key]
+	for _, opt := range opts {
+		if opt == rjs.SetOptionNX && exists || opt == rjs.SetOptionXX && !exists {
+			return nil, nil
+		}
+	}
+	val, err := toJSONValue(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	field, ok := fieldOf(path)
+	switch {
+	case !ok:
+		return nil, errors.New("fake: unsupported path " + path)
+	case field == "":
+		doc, isObj := val.(map[string]any)
+		if !isObj {
+			return nil, errors.New("fake: only objects can be stored")
+		}
+		f.docs[key] = doc
+	case !exists:
+		return nil, errors.New("fake: new objects must be created at the root")
+	default:
+		f.docs[key][field] = val
+	}
+	return "OK", nil
+}
+
+func (f *fakeJSONStore) JSONArrLen(key, path string) (any, error) {
+	raw, err := f.JSONGet(key, path)
+	if err != nil {
+		return nil, err
+	}
+	var arr []any
+	if err := json.Unmarshal(raw.([]byte), &arr); err != nil || arr == nil {
+		return nil, errors.New("fake: not an array")
+	}
+	return int64(len(arr)), nil
+}
+
+func (f *fakeJSONStore) JSONType(key, path string) (any, error) {
+	raw, err := f.JSONGet(key, path)
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var v any
+	if err := json.Unmarshal(raw.([]byte), &v); err != nil {
+		return nil, err
+	}
+	switch v.(type) {
+	case nil:
+		return "null", nil
+	case []any:
+		return "array", nil
+	case map[string]any:
+		return "object", nil
+	case string:
+		return "string", nil
+	case bool:
+		return "boolean", nil
+	}
+	return "number", nil
+}
+
+func (f *fakeJSONStore) WithContext(context.Context) JSONStore {
+	return f
+}
+
+func TestFakeJSONStore(t *testing.T) {
+	v, _ := newTestVoterList(t)
+	store := newFakeJSONStore()
+	v.SetJSONStore(store)
+
+	voter := Voter{VoterId: 1, Name: "Ada", Email: "ada@example.com"}
+	added, err := v.setVoterIfAbsent(&voter)
+	require.NoError(t, err)
+	assert.True(t, added)
+	added, err = v.setVoterIfAbsent(&voter)
+	require.NoError(t, err)
+	assert.False(t, added)
+
+	got, err := v.GetVoter(1)
+	require.NoError(t, err)
+	assert.Equal(t, "Ada", got.Name)
+	assert.Contains(t, store.docs, v.redisKeyFromId(1), "the voter should only live in the fake")
+
+	count, err := v.GetVoteCount(1)
+	require.NoError(t, err)
+	assert.Zero(t, count)
+
+	_, err = v.GetVoter(2)
+	assert.ErrorIs(t, err, ErrVoterNotFound)
+
+	//Errors from the store reach the caller as they are, and the voter
+	//list's WithContext copies keep using the store
+	store.err = errors.New("fake: store is down")
+	_, err = v.WithContext(context.Background()).GetVoter(1)
+	assert.ErrorIs(t, err, store.err)
+	assert.NotErrorIs(t, err, ErrVoterNotFound)
+}
+
+func TestJSONGetReplyTypes(t *testing.T) {
+	v, _ := newTestVoterList(t)
+	store := newFakeJSONStore()
+	v.SetJSONStore(store)
+	voter := Voter{VoterId: 1, Name: "Ada", Email: "ada@example.com",
+		VoteHistory: []VoterHistory{{PollId: 3, VoteId: 1}}}
+	_, err := v.setVoterIfAbsent(&voter)
+	require.NoError(t, err)
+
+	//Some ReJSON and client versions answer with a string
+	store.replyAs = func(raw []byte) any { return string(raw) }
+	got, err := v.GetVoter(1)
+	require.NoError(t, err)
+	assert.Equal(t, "Ada", got.Name)
+	history, err := v.GetVoteHistory(1)
+	require.NoError(t, err)
+	assert.Equal(t, voter.VoteHistory, history)
+	field, err := v.GetVoterField(1, ".Email")
+	require.NoError(t, err)
+	assert.JSONEq(t, `"ada@example.com"`, string(field))
+
+	//Anything else is an error instead of a panic
+	store.replyAs = func(raw []byte) any { return len(raw) }
+	_, err = v.GetVoter(1)
+	var replyErr *ReplyTypeError
+	require.ErrorAs(t, err, &replyErr)
+	assert.Equal(t, v.redisKeyFromId(1), replyErr.Key)
+	assert.NotErrorIs(t, err, ErrCorruptVoter)
+	_, err = v.GetVoterField(1, ".Email")
+	assert.ErrorAs(t, err, &replyErr)
+}
@@ -0,0 +1,45 @@
+package db
+
+import (
+	"os"
+
+	"drexel.edu/voter/db/memredis"
+	"github.com/redis/go-redis/v9"
+)
+
+// NewInMemory returns a voter list kept in process memory, by an in-process
+// redis, rather than in a redis server.  It behaves like one made by New
+// but everything it holds is lost when the process exits, it is only meant
+// for demos and local development without redis.  The key prefix and the
+// vote history cap are read from the environment like New does, the other
+// REDIS_* settings are about the connection and do not apply.
+//
+// The in-process redis is the memredis emulator the tests run against.
+// Reusing it, rather than writing a second store behind the voter list,
+// keeps every route, transaction and error the same in a demo as against
+// redis, at the cost of linking miniredis into the server.
+func NewInMemory() (*VoterList, error) {
+	server, err := memredis.Run()
+	if err != nil {
+		return nil, err
+	}
+
+	//The server is in this process, there is nothing to wait for
+	voterList, err := newWithOptions(&redis.Options{Addr: server.Addr()}, retryPolicy{attempts: 1})
+	if err != nil {
+		server.Close()
+		return nil, err
+	}
+	voterList.memory = server
+	if err := voterList.setMaxVoteHistoryFromEnv(); err != nil {
+		voterList.Close()
+		return nil, err
+	}
+	voterList.SetKeyPrefix(os.Getenv("REDIS_KEY_PREFIX"))
+	return voterList, nil
+}
+
+// InMemory reports whether the voter list was made by NewInMemory
+func (v *VoterList) InMemory() bool {
+	return v.memory != nil
+}
@@ -0,0 +1,569 @@
+// Package memredis runs an in-process redis server.  It is backed by
+// miniredis, which does not ship the ReJSON module, so the subset of JSON.*
+// commands used by the voter db package is emulated here on top of plain
+// string keys.  This lets the db and api layers be exercised without a live
+// redis-stack instance.
+//
+// It is an ordinary package rather than test code because db.NewInMemory
+// also runs it, as the store the server falls back to for demos when redis
+// can not be reached.
+package memredis
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"strconv"
+	"sync"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/alicebob/miniredis/v2/server"
+)
+
+// Server is a running miniredis instance with the JSON commands registered.
+// All of the miniredis helpers (Addr, Close, FastForward, ...) are available
+// through the embedded type.
+type Server struct {
+	*miniredis.Miniredis
+
+	//mu serializes the JSON commands, each one is a read-modify-write of a
+	//string key so they must not interleave with each other
+	mu sync.Mutex
+
+	//inTx tracks the connections that are between MULTI and EXEC so JSON
+	//writes can be queued as part of the transaction.  pending holds the
+	//documents those writes will leave behind, so a second write to the
+	//same key in the transaction builds on the first as it does in ReJSON,
+	//a nil document is a key the transaction deletes.
+	txMu    sync.Mutex
+	inTx    map[*server.Peer]bool
+	pending map[*server.Peer]map[string]*string
+}
+
+// Run starts a new server on a random local port
+func Run() (*Server, error) {
+	m, err := miniredis.Run()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		Miniredis: m,
+		inTx:      make(map[*server.Peer]bool),
+		pending:   make(map[*server.Peer]map[string]*string),
+	}
+
+	commands := map[string]server.Cmd{
+		"JSON.GET":       s.cmdGet,
+		"JSON.SET":       s.cmdSet,
+		"JSON.DEL":       s.cmdDel,
+		"JSON.TYPE":      s.cmdType,
+		"JSON.ARRLEN":    s.cmdArrLen,
+		"JSON.ARRAPPEND": s.cmdArrAppend,
+		"JSON.ARRINSERT": s.cmdArrInsert,
+		"JSON.NUMINCRBY": s.cmdNumIncrBy,
+	}
+	for name, cmd := range commands {
+		if err := m.Server().Register(name, cmd); err != nil {
+			m.Close()
+			return nil, err
+		}
+	}
+	m.Server().SetPreHook(s.trackTx)
+
+	return s, nil
+}
+
+// trackTx watches for MULTI/EXEC/DISCARD so we know when a connection is
+// queueing a transaction.  It never handles the command itself.
+func (s *Server) trackTx(c *server.Peer, cmd string, args ...string) bool {
+	s.txMu.Lock()
+	defer s.txMu.Unlock()
+
+	switch cmd {
+	case "MULTI":
+		s.inTx[c] = true
+		s.pending[c] = make(map[string]*string)
+	case "EXEC", "DISCARD":
+		delete(s.inTx, c)
+		delete(s.pending, c)
+	}
+	return false
+}
+
+func (s *Server) queued(c *server.Peer) bool {
+	s.txMu.Lock()
+	defer s.txMu.Unlock()
+	return s.inTx[c]
+}
+
+// queue records what a write queued by c leaves at key, nil for a delete
+func (s *Server) queue(c *server.Peer, key string, raw *string) {
+	s.txMu.Lock()
+	defer s.txMu.Unlock()
+	if pending := s.pending[c]; pending != nil {
+		pending[key] = raw
+	}
+}
+
+// load returns the decoded document stored at key, ok is false when the key
+// does not exist.  Inside a transaction it is the document as the writes c
+// has queued so far leave it.
+func (s *Server) load(c *server.Peer, key string) (any, bool, error) {
+	s.txMu.Lock()
+	queued, isQueued := s.pending[c][key]
+	s.txMu.Unlock()
+	if isQueued {
+		if queued == nil {
+			return nil, false, nil
+		}
+		doc, err := decode(*queued)
+		return doc, err == nil, err
+	}
+
+	raw, err := s.Get(key)
+	if err == miniredis.ErrKeyNotFound {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	doc, err := decode(raw)
+	if err != nil {
+		return nil, false, err
+	}
+	return doc, true, nil
+}
+
+// store writes a document back to key.  Inside a transaction the write is
+// handed to miniredis as a plain SET so it is queued and applied on EXEC,
+// otherwise it is written directly, keeping any expiration on the key.
+func (s *Server) store(c *server.Peer, key string, doc any) error {
+	raw, err := encode(doc)
+	if err != nil {
+		return err
+	}
+
+	if s.queued(c) {
+		s.queue(c, key, &raw)
+		s.Server().Dispatch(c, []string{"SET", key, raw, "KEEPTTL"})
+		return nil
+	}
+
+	ttl := s.TTL(key)
+	if err := s.Set(key, raw); err != nil {
+		return err
+	}
+	if ttl > 0 {
+		s.SetTTL(key, ttl)
+	}
+	return nil
+}
+
+// JSON.GET <key> [path]
+func (s *Server) cmdGet(c *server.Peer, cmd string, args []string) {
+	if len(args) < 1 {
+		c.WriteError(errWrongArgs(cmd))
+		return
+	}
+	if s.queued(c) {
+		c.WriteError("ERR JSON reads are not supported inside MULTI")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path := rootPath
+	if len(args) > 1 {
+		path = args[1]
+	}
+	p, err := parsePath(path)
+	if err != nil {
+		c.WriteError(err.Error())
+		return
+	}
+
+	doc, ok, err := s.load(c, args[0])
+	if err != nil {
+		c.WriteError(err.Error())
+		return
+	}
+	if !ok {
+		c.WriteNull()
+		return
+	}
+
+	val, found := p.get(doc)
+	if !found {
+		c.WriteError(errNoPath(path))
+		return
+	}
+	raw, err := encode(val)
+	if err != nil {
+		c.WriteError(err.Error())
+		return
+	}
+	c.WriteBulk(raw)
+}
+
+// JSON.SET <key> <path> <json> [NX | XX]
+func (s *Server) cmdSet(c *server.Peer, cmd string, args []string) {
+	if len(args) < 3 || len(args) > 4 {
+		c.WriteError(errWrongArgs(cmd))
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, path := args[0], args[1]
+	nx, xx := false, false
+	if len(args) == 4 {
+		switch args[3] {
+		case "NX", "nx":
+			nx = true
+		case "XX", "xx":
+			xx = true
+		default:
+			c.WriteError("ERR syntax error")
+			return
+		}
+	}
+
+	p, err := parsePath(path)
+	if err != nil {
+		c.WriteError(err.Error())
+		return
+	}
+	val, err := decode(args[2])
+	if err != nil {
+		c.WriteError("ERR invalid JSON: " + err.Error())
+		return
+	}
+
+	doc, ok, err := s.load(c, key)
+	if err != nil {
+		c.WriteError(err.Error())
+		return
+	}
+
+	if !ok {
+		if xx {
+			c.WriteNull()
+			return
+		}
+		if !p.isRoot() {
+			c.WriteError("ERR new objects must be created at the root")
+			return
+		}
+		doc = val
+	} else {
+		_, exists := p.get(doc)
+		if (nx && exists) || (xx && !exists) {
+			c.WriteNull()
+			return
+		}
+		if doc, err = p.set(doc, val); err != nil {
+			c.WriteError(errNoPath(path))
+			return
+		}
+	}
+
+	if err := s.store(c, key, doc); err != nil {
+		c.WriteError(err.Error())
+		return
+	}
+	if !s.queued(c) {
+		c.WriteOK()
+	}
+}
+
+// JSON.DEL <key> [path]
+func (s *Server) cmdDel(c *server.Peer, cmd string, args []string) {
+	if len(args) < 1 || len(args) > 2 {
+		c.WriteError(errWrongArgs(cmd))
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, path := args[0], rootPath
+	if len(args) == 2 {
+		path = args[1]
+	}
+	p, err := parsePath(path)
+	if err != nil {
+		c.WriteError(err.Error())
+		return
+	}
+
+	if p.isRoot() {
+		if s.queued(c) {
+			s.queue(c, key, nil)
+			s.Server().Dispatch(c, []string{"DEL", key})
+			return
+		}
+		if s.Del(key) {
+			c.WriteInt(1)
+		} else {
+			c.WriteInt(0)
+		}
+		return
+	}
+
+	doc, ok, err := s.load(c, key)
+	if err != nil {
+		c.WriteError(err.Error())
+		return
+	}
+	if !ok {
+		c.WriteInt(0)
+		return
+	}
+
+	doc, removed := p.remove(doc)
+	if removed || s.queued(c) {
+		if err := s.store(c, key, doc); err != nil {
+			c.WriteError(err.Error())
+			return
+		}
+	}
+	if s.queued(c) {
+		return
+	}
+	if removed {
+		c.WriteInt(1)
+	} else {
+		c.WriteInt(0)
+	}
+}
+
+// lookup resolves the <key> [path] arguments of a read-only command.  ok is
+// false when a reply has already been written, either an error or the null
+// that ReJSON answers for a missing key.
+func (s *Server) lookup(c *server.Peer, cmd string, args []string) (val any, ok bool) {
+	if len(args) < 1 || len(args) > 2 {
+		c.WriteError(errWrongArgs(cmd))
+		return nil, false
+	}
+	if s.queued(c) {
+		c.WriteError("ERR JSON reads are not supported inside MULTI")
+		return nil, false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path := rootPath
+	if len(args) == 2 {
+		path = args[1]
+	}
+	p, err := parsePath(path)
+	if err != nil {
+		c.WriteError(err.Error())
+		return nil, false
+	}
+
+	doc, found, err := s.load(c, args[0])
+	if err != nil {
+		c.WriteError(err.Error())
+		return nil, false
+	}
+	if !found {
+		c.WriteNull()
+		return nil, false
+	}
+
+	val, found = p.get(doc)
+	if !found {
+		c.WriteError(errNoPath(path))
+		return nil, false
+	}
+	return val, true
+}
+
+// JSON.TYPE <key> [path]
+func (s *Server) cmdType(c *server.Peer, cmd string, args []string) {
+	val, ok := s.lookup(c, cmd, args)
+	if !ok {
+		return
+	}
+	c.WriteInline(typeName(val))
+}
+
+// JSON.ARRLEN <key> [path]
+func (s *Server) cmdArrLen(c *server.Peer, cmd string, args []string) {
+	val, ok := s.lookup(c, cmd, args)
+	if !ok {
+		return
+	}
+	arr, isArr := val.([]any)
+	if !isArr {
+		c.WriteError(errNotArray(val))
+		return
+	}
+	c.WriteInt(len(arr))
+}
+
+// modify runs fn on the value at path in the document stored at key and
+// stores the result, the reply fn returns is sent unless the write was
+// queued by MULTI.  A missing key is an error, as it is for ReJSON.
+func (s *Server) modify(c *server.Peer, key, path string, fn func(val any) (any, any, error)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, err := parsePath(path)
+	if err != nil {
+		c.WriteError(err.Error())
+		return
+	}
+
+	doc, ok, err := s.load(c, key)
+	if err != nil {
+		c.WriteError(err.Error())
+		return
+	}
+	if !ok {
+		c.WriteError("ERR could not perform this operation on a key that doesn't exist")
+		return
+	}
+
+	var reply any
+	doc, err = p.update(doc, func(old any, exists bool) (any, error) {
+		if !exists {
+			return nil, errors.New(errNoPath(path))
+		}
+		val, r, err := fn(old)
+		reply = r
+		return val, err
+	})
+	if err != nil {
+		c.WriteError(err.Error())
+		return
+	}
+
+	if err := s.store(c, key, doc); err != nil {
+		c.WriteError(err.Error())
+		return
+	}
+	if s.queued(c) {
+		return
+	}
+	switch r := reply.(type) {
+	case int:
+		c.WriteInt(r)
+	case string:
+		c.WriteBulk(r)
+	}
+}
+
+// JSON.ARRAPPEND <key> <path> <json> [json ...]
+func (s *Server) cmdArrAppend(c *server.Peer, cmd string, args []string) {
+	if len(args) < 3 {
+		c.WriteError(errWrongArgs(cmd))
+		return
+	}
+
+	values, ok := decodeValues(c, args[2:])
+	if !ok {
+		return
+	}
+
+	s.modify(c, args[0], args[1], func(val any) (any, any, error) {
+		arr, ok := val.([]any)
+		if !ok {
+			return nil, nil, errors.New(errNotArray(val))
+		}
+		arr = append(arr, values...)
+		return arr, len(arr), nil
+	})
+}
+
+// JSON.ARRINSERT <key> <path> <index> <json> [json ...]
+func (s *Server) cmdArrInsert(c *server.Peer, cmd string, args []string) {
+	if len(args) < 4 {
+		c.WriteError(errWrongArgs(cmd))
+		return
+	}
+	index, err := strconv.Atoi(args[2])
+	if err != nil {
+		c.WriteError("ERR index is not an integer")
+		return
+	}
+	values, ok := decodeValues(c, args[3:])
+	if !ok {
+		return
+	}
+
+	s.modify(c, args[0], args[1], func(val any) (any, any, error) {
+		arr, ok := val.([]any)
+		if !ok {
+			return nil, nil, errors.New(errNotArray(val))
+		}
+		at := index
+		if at < 0 {
+			at += len(arr)
+		}
+		if at < 0 || at > len(arr) {
+			return nil, nil, errors.New("ERR index out of bounds")
+		}
+		arr = slices.Insert(arr, at, values...)
+		return arr, len(arr), nil
+	})
+}
+
+// JSON.NUMINCRBY <key> <path> <number>
+func (s *Server) cmdNumIncrBy(c *server.Peer, cmd string, args []string) {
+	if len(args) != 3 {
+		c.WriteError(errWrongArgs(cmd))
+		return
+	}
+	by, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		c.WriteError("ERR only integer increments are supported")
+		return
+	}
+
+	s.modify(c, args[0], args[1], func(val any) (any, any, error) {
+		num, ok := val.(json.Number)
+		if !ok {
+			return nil, nil, errors.New("ERR wrong type of path value - expected a number but found " + typeName(val))
+		}
+		n, err := num.Int64()
+		if err != nil {
+			return nil, nil, errors.New("ERR only integers can be incremented")
+		}
+		next := json.Number(strconv.FormatInt(n+by, 10))
+		return next, next.String(), nil
+	})
+}
+
+// decodeValues parses the JSON arguments of an array command, ok is false
+// when one of them is invalid and the error has been written
+func decodeValues(c *server.Peer, args []string) (values []any, ok bool) {
+	values = make([]any, len(args))
+	for i, raw := range args {
+		val, err := decode(raw)
+		if err != nil {
+			c.WriteError("ERR invalid JSON: " + err.Error())
+			return nil, false
+		}
+		values[i] = val
+	}
+	return values, true
+}
+
+func errWrongArgs(cmd string) string {
+	return "ERR wrong number of arguments for '" + cmd + "' command"
+}
+
+func errNoPath(path string) string {
+	return "ERR Path '" + path + "' does not exist"
+}
+
+func errNotArray(val any) string {
+	return "ERR wrong type of path value - expected array but found " + typeName(val)
+}
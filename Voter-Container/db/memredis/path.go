@@ -0,0 +1,238 @@
+package memredis
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+const rootPath = "."
+
+// path is a parsed legacy ReJSON path such as ".VoteHistory[0].PollId".
+// Each step is either an object member name (string) or an array index (int).
+type path []any
+
+var errBadPath = errors.New("ERR invalid JSON path")
+
+func parsePath(raw string) (path, error) {
+	p := strings.TrimPrefix(raw, "$")
+	if p == "" || p == rootPath {
+		return path{}, nil
+	}
+
+	var steps path
+	for len(p) > 0 {
+		switch p[0] {
+		case '.':
+			p = p[1:]
+			end := strings.IndexAny(p, ".[")
+			if end < 0 {
+				end = len(p)
+			}
+			if end == 0 {
+				return nil, errBadPath
+			}
+			steps = append(steps, p[:end])
+			p = p[end:]
+		case '[':
+			end := strings.IndexByte(p, ']')
+			if end < 0 {
+				return nil, errBadPath
+			}
+			inner := p[1:end]
+			if unq, err := strconv.Unquote(inner); err == nil {
+				steps = append(steps, unq)
+			} else if idx, err := strconv.Atoi(inner); err == nil {
+				steps = append(steps, idx)
+			} else {
+				return nil, errBadPath
+			}
+			p = p[end+1:]
+		default:
+			//a bare member name is allowed at the start of a path
+			if len(steps) > 0 {
+				return nil, errBadPath
+			}
+			p = "." + p
+		}
+	}
+	return steps, nil
+}
+
+func (p path) isRoot() bool {
+	return len(p) == 0
+}
+
+// step resolves a single path element against a container
+func step(node any, s any) (any, bool) {
+	switch s := s.(type) {
+	case string:
+		obj, ok := node.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		v, ok := obj[s]
+		return v, ok
+	case int:
+		arr, ok := node.([]any)
+		if !ok {
+			return nil, false
+		}
+		if s < 0 {
+			s += len(arr)
+		}
+		if s < 0 || s >= len(arr) {
+			return nil, false
+		}
+		return arr[s], true
+	}
+	return nil, false
+}
+
+func (p path) get(doc any) (any, bool) {
+	node := doc
+	for _, s := range p {
+		var ok bool
+		if node, ok = step(node, s); !ok {
+			return nil, false
+		}
+	}
+	return node, true
+}
+
+// update replaces the value at the path with the result of fn, returning the
+// new document.  The parent of the final element must already exist.
+func (p path) update(doc any, fn func(any, bool) (any, error)) (any, error) {
+	if p.isRoot() {
+		return fn(doc, true)
+	}
+
+	parent, ok := p[:len(p)-1].get(doc)
+	if !ok {
+		return nil, errBadPath
+	}
+
+	switch last := p[len(p)-1].(type) {
+	case string:
+		obj, ok := parent.(map[string]any)
+		if !ok {
+			return nil, errBadPath
+		}
+		old, exists := obj[last]
+		v, err := fn(old, exists)
+		if err != nil {
+			return nil, err
+		}
+		obj[last] = v
+	case int:
+		arr, ok := parent.([]any)
+		if !ok {
+			return nil, errBadPath
+		}
+		if last < 0 {
+			last += len(arr)
+		}
+		if last < 0 || last >= len(arr) {
+			return nil, errBadPath
+		}
+		v, err := fn(arr[last], true)
+		if err != nil {
+			return nil, err
+		}
+		arr[last] = v
+	}
+	return doc, nil
+}
+
+func (p path) set(doc, val any) (any, error) {
+	return p.update(doc, func(any, bool) (any, error) {
+		return val, nil
+	})
+}
+
+// remove deletes the value at the path from its parent container
+func (p path) remove(doc any) (any, bool) {
+	if p.isRoot() {
+		return nil, true
+	}
+
+	parentPath := p[:len(p)-1]
+	parent, ok := parentPath.get(doc)
+	if !ok {
+		return doc, false
+	}
+
+	switch last := p[len(p)-1].(type) {
+	case string:
+		obj, ok := parent.(map[string]any)
+		if !ok {
+			return doc, false
+		}
+		if _, exists := obj[last]; !exists {
+			return doc, false
+		}
+		delete(obj, last)
+		return doc, true
+	case int:
+		arr, ok := parent.([]any)
+		if !ok {
+			return doc, false
+		}
+		if last < 0 {
+			last += len(arr)
+		}
+		if last < 0 || last >= len(arr) {
+			return doc, false
+		}
+		arr = append(arr[:last:last], arr[last+1:]...)
+		doc, err := parentPath.set(doc, arr)
+		return doc, err == nil
+	}
+	return doc, false
+}
+
+// typeName is the name JSON.TYPE reports for a decoded value
+func typeName(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return "integer"
+		}
+		return "number"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return "unknown"
+}
+
+// decode parses a JSON document keeping numbers exactly as they were written
+func decode(raw string) (any, error) {
+	dec := json.NewDecoder(strings.NewReader(raw))
+	dec.UseNumber()
+
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func encode(v any) (string, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
@@ -0,0 +1,127 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrMergeSameVoter is returned by MergeVoters when both ids are the same
+var ErrMergeSameVoter = errors.New("a voter can not be merged into itself")
+
+// mergeHistories returns keep's votes with merge's added.  A poll both
+// voted in keeps the vote with the later VoteDate, in keep's place, votes
+// only merge has are added after keep's in merge's order.
+func mergeHistories(keep, merge []VoterHistory) []VoterHistory {
+	merged := make([]VoterHistory, len(keep), len(keep)+len(merge))
+	copy(merged, keep)
+	at := make(map[uint]int, len(keep))
+	for i, poll := range merged {
+		at[poll.PollId] = i
+	}
+	for _, poll := range merge {
+		i, ok := at[poll.PollId]
+		if !ok {
+			at[poll.PollId] = len(merged)
+			merged = append(merged, poll)
+			continue
+		}
+		if poll.VoteDate.After(merged[i].VoteDate) {
+			merged[i] = poll
+		}
+	}
+	return merged
+}
+
+// MergeVoters folds the voter with mergeId into the one with keepId, for
+// when the two turn out to be the same person.  keepId ends up with the
+// votes of both, the later vote wins for a poll both voted in, and keeps
+// its name and email.  mergeId is deleted.  Both voters are read and
+// written in one WATCH/MULTI transaction, which is tried again if either
+// changes meanwhile, ErrVersionConflict is returned if they keep changing.
+// A missing or soft deleted voter is reported as ErrVoterNotFound.  It
+// returns the voter as it was stored.
+func (v *VoterList) MergeVoters(keepId, mergeId int) (Voter, error) {
+	if keepId == mergeId {
+		return Voter{}, ErrMergeSameVoter
+	}
+	keepKey, mergeKey := v.redisKeyFromId(keepId), v.redisKeyFromId(mergeId)
+
+	var merged Voter
+	update := func(tx *redis.Tx) error {
+		keep, err := v.getVoterInTx(tx, keepKey)
+		if err != nil {
+			return err
+		}
+		merge, err := v.getVoterInTx(tx, mergeKey)
+		if err != nil {
+			return err
+		}
+
+		merged = keep
+		merged.Version++
+		merged.VoteHistory = mergeHistories(keep.VoteHistory, merge.VoteHistory)
+		voterJson, err := json.Marshal(merged)
+		if err != nil {
+			return err
+		}
+
+		//The merged voter's email is dropped from the index if it still
+		//points at it, like DeleteVoter, or handed to the kept voter when
+		//both have the same email
+		mergeField := NormalizeEmail(merge.Email)
+		indexed, err := tx.HGet(v.context, v.emailIndexKey(), mergeField).Result()
+		if err != nil && !isRedisNilError(err) {
+			return err
+		}
+
+		_, err = tx.TxPipelined(v.context, func(pipe redis.Pipeliner) error {
+			pipe.Do(v.context, "JSON.SET", keepKey, ".", string(voterJson))
+			pipe.Del(v.context, mergeKey)
+			switch {
+			case mergeField == NormalizeEmail(keep.Email):
+				pipe.HSet(v.context, v.emailIndexKey(), mergeField, keep.VoterId)
+			case indexed == strconv.Itoa(int(merge.VoterId)):
+				pipe.HDel(v.context, v.emailIndexKey(), mergeField)
+			}
+			if merge.Deleted {
+				pipe.SRem(v.context, v.deletedKey(), merge.VoterId)
+			}
+			if delta := votesOf(merged) - votesOf(keep, merge); delta != 0 {
+				pipe.IncrBy(v.context, v.votesTotalKey(), int64(delta))
+			}
+			return nil
+		})
+		return err
+	}
+
+	if err := v.watch(true, update, keepKey, mergeKey); err != nil {
+		return Voter{}, err
+	}
+	return merged, nil
+}
+
+// getVoterInTx reads the voter at key inside a WATCH, a soft deleted voter
+// is reported as ErrVoterNotFound unless the list includes deleted voters
+func (v *VoterList) getVoterInTx(tx *redis.Tx, key string) (Voter, error) {
+	var voter Voter
+	get := redis.NewCmd(v.context, "JSON.GET", key, ".")
+	_ = tx.Process(v.context, get)
+	raw, err := get.Text()
+	if err != nil {
+		if isRedisNilError(err) {
+			return voter, ErrVoterNotFound
+		}
+		return voter, wrongTypeAsCorrupt(err)
+	}
+	if err := json.Unmarshal([]byte(raw), &voter); err != nil {
+		return voter, fmt.Errorf("%w: %w", ErrCorruptVoter, err)
+	}
+	if voter.Deleted && !v.includeDeleted {
+		return voter, ErrVoterNotFound
+	}
+	return voter, nil
+}
@@ -0,0 +1,67 @@
+package db
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisPollsKey is appended to the prefix to name the poll registry, a hash
+// from poll id to whether the poll is open or closed
+const RedisPollsKey = "polls"
+
+const (
+	pollOpen   = "open"
+	pollClosed = "closed"
+)
+
+// ErrPollClosed is returned by AddPoll for a vote in a poll that is not
+// open
+var ErrPollClosed = errors.New("poll is not open")
+
+func (v *VoterList) pollsKey() string {
+	return v.keyPrefix + RedisPollsKey
+}
+
+// OpenPoll marks the poll as open so votes can be recorded in it.  Once any
+// poll has been opened or closed, only votes in open polls are accepted.
+func (v *VoterList) OpenPoll(pollId uint) error {
+	return v.cacheClient.HSet(v.context, v.pollsKey(), strconv.FormatUint(uint64(pollId), 10), pollOpen).Err()
+}
+
+// ClosePoll marks the poll as closed, votes already recorded in it are
+// kept but no more are accepted
+func (v *VoterList) ClosePoll(pollId uint) error {
+	return v.cacheClient.HSet(v.context, v.pollsKey(), strconv.FormatUint(uint64(pollId), 10), pollClosed).Err()
+}
+
+// PollOpen reports whether votes can be recorded in the poll.  Without a
+// poll registry, when no poll has ever been opened or closed, every poll
+// is open.  Otherwise a poll that was never opened is not.
+func (v *VoterList) PollOpen(pollId uint) (bool, error) {
+	var status *redis.StringCmd
+	var registry *redis.IntCmd
+	err := v.withRetry(func() error {
+		cmds, _ := v.cacheClient.Pipelined(v.context, func(pipe redis.Pipeliner) error {
+			status = pipe.HGet(v.context, v.pollsKey(), strconv.FormatUint(uint64(pollId), 10))
+			registry = pipe.Exists(v.context, v.pollsKey())
+			return nil
+		})
+		//A poll missing from the registry is not a failure
+		for _, cmd := range cmds {
+			if err := cmd.Err(); err != nil && !isRedisNilError(err) {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	if registry.Val() == 0 {
+		return true, nil
+	}
+	return status.Val() == pollOpen, nil
+}
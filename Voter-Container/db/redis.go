@@ -2,18 +2,40 @@ package db
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
+	"net/mail"
 	"os"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
-	"github.com/nitishm/go-rejson/v4"
+	"drexel.edu/voter/db/memredis"
+	"drexel.edu/voter/logging"
+	"github.com/nitishm/go-rejson/v4/rjs"
 	"github.com/redis/go-redis/v9"
 )
 
+// The binding tags are checked by the API when a request is decoded, they
+// catch missing fields early, Validate still has the final say
+
 type VoterHistory struct {
+	PollId   uint      `json:"PollId" binding:"required"`
+	VoteId   uint      `json:"VoteId"`
+	VoteDate time.Time `json:"VoteDate"`
+}
+
+// VoteEvent describes a vote that was just recorded
+type VoteEvent struct {
+	VoterId  uint      `json:"VoterId"`
 	PollId   uint      `json:"PollId"`
 	VoteId   uint      `json:"VoteId"`
 	VoteDate time.Time `json:"VoteDate"`
@@ -21,21 +43,195 @@ type VoterHistory struct {
 
 type Voter struct {
 	VoterId     uint           `json:"VoterId"`
-	Name        string         `json:"Name"`
-	Email       string         `json:"Email"`
-	VoteHistory []VoterHistory `json:"VoteHistory"`
+	Name        string         `json:"Name" binding:"required"`
+	Email       string         `json:"Email" binding:"required"`
+	VoteHistory []VoterHistory `json:"VoteHistory" binding:"dive"`
+
+	//Version starts at 1 and goes up by one on every write, UpdateVoter
+	//uses it to detect that someone else changed the voter in the meantime
+	Version uint `json:"Version"`
+
+	//Deleted is set by SoftDeleteVoter, a soft deleted voter is kept in
+	//redis but left out of lookups and lists until RestoreVoter is called.
+	//Only those two change it, whatever a client sends is ignored.
+	Deleted   bool      `json:"Deleted"`
+	DeletedAt time.Time `json:"DeletedAt"`
+}
+
+// ValidationError reports which field of a voter failed validation
+type ValidationError struct {
+	Field   string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid %s: %s", e.Field, e.Message)
+}
+
+// Validate checks that a voter is fit to be stored, it returns a
+// *ValidationError naming the first offending field
+func (voter *Voter) Validate() error {
+	if strings.TrimSpace(voter.Name) == "" {
+		return &ValidationError{Field: "Name", Message: "name must not be empty"}
+	}
+
+	if voter.Email == "" {
+		return &ValidationError{Field: "Email", Message: "email must not be empty"}
+	}
+
+	//ParseAddress also accepts forms like "Name <user@host>", we only want
+	//the bare address so the parsed result must match the input exactly
+	addr, err := mail.ParseAddress(voter.Email)
+	if err != nil || addr.Address != voter.Email {
+		return &ValidationError{Field: "Email", Message: fmt.Sprintf("%q is not a valid email address", voter.Email)}
+	}
+
+	return nil
+}
+
+// Validate checks that a vote is fit to be stored, zero is what a client
+// that forgot to set PollId or VoteId sends, so neither may be zero.  It
+// returns a *ValidationError naming the first offending field.
+func (poll *VoterHistory) Validate() error {
+	if poll.PollId == 0 {
+		return &ValidationError{Field: "PollId", Message: "poll id must not be zero"}
+	}
+	if poll.VoteId == 0 {
+		return &ValidationError{Field: "VoteId", Message: "vote id must not be zero"}
+	}
+	return nil
+}
+
+// ErrVoterNotFound is returned when there is no voter with the requested
+// id, any other error means redis itself could not be reached or failed
+var ErrVoterNotFound = errors.New("voter does not exist")
+
+// ErrUnreachable is returned by New and NewWithCacheInstance when redis did
+// not answer a PING, as opposed to being misconfigured
+var ErrUnreachable = errors.New("unable to connect to redis")
+
+// ErrCorruptVoter is returned when a voter key holds something that is not
+// a voter, such as JSON written by another tool.  Lists skip those keys, see
+// Skipped.
+var ErrCorruptVoter = errors.New("stored voter could not be read")
+
+// ReplyTypeError is returned when redis answers a JSON read with a type the
+// voter list does not know how to decode, which points at a client library
+// or module version mismatch rather than at the stored data
+type ReplyTypeError struct {
+	Key   string
+	Reply any
+}
+
+func (e *ReplyTypeError) Error() string {
+	return fmt.Sprintf("unexpected reply of type %T reading %s", e.Reply, e.Key)
+}
+
+// replyBytes returns the JSON in a JSON.GET reply for key.  Depending on
+// the ReJSON and client versions the reply is bytes or a string, anything
+// else is a *ReplyTypeError.
+func replyBytes(key string, reply any) ([]byte, error) {
+	switch raw := reply.(type) {
+	case []byte:
+		return raw, nil
+	case string:
+		return []byte(raw), nil
+	}
+	return nil, &ReplyTypeError{Key: key, Reply: reply}
+}
+
+// ErrVersionConflict is returned by UpdateVoter when the voter was changed
+// since the caller read it
+var ErrVersionConflict = errors.New("voter was changed by someone else, reload it and try again")
+
+// ErrVoterExists is returned when adding a voter whose id is already used
+var ErrVoterExists = errors.New("voter already exists")
+
+// ErrEmailTaken is returned when adding or updating a voter with an email
+// that already belongs to another voter
+var ErrEmailTaken = errors.New("email already belongs to another voter")
+
+// ErrDuplicatePoll is returned by AddPoll when the voter already has a vote
+// recorded for the poll
+var ErrDuplicatePoll = errors.New("voter has already voted in this poll")
+
+// ErrPollNotFound is returned when the voter has no vote recorded for a poll
+var ErrPollNotFound = errors.New("poll does not exist for the specified voter")
+
+// PollOptions changes how AddPoll records a vote
+type PollOptions struct {
+	//Overwrite replaces the VoteId and VoteDate of an existing vote for
+	//the same poll instead of returning ErrDuplicatePoll
+	Overwrite bool
+
+	//ServerTime stamps the vote with the server's clock even when the
+	//client supplied a VoteDate
+	ServerTime bool
+
+	//Sorted keeps the history in VoteDate order, the vote goes in before
+	//the first vote with a later date instead of at the end.  The stored
+	//history is expected to be sorted already.
+	Sorted bool
 }
 
 const (
 	RedisNilError        = "redis: nil"
 	RedisDefaultLocation = "0.0.0.0:6379"
-	RedisKeyPrefix       = "voter:"
+
+	//RedisKeyPrefix is the default namespace for every key we write, set
+	//REDIS_KEY_PREFIX to run several isolated instances against one redis
+	RedisKeyPrefix = "voter:"
+
+	//RedisIdSeqKey is appended to the prefix to name the id counter
+	RedisIdSeqKey = "id:seq"
+
+	//RedisEmailIndexKey is appended to the prefix to name a hash of lower
+	//cased email to voter id, it lets GetVoterByEmail find a voter without
+	//scanning them all
+	RedisEmailIndexKey = "email"
+
+	//RedisDeletedKey is appended to the prefix to name the set of soft
+	//deleted voter ids, lists consult it to skip those voters without
+	//loading them
+	RedisDeletedKey = "deleted"
+
+	//RedisVotesTotalKey is appended to the prefix to name the running total
+	//of votes cast, it answers GetVoteTotal without scanning the voters
+	RedisVotesTotalKey = "votes:total"
+
+	//DefaultScanBatchSize is the COUNT hint passed to SCAN, it is also the
+	//number of keys removed per UNLINK when deleting everything
+	DefaultScanBatchSize = 100
 )
 
 type cache struct {
-	cacheClient *redis.Client
-	jsonHelper  *rejson.Handler
-	context     context.Context
+	cacheClient   *redis.Client
+	jsonHelper    JSONStore
+	context       context.Context
+	scanBatchSize int
+	keyPrefix     string
+	retry         retryPolicy
+
+	//includeDeleted makes lookups and lists return soft deleted voters
+	includeDeleted bool
+
+	//maxVoteHistory caps the votes per voter, zero for no cap, and
+	//historyPolicy says what a vote past the cap does
+	maxVoteHistory int
+	historyPolicy  VoteHistoryPolicy
+
+	//voteHook, when set, is told about every new vote and votesChannel,
+	//when set, is the redis channel it is published to
+	voteHook     func(VoteEvent)
+	votesChannel string
+
+	//memory is the in-process redis backing a voter list made by
+	//NewInMemory, it is stopped by Close
+	memory *memredis.Server
+
+	//skipped counts the corrupt voters lists have left out, each copy made
+	//by WithContext starts its own count
+	skipped *atomic.Int64
 }
 
 // ToDo is the struct that represents the main object of our
@@ -55,30 +251,78 @@ func New() (*VoterList, error) {
 	if redisUrl == "" {
 		redisUrl = RedisDefaultLocation
 	}
-	log.Println("DEBUG:  USING REDIS URL: " + redisUrl)
-	return NewWithCacheInstance(redisUrl)
+	slog.Debug("Using redis", "url", redisUrl)
+
+	voterList, err := NewWithCacheInstance(redisUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	//The scan batch size can also be tuned from the environment
+	if batch := os.Getenv("REDIS_SCAN_BATCH_SIZE"); batch != "" {
+		size, err := strconv.Atoi(batch)
+		if err != nil {
+			voterList.Close()
+			return nil, fmt.Errorf("invalid REDIS_SCAN_BATCH_SIZE %q: %w", batch, err)
+		}
+		voterList.SetScanBatchSize(size)
+	}
+
+	if err := voterList.setMaxVoteHistoryFromEnv(); err != nil {
+		voterList.Close()
+		return nil, err
+	}
+
+	voterList.SetKeyPrefix(os.Getenv("REDIS_KEY_PREFIX"))
+	return voterList, nil
 }
 
 // NewWithCacheInstance is a constructor function that returns a pointer to a new
 // ToDo struct.  It accepts a string that represents the location of the redis
-// cache.
+// cache, credentials, TLS, pool size, timeouts and how long to wait for
+// redis to come up are picked up from the environment, see redisOptions and
+// connectRetryFromEnv.
 func NewWithCacheInstance(location string) (*VoterList, error) {
 
-	//Connect to redis.  Other options can be provided, but the
-	//defaults are OK
-	client := redis.NewClient(&redis.Options{
-		Addr: location,
-	})
+	opts, err := redisOptions(location)
+	if err != nil {
+		return nil, err
+	}
+
+	retry, err := connectRetryFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	commandRetry, err := commandRetryFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	voterList, err := newWithOptions(opts, retry)
+	if err != nil {
+		return nil, err
+	}
+	voterList.retry = commandRetry
+	return voterList, nil
+}
+
+func newWithOptions(opts *redis.Options, retry retryPolicy) (*VoterList, error) {
+
+	//Connect to redis
+	client := redis.NewClient(opts)
 
 	//We use this context to coordinate betwen our go code and
 	//the redis operaitons
 	ctx := context.Background()
 
 	//This is the reccomended way to ensure that our redis connection
-	//is working
-	err := client.Ping(ctx).Err()
-	if err != nil {
-		log.Println("Error connecting to redis" + err.Error() + "cache might not be available, continuing...")
+	//is working.  A container often starts a little before redis does, so
+	//we give it a few tries, but if redis stays unreachable there is nothing
+	//useful this service can do and we let the caller decide what to do
+	if err := pingWithRetry(ctx, client, retry); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("%w at %s: %w", ErrUnreachable, opts.Addr, err)
 	}
 
 	//By default, redis manages keys and values, where the values
@@ -87,216 +331,2174 @@ func NewWithCacheInstance(location string) (*VoterList, error) {
 	//however, we need a companion library in order to work with it
 	//Below we create an instance of the JSON helper and associate
 	//it with our redis connnection
-	jsonHelper := rejson.NewReJSONHandler()
-	jsonHelper.SetGoRedisClientWithContext(ctx, client)
+	jsonHelper := newRejsonStore(ctx, client)
+
+	//Failed commands are logged with the request id from their context
+	client.AddHook(errorLogHook{})
 
 	//Return a pointer to a new ToDo struct
 	return &VoterList{
 		cache: cache{
-			cacheClient: client,
-			jsonHelper:  jsonHelper,
-			context:     ctx,
+			cacheClient:   client,
+			jsonHelper:    jsonHelper,
+			context:       ctx,
+			scanBatchSize: DefaultScanBatchSize,
+			keyPrefix:     RedisKeyPrefix,
+			retry: retryPolicy{
+				attempts: DefaultRedisRetryAttempts,
+				backoff:  DefaultRedisRetryBackoff,
+			},
+			skipped: new(atomic.Int64),
 		},
 	}, nil
 }
 
-//------------------------------------------------------------
-// REDIS HELPERS
-//------------------------------------------------------------
+// Defaults for the redis client, they can be changed with the environment
+// variables read by redisOptions, connectRetryFromEnv and
+// commandRetryFromEnv
+const (
+	DefaultRedisDialTimeout    = 5 * time.Second
+	DefaultRedisReadTimeout    = 3 * time.Second
+	DefaultRedisWriteTimeout   = 3 * time.Second
+	DefaultRedisConnectTries   = 5
+	DefaultRedisConnectBackoff = 500 * time.Millisecond
+	DefaultRedisRetryAttempts  = 3
+	DefaultRedisRetryBackoff   = 20 * time.Millisecond
+)
 
-// We will use this later, you can ignore for now
-func isRedisNilError(err error) bool {
-	return errors.Is(err, redis.Nil) || err.Error() == RedisNilError
-}
+// DefaultRedisPoolSize is the number of connections kept per CPU
+const DefaultRedisPoolSize = 10
 
-// In redis, our keys will be strings, they will look like
-// todo:<number>.  This function will take an integer and
-// return a string that can be used as a key in redis
-func redisKeyFromId(id int) string {
-	return fmt.Sprintf("%s%d", RedisKeyPrefix, id)
-}
+// redisOptions builds the client options for the redis at location.  A
+// plain local redis needs nothing else, a managed one usually needs some of
+// these environment variables:
+//
+//	REDIS_USERNAME       ACL user name
+//	REDIS_PASSWORD       password for the user, or the legacy requirepass
+//	REDIS_DB             database number, 0 by default
+//	REDIS_TLS            "true" to connect over TLS
+//	REDIS_POOL_SIZE      connections in the pool, 10 per CPU by default
+//	REDIS_DIAL_TIMEOUT   e.g. "5s", how long to wait for a new connection
+//	REDIS_READ_TIMEOUT   e.g. "3s", how long to wait for a reply
+//	REDIS_WRITE_TIMEOUT  e.g. "3s", how long to wait to send a command
+func redisOptions(location string) (*redis.Options, error) {
+	opts := &redis.Options{
+		Addr:         location,
+		Username:     os.Getenv("REDIS_USERNAME"),
+		Password:     os.Getenv("REDIS_PASSWORD"),
+		PoolSize:     DefaultRedisPoolSize * runtime.GOMAXPROCS(0),
+		DialTimeout:  DefaultRedisDialTimeout,
+		ReadTimeout:  DefaultRedisReadTimeout,
+		WriteTimeout: DefaultRedisWriteTimeout,
+	}
 
-// Helper to return a ToDoItem from redis provided a key
-func (v *VoterList) getItemFromRedis(key string, voter *Voter) error {
+	if poolEnv := os.Getenv("REDIS_POOL_SIZE"); poolEnv != "" {
+		size, err := strconv.Atoi(poolEnv)
+		if err != nil || size < 1 {
+			return nil, fmt.Errorf("invalid REDIS_POOL_SIZE %q", poolEnv)
+		}
+		opts.PoolSize = size
+	}
 
-	//Lets query redis for the item, note we can return parts of the
-	//json structure, the second parameter "." means return the entire
-	//json structure
-	voterObject, err := v.jsonHelper.JSONGet(key, ".")
-	if err != nil {
-		return err
+	timeouts := []struct {
+		env   string
+		value *time.Duration
+	}{
+		{"REDIS_DIAL_TIMEOUT", &opts.DialTimeout},
+		{"REDIS_READ_TIMEOUT", &opts.ReadTimeout},
+		{"REDIS_WRITE_TIMEOUT", &opts.WriteTimeout},
+	}
+	for _, timeout := range timeouts {
+		if err := durationFromEnv(timeout.env, timeout.value); err != nil {
+			return nil, err
+		}
 	}
 
-	//JSONGet returns an "any" object, or empty interface,
-	//we need to convert it to a byte array, which is the
-	//underlying type of the object, then we can unmarshal
-	//it into our ToDoItem struct
-	err = json.Unmarshal(voterObject.([]byte), voter)
-	if err != nil {
-		return err
+	if dbEnv := os.Getenv("REDIS_DB"); dbEnv != "" {
+		dbNum, err := strconv.Atoi(dbEnv)
+		if err != nil || dbNum < 0 {
+			return nil, fmt.Errorf("invalid REDIS_DB %q", dbEnv)
+		}
+		opts.DB = dbNum
+	}
+
+	if tlsEnv := os.Getenv("REDIS_TLS"); tlsEnv != "" {
+		useTLS, err := strconv.ParseBool(tlsEnv)
+		if err != nil {
+			return nil, fmt.Errorf("invalid REDIS_TLS %q: %w", tlsEnv, err)
+		}
+		if useTLS {
+			//The certificate has to match the host we dial, not the port
+			host, _, err := net.SplitHostPort(location)
+			if err != nil {
+				host = location
+			}
+			opts.TLSConfig = &tls.Config{
+				MinVersion: tls.VersionTLS12,
+				ServerName: host,
+			}
+		}
 	}
 
+	return opts, nil
+}
+
+// durationFromEnv overwrites value with the duration in the environment
+// variable, if it is set
+func durationFromEnv(env string, value *time.Duration) error {
+	raw := os.Getenv(env)
+	if raw == "" {
+		return nil
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil || d <= 0 {
+		return fmt.Errorf("invalid %s %q, expected a duration like 3s", env, raw)
+	}
+	*value = d
 	return nil
 }
 
-func (v *VoterList) AddVoter(voter *Voter) error {
+// retryPolicy controls how often a failed redis call is tried again, the
+// wait between attempts starts at backoff and doubles after each failure
+type retryPolicy struct {
+	attempts int
+	backoff  time.Duration
+}
 
-	//Before we add an item to the DB, lets make sure
-	//it does not exist, if it does, return an error
-	redisKey := redisKeyFromId(int(voter.VoterId))
-	var existingVoter Voter
-	if err := v.getItemFromRedis(redisKey, &existingVoter); err == nil {
-		return errors.New("voter already exists")
-	}
+// connectRetryFromEnv reads REDIS_CONNECT_ATTEMPTS and
+// REDIS_CONNECT_BACKOFF, e.g. "500ms", which control how long to wait for
+// redis when starting up
+func connectRetryFromEnv() (retryPolicy, error) {
+	return retryFromEnv("REDIS_CONNECT_ATTEMPTS", "REDIS_CONNECT_BACKOFF", retryPolicy{
+		attempts: DefaultRedisConnectTries,
+		backoff:  DefaultRedisConnectBackoff,
+	})
+}
 
-	//Add item to database with JSON Set
-	if _, err := v.jsonHelper.JSONSet(redisKey, ".", voter); err != nil {
-		return err
+// commandRetryFromEnv reads REDIS_RETRY_ATTEMPTS and REDIS_RETRY_BACKOFF,
+// e.g. "20ms", which control how a command that hit a network blip is
+// retried
+func commandRetryFromEnv() (retryPolicy, error) {
+	return retryFromEnv("REDIS_RETRY_ATTEMPTS", "REDIS_RETRY_BACKOFF", retryPolicy{
+		attempts: DefaultRedisRetryAttempts,
+		backoff:  DefaultRedisRetryBackoff,
+	})
+}
+
+func retryFromEnv(attemptsEnv, backoffEnv string, retry retryPolicy) (retryPolicy, error) {
+	if raw := os.Getenv(attemptsEnv); raw != "" {
+		attempts, err := strconv.Atoi(raw)
+		if err != nil || attempts < 1 {
+			return retry, fmt.Errorf("invalid %s %q", attemptsEnv, raw)
+		}
+		retry.attempts = attempts
 	}
 
-	//If everything is ok, return nil for the error
-	return nil
+	if err := durationFromEnv(backoffEnv, &retry.backoff); err != nil {
+		return retry, err
+	}
+	return retry, nil
 }
 
-func (v *VoterList) DeleteVoter(id int) error {
-
-	pattern := redisKeyFromId(int(id))
-	numDeleted, err := v.cacheClient.Del(v.context, pattern).Result()
-	if err != nil {
-		return err
+// isTransientRedisError reports whether err may go away by trying again.
+// A missing key, an error reply such as a bad password and a cancelled
+// request will not, a dropped connection or a timeout might.
+func isTransientRedisError(err error) bool {
+	if err == nil || isRedisNilError(err) {
+		return false
 	}
-	if numDeleted == 0 {
-		return errors.New("attempted to delete non-existent item")
+	var replyErr redis.Error
+	if errors.As(err, &replyErr) {
+		return false
 	}
+	return !errors.Is(err, context.Canceled) &&
+		!errors.Is(err, context.DeadlineExceeded) &&
+		!errors.Is(err, redis.ErrClosed)
+}
 
-	return nil
+// retryTransient calls op until it succeeds, fails with an error that is
+// not transient or the attempts run out, it gives up early once ctx is done
+func retryTransient(ctx context.Context, retry retryPolicy, msg string, op func() error) error {
+	backoff := retry.backoff
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if !isTransientRedisError(err) || attempt >= retry.attempts {
+			return err
+		}
+
+		logging.FromContext(ctx).Warn(msg,
+			"attempt", attempt, "attempts", retry.attempts, "wait", backoff.String(), "error", err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
 }
 
-func (v *VoterList) DeleteAll() error {
+// pingWithRetry pings redis until it answers or the attempts run out.  Only
+// network errors are retried, an error reply such as a bad password will not
+// go away by waiting.
+func pingWithRetry(ctx context.Context, client *redis.Client, retry retryPolicy) error {
+	return retryTransient(ctx, retry, "redis not ready, retrying", func() error {
+		return client.Ping(ctx).Err()
+	})
+}
 
-	pattern := RedisKeyPrefix + "*"
-	ks, _ := v.cacheClient.Keys(v.context, pattern).Result()
+// withRetry runs a single redis call, trying it again with the voter
+// list's retry policy when it fails with a transient error.  Only calls that
+// are safe to repeat should go through it.
+func (v *VoterList) withRetry(op func() error) error {
+	return retryTransient(v.context, v.retry, "redis command failed, retrying", op)
+}
 
-	numDeleted, err := v.cacheClient.Del(v.context, ks...).Result()
-	if err != nil {
-		return err
+// WithContext returns a copy of the voter list that sends its redis
+// commands with ctx, so they stop when ctx is cancelled and any failure is
+// logged with the request id ctx carries.  The copy shares the redis
+// client, closing either one closes both.
+func (v *VoterList) WithContext(ctx context.Context) *VoterList {
+	return &VoterList{
+		cache: cache{
+			cacheClient:    v.cacheClient,
+			jsonHelper:     v.jsonHelper.WithContext(ctx),
+			context:        ctx,
+			scanBatchSize:  v.scanBatchSize,
+			keyPrefix:      v.keyPrefix,
+			retry:          v.retry,
+			includeDeleted: v.includeDeleted,
+			maxVoteHistory: v.maxVoteHistory,
+			historyPolicy:  v.historyPolicy,
+			voteHook:       v.voteHook,
+			votesChannel:   v.votesChannel,
+			memory:         v.memory,
+			skipped:        new(atomic.Int64),
+		},
 	}
+}
+
+// Skipped is how many corrupt voters the lists made with this voter list
+// have left out, it is meant to be read from the copy WithContext made for
+// a single request
+func (v *VoterList) Skipped() int {
+	return int(v.skipped.Load())
+}
 
-	if numDeleted != int64(len(ks)) {
-		return errors.New("one or more items could not be deleted")
+// skipCorrupt reports whether err is ErrCorruptVoter, in which case the
+// voter at key is logged and counted as skipped
+func (v *VoterList) skipCorrupt(key string, err error) bool {
+	if !errors.Is(err, ErrCorruptVoter) {
+		return false
 	}
+	logging.FromContext(v.context).Warn("Skipping a voter that could not be read", "key", key, "error", err)
+	v.skipped.Add(1)
+	return true
+}
 
-	return nil
+// IncludeDeleted returns a copy of the voter list whose lookups and lists
+// also return soft deleted voters.  Like WithContext the copy shares the
+// redis client.
+func (v *VoterList) IncludeDeleted() *VoterList {
+	c := v.WithContext(v.context)
+	c.includeDeleted = true
+	return c
+}
+
+// Ping checks that redis is reachable
+func (v *VoterList) Ping() error {
+	return v.cacheClient.Ping(v.context).Err()
 }
 
-func (v *VoterList) UpdateVoter(voter Voter) error {
+// AddHook installs a go-redis hook on the client, e.g. to collect metrics
+// about the commands that are sent
+func (v *VoterList) AddHook(hook redis.Hook) {
+	v.cacheClient.AddHook(hook)
+}
 
-	redisKey := redisKeyFromId(int(voter.VoterId))
-	var existingItem Voter
-	if err := v.getItemFromRedis(redisKey, &existingItem); err != nil {
-		return errors.New("item does not exist")
+// SetScanBatchSize changes how many keys are requested per SCAN call and
+// removed per UNLINK, values less than 1 restore the default
+func (v *VoterList) SetScanBatchSize(size int) {
+	if size < 1 {
+		size = DefaultScanBatchSize
 	}
+	v.scanBatchSize = size
+}
 
-	if _, err := v.jsonHelper.JSONSet(redisKey, ".", voter); err != nil {
-		return err
+// SetKeyPrefix changes the namespace every key is written under, so that
+// voter lists with different prefixes share a redis without seeing each
+// other's voters.  A ":" is added when the prefix does not end in one and
+// an empty prefix restores the default.  Change it before storing voters,
+// the ones under the old prefix are not moved.
+func (v *VoterList) SetKeyPrefix(prefix string) {
+	if prefix == "" {
+		prefix = RedisKeyPrefix
 	}
+	if !strings.HasSuffix(prefix, ":") {
+		prefix += ":"
+	}
+	v.keyPrefix = prefix
+}
 
-	return nil
+// SetJSONStore replaces the store used to read voter documents and to add
+// voters.  Everything else, such as the key scans, the email index and the
+// writes made in transactions, still goes to the redis client the voter
+// list was created with, see JSONStore.
+func (v *VoterList) SetJSONStore(store JSONStore) {
+	v.jsonHelper = store
 }
 
-func (v *VoterList) GetVoter(id int) (Voter, error) {
+// SetVoteHook has hook called with every vote AddPoll or UpsertPoll
+// records for a poll the voter had not voted in before, after it is
+// stored.  It is called on the goroutine that added the vote so it should
+// not block.  Copies made with WithContext before the hook is set do not
+// see it, set it once when the voter list is created.
+func (v *VoterList) SetVoteHook(hook func(VoteEvent)) {
+	v.voteHook = hook
+}
 
-	var voter Voter
-	pattern := redisKeyFromId(int(id))
-	err := v.getItemFromRedis(pattern, &voter)
-	if err != nil {
-		return Voter{}, err
+// Close releases the underlying redis connection pool, it should be
+// called once when the service shuts down
+func (v *VoterList) Close() error {
+	err := v.cacheClient.Close()
+	if v.memory != nil {
+		v.memory.Close()
 	}
+	return err
+}
 
-	return voter, nil
+//------------------------------------------------------------
+// REDIS HELPERS
+//------------------------------------------------------------
+
+// We will use this later, you can ignore for now
+func isRedisNilError(err error) bool {
+	return err != nil && (errors.Is(err, redis.Nil) || err.Error() == RedisNilError)
 }
 
-func (v *VoterList) GetAllVoters() ([]Voter, error) {
+// errorLogHook logs redis commands that fail, a nil reply just means the
+// key does not exist so it is left out
+type errorLogHook struct{}
 
-	var voterList []Voter
-	var voter Voter
+func (errorLogHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
 
-	pattern := RedisKeyPrefix + "*"
-	ks, _ := v.cacheClient.Keys(v.context, pattern).Result()
-	for _, key := range ks {
-		err := v.getItemFromRedis(key, &voter)
-		if err != nil {
-			return nil, err
+func (errorLogHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		err := next(ctx, cmd)
+		if err != nil && !isRedisNilError(err) {
+			logging.FromContext(ctx).Error("redis command failed", "cmd", cmd.Name(), "error", err)
 		}
-		voterList = append(voterList, voter)
+		return err
 	}
+}
 
-	return voterList, nil
+func (errorLogHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		err := next(ctx, cmds)
+		for _, cmd := range cmds {
+			if cmdErr := cmd.Err(); cmdErr != nil && !isRedisNilError(cmdErr) {
+				logging.FromContext(ctx).Error("redis command failed", "cmd", cmd.Name(), "error", cmdErr)
+			}
+		}
+		return err
+	}
 }
 
-func (v *VoterList) PrintItem(voter Voter) {
-	jsonBytes, _ := json.MarshalIndent(voter, "", "  ")
-	fmt.Println(string(jsonBytes))
+// NormalizeEmail is the form emails are stored, indexed and compared in,
+// trimmed and lower cased, so that User@Example.com and user@example.com
+// are the same email
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
 }
 
-func (v *VoterList) PrintAllItems(voterList []Voter) {
-	for _, voter := range voterList {
-		v.PrintItem(voter)
+// indexEmails points the email index at the given voters.  An email the
+// index already gives to another voter is left alone, that voter got there
+// first, which only happens when two clients add the same email at once.
+func (v *VoterList) indexEmails(voters ...Voter) error {
+	if len(voters) == 0 {
+		return nil
+	}
+	cmds := make([]*redis.BoolCmd, len(voters))
+	_, err := v.cacheClient.Pipelined(v.context, func(pipe redis.Pipeliner) error {
+		for i, voter := range voters {
+			cmds[i] = pipe.HSetNX(v.context, v.emailIndexKey(), NormalizeEmail(voter.Email), voter.VoterId)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
+
+	for i, voter := range voters {
+		if cmds[i].Val() {
+			continue
+		}
+		//Already there, which is fine if it is this voter's own entry
+		owner, err := v.cacheClient.HGet(v.context, v.emailIndexKey(), NormalizeEmail(voter.Email)).Result()
+		if err != nil && !isRedisNilError(err) {
+			return err
+		}
+		if owner != strconv.Itoa(int(voter.VoterId)) {
+			logging.FromContext(v.context).Warn("Email already indexed for another voter",
+				"email", voter.Email, "voter", voter.VoterId, "owner", owner)
+		}
+	}
+	return nil
 }
 
-func (v *VoterList) JsonToItem(jsonString string) (Voter, error) {
-	var voter Voter
-	err := json.Unmarshal([]byte(jsonString), &voter)
+// unindexEmail removes an email from the index if it still points at id,
+// another voter may have registered the same email since
+func (v *VoterList) unindexEmail(email string, id uint) error {
+	field := NormalizeEmail(email)
+	indexed, err := v.cacheClient.HGet(v.context, v.emailIndexKey(), field).Result()
+	if isRedisNilError(err) {
+		return nil
+	}
 	if err != nil {
-		return Voter{}, err
+		return err
 	}
-
-	return voter, nil
+	if indexed != strconv.Itoa(int(id)) {
+		return nil
+	}
+	return v.cacheClient.HDel(v.context, v.emailIndexKey(), field).Err()
 }
 
-func (v *VoterList) GetVoteHistory(id int) ([]VoterHistory, error) {
+// In redis, our keys will be strings, they will look like
+// voter:<number>.  This function will take an integer and
+// return a string that can be used as a key in redis
+func (v *VoterList) redisKeyFromId(id int) string {
+	return fmt.Sprintf("%s%d", v.keyPrefix, id)
+}
 
-	redisKey := redisKeyFromId(id)
-	var existingVoter Voter
-	if err := v.getItemFromRedis(redisKey, &existingVoter); err != nil {
-		return existingVoter.VoteHistory, errors.New("voter does not exist")
+// idFromRedisKey is the inverse of redisKeyFromId, it returns -1 if the
+// key is not a voter key
+func (v *VoterList) idFromRedisKey(key string) int {
+	rest, ok := strings.CutPrefix(key, v.keyPrefix)
+	if !ok {
+		return -1
+	}
+	id, err := strconv.Atoi(rest)
+	if err != nil || id < 0 {
+		return -1
 	}
+	return id
+}
 
-	return existingVoter.VoteHistory, nil
+// idSeqKey is the counter new voter ids are taken from
+func (v *VoterList) idSeqKey() string {
+	return v.keyPrefix + RedisIdSeqKey
 }
 
-func (v *VoterList) GetSingleVoteHistory(voterId int, pollId uint) (*VoterHistory, error) {
+// emailIndexKey is the hash of email to voter id
+func (v *VoterList) emailIndexKey() string {
+	return v.keyPrefix + RedisEmailIndexKey
+}
+
+// deletedKey is the set of soft deleted voter ids
+func (v *VoterList) deletedKey() string {
+	return v.keyPrefix + RedisDeletedKey
+}
+
+// votesTotalKey is the running total of votes cast
+func (v *VoterList) votesTotalKey() string {
+	return v.keyPrefix + RedisVotesTotalKey
+}
 
-	redisKey := redisKeyFromId(voterId)
-	var existingVoter Voter
-	if err := v.getItemFromRedis(redisKey, &existingVoter); err != nil {
-		return nil, errors.New("voter does not exist")
+// countVotes moves the running total of votes by delta.  It is not
+// retried, an INCRBY that went through but lost its reply would be counted
+// twice.
+func (v *VoterList) countVotes(delta int) error {
+	if delta == 0 {
+		return nil
 	}
+	return v.cacheClient.IncrBy(v.context, v.votesTotalKey(), int64(delta)).Err()
+}
 
-	for _, vote := range existingVoter.VoteHistory {
-		if vote.PollId == pollId {
-			return &vote, nil
+// votesOf is how many votes the voters hold towards the running total,
+// soft deleted voters hold none
+func votesOf(voters ...Voter) int {
+	n := 0
+	for _, voter := range voters {
+		if !voter.Deleted {
+			n += len(voter.VoteHistory)
 		}
 	}
+	return n
+}
 
-	return nil, errors.New("poll does not exist for the specified voter")
+// wrongTypeAsCorrupt wraps err in ErrCorruptVoter when redis refused to read
+// a key as JSON because it holds another type, such as a plain string
+func wrongTypeAsCorrupt(err error) error {
+	if err != nil && strings.HasPrefix(err.Error(), "WRONGTYPE") {
+		return fmt.Errorf("%w: %w", ErrCorruptVoter, err)
+	}
+	return err
 }
 
-func (v *VoterList) AddPoll(voterId int, poll VoterHistory) (Voter, error) {
+// Helper to return a ToDoItem from redis provided a key, a missing key is
+// reported as ErrVoterNotFound and one that does not hold a voter as
+// ErrCorruptVoter
+func (v *VoterList) getItemFromRedis(key string, voter *Voter) error {
 
-	redisKey := redisKeyFromId(voterId)
-	var existingVoter Voter
-	if err := v.getItemFromRedis(redisKey, &existingVoter); err != nil {
-		return existingVoter, errors.New("voter does not exist")
+	//Lets query redis for the item, note we can return parts of the
+	//json structure, the second parameter "." means return the entire
+	//json structure
+	var voterObject any
+	err := v.withRetry(func() (err error) {
+		voterObject, err = v.jsonHelper.JSONGet(key, ".")
+		return err
+	})
+	if err != nil {
+		if isRedisNilError(err) {
+			return ErrVoterNotFound
+		}
+		return wrongTypeAsCorrupt(err)
 	}
 
-	existingVoter.VoteHistory = append(existingVoter.VoteHistory, poll)
-
-	if _, err := v.jsonHelper.JSONSet(redisKey, ".", existingVoter); err != nil {
-		return existingVoter, err
+	//JSONGet returns an "any" object, or empty interface,
+	//we need to convert it to a byte array, which is the
+	//underlying type of the object, then we can unmarshal
+	//it into our ToDoItem struct
+	raw, err := replyBytes(key, voterObject)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(raw, voter); err != nil {
+		return fmt.Errorf("%w: %w", ErrCorruptVoter, err)
 	}
 
-	return existingVoter, nil
+	return nil
+}
+
+// AddVoter stores a new voter.  When voter.VoterId is zero an id is
+// assigned from a counter kept in redis and written back into voter, so it
+// survives restarts and concurrent clients never pick the same id.  The
+// email is stored normalized, see NormalizeEmail, and written back into
+// voter.  An email that belongs to another voter is refused with
+// ErrEmailTaken.  The check and the write are separate steps, two clients
+// adding the same email at the same moment can both get through.
+func (v *VoterList) AddVoter(voter *Voter) error {
+	return v.addVoter(voter, 0)
+}
+
+// addVoter is AddVoter, a ttl above zero has redis remove the voter once it
+// has elapsed
+func (v *VoterList) addVoter(voter *Voter, ttl time.Duration) error {
+
+	voter.Email = NormalizeEmail(voter.Email)
+	if err := voter.Validate(); err != nil {
+		return err
+	}
+
+	owner, err := v.emailOwner(voter.Email)
+	if err != nil {
+		return err
+	}
+	//The voter itself owning the email means it exists, which is reported
+	//as ErrVoterExists below
+	if owner != 0 && owner != voter.VoterId {
+		return ErrEmailTaken
+	}
+
+	voter.Version = 1
+	voter.Deleted, voter.DeletedAt = false, time.Time{}
+	if voter.VoterId == 0 {
+		if err := v.addVoterWithNewId(voter, ttl); err != nil {
+			return err
+		}
+		if err := v.indexEmails(*voter); err != nil {
+			return err
+		}
+		return v.countVotes(votesOf(*voter))
+	}
+
+	//createVoter makes the existence check and the write a single atomic
+	//step, if the voter already exists nothing is written
+	added, err := v.createVoter(voter, ttl)
+	if err != nil {
+		return err
+	}
+	if !added {
+		return ErrVoterExists
+	}
+
+	if err := v.indexEmails(*voter); err != nil {
+		return err
+	}
+	return v.countVotes(votesOf(*voter))
+}
+
+// upsertRetries is how often UpsertVoter retries when the voter is deleted
+// or created by someone else between its two steps
+const upsertRetries = 3
+
+// UpsertVoter adds the voter if it does not exist yet and replaces it if it
+// does, so a client retrying an add does not get ErrVoterExists.  Like
+// UpdateVoter a nil VoteHistory keeps the stored history.  created reports
+// which of the two happened.
+func (v *VoterList) UpsertVoter(voter *Voter) (created bool, err error) {
+
+	voter.Email = NormalizeEmail(voter.Email)
+	if err := voter.Validate(); err != nil {
+		return false, err
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := v.AddVoter(voter)
+		if err == nil {
+			return true, nil
+		}
+		if !errors.Is(err, ErrVoterExists) {
+			return false, err
+		}
+
+		//An upsert always wins, there is no version to check against
+		voter.Version = 0
+		err = v.UpdateVoter(voter)
+		if errors.Is(err, ErrVoterNotFound) && attempt < upsertRetries {
+			//Deleted since AddVoter saw it, try adding it again
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		return false, nil
+	}
+}
+
+// AddVoterWithTTL stores a new voter that redis removes automatically once
+// ttl has elapsed.  The voter and its expiry are written together, a
+// voter is never stored without it.  A ttl of zero means the voter never
+// expires, exactly like AddVoter.
+func (v *VoterList) AddVoterWithTTL(voter *Voter, ttl time.Duration) error {
+	if ttl < 0 {
+		return errors.New("ttl must not be negative")
+	}
+
+	return v.addVoter(voter, ttl)
+}
+
+// BatchError describes why one voter of a batch was not added
+type BatchError struct {
+	Index   int
+	VoterId uint
+	Err     error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("voter %d (item %d): %v", e.VoterId, e.Index, e.Err)
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// AddVoters adds many voters using a single redis pipeline instead of a round
+// trip per voter.  Voters that fail validation or whose id is already taken
+// are skipped, each one is reported as a *BatchError in errs.  Like
+// AddVoter an email that belongs to another voter is refused with
+// ErrEmailTaken, and so is an email that an earlier voter of the batch
+// uses.  Voters with a zero VoterId are assigned ids from the same counter
+// AddVoter uses, the ids are written back into the slice.
+func (v *VoterList) AddVoters(voters []Voter) (added int, errs []error) {
+
+	var pending []int
+	var needIds []int
+	//claimed is the id each email of the batch went to so far, a repeat of
+	//the same id is left for the NX write to report as ErrVoterExists
+	claimed := make(map[string]uint, len(voters))
+	for i := range voters {
+		voters[i].Email = NormalizeEmail(voters[i].Email)
+		if err := voters[i].Validate(); err != nil {
+			errs = append(errs, &BatchError{Index: i, VoterId: voters[i].VoterId, Err: err})
+			continue
+		}
+		if id, ok := claimed[voters[i].Email]; ok && (id == 0 || id != voters[i].VoterId) {
+			errs = append(errs, &BatchError{Index: i, VoterId: voters[i].VoterId, Err: ErrEmailTaken})
+			continue
+		}
+		owner, err := v.emailOwner(voters[i].Email)
+		if err == nil && owner != 0 && owner != voters[i].VoterId {
+			err = ErrEmailTaken
+		}
+		if err != nil {
+			errs = append(errs, &BatchError{Index: i, VoterId: voters[i].VoterId, Err: err})
+			continue
+		}
+		claimed[voters[i].Email] = voters[i].VoterId
+		if voters[i].VoterId == 0 {
+			needIds = append(needIds, i)
+		}
+		pending = append(pending, i)
+	}
+
+	//Reserve a block of ids with one INCRBY rather than one INCR each
+	if len(needIds) > 0 {
+		last, err := v.cacheClient.IncrBy(v.context, v.idSeqKey(), int64(len(needIds))).Result()
+		if err != nil {
+			for _, i := range pending {
+				errs = append(errs, &BatchError{Index: i, VoterId: voters[i].VoterId, Err: err})
+			}
+			return 0, errs
+		}
+		first := last - int64(len(needIds)) + 1
+		for n, i := range needIds {
+			voters[i].VoterId = uint(first + int64(n))
+		}
+	}
+	autoId := make(map[int]bool, len(needIds))
+	for _, i := range needIds {
+		autoId[i] = true
+	}
+
+	cmds := make([]*redis.Cmd, len(pending))
+	_, err := v.cacheClient.Pipelined(v.context, func(pipe redis.Pipeliner) error {
+		for n, i := range pending {
+			voters[i].Version = 1
+			voters[i].Deleted, voters[i].DeletedAt = false, time.Time{}
+			voterJson, err := json.Marshal(voters[i])
+			if err != nil {
+				return err
+			}
+			redisKey := v.redisKeyFromId(int(voters[i].VoterId))
+			cmds[n] = pipe.Do(v.context, "JSON.SET", redisKey, ".", string(voterJson), "NX")
+		}
+		return nil
+	})
+	//A nil reply from an NX set that was skipped shows up as redis.Nil, that
+	//is handled per command below
+	if err != nil && !isRedisNilError(err) {
+		for _, i := range pending {
+			errs = append(errs, &BatchError{Index: i, VoterId: voters[i].VoterId, Err: err})
+		}
+		return 0, errs
+	}
+
+	var addedVoters []Voter
+	for n, i := range pending {
+		err := cmds[n].Err()
+		switch {
+		case err == nil:
+			added++
+			addedVoters = append(addedVoters, voters[i])
+		case isRedisNilError(err) && autoId[i]:
+			//The reserved id was already taken by a voter added with an
+			//explicit id, let the one at a time path pick another
+			if err := v.addVoterWithNewId(&voters[i], 0); err != nil {
+				errs = append(errs, &BatchError{Index: i, VoterId: voters[i].VoterId, Err: err})
+				continue
+			}
+			added++
+			addedVoters = append(addedVoters, voters[i])
+		case isRedisNilError(err):
+			errs = append(errs, &BatchError{Index: i, VoterId: voters[i].VoterId, Err: ErrVoterExists})
+		default:
+			errs = append(errs, &BatchError{Index: i, VoterId: voters[i].VoterId, Err: err})
+		}
+	}
+
+	//The voters are stored at this point, a failure here only means they
+	//can not be found by email yet
+	if err := v.indexEmails(addedVoters...); err != nil {
+		errs = append(errs, fmt.Errorf("updating email index: %w", err))
+	}
+	if err := v.countVotes(votesOf(addedVoters...)); err != nil {
+		errs = append(errs, fmt.Errorf("updating vote total: %w", err))
+	}
+
+	return added, errs
+}
+
+func (v *VoterList) addVoterWithNewId(voter *Voter, ttl time.Duration) error {
+	for {
+		id, err := v.cacheClient.Incr(v.context, v.idSeqKey()).Result()
+		if err != nil {
+			return err
+		}
+
+		//A client may have already used this id explicitly, in which case
+		//we just move on to the next one
+		voter.VoterId = uint(id)
+		added, err := v.createVoter(voter, ttl)
+		if err != nil {
+			voter.VoterId = 0
+			return err
+		}
+		if added {
+			return nil
+		}
+	}
+}
+
+// createVoter stores voter unless its id is taken, added is false when it
+// is.  With a ttl above zero the voter and its expiry are written in one
+// transaction, so it is never stored without the expiry.
+func (v *VoterList) createVoter(voter *Voter, ttl time.Duration) (added bool, err error) {
+	if ttl == 0 {
+		return v.setVoterIfAbsent(voter)
+	}
+
+	redisKey := v.redisKeyFromId(int(voter.VoterId))
+	voterJson, err := json.Marshal(voter)
+	if err != nil {
+		return false, err
+	}
+	//An EXPIRE queued next to a JSON.SET NX would also apply when NX skips
+	//the write, so the key is checked under WATCH instead
+	update := func(tx *redis.Tx) error {
+		exists, err := tx.Exists(v.context, redisKey).Result()
+		if err != nil || exists > 0 {
+			return err
+		}
+		_, err = tx.TxPipelined(v.context, func(pipe redis.Pipeliner) error {
+			pipe.Do(v.context, "JSON.SET", redisKey, ".", string(voterJson))
+			pipe.Expire(v.context, redisKey, ttl)
+			return nil
+		})
+		added = err == nil
+		return err
+	}
+	err = v.watch(true, update, redisKey)
+	return added, err
+}
+
+func (v *VoterList) setVoterIfAbsent(voter *Voter) (bool, error) {
+	redisKey := v.redisKeyFromId(int(voter.VoterId))
+	//Not retried, if the first attempt went through but its reply was lost
+	//a retry would find the voter and report it as already existing
+	res, err := v.jsonHelper.JSONSet(redisKey, ".", voter, rjs.SetOptionNX)
+	if err != nil {
+		return false, err
+	}
+
+	//JSONSet returns nil rather than "OK" when NX stopped the write
+	return res != nil, nil
+}
+
+func (v *VoterList) DeleteVoter(id int) error {
+
+	//The voter is read first to know which email to drop from the index
+	pattern := v.redisKeyFromId(int(id))
+	var voter Voter
+	if err := v.getItemFromRedis(pattern, &voter); err != nil {
+		return err
+	}
+
+	numDeleted, err := v.cacheClient.Del(v.context, pattern).Result()
+	if err != nil {
+		return err
+	}
+	if numDeleted == 0 {
+		return ErrVoterNotFound
+	}
+
+	if voter.Deleted {
+		if err := v.cacheClient.SRem(v.context, v.deletedKey(), voter.VoterId).Err(); err != nil {
+			return err
+		}
+	}
+	if err := v.countVotes(-votesOf(voter)); err != nil {
+		return err
+	}
+	return v.unindexEmail(voter.Email, voter.VoterId)
+}
+
+// DeleteVoters removes the voters with the given ids in a single UNLINK and
+// returns how many of them actually existed, ids without a voter are skipped
+func (v *VoterList) DeleteVoters(ids []int) (deleted int, err error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = v.redisKeyFromId(id)
+	}
+
+	//The voters are read first to know which emails to drop from the index
+	voters, err := v.IncludeDeleted().getVotersFromKeys(keys)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := v.cacheClient.Unlink(v.context, keys...).Result()
+	if err != nil {
+		return 0, err
+	}
+	if err := v.countVotes(-votesOf(voters...)); err != nil {
+		return int(n), err
+	}
+
+	for _, voter := range voters {
+		if voter.Deleted {
+			if err := v.cacheClient.SRem(v.context, v.deletedKey(), voter.VoterId).Err(); err != nil {
+				return int(n), err
+			}
+		}
+		if err := v.unindexEmail(voter.Email, voter.VoterId); err != nil {
+			return int(n), err
+		}
+	}
+	return int(n), nil
+}
+
+// DeleteAll removes every voter.  Keys are found with SCAN and removed in
+// batches with UNLINK, which frees the memory in the background, so neither
+// step blocks redis when there are a lot of voters.
+func (v *VoterList) DeleteAll() error {
+
+	//Soft deleted voters go too
+	ks, err := v.IncludeDeleted().voterKeys()
+	if err != nil {
+		return err
+	}
+
+	//A key that is gone by the time it is unlinked, because it expired or
+	//someone deleted it meanwhile, is simply not counted by UNLINK
+	for start := 0; start < len(ks); start += v.scanBatchSize {
+		end := min(start+v.scanBatchSize, len(ks))
+		if err := v.cacheClient.Unlink(v.context, ks[start:end]...).Err(); err != nil {
+			return err
+		}
+	}
+
+	//Cleared even with no voters left, they may have expired without
+	//taking their entries along
+	return v.cacheClient.Unlink(v.context, v.emailIndexKey(), v.deletedKey(), v.votesTotalKey()).Err()
+}
+
+// txRetries is how many more times a WATCH transaction is tried when the
+// watched keys change before it commits and the caller gave no version
+const txRetries = 3
+
+// watch runs update under WATCH of keys.  When one of them is written
+// before EXEC and retry is set, update runs again with fresh reads, up to
+// txRetries more times.  A transaction that is not retried, or still fails
+// after that, returns ErrVersionConflict.
+func (v *VoterList) watch(retry bool, update func(tx *redis.Tx) error, keys ...string) error {
+	for attempt := 0; ; attempt++ {
+		err := v.cacheClient.Watch(v.context, update, keys...)
+		if !errors.Is(err, redis.TxFailedErr) {
+			return err
+		}
+		if !retry || attempt >= txRetries {
+			return ErrVersionConflict
+		}
+	}
+}
+
+// UpdateVoter replaces a voter.  When voter.Version is set it has to match
+// the stored version, otherwise the voter was changed since the caller read
+// it and ErrVersionConflict is returned instead of overwriting that change.
+// A zero Version skips the check for clients that do not track versions.
+// A nil VoteHistory keeps the stored history, only a non-nil one, even an
+// empty one, replaces it.  The email is normalized like AddVoter's,
+// changing it to one that belongs to another voter returns ErrEmailTaken.
+// On success voter holds what was stored, including the new version.
+func (v *VoterList) UpdateVoter(voter *Voter) error {
+
+	voter.Email = NormalizeEmail(voter.Email)
+	if err := voter.Validate(); err != nil {
+		return err
+	}
+
+	redisKey := v.redisKeyFromId(int(voter.VoterId))
+
+	//WATCH makes the EXEC fail if the key is written between our read and
+	//our write, so the version check and the update happen as one step
+	update := func(tx *redis.Tx) error {
+		//Like GetVoter a soft deleted voter is not found
+		existingVoter, err := v.getVoterInTx(tx, redisKey)
+		if err != nil {
+			return err
+		}
+		if voter.Version != 0 && voter.Version != existingVoter.Version {
+			return ErrVersionConflict
+		}
+
+		updated := *voter
+		updated.Version = existingVoter.Version + 1
+		updated.Deleted, updated.DeletedAt = existingVoter.Deleted, existingVoter.DeletedAt
+		if updated.VoteHistory == nil {
+			updated.VoteHistory = existingVoter.VoteHistory
+		}
+		voterJson, err := json.Marshal(updated)
+		if err != nil {
+			return err
+		}
+
+		//When the email changes the old entry is dropped from the index,
+		//unless it has since been taken over by another voter.  Keeping the
+		//same email is always fine, taking another voter's is not.
+		oldField := NormalizeEmail(existingVoter.Email)
+		newField := NormalizeEmail(updated.Email)
+		dropOld := false
+		if oldField != newField {
+			owner, err := v.emailOwner(updated.Email)
+			if err != nil {
+				return err
+			}
+			if owner != 0 && owner != updated.VoterId {
+				return ErrEmailTaken
+			}
+
+			indexed, err := tx.HGet(v.context, v.emailIndexKey(), oldField).Result()
+			if err != nil && !isRedisNilError(err) {
+				return err
+			}
+			dropOld = indexed == strconv.Itoa(int(updated.VoterId))
+		}
+
+		_, err = tx.TxPipelined(v.context, func(pipe redis.Pipeliner) error {
+			pipe.Do(v.context, "JSON.SET", redisKey, ".", string(voterJson))
+			if dropOld {
+				pipe.HDel(v.context, v.emailIndexKey(), oldField)
+			}
+			pipe.HSet(v.context, v.emailIndexKey(), newField, updated.VoterId)
+			if delta := votesOf(updated) - votesOf(existingVoter); delta != 0 {
+				pipe.IncrBy(v.context, v.votesTotalKey(), int64(delta))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		voter.Version = updated.Version
+		voter.VoteHistory = updated.VoteHistory
+		voter.Deleted, voter.DeletedAt = updated.Deleted, updated.DeletedAt
+		return nil
+	}
+
+	//Only the voter is watched, every add writes to the email index and
+	//watching it would turn unrelated adds into conflicts.  Without a
+	//version the caller asked for no check, so a write that slipped in is
+	//simply read again.
+	return v.watch(voter.Version == 0, update, redisKey)
+}
+
+// VoterPatch holds the fields of a partial update, a nil field is left as
+// it is.  Version works as it does for UpdateVoter.
+type VoterPatch struct {
+	Name    *string `json:"Name"`
+	Email   *string `json:"Email"`
+	Version uint    `json:"Version"`
+}
+
+// patchRetries is how often PatchVoter retries when the voter keeps
+// changing under it
+const patchRetries = 3
+
+// PatchVoter changes only the fields set in patch and keeps the rest of the
+// voter, including its vote history, as it is.  It returns the voter as it
+// was stored.
+func (v *VoterList) PatchVoter(id int, patch VoterPatch) (Voter, error) {
+
+	for attempt := 0; ; attempt++ {
+		voter, err := v.GetVoter(id)
+		if err != nil {
+			return Voter{}, err
+		}
+		if patch.Version != 0 && patch.Version != voter.Version {
+			return Voter{}, ErrVersionConflict
+		}
+
+		if patch.Name != nil {
+			voter.Name = *patch.Name
+		}
+		if patch.Email != nil {
+			voter.Email = *patch.Email
+		}
+
+		//UpdateVoter checks the version we read, so a write that slipped in
+		//between is not lost.  Without a version from the caller we simply
+		//read the voter again and reapply the patch.
+		err = v.UpdateVoter(&voter)
+		if errors.Is(err, ErrVersionConflict) && patch.Version == 0 && attempt < patchRetries {
+			continue
+		}
+		if err != nil {
+			return Voter{}, err
+		}
+		return voter, nil
+	}
+}
+
+// GetVoter returns the voter with the given id, a soft deleted voter is
+// reported as ErrVoterNotFound unless the list was made with IncludeDeleted
+func (v *VoterList) GetVoter(id int) (Voter, error) {
+
+	var voter Voter
+	pattern := v.redisKeyFromId(int(id))
+	err := v.getItemFromRedis(pattern, &voter)
+	if err != nil {
+		return Voter{}, err
+	}
+	if voter.Deleted && !v.includeDeleted {
+		return Voter{}, ErrVoterNotFound
+	}
+
+	return voter, nil
+}
+
+// SoftDeleteVoter marks the voter as deleted rather than removing it, it
+// keeps its history and email but is left out of lookups and lists until
+// RestoreVoter is called.  Deleting a voter that is already soft deleted
+// reports ErrVoterNotFound, like a hard delete would.
+func (v *VoterList) SoftDeleteVoter(id int) error {
+	return v.setDeleted(id, true)
+}
+
+// RestoreVoter undoes SoftDeleteVoter, restoring a voter that is not
+// deleted is not an error
+func (v *VoterList) RestoreVoter(id int) error {
+	return v.setDeleted(id, false)
+}
+
+// setDeleted changes the deleted flag of the voter and the set of deleted
+// ids together, under WATCH like UpdateVoter so no other write to the voter
+// is lost
+func (v *VoterList) setDeleted(id int, deleted bool) error {
+	redisKey := v.redisKeyFromId(id)
+
+	update := func(tx *redis.Tx) error {
+		voter, err := v.IncludeDeleted().getVoterInTx(tx, redisKey)
+		if err != nil {
+			return err
+		}
+		if voter.Deleted == deleted {
+			if deleted {
+				return ErrVoterNotFound
+			}
+			return nil
+		}
+
+		voter.Version++
+		voter.Deleted, voter.DeletedAt = deleted, time.Time{}
+		if deleted {
+			voter.DeletedAt = time.Now().UTC()
+		}
+		voterJson, err := json.Marshal(voter)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(v.context, func(pipe redis.Pipeliner) error {
+			pipe.Do(v.context, "JSON.SET", redisKey, ".", string(voterJson))
+			//A soft deleted voter's votes are not counted, like in
+			//CountTotalVotes
+			if deleted {
+				pipe.SAdd(v.context, v.deletedKey(), voter.VoterId)
+				pipe.DecrBy(v.context, v.votesTotalKey(), int64(len(voter.VoteHistory)))
+			} else {
+				pipe.SRem(v.context, v.deletedKey(), voter.VoterId)
+				pipe.IncrBy(v.context, v.votesTotalKey(), int64(len(voter.VoteHistory)))
+			}
+			return nil
+		})
+		return err
+	}
+
+	return v.watch(true, update, redisKey)
+}
+
+// emailOwner returns the id of the voter using email, soft deleted voters
+// included, or 0 when there is none.  The email index answers when there is
+// one, without it every voter is read.
+func (v *VoterList) emailOwner(email string) (uint, error) {
+	indexed, err := v.cacheClient.Exists(v.context, v.emailIndexKey()).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	all := v.IncludeDeleted()
+	if indexed > 0 {
+		voter, err := all.GetVoterByEmail(email)
+		if errors.Is(err, ErrVoterNotFound) {
+			return 0, nil
+		}
+		return voter.VoterId, err
+	}
+
+	field := NormalizeEmail(email)
+	var owner uint
+	errFound := errors.New("found")
+	err = all.EachVoter(func(voter Voter) error {
+		if NormalizeEmail(voter.Email) == field {
+			owner = voter.VoterId
+			return errFound
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errFound) {
+		return 0, err
+	}
+	return owner, nil
+}
+
+// GetVoterByEmail looks the voter up through the email index rather than
+// scanning every voter, emails are matched once normalized so case and
+// surrounding spaces do not matter
+func (v *VoterList) GetVoterByEmail(email string) (Voter, error) {
+	field := NormalizeEmail(email)
+	idStr, err := v.cacheClient.HGet(v.context, v.emailIndexKey(), field).Result()
+	if err != nil {
+		if isRedisNilError(err) {
+			return Voter{}, ErrVoterNotFound
+		}
+		return Voter{}, err
+	}
+
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return Voter{}, fmt.Errorf("corrupt email index entry %q: %w", idStr, err)
+	}
+
+	//A voter that expired leaves its entry behind, so check the entry is
+	//still right and tidy it up if it is not.  A soft deleted voter keeps
+	//its entry so it is found again once restored.
+	voter, err := v.IncludeDeleted().GetVoter(id)
+	if err == nil && NormalizeEmail(voter.Email) == field {
+		if voter.Deleted && !v.includeDeleted {
+			return Voter{}, ErrVoterNotFound
+		}
+		return voter, nil
+	}
+	if err != nil && !errors.Is(err, ErrVoterNotFound) {
+		return Voter{}, err
+	}
+	if err := v.unindexEmail(email, uint(id)); err != nil {
+		return Voter{}, err
+	}
+	return Voter{}, ErrVoterNotFound
+}
+
+func (v *VoterList) GetAllVoters() ([]Voter, error) {
+
+	ks, err := v.voterKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	return v.getVotersFromKeys(ks)
+}
+
+// GetInactiveVoters returns the voters, in id order, who have not voted in
+// any poll, whether their history is missing or an empty list
+func (v *VoterList) GetInactiveVoters() ([]Voter, error) {
+	inactive := make([]Voter, 0)
+	err := v.EachVoter(func(voter Voter) error {
+		if len(voter.VoteHistory) == 0 {
+			inactive = append(inactive, voter)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return inactive, nil
+}
+
+// CountTotalVotes returns the number of votes cast by all voters together
+func (v *VoterList) CountTotalVotes() (int, error) {
+	total := 0
+	err := v.EachVoter(func(voter Voter) error {
+		total += len(voter.VoteHistory)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
+// GetVoteTotal returns the running total of votes, which every write keeps
+// up to date, so unlike CountTotalVotes it is a single read however many
+// voters there are.  Voters that expire and writes that fail half way are
+// not accounted for, ReconcileVoteTotal puts the total right again.
+func (v *VoterList) GetVoteTotal() (int, error) {
+	var total int
+	err := v.withRetry(func() (err error) {
+		total, err = v.cacheClient.Get(v.context, v.votesTotalKey()).Int()
+		return err
+	})
+	if isRedisNilError(err) {
+		return 0, nil
+	}
+	return total, err
+}
+
+// ReconcileVoteTotal recounts the votes with CountTotalVotes and stores the
+// result as the running total, which it returns.  Votes cast while the
+// voters are being counted may be missed until the next reconcile.
+func (v *VoterList) ReconcileVoteTotal() (int, error) {
+	total, err := v.CountTotalVotes()
+	if err != nil {
+		return 0, err
+	}
+	if err := v.cacheClient.Set(v.context, v.votesTotalKey(), total, 0).Err(); err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
+// SortField names what a list of voters can be ordered by
+type SortField string
+
+const (
+	SortById    SortField = "id"
+	SortByName  SortField = "name"
+	SortByPolls SortField = "polls"
+)
+
+// ErrInvalidSort is returned when asked to sort by an unknown field
+var ErrInvalidSort = errors.New("voters can only be sorted by id, name or polls")
+
+// GetAllVotersSorted returns every voter ordered by the given field, desc
+// reverses the order.  Voters that tie are always ordered by ascending id so
+// the result is the same on every call.
+func (v *VoterList) GetAllVotersSorted(by SortField, desc bool) ([]Voter, error) {
+	voterList, err := v.GetAllVoters()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := sortVoters(voterList, by, desc); err != nil {
+		return nil, err
+	}
+	return voterList, nil
+}
+
+func sortVoters(voterList []Voter, by SortField, desc bool) error {
+	var cmp func(a, b *Voter) int
+	switch by {
+	case SortById:
+		cmp = func(a, b *Voter) int { return 0 }
+	case SortByName:
+		cmp = func(a, b *Voter) int { return strings.Compare(a.Name, b.Name) }
+	case SortByPolls:
+		cmp = func(a, b *Voter) int { return len(a.VoteHistory) - len(b.VoteHistory) }
+	default:
+		return ErrInvalidSort
+	}
+
+	sort.SliceStable(voterList, func(i, j int) bool {
+		a, b := &voterList[i], &voterList[j]
+		if c := cmp(a, b); c != 0 {
+			return (c < 0) != desc
+		}
+		//Ties fall back to the id, which is reversed too when sorting by id
+		if by == SortById && desc {
+			return a.VoterId > b.VoterId
+		}
+		return a.VoterId < b.VoterId
+	})
+	return nil
+}
+
+// EachVoter calls fn for every voter in id order, loading them one at a time
+// so the whole list is never held in memory.  It stops at the first error
+// from fn and returns it.
+func (v *VoterList) EachVoter(fn func(Voter) error) error {
+	ks, err := v.voterKeys()
+	if err != nil {
+		return err
+	}
+
+	for _, key := range ks {
+		var voter Voter
+		err := v.getItemFromRedis(key, &voter)
+		if errors.Is(err, ErrVoterNotFound) || voter.Deleted && !v.includeDeleted {
+			//Deleted or expired since the keys were listed
+			continue
+		}
+		if v.skipCorrupt(key, err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(voter); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CountVoters returns the number of voters, it only counts keys and never
+// loads the voters themselves
+func (v *VoterList) CountVoters() (int, error) {
+	ks, err := v.voterKeys()
+	if err != nil {
+		return 0, err
+	}
+	return len(ks), nil
+}
+
+// GetVoterIds returns the ids of every voter in ascending order, like
+// CountVoters it only looks at the keys
+func (v *VoterList) GetVoterIds() ([]uint, error) {
+	ks, err := v.voterKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]uint, len(ks))
+	for i, key := range ks {
+		ids[i] = uint(v.idFromRedisKey(key))
+	}
+	return ids, nil
+}
+
+// GetVotersPaged returns at most limit voters starting at offset, ordered
+// by voter id so pages are stable between calls.  It also returns the total
+// number of voters so callers can work out how many pages there are.  Only
+// the voters on the requested page are loaded from redis.
+func (v *VoterList) GetVotersPaged(offset, limit int) ([]Voter, int, error) {
+	return v.GetVotersPagedSorted(offset, limit, SortById, false)
+}
+
+// GetVotersPagedSorted is GetVotersPaged with the order of
+// GetAllVotersSorted.  Sorting by id only loads the requested page, the
+// other fields need every voter loaded to know which ones are on the page.
+func (v *VoterList) GetVotersPagedSorted(offset, limit int, by SortField, desc bool) ([]Voter, int, error) {
+	if offset < 0 || limit < 0 {
+		return nil, 0, errors.New("offset and limit must not be negative")
+	}
+
+	if by != SortById {
+		voterList, err := v.GetAllVotersSorted(by, desc)
+		if err != nil {
+			return nil, 0, err
+		}
+		start, end := pageBounds(len(voterList), offset, limit)
+		return voterList[start:end], len(voterList), nil
+	}
+
+	ks, err := v.voterKeys()
+	if err != nil {
+		return nil, 0, err
+	}
+	if desc {
+		slices.Reverse(ks)
+	}
+
+	total := len(ks)
+	start, end := pageBounds(total, offset, limit)
+	voterList, err := v.getVotersFromKeys(ks[start:end])
+	if err != nil {
+		return nil, 0, err
+	}
+	return voterList, total, nil
+}
+
+// pageBounds clamps a page to the slice indexes of a list of total items, a
+// limit of zero means the rest of the list
+func pageBounds(total, offset, limit int) (int, int) {
+	if offset >= total {
+		return total, total
+	}
+	end := offset + limit
+	if limit == 0 || end > total {
+		end = total
+	}
+	return offset, end
+}
+
+// voterKeys walks the keyspace with SCAN rather than KEYS so a large number
+// of voters does not block redis, the keys are returned ordered by voter id.
+// Soft deleted voters are left out unless the list was made with
+// IncludeDeleted.
+func (v *VoterList) voterKeys() ([]string, error) {
+	//Voter keys end in a number, this keeps keys like the id counter that
+	//share the prefix out of the results
+	pattern := v.keyPrefix + "[0-9]*"
+
+	//SCAN may return a key more than once, so we dedupe as we go
+	seen := make(map[string]bool)
+	var ks []string
+
+	iter := v.cacheClient.Scan(v.context, 0, pattern, int64(v.scanBatchSize)).Iterator()
+	for iter.Next(v.context) {
+		key := iter.Val()
+		//The pattern also matches keys of a longer prefix such as
+		//voter:2b:7, those belong to another namespace
+		if v.idFromRedisKey(key) < 0 {
+			continue
+		}
+		if !seen[key] {
+			seen[key] = true
+			ks = append(ks, key)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(ks, func(i, j int) bool {
+		return v.idFromRedisKey(ks[i]) < v.idFromRedisKey(ks[j])
+	})
+	if v.includeDeleted {
+		return ks, nil
+	}
+	return v.withoutDeleted(ks)
+}
+
+// withoutDeleted drops the keys of soft deleted voters, using the set of
+// their ids so none of the voters has to be loaded
+func (v *VoterList) withoutDeleted(ks []string) ([]string, error) {
+	members, err := v.cacheClient.SMembers(v.context, v.deletedKey()).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(members) == 0 {
+		return ks, nil
+	}
+
+	deleted := make(map[string]bool, len(members))
+	for _, id := range members {
+		deleted[v.keyPrefix+id] = true
+	}
+	return slices.DeleteFunc(ks, func(key string) bool { return deleted[key] }), nil
+}
+
+// GetVotersByIds loads the voters with the given ids in one pipelined round
+// trip rather than one per voter, in the order the ids are given.  Ids with
+// no voter, or a soft deleted one, are left out and an id asked for twice
+// is only returned once.
+func (v *VoterList) GetVotersByIds(ids []int) ([]Voter, error) {
+	keys := make([]string, 0, len(ids))
+	seen := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			keys = append(keys, v.redisKeyFromId(id))
+		}
+	}
+
+	voterList := make([]Voter, 0, len(keys))
+	if len(keys) == 0 {
+		return voterList, nil
+	}
+
+	cmds := make([]*redis.Cmd, len(keys))
+	err := v.withRetry(func() error {
+		_, err := v.cacheClient.Pipelined(v.context, func(pipe redis.Pipeliner) error {
+			for i, key := range keys {
+				cmds[i] = pipe.Do(v.context, "JSON.GET", key, ".")
+			}
+			return nil
+		})
+		//A missing voter shows up as redis.Nil and a key that is not a voter
+		//as an error reply, both are handled per command below
+		var replyErr redis.Error
+		if isRedisNilError(err) || errors.As(err, &replyErr) {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i, cmd := range cmds {
+		raw, err := cmd.Text()
+		if isRedisNilError(err) {
+			continue
+		}
+		err = wrongTypeAsCorrupt(err)
+		var voter Voter
+		if err == nil {
+			if jsonErr := json.Unmarshal([]byte(raw), &voter); jsonErr != nil {
+				err = fmt.Errorf("%w: %w", ErrCorruptVoter, jsonErr)
+			}
+		}
+		if v.skipCorrupt(keys[i], err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if voter.Deleted && !v.includeDeleted {
+			continue
+		}
+		voterList = append(voterList, voter)
+	}
+	return voterList, nil
+}
+
+func (v *VoterList) getVotersFromKeys(ks []string) ([]Voter, error) {
+	voterList := make([]Voter, 0, len(ks))
+	for _, key := range ks {
+		var voter Voter
+		err := v.getItemFromRedis(key, &voter)
+		if errors.Is(err, ErrVoterNotFound) || voter.Deleted && !v.includeDeleted {
+			//Deleted or expired since the keys were listed
+			continue
+		}
+		if v.skipCorrupt(key, err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		voterList = append(voterList, voter)
+	}
+
+	return voterList, nil
+}
+
+func (v *VoterList) PrintItem(voter Voter) {
+	jsonBytes, _ := json.MarshalIndent(voter, "", "  ")
+	fmt.Println(string(jsonBytes))
+}
+
+func (v *VoterList) PrintAllItems(voterList []Voter) {
+	for _, voter := range voterList {
+		v.PrintItem(voter)
+	}
+}
+
+func (v *VoterList) JsonToItem(jsonString string) (Voter, error) {
+	var voter Voter
+	err := json.Unmarshal([]byte(jsonString), &voter)
+	if err != nil {
+		return Voter{}, err
+	}
+
+	return voter, nil
+}
+
+func (v *VoterList) GetVoteHistory(id int) ([]VoterHistory, error) {
+	return v.getVoteHistory(v.redisKeyFromId(id))
+}
+
+// GetVoteCount returns how many polls the voter has voted in.  Redis
+// measures the VoteHistory array itself, so the voter is never fetched,
+// whether it is soft deleted is looked up in the set of deleted ids.
+func (v *VoterList) GetVoteCount(voterId int) (int, error) {
+
+	redisKey := v.redisKeyFromId(voterId)
+	if !v.includeDeleted {
+		deleted, err := v.cacheClient.SIsMember(v.context, v.deletedKey(), voterId).Result()
+		if err != nil {
+			return 0, err
+		}
+		if deleted {
+			return 0, ErrVoterNotFound
+		}
+	}
+
+	var res any
+	err := v.withRetry(func() (err error) {
+		res, err = v.jsonHelper.JSONArrLen(redisKey, ".VoteHistory")
+		return err
+	})
+	if isRedisNilError(err) {
+		return 0, ErrVoterNotFound
+	}
+	if err != nil {
+		//A voter that never had any history is stored with a null
+		//VoteHistory rather than an empty array, which ARRLEN refuses
+		if t, typeErr := v.jsonHelper.JSONType(redisKey, ".VoteHistory"); typeErr == nil && t == "null" {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	n, ok := res.(int64)
+	if !ok {
+		return 0, fmt.Errorf("unexpected JSON.ARRLEN reply %T", res)
+	}
+	return int(n), nil
+}
+
+// GetVoteHistoryInRange returns the votes cast between from and to, both
+// ends included.  A zero from or to leaves that end of the range open.
+func (v *VoterList) GetVoteHistoryInRange(voterId int, from, to time.Time) ([]VoterHistory, error) {
+
+	history, err := v.GetVoteHistory(voterId)
+	if err != nil {
+		return nil, err
+	}
+
+	inRange := make([]VoterHistory, 0, len(history))
+	for _, vote := range history {
+		if !from.IsZero() && vote.VoteDate.Before(from) {
+			continue
+		}
+		if !to.IsZero() && vote.VoteDate.After(to) {
+			continue
+		}
+		inRange = append(inRange, vote)
+	}
+	return inRange, nil
+}
+
+// GetVoteHistorySince returns the votes cast strictly after since, so a
+// client that has seen every vote up to since only gets the new ones
+func (v *VoterList) GetVoteHistorySince(voterId int, since time.Time) ([]VoterHistory, error) {
+
+	history, err := v.GetVoteHistory(voterId)
+	if err != nil {
+		return nil, err
+	}
+
+	newer := make([]VoterHistory, 0, len(history))
+	for _, vote := range history {
+		if vote.VoteDate.After(since) {
+			newer = append(newer, vote)
+		}
+	}
+	return newer, nil
+}
+
+// GetVoteHistoryPaged returns up to limit votes of the voter starting at
+// offset, in the order they were recorded, along with how many votes it
+// has in all.  A limit of zero means the rest of the history, an offset
+// past the end gives an empty page.
+func (v *VoterList) GetVoteHistoryPaged(voterId, offset, limit int) ([]VoterHistory, int, error) {
+	return v.GetVoteHistoryPagedSorted(voterId, offset, limit, "", false)
+}
+
+// GetVoteHistoryPagedSorted is GetVoteHistoryPaged with the history ordered
+// like SortVoteHistory orders it before it is paged
+func (v *VoterList) GetVoteHistoryPagedSorted(voterId, offset, limit int, by HistorySortField, desc bool) ([]VoterHistory, int, error) {
+	if offset < 0 || limit < 0 {
+		return nil, 0, errors.New("offset and limit must not be negative")
+	}
+
+	history, err := v.GetVoteHistorySorted(voterId, by, desc)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	start, end := pageBounds(len(history), offset, limit)
+	return append([]VoterHistory{}, history[start:end]...), len(history), nil
+}
+
+// HistorySortField names what a vote history can be ordered by
+type HistorySortField string
+
+const (
+	SortVotesByDate HistorySortField = "date"
+	SortVotesByPoll HistorySortField = "poll"
+)
+
+// ErrInvalidHistorySort is returned when asked to sort votes by an unknown
+// field
+var ErrInvalidHistorySort = errors.New("votes can only be sorted by date or poll")
+
+// GetVoteHistorySorted returns the votes of the voter ordered like
+// SortVoteHistory orders them
+func (v *VoterList) GetVoteHistorySorted(voterId int, by HistorySortField, desc bool) ([]VoterHistory, error) {
+	history, err := v.GetVoteHistory(voterId)
+	if err != nil {
+		return nil, err
+	}
+	if err := SortVoteHistory(history, by, desc); err != nil {
+		return nil, err
+	}
+	return history, nil
+}
+
+// SortVoteHistory orders history by VoteDate or PollId, desc reverses the
+// order.  Votes cast at the same time are always ordered by ascending poll
+// id.  An empty by leaves the votes in the order they were recorded.
+func SortVoteHistory(history []VoterHistory, by HistorySortField, desc bool) error {
+	var cmp func(a, b *VoterHistory) int
+	switch by {
+	case "":
+		return nil
+	case SortVotesByDate:
+		cmp = func(a, b *VoterHistory) int { return a.VoteDate.Compare(b.VoteDate) }
+	case SortVotesByPoll:
+		cmp = func(a, b *VoterHistory) int { return 0 }
+	default:
+		return ErrInvalidHistorySort
+	}
+
+	sort.SliceStable(history, func(i, j int) bool {
+		a, b := &history[i], &history[j]
+		if c := cmp(a, b); c != 0 {
+			return (c < 0) != desc
+		}
+		//Ties fall back to the poll id, which is reversed too when sorting
+		//by poll
+		if by == SortVotesByPoll && desc {
+			return a.PollId > b.PollId
+		}
+		return a.PollId < b.PollId
+	})
+	return nil
+}
+
+func (v *VoterList) GetSingleVoteHistory(voterId int, pollId uint) (*VoterHistory, error) {
+
+	history, err := v.GetVoteHistory(voterId)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range history {
+		if history[i].PollId == pollId {
+			//Hand back a copy of its own rather than a pointer into the history
+			match := history[i]
+			return &match, nil
+		}
+	}
+
+	return nil, ErrPollNotFound
+}
+
+// GetMissingPolls returns the polls in active that the voter has not voted
+// in yet, in the order they appear in active.  An empty active list gives an
+// empty result, but the voter still has to exist.
+func (v *VoterList) GetMissingPolls(voterId int, active []uint) ([]uint, error) {
+
+	history, err := v.GetVoteHistory(voterId)
+	if err != nil {
+		return nil, err
+	}
+
+	voted := make(map[uint]bool, len(history))
+	for _, vote := range history {
+		voted[vote.PollId] = true
+	}
+
+	missing := make([]uint, 0, len(active))
+	for _, pollId := range active {
+		if !voted[pollId] {
+			missing = append(missing, pollId)
+			//A poll listed twice is only reported once
+			voted[pollId] = true
+		}
+	}
+	return missing, nil
+}
+
+// AddPoll records a vote for the voter and returns the resulting vote
+// history.  A voter can only vote once per poll, a second vote for the same
+// PollId returns ErrDuplicatePoll unless opts.Overwrite is set, in which
+// case the earlier vote is replaced.  A vote without a VoteDate is stamped
+// with the current time in UTC.
+//
+// The new vote is appended by redis itself, so the rest of the voter is
+// never rewritten.  The voter is read under WATCH and the append only
+// commits if it was not written meanwhile, otherwise the checks run again,
+// so two clients voting in the same poll for the same voter at the same
+// moment can not both get through.
+//
+// Once there is a poll registry, see OpenPoll, votes in polls that are not
+// open are refused with ErrPollClosed, whether or not they replace an
+// earlier vote.  A vote that is under way when its poll closes may still be
+// recorded.  A vote failing VoterHistory.Validate is refused with a
+// *ValidationError.
+//
+// A new vote for a voter that has the maximum number of votes, see
+// SetMaxVoteHistory, is refused with ErrVoteHistoryFull or makes room by
+// evicting the voter's oldest votes, depending on the policy.  Replacing a
+// vote is always allowed.
+func (v *VoterList) AddPoll(voterId int, poll VoterHistory, opts PollOptions) ([]VoterHistory, error) {
+	history, _, err := v.addPoll(voterId, poll, opts)
+	return history, err
+}
+
+// UpsertPoll replaces the voter's vote for poll.PollId when there is one and
+// adds it otherwise, so sending the same vote twice leaves a single vote.
+// created reports which of the two happened.
+func (v *VoterList) UpsertPoll(voterId int, poll VoterHistory) (created bool, err error) {
+	_, created, err = v.addPoll(voterId, poll, PollOptions{Overwrite: true})
+	return created, err
+}
+
+// addPoll is AddPoll, created is false when an earlier vote was replaced
+func (v *VoterList) addPoll(voterId int, poll VoterHistory, opts PollOptions) (history []VoterHistory, created bool, err error) {
+	if err := poll.Validate(); err != nil {
+		return nil, false, err
+	}
+
+	open, err := v.PollOpen(poll.PollId)
+	if err != nil {
+		return nil, false, err
+	}
+	if !open {
+		return nil, false, ErrPollClosed
+	}
+
+	if opts.ServerTime || poll.VoteDate.IsZero() {
+		poll.VoteDate = time.Now()
+	}
+	//Whatever offset the client sent, the same instant is stored in UTC
+	poll.VoteDate = poll.VoteDate.UTC()
+
+	redisKey := v.redisKeyFromId(voterId)
+	err = v.writeHistory(redisKey, func(voter Voter) ([]any, int, error) {
+		history, created = voter.VoteHistory, false
+		for i := range history {
+			if history[i].PollId != poll.PollId {
+				continue
+			}
+			if !opts.Overwrite {
+				return nil, 0, ErrDuplicatePoll
+			}
+			history[i].VoteId = poll.VoteId
+			history[i].VoteDate = poll.VoteDate
+			if opts.Sorted {
+				//The new date may move the vote, the history is small so it
+				//is simply written back in order
+				sort.SliceStable(history, func(a, b int) bool {
+					return history[a].VoteDate.Before(history[b].VoteDate)
+				})
+				historyJson, err := json.Marshal(history)
+				if err != nil {
+					return nil, 0, err
+				}
+				return []any{"JSON.SET", redisKey, ".VoteHistory", string(historyJson)}, 0, nil
+			}
+			voteJson, err := json.Marshal(history[i])
+			if err != nil {
+				return nil, 0, err
+			}
+			return []any{"JSON.SET", redisKey, fmt.Sprintf(".VoteHistory[%d]", i), string(voteJson)}, 0, nil
+		}
+
+		voteJson, err := json.Marshal(poll)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		//Only a new vote grows the history, so the cap is checked here.
+		//With EvictOldestVote the oldest votes make room and the history is
+		//written back whole.
+		evicted := 0
+		if v.maxVoteHistory > 0 && len(history) >= v.maxVoteHistory {
+			if v.historyPolicy != EvictOldestVote {
+				return nil, 0, ErrVoteHistoryFull
+			}
+			evicted = len(history) - v.maxVoteHistory + 1
+			history = evictOldest(history, evicted)
+		}
+
+		at := len(history)
+		if opts.Sorted {
+			at = sort.Search(len(history), func(i int) bool {
+				return history[i].VoteDate.After(poll.VoteDate)
+			})
+		}
+		wasNull := history == nil
+		history, created = slices.Insert(slices.Clip(history), at, poll), true
+		switch {
+		case evicted > 0:
+			historyJson, err := json.Marshal(history)
+			if err != nil {
+				return nil, 0, err
+			}
+			return []any{"JSON.SET", redisKey, ".VoteHistory", string(historyJson)}, 1 - evicted, nil
+		case wasNull:
+			//A voter without any votes has a null history, which can not be
+			//appended to
+			return []any{"JSON.SET", redisKey, ".VoteHistory", "[" + string(voteJson) + "]"}, 1, nil
+		case at < len(history)-1:
+			return []any{"JSON.ARRINSERT", redisKey, ".VoteHistory", at, string(voteJson)}, 1, nil
+		default:
+			return []any{"JSON.ARRAPPEND", redisKey, ".VoteHistory", string(voteJson)}, 1, nil
+		}
+	})
+	if err != nil {
+		return history, false, err
+	}
+	if !created {
+		return history, false, nil
+	}
+
+	vote := VoteEvent{VoterId: uint(voterId), PollId: poll.PollId, VoteId: poll.VoteId, VoteDate: poll.VoteDate}
+	if v.voteHook != nil {
+		v.voteHook(vote)
+	}
+	v.publishVote(vote)
+	return history, true, nil
+}
+
+// getVoteHistory reads the VoteHistory of the voter stored at key, the
+// vote history calls all go through it.  The whole voter is read so that,
+// like GetVoter, a soft deleted voter is reported as ErrVoterNotFound
+// unless the list includes deleted voters.
+func (v *VoterList) getVoteHistory(key string) ([]VoterHistory, error) {
+	var voter Voter
+	if err := v.getItemFromRedis(key, &voter); err != nil {
+		return nil, err
+	}
+	if voter.Deleted && !v.includeDeleted {
+		return nil, ErrVoterNotFound
+	}
+	return voter.VoteHistory, nil
+}
+
+// writeHistory changes the vote history of the voter at key.  The voter is
+// read under WATCH and handed to change, which returns the command making
+// the change and how many votes it adds, or takes off when negative.  The
+// command, a bump of the voter's Version and the change to the running
+// total go in one MULTI that only commits if the voter was not written
+// since it was read, so the total moves with the history or not at all.
+// The transaction is tried again when it does not commit, see watch.  An
+// error from change is returned as it is and nothing is written.
+//
+// Like GetVoter a soft deleted voter is reported as ErrVoterNotFound, one
+// changed through a list that includes deleted voters leaves the total
+// alone since its votes are not counted.
+func (v *VoterList) writeHistory(key string, change func(voter Voter) (cmd []any, votes int, err error)) error {
+	update := func(tx *redis.Tx) error {
+		voter, err := v.getVoterInTx(tx, key)
+		if err != nil {
+			return err
+		}
+		cmd, votes, err := change(voter)
+		if err != nil {
+			return err
+		}
+		if voter.Deleted {
+			votes = 0
+		}
+
+		_, err = tx.TxPipelined(v.context, func(pipe redis.Pipeliner) error {
+			pipe.Do(v.context, cmd...)
+			pipe.Do(v.context, "JSON.NUMINCRBY", key, ".Version", 1)
+			if votes != 0 {
+				pipe.IncrBy(v.context, v.votesTotalKey(), int64(votes))
+			}
+			return nil
+		})
+		return err
+	}
+	return v.watch(true, update, key)
+}
+
+// ClearVoteHistory removes every vote of the voter and leaves the rest of
+// the voter as it is
+func (v *VoterList) ClearVoteHistory(voterId int) error {
+	redisKey := v.redisKeyFromId(voterId)
+	return v.writeHistory(redisKey, func(voter Voter) ([]any, int, error) {
+		return []any{"JSON.SET", redisKey, ".VoteHistory", "[]"}, -len(voter.VoteHistory), nil
+	})
+}
+
+func (v *VoterList) DeletePoll(voterId int, pollId uint) error {
+	redisKey := v.redisKeyFromId(voterId)
+	return v.writeHistory(redisKey, func(voter Voter) ([]any, int, error) {
+		for i, vote := range voter.VoteHistory {
+			if vote.PollId == pollId {
+				return []any{"JSON.DEL", redisKey, fmt.Sprintf(".VoteHistory[%d]", i)}, -1, nil
+			}
+		}
+		return nil, 0, ErrPollNotFound
+	})
+}
+
+// UpdatePoll corrects the VoteId and VoteDate of an existing vote, the vote
+// is matched on poll.PollId and ErrPollNotFound is returned if there is none
+func (v *VoterList) UpdatePoll(voterId int, poll VoterHistory) error {
+	redisKey := v.redisKeyFromId(voterId)
+	return v.writeHistory(redisKey, func(voter Voter) ([]any, int, error) {
+		for i, vote := range voter.VoteHistory {
+			if vote.PollId != poll.PollId {
+				continue
+			}
+			vote.VoteId, vote.VoteDate = poll.VoteId, poll.VoteDate
+			voteJson, err := json.Marshal(vote)
+			if err != nil {
+				return nil, 0, err
+			}
+			return []any{"JSON.SET", redisKey, fmt.Sprintf(".VoteHistory[%d]", i), string(voteJson)}, 0, nil
+		}
+		return nil, 0, ErrPollNotFound
+	})
+}
+
+// GetVotersForPoll returns the ids of the voters who voted in the poll, in
+// ascending order.  A poll nobody voted in gives an empty list.
+func (v *VoterList) GetVotersForPoll(pollId uint) ([]uint, error) {
+	ids := make([]uint, 0)
+	err := v.EachVoter(func(voter Voter) error {
+		for _, vote := range voter.VoteHistory {
+			if vote.PollId == pollId {
+				ids = append(ids, voter.VoterId)
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// ErrNoPolls is returned by GetVotersInAllPolls when it is given no polls
+var ErrNoPolls = errors.New("no poll ids given")
+
+// GetVotersInAllPolls returns the ids of the voters who voted in every one
+// of the polls, in ascending order, repeated poll ids count once.  No voter
+// qualifying gives an empty list.  An empty set of polls is refused with
+// ErrNoPolls rather than matching every voter.
+func (v *VoterList) GetVotersInAllPolls(pollIds []uint) ([]uint, error) {
+	if len(pollIds) == 0 {
+		return nil, ErrNoPolls
+	}
+	wanted := make(map[uint]bool, len(pollIds))
+	for _, pollId := range pollIds {
+		wanted[pollId] = true
+	}
+
+	ids := make([]uint, 0)
+	err := v.EachVoter(func(voter Voter) error {
+		covered := make(map[uint]bool, len(wanted))
+		for _, vote := range voter.VoteHistory {
+			if wanted[vote.PollId] {
+				covered[vote.PollId] = true
+			}
+		}
+		if len(covered) == len(wanted) {
+			ids = append(ids, voter.VoterId)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// GetPollResults tallies the votes cast in a poll across every voter and
+// returns a histogram of VoteId to the number of voters who picked it.  A
+// poll nobody voted in gives an empty map rather than an error.
+func (v *VoterList) GetPollResults(pollId uint) (map[uint]int, error) {
+	results, _, err := v.GetPollResultsSampled(pollId)
+	return results, err
+}
+
+// GetPollResultsSampled is GetPollResults that also reports how many voters
+// were looked at to build the histogram
+func (v *VoterList) GetPollResultsSampled(pollId uint) (map[uint]int, int, error) {
+	ks, err := v.voterKeys()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	voters, err := v.getVotersFromKeys(ks)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	results := make(map[uint]int)
+	for _, voter := range voters {
+		for _, vote := range voter.VoteHistory {
+			if vote.PollId == pollId {
+				results[vote.VoteId]++
+			}
+		}
+	}
 
+	return results, len(voters), nil
 }
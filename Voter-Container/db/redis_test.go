@@ -0,0 +1,2583 @@
+package db
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"drexel.edu/voter/db/memredis"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// commandRecorder is a go-redis hook that remembers the name of every
+// command sent to redis, after is called once a command has been answered
+type commandRecorder struct {
+	mu       sync.Mutex
+	commands map[string]int
+	after    func(cmd redis.Cmder)
+}
+
+func recordCommands(v *VoterList) *commandRecorder {
+	rec := &commandRecorder{commands: make(map[string]int)}
+	v.cacheClient.AddHook(rec)
+	return rec
+}
+
+func (r *commandRecorder) record(cmd redis.Cmder) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.commands[strings.ToLower(cmd.Name())]++
+}
+
+func (r *commandRecorder) count(name string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.commands[name]
+}
+
+func (r *commandRecorder) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (r *commandRecorder) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		r.record(cmd)
+		err := next(ctx, cmd)
+		if r.after != nil {
+			r.after(cmd)
+		}
+		return err
+	}
+}
+
+func (r *commandRecorder) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		for _, cmd := range cmds {
+			r.record(cmd)
+		}
+		return next(ctx, cmds)
+	}
+}
+
+// newTestVoterList returns a VoterList connected to a fresh in-process redis
+func newTestVoterList(t *testing.T) (*VoterList, *memredis.Server) {
+	t.Helper()
+
+	mr, err := memredis.Run()
+	require.NoError(t, err)
+	t.Cleanup(mr.Close)
+
+	voterList, err := NewWithCacheInstance(mr.Addr())
+	require.NoError(t, err)
+	t.Cleanup(func() { voterList.Close() })
+
+	return voterList, mr
+}
+
+func seedVoters(t *testing.T, v *VoterList, n int) {
+	t.Helper()
+	for i := 1; i <= n; i++ {
+		voter := Voter{
+			VoterId: uint(i),
+			Name:    fmt.Sprintf("Voter %d", i),
+			Email:   fmt.Sprintf("voter%d@example.com", i),
+		}
+		require.NoError(t, v.AddVoter(&voter))
+	}
+}
+
+// TestVoterLifecycle walks one voter through every basic operation against
+// the in-process redis, each of the focused tests below covers one of them
+// in more depth
+func TestVoterLifecycle(t *testing.T) {
+	v, _ := newTestVoterList(t)
+
+	voter := Voter{VoterId: 1, Name: "Ada", Email: "ada@example.com"}
+	require.NoError(t, v.AddVoter(&voter))
+	assert.ErrorIs(t, v.AddVoter(&voter), ErrVoterExists)
+
+	got, err := v.GetVoter(1)
+	require.NoError(t, err)
+	assert.Equal(t, "Ada", got.Name)
+	assert.Equal(t, uint(1), got.Version)
+
+	got.Name = "Ada Lovelace"
+	require.NoError(t, v.UpdateVoter(&got))
+	_, err = v.AddPoll(1, VoterHistory{PollId: 1, VoteId: 2}, PollOptions{})
+	require.NoError(t, err)
+
+	got, err = v.GetVoter(1)
+	require.NoError(t, err)
+	assert.Equal(t, "Ada Lovelace", got.Name)
+	require.Len(t, got.VoteHistory, 1)
+	assert.Equal(t, uint(2), got.VoteHistory[0].VoteId)
+
+	require.NoError(t, v.DeleteVoter(1))
+	_, err = v.GetVoter(1)
+	assert.ErrorIs(t, err, ErrVoterNotFound)
+	assert.ErrorIs(t, v.DeleteVoter(1), ErrVoterNotFound)
+
+	seedVoters(t, v, 3)
+	require.NoError(t, v.DeleteAll())
+	count, err := v.CountVoters()
+	require.NoError(t, err)
+	assert.Zero(t, count)
+	_, err = v.GetVoterByEmail("voter1@example.com")
+	assert.ErrorIs(t, err, ErrVoterNotFound)
+}
+
+func TestGetVotersPaged(t *testing.T) {
+	v, _ := newTestVoterList(t)
+	seedVoters(t, v, 25)
+
+	page, total, err := v.GetVotersPaged(10, 10)
+	require.NoError(t, err)
+	assert.Equal(t, 25, total)
+	require.Len(t, page, 10)
+	assert.Equal(t, uint(11), page[0].VoterId)
+	assert.Equal(t, uint(20), page[9].VoterId)
+
+	page, total, err = v.GetVotersPaged(20, 10)
+	require.NoError(t, err)
+	assert.Equal(t, 25, total)
+	assert.Len(t, page, 5)
+
+	page, total, err = v.GetVotersPaged(100, 10)
+	require.NoError(t, err)
+	assert.Equal(t, 25, total)
+	assert.Empty(t, page)
+
+	_, _, err = v.GetVotersPaged(-1, 10)
+	assert.Error(t, err)
+}
+
+func TestScanLargeKeyspaceWithoutKeys(t *testing.T) {
+	v, _ := newTestVoterList(t)
+	seedVoters(t, v, 5000)
+
+	rec := recordCommands(v)
+
+	voters, err := v.GetAllVoters()
+	require.NoError(t, err)
+	assert.Len(t, voters, 5000)
+	assert.Equal(t, uint(1), voters[0].VoterId)
+	assert.Equal(t, uint(5000), voters[4999].VoterId)
+
+	require.NoError(t, v.DeleteAll())
+	voters, err = v.GetAllVoters()
+	require.NoError(t, err)
+	assert.Empty(t, voters)
+
+	assert.Zero(t, rec.count("keys"), "KEYS must not be used")
+	assert.Greater(t, rec.count("scan"), 1, "SCAN should be called in batches")
+	assert.GreaterOrEqual(t, rec.count("unlink"), 5000/DefaultScanBatchSize)
+	assert.Zero(t, rec.count("del"))
+}
+
+func TestVoterValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		voter Voter
+		field string
+	}{
+		{"valid", Voter{Name: "Jane", Email: "jane@example.com"}, ""},
+		{"empty name", Voter{Name: "  ", Email: "jane@example.com"}, "Name"},
+		{"empty email", Voter{Name: "Jane", Email: ""}, "Email"},
+		{"not an email", Voter{Name: "Jane", Email: "not-an-email"}, "Email"},
+		{"duplicate at", Voter{Name: "Jane", Email: "jane@@example.com"}, "Email"},
+		{"two ats", Voter{Name: "Jane", Email: "jane@foo@example.com"}, "Email"},
+		{"leading whitespace", Voter{Name: "Jane", Email: " jane@example.com"}, "Email"},
+		{"trailing whitespace", Voter{Name: "Jane", Email: "jane@example.com "}, "Email"},
+		{"display name", Voter{Name: "Jane", Email: "Jane <jane@example.com>"}, "Email"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.voter.Validate()
+			if tt.field == "" {
+				assert.NoError(t, err)
+				return
+			}
+
+			var validationErr *ValidationError
+			require.ErrorAs(t, err, &validationErr)
+			assert.Equal(t, tt.field, validationErr.Field)
+		})
+	}
+}
+
+func TestAddAndUpdateVoterValidate(t *testing.T) {
+	v, _ := newTestVoterList(t)
+
+	bad := Voter{VoterId: 1, Name: "Jane", Email: "not-an-email"}
+	assert.Error(t, v.AddVoter(&bad))
+	_, err := v.GetVoter(1)
+	assert.Error(t, err, "invalid voter must not be stored")
+
+	seedVoters(t, v, 1)
+	assert.Error(t, v.UpdateVoter(&bad))
+}
+
+func TestAddPollDuplicate(t *testing.T) {
+	v, _ := newTestVoterList(t)
+	seedVoters(t, v, 1)
+
+	first := VoterHistory{PollId: 7, VoteId: 1, VoteDate: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	_, err := v.AddPoll(1, first, PollOptions{})
+	require.NoError(t, err)
+
+	second := VoterHistory{PollId: 7, VoteId: 2, VoteDate: time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)}
+	_, err = v.AddPoll(1, second, PollOptions{})
+	assert.ErrorIs(t, err, ErrDuplicatePoll)
+
+	history, err := v.GetVoteHistory(1)
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	assert.Equal(t, uint(1), history[0].VoteId)
+
+	history, err = v.AddPoll(1, second, PollOptions{Overwrite: true})
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+
+	history, err = v.GetVoteHistory(1)
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	assert.Equal(t, uint(2), history[0].VoteId)
+	assert.True(t, second.VoteDate.Equal(history[0].VoteDate))
+}
+
+func TestAddPolls(t *testing.T) {
+	v, _ := newTestVoterList(t)
+	seedVoters(t, v, 1)
+	_, err := v.AddPoll(1, VoterHistory{PollId: 1, VoteId: 1}, PollOptions{})
+	require.NoError(t, err)
+	before, err := v.GetVoter(1)
+	require.NoError(t, err)
+	var hooked []uint
+	v.SetVoteHook(func(vote VoteEvent) { hooked = append(hooked, vote.PollId) })
+
+	voter, errs, err := v.AddPolls(1, []VoterHistory{
+		{PollId: 2, VoteId: 1},
+		{PollId: 1, VoteId: 2},
+		{PollId: 3, VoteId: 1},
+		{PollId: 2, VoteId: 3},
+		{PollId: 4},
+	})
+	require.NoError(t, err)
+
+	require.Len(t, errs, 3)
+	var batchErr *PollBatchError
+	require.ErrorAs(t, errs[0], &batchErr)
+	assert.Equal(t, 1, batchErr.Index)
+	assert.ErrorIs(t, errs[0], ErrDuplicatePoll, "already in the history")
+	require.ErrorAs(t, errs[1], &batchErr)
+	assert.Equal(t, 3, batchErr.Index)
+	assert.Equal(t, uint(2), batchErr.PollId)
+	assert.ErrorIs(t, errs[1], ErrDuplicatePoll, "earlier in the batch")
+	var validationErr *ValidationError
+	assert.ErrorAs(t, errs[2], &validationErr)
+
+	stored, err := v.GetVoter(1)
+	require.NoError(t, err)
+	assert.Equal(t, stored, voter)
+	assert.Equal(t, before.Version+1, stored.Version)
+	require.Len(t, stored.VoteHistory, 3)
+	for i, pollId := range []uint{1, 2, 3} {
+		assert.Equal(t, pollId, stored.VoteHistory[i].PollId)
+		assert.False(t, stored.VoteHistory[i].VoteDate.IsZero())
+	}
+	assert.Equal(t, uint(1), stored.VoteHistory[1].VoteId, "the first vote for a poll wins")
+	assert.Equal(t, []uint{2, 3}, hooked)
+	total, err := v.GetVoteTotal()
+	require.NoError(t, err)
+	assert.Equal(t, 3, total)
+
+	//Nothing is written when every vote is skipped
+	require.NoError(t, v.OpenPoll(9))
+	voter, errs, err = v.AddPolls(1, []VoterHistory{{PollId: 3, VoteId: 1}, {PollId: 5, VoteId: 1}})
+	require.NoError(t, err)
+	require.Len(t, errs, 2)
+	assert.ErrorIs(t, errs[1], ErrPollClosed)
+	assert.Equal(t, stored.Version, voter.Version)
+
+	_, _, err = v.AddPolls(42, []VoterHistory{{PollId: 1, VoteId: 1}})
+	assert.ErrorIs(t, err, ErrVoterNotFound)
+}
+
+func TestMaxVoteHistory(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2024, 5, d, 0, 0, 0, 0, time.UTC) }
+	//Voter 1 ends up at the cap of 3, poll 2 has the oldest vote
+	seed := func(t *testing.T, policy VoteHistoryPolicy) *VoterList {
+		v, _ := newTestVoterList(t)
+		seedVoters(t, v, 1)
+		require.NoError(t, v.SetMaxVoteHistory(3, policy))
+		for _, vote := range []VoterHistory{{PollId: 1, VoteId: 1, VoteDate: day(2)}, {PollId: 2, VoteId: 1, VoteDate: day(1)}} {
+			_, err := v.AddPoll(1, vote, PollOptions{})
+			require.NoError(t, err)
+		}
+		_, err := v.AddPoll(1, VoterHistory{PollId: 3, VoteId: 1, VoteDate: day(3)}, PollOptions{})
+		require.NoError(t, err, "the vote that reaches the cap is still accepted")
+		return v
+	}
+
+	t.Run("reject", func(t *testing.T) {
+		v := seed(t, RejectVote)
+		_, err := v.AddPoll(1, VoterHistory{PollId: 4, VoteId: 1, VoteDate: day(4)}, PollOptions{})
+		assert.ErrorIs(t, err, ErrVoteHistoryFull)
+
+		//Replacing a vote does not grow the history
+		_, err = v.AddPoll(1, VoterHistory{PollId: 3, VoteId: 2}, PollOptions{Overwrite: true})
+		assert.NoError(t, err)
+
+		voter, err := v.GetVoter(1)
+		require.NoError(t, err)
+		assert.Equal(t, []uint{1, 2, 3}, pollIdsOf(voter.VoteHistory))
+		total, err := v.GetVoteTotal()
+		require.NoError(t, err)
+		assert.Equal(t, 3, total)
+	})
+
+	t.Run("evict oldest", func(t *testing.T) {
+		v := seed(t, EvictOldestVote)
+		history, err := v.AddPoll(1, VoterHistory{PollId: 4, VoteId: 1, VoteDate: day(4)}, PollOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, []uint{1, 3, 4}, pollIdsOf(history))
+
+		voter, err := v.GetVoter(1)
+		require.NoError(t, err)
+		assert.Equal(t, []uint{1, 3, 4}, pollIdsOf(voter.VoteHistory))
+		total, err := v.GetVoteTotal()
+		require.NoError(t, err)
+		assert.Equal(t, 3, total)
+	})
+
+	t.Run("batch", func(t *testing.T) {
+		v := seed(t, RejectVote)
+		_, errs, err := v.AddPolls(1, []VoterHistory{{PollId: 4, VoteId: 1}})
+		require.NoError(t, err)
+		require.Len(t, errs, 1)
+		assert.ErrorIs(t, errs[0], ErrVoteHistoryFull)
+
+		v = seed(t, EvictOldestVote)
+		voter, errs, err := v.AddPolls(1, []VoterHistory{{PollId: 4, VoteId: 1, VoteDate: day(4)}, {PollId: 5, VoteId: 1, VoteDate: day(5)}})
+		require.NoError(t, err)
+		assert.Empty(t, errs)
+		assert.Equal(t, []uint{3, 4, 5}, pollIdsOf(voter.VoteHistory))
+	})
+
+	t.Run("unknown policy", func(t *testing.T) {
+		v, _ := newTestVoterList(t)
+		assert.Error(t, v.SetMaxVoteHistory(3, "newest"))
+	})
+}
+
+func TestAddPollToVoterDeletedMeanwhile(t *testing.T) {
+	v, _ := newTestVoterList(t)
+	seedVoters(t, v, 1)
+	other, err := NewWithCacheInstance(v.cacheClient.Options().Addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { other.Close() })
+
+	//The voter is deleted right after AddPoll has read it, the vote must
+	//not be counted without being stored
+	rec := recordCommands(v)
+	interfered := false
+	rec.after = func(cmd redis.Cmder) {
+		if interfered || strings.ToLower(cmd.Name()) != "json.get" {
+			return
+		}
+		interfered = true
+		require.NoError(t, other.DeleteVoter(1))
+	}
+	_, err = v.AddPoll(1, VoterHistory{PollId: 1, VoteId: 1}, PollOptions{})
+	assert.ErrorIs(t, err, ErrVoterNotFound)
+	require.True(t, interfered)
+
+	total, err := v.GetVoteTotal()
+	require.NoError(t, err)
+	assert.Zero(t, total)
+}
+
+func TestAddPollRacingDuplicate(t *testing.T) {
+	v, _ := newTestVoterList(t)
+	seedVoters(t, v, 1)
+	other, err := NewWithCacheInstance(v.cacheClient.Options().Addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { other.Close() })
+
+	//Another client votes in the same poll right after AddPoll has checked
+	//the history for it
+	rec := recordCommands(v)
+	interfered := false
+	rec.after = func(cmd redis.Cmder) {
+		if interfered || strings.ToLower(cmd.Name()) != "json.get" {
+			return
+		}
+		interfered = true
+		_, err := other.AddPoll(1, VoterHistory{PollId: 1, VoteId: 1}, PollOptions{})
+		require.NoError(t, err)
+	}
+	_, err = v.AddPoll(1, VoterHistory{PollId: 1, VoteId: 2}, PollOptions{})
+	assert.ErrorIs(t, err, ErrDuplicatePoll)
+	require.True(t, interfered)
+
+	history, err := v.GetVoteHistory(1)
+	require.NoError(t, err)
+	assert.Equal(t, []uint{1}, pollIdsOf(history))
+	total, err := v.GetVoteTotal()
+	require.NoError(t, err)
+	assert.Equal(t, 1, total)
+}
+
+func TestAddPollAppendsInPlace(t *testing.T) {
+	v, _ := newTestVoterList(t)
+	seedVoters(t, v, 1)
+
+	//The first vote replaces the null history of a new voter
+	_, err := v.AddPoll(1, VoterHistory{PollId: 1, VoteId: 1}, PollOptions{})
+	require.NoError(t, err)
+	before, err := v.GetVoter(1)
+	require.NoError(t, err)
+
+	calls := recordCommands(v)
+	vote := VoterHistory{PollId: 2, VoteId: 3, VoteDate: time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)}
+	history, err := v.AddPoll(1, vote, PollOptions{})
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+	assert.Equal(t, 1, calls.count("json.arrappend"))
+	assert.Zero(t, calls.count("json.set"), "the voter should not be rewritten")
+
+	after, err := v.GetVoter(1)
+	require.NoError(t, err)
+	require.Len(t, after.VoteHistory, 2)
+	assert.Equal(t, before.VoteHistory[0], after.VoteHistory[0])
+	assert.Equal(t, vote.PollId, after.VoteHistory[1].PollId)
+	assert.Equal(t, vote.VoteId, after.VoteHistory[1].VoteId)
+	assert.True(t, vote.VoteDate.Equal(after.VoteHistory[1].VoteDate))
+
+	assert.Equal(t, before.Name, after.Name)
+	assert.Equal(t, before.Email, after.Email)
+	assert.Equal(t, before.VoterId, after.VoterId)
+	assert.Equal(t, before.Version+1, after.Version)
+
+	_, err = v.AddPoll(99, vote, PollOptions{})
+	assert.ErrorIs(t, err, ErrVoterNotFound)
+}
+
+func TestAddPollSorted(t *testing.T) {
+	v, _ := newTestVoterList(t)
+	seedVoters(t, v, 1)
+	day := func(d int) time.Time { return time.Date(2024, 1, d, 0, 0, 0, 0, time.UTC) }
+
+	//middle, head, tail, then between the first two
+	for i, d := range []int{10, 2, 20, 5} {
+		_, err := v.AddPoll(1, VoterHistory{PollId: uint(i + 1), VoteId: 1, VoteDate: day(d)}, PollOptions{Sorted: true})
+		require.NoError(t, err)
+	}
+
+	history, err := v.GetVoteHistory(1)
+	require.NoError(t, err)
+	require.Len(t, history, 4)
+	assert.True(t, slices.IsSortedFunc(history, func(a, b VoterHistory) int {
+		return a.VoteDate.Compare(b.VoteDate)
+	}))
+	pollIds := make([]uint, len(history))
+	for i, vote := range history {
+		pollIds[i] = vote.PollId
+	}
+	assert.Equal(t, []uint{2, 4, 1, 3}, pollIds)
+
+	//Overwriting with a new date moves the vote into place
+	history, err = v.AddPoll(1, VoterHistory{PollId: 3, VoteId: 2, VoteDate: day(1)}, PollOptions{Sorted: true, Overwrite: true})
+	require.NoError(t, err)
+	assert.Equal(t, uint(3), history[0].PollId)
+	stored, err := v.GetVoteHistory(1)
+	require.NoError(t, err)
+	assert.Equal(t, history, stored)
+}
+
+func TestDeletePoll(t *testing.T) {
+	v, _ := newTestVoterList(t)
+	seedVoters(t, v, 1)
+
+	for _, pollId := range []uint{1, 2, 3} {
+		_, err := v.AddPoll(1, VoterHistory{PollId: pollId, VoteId: pollId}, PollOptions{})
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, v.DeletePoll(1, 2))
+	history, err := v.GetVoteHistory(1)
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+	assert.Equal(t, uint(1), history[0].PollId)
+	assert.Equal(t, uint(3), history[1].PollId)
+
+	assert.ErrorIs(t, v.DeletePoll(1, 2), ErrPollNotFound)
+	assert.Error(t, v.DeletePoll(99, 1))
+}
+
+func TestUpsertPoll(t *testing.T) {
+	v, _ := newTestVoterList(t)
+	seedVoters(t, v, 1)
+	voteDate := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	created, err := v.UpsertPoll(1, VoterHistory{PollId: 4, VoteId: 1, VoteDate: voteDate.In(time.FixedZone("EST", -5*3600))})
+	require.NoError(t, err)
+	assert.True(t, created)
+	stored, err := v.GetSingleVoteHistory(1, 4)
+	require.NoError(t, err)
+	assert.Equal(t, VoterHistory{PollId: 4, VoteId: 1, VoteDate: voteDate}, *stored, "the date is stored in UTC")
+
+	created, err = v.UpsertPoll(1, VoterHistory{PollId: 4, VoteId: 2})
+	require.NoError(t, err)
+	assert.False(t, created)
+
+	history, err := v.GetVoteHistory(1)
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	assert.Equal(t, uint(2), history[0].VoteId)
+	assert.WithinDuration(t, time.Now(), history[0].VoteDate, time.Minute, "a vote without a date gets the current time")
+
+	_, err = v.UpsertPoll(99, VoterHistory{PollId: 4, VoteId: 1})
+	assert.ErrorIs(t, err, ErrVoterNotFound)
+}
+
+func TestClearVoteHistory(t *testing.T) {
+	v, _ := newTestVoterList(t)
+	seedVoters(t, v, 1)
+	for _, pollId := range []uint{1, 2} {
+		_, err := v.AddPoll(1, VoterHistory{PollId: pollId, VoteId: 1}, PollOptions{})
+		require.NoError(t, err)
+	}
+	before, err := v.GetVoter(1)
+	require.NoError(t, err)
+
+	require.NoError(t, v.ClearVoteHistory(1))
+	after, err := v.GetVoter(1)
+	require.NoError(t, err)
+	assert.NotNil(t, after.VoteHistory)
+	assert.Empty(t, after.VoteHistory)
+	assert.Equal(t, before.Name, after.Name)
+	assert.Equal(t, before.Email, after.Email)
+	assert.Equal(t, before.Version+1, after.Version)
+
+	//Clearing an empty history is not an error
+	require.NoError(t, v.ClearVoteHistory(1))
+
+	assert.ErrorIs(t, v.ClearVoteHistory(99), ErrVoterNotFound)
+	_, err = v.GetVoter(99)
+	assert.ErrorIs(t, err, ErrVoterNotFound, "nothing should be created for a missing voter")
+}
+
+func TestUpdatePoll(t *testing.T) {
+	v, _ := newTestVoterList(t)
+	seedVoters(t, v, 1)
+	_, err := v.AddPoll(1, VoterHistory{PollId: 4, VoteId: 1}, PollOptions{})
+	require.NoError(t, err)
+
+	voteDate := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	require.NoError(t, v.UpdatePoll(1, VoterHistory{PollId: 4, VoteId: 9, VoteDate: voteDate}))
+
+	poll, err := v.GetSingleVoteHistory(1, 4)
+	require.NoError(t, err)
+	assert.Equal(t, uint(9), poll.VoteId)
+	assert.True(t, voteDate.Equal(poll.VoteDate))
+
+	assert.ErrorIs(t, v.UpdatePoll(1, VoterHistory{PollId: 5, VoteId: 1}), ErrPollNotFound)
+	assert.ErrorIs(t, v.UpdatePoll(99, VoterHistory{PollId: 4, VoteId: 1}), ErrVoterNotFound)
+
+	//the correction bumps the version and leaves the vote total alone
+	voter, err := v.GetVoter(1)
+	require.NoError(t, err)
+	assert.Equal(t, uint(3), voter.Version)
+	total, err := v.GetVoteTotal()
+	require.NoError(t, err)
+	assert.Equal(t, 1, total)
+}
+
+func TestGetVoteCount(t *testing.T) {
+	v, _ := newTestVoterList(t)
+	seedVoters(t, v, 1)
+
+	//seeded voters have a null history
+	count, err := v.GetVoteCount(1)
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	for _, pollId := range []uint{1, 2, 3} {
+		_, err := v.AddPoll(1, VoterHistory{PollId: pollId, VoteId: 1}, PollOptions{})
+		require.NoError(t, err)
+	}
+	require.NoError(t, v.DeletePoll(1, 2))
+
+	calls := recordCommands(v)
+	count, err = v.GetVoteCount(1)
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+	assert.Equal(t, 1, calls.count("json.arrlen"))
+	assert.Zero(t, calls.count("json.get"), "the voter should not be fetched")
+
+	_, err = v.GetVoteCount(99)
+	assert.ErrorIs(t, err, ErrVoterNotFound)
+}
+
+func TestGetVoterField(t *testing.T) {
+	v, _ := newTestVoterList(t)
+	seedVoters(t, v, 1)
+	_, err := v.AddPoll(1, VoterHistory{PollId: 4, VoteId: 7}, PollOptions{})
+	require.NoError(t, err)
+
+	calls := recordCommands(v)
+	email, err := v.GetVoterField(1, ".Email")
+	require.NoError(t, err)
+	assert.JSONEq(t, `"voter1@example.com"`, string(email))
+	assert.Equal(t, 2, calls.count("json.get"), "only the flag and the field should be read")
+
+	pollId, err := v.GetVoterField(1, ".VoteHistory[0].PollId")
+	require.NoError(t, err)
+	assert.JSONEq(t, `4`, string(pollId))
+
+	for _, path := range []string{"", ".", "Email", ".Email.", ".Vote History", ".VoteHistory[x]", "..Email"} {
+		_, err = v.GetVoterField(1, path)
+		assert.ErrorIs(t, err, ErrBadPath, path)
+	}
+	for _, path := range []string{".Nope", ".VoteHistory[5]", ".Email[0]"} {
+		_, err = v.GetVoterField(1, path)
+		assert.ErrorIs(t, err, ErrFieldNotFound, path)
+	}
+	_, err = v.GetVoterField(99, ".Email")
+	assert.ErrorIs(t, err, ErrVoterNotFound)
+
+	require.NoError(t, v.SoftDeleteVoter(1))
+	_, err = v.GetVoterField(1, ".Email")
+	assert.ErrorIs(t, err, ErrVoterNotFound)
+	_, err = v.IncludeDeleted().GetVoterField(1, ".Email")
+	assert.NoError(t, err)
+}
+
+func TestSortVoteHistory(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2024, 3, d, 12, 0, 0, 0, time.UTC) }
+	recorded := []VoterHistory{
+		{PollId: 2, VoteId: 1, VoteDate: day(3)},
+		{PollId: 3, VoteId: 1, VoteDate: day(1)},
+		{PollId: 1, VoteId: 1, VoteDate: day(3)},
+		{PollId: 4, VoteId: 1, VoteDate: day(2)},
+	}
+	polls := func(history []VoterHistory) []uint {
+		ids := make([]uint, len(history))
+		for i, vote := range history {
+			ids[i] = vote.PollId
+		}
+		return ids
+	}
+
+	tests := []struct {
+		by   HistorySortField
+		desc bool
+		want []uint
+	}{
+		{SortVotesByDate, true, []uint{1, 2, 4, 3}},
+		{SortVotesByDate, false, []uint{3, 4, 1, 2}},
+		{SortVotesByPoll, false, []uint{1, 2, 3, 4}},
+		{SortVotesByPoll, true, []uint{4, 3, 2, 1}},
+		{"", false, []uint{2, 3, 1, 4}},
+	}
+	for _, tt := range tests {
+		history := slices.Clone(recorded)
+		require.NoError(t, SortVoteHistory(history, tt.by, tt.desc))
+		assert.Equal(t, tt.want, polls(history), "by %q desc %v", tt.by, tt.desc)
+	}
+	assert.ErrorIs(t, SortVoteHistory(slices.Clone(recorded), "name", false), ErrInvalidHistorySort)
+
+	v, _ := newTestVoterList(t)
+	voter := Voter{VoterId: 1, Name: "Ada", Email: "ada@example.com", VoteHistory: recorded}
+	require.NoError(t, v.AddVoter(&voter))
+	history, err := v.GetVoteHistorySorted(1, SortVotesByDate, true)
+	require.NoError(t, err)
+	assert.Equal(t, []uint{1, 2, 4, 3}, polls(history))
+	page, total, err := v.GetVoteHistoryPagedSorted(1, 1, 2, SortVotesByPoll, false)
+	require.NoError(t, err)
+	assert.Equal(t, 4, total)
+	assert.Equal(t, []uint{2, 3}, polls(page), "sorted before it is paged")
+	_, err = v.GetVoteHistorySorted(42, SortVotesByDate, true)
+	assert.ErrorIs(t, err, ErrVoterNotFound)
+}
+
+func TestGetVoteHistoryPaged(t *testing.T) {
+	v, _ := newTestVoterList(t)
+	voter := Voter{VoterId: 1, Name: "Ada", Email: "ada@example.com"}
+	for pollId := uint(1); pollId <= 250; pollId++ {
+		voter.VoteHistory = append(voter.VoteHistory, VoterHistory{PollId: pollId, VoteId: 1})
+	}
+	require.NoError(t, v.AddVoter(&voter))
+	stored, err := v.GetVoteHistory(1)
+	require.NoError(t, err)
+
+	var paged []VoterHistory
+	for offset := 0; ; offset += 40 {
+		page, total, err := v.GetVoteHistoryPaged(1, offset, 40)
+		require.NoError(t, err)
+		assert.Equal(t, 250, total)
+		if len(page) == 0 {
+			break
+		}
+		assert.LessOrEqual(t, len(page), 40)
+		paged = append(paged, page...)
+	}
+	assert.Equal(t, stored, paged, "the pages add up to the whole history, in order")
+
+	page, total, err := v.GetVoteHistoryPaged(1, 1000, 10)
+	require.NoError(t, err)
+	assert.Equal(t, 250, total)
+	assert.NotNil(t, page)
+	assert.Empty(t, page, "an offset past the end is an empty page")
+
+	page, _, err = v.GetVoteHistoryPaged(1, 240, 0)
+	require.NoError(t, err)
+	assert.Len(t, page, 10, "no limit is the rest of the history")
+
+	require.NoError(t, v.AddVoter(&Voter{VoterId: 2, Name: "Bob", Email: "bob@example.com"}))
+	page, total, err = v.GetVoteHistoryPaged(2, 0, 10)
+	require.NoError(t, err)
+	assert.Empty(t, page)
+	assert.NotNil(t, page)
+	assert.Zero(t, total)
+
+	_, _, err = v.GetVoteHistoryPaged(42, 0, 10)
+	assert.ErrorIs(t, err, ErrVoterNotFound)
+	_, _, err = v.GetVoteHistoryPaged(1, -1, 10)
+	assert.Error(t, err)
+}
+
+func TestGetVoteHistoryInRange(t *testing.T) {
+	v, _ := newTestVoterList(t)
+	seedVoters(t, v, 1)
+	day := func(d int) time.Time { return time.Date(2024, 5, d, 12, 0, 0, 0, time.UTC) }
+	for i, d := range []int{1, 2, 3, 4} {
+		_, err := v.AddPoll(1, VoterHistory{PollId: uint(i + 1), VoteId: 1, VoteDate: day(d)}, PollOptions{})
+		require.NoError(t, err)
+	}
+
+	pollIds := func(history []VoterHistory) []uint {
+		ids := []uint{}
+		for _, vote := range history {
+			ids = append(ids, vote.PollId)
+		}
+		return ids
+	}
+
+	tests := []struct {
+		name     string
+		from, to time.Time
+		want     []uint
+	}{
+		{"both ends inclusive", day(2), day(3), []uint{2, 3}},
+		{"only from", day(3), time.Time{}, []uint{3, 4}},
+		{"only to", time.Time{}, day(1), []uint{1}},
+		{"open", time.Time{}, time.Time{}, []uint{1, 2, 3, 4}},
+		{"nothing in range", day(5), day(6), []uint{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			history, err := v.GetVoteHistoryInRange(1, tt.from, tt.to)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, pollIds(history))
+		})
+	}
+
+	_, err := v.GetVoteHistoryInRange(99, day(1), day(2))
+	assert.ErrorIs(t, err, ErrVoterNotFound)
+}
+
+func TestGetSingleVoteHistoryReturnsCopies(t *testing.T) {
+	v, _ := newTestVoterList(t)
+	seedVoters(t, v, 1)
+	first := VoterHistory{PollId: 1, VoteId: 10, VoteDate: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	second := VoterHistory{PollId: 2, VoteId: 20, VoteDate: time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)}
+	for _, poll := range []VoterHistory{first, second} {
+		_, err := v.AddPoll(1, poll, PollOptions{})
+		require.NoError(t, err)
+	}
+
+	got1, err := v.GetSingleVoteHistory(1, 1)
+	require.NoError(t, err)
+	got2, err := v.GetSingleVoteHistory(1, 2)
+	require.NoError(t, err)
+
+	assert.NotSame(t, got1, got2)
+	assert.Equal(t, uint(1), got1.PollId)
+	assert.Equal(t, uint(10), got1.VoteId)
+	assert.True(t, first.VoteDate.Equal(got1.VoteDate))
+	assert.Equal(t, uint(2), got2.PollId)
+	assert.Equal(t, uint(20), got2.VoteId)
+	assert.True(t, second.VoteDate.Equal(got2.VoteDate))
+
+	//changing one result must not show up in the other
+	got1.VoteId = 99
+	assert.Equal(t, uint(20), got2.VoteId)
+}
+
+func TestGetMissingPolls(t *testing.T) {
+	v, _ := newTestVoterList(t)
+	seedVoters(t, v, 1)
+	for _, pollId := range []uint{1, 3} {
+		_, err := v.AddPoll(1, VoterHistory{PollId: pollId, VoteId: 1}, PollOptions{})
+		require.NoError(t, err)
+	}
+
+	missing, err := v.GetMissingPolls(1, []uint{4, 1, 2, 3, 2})
+	require.NoError(t, err)
+	assert.Equal(t, []uint{4, 2}, missing)
+
+	missing, err = v.GetMissingPolls(1, nil)
+	require.NoError(t, err)
+	assert.Empty(t, missing)
+
+	_, err = v.GetMissingPolls(99, []uint{1})
+	assert.ErrorIs(t, err, ErrVoterNotFound)
+}
+
+func TestAddVoterAssignsIds(t *testing.T) {
+	v, _ := newTestVoterList(t)
+
+	//an explicit id should be skipped over by the counter
+	explicit := Voter{VoterId: 2, Name: "Explicit", Email: "explicit@example.com"}
+	require.NoError(t, v.AddVoter(&explicit))
+
+	const numVoters = 10
+	ids := make(chan uint, numVoters)
+	var wg sync.WaitGroup
+	for i := 0; i < numVoters; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			voter := Voter{Name: "Auto", Email: fmt.Sprintf("auto%d@example.com", i)}
+			assert.NoError(t, v.AddVoter(&voter))
+			ids <- voter.VoterId
+		}(i)
+	}
+	wg.Wait()
+	close(ids)
+
+	seen := make(map[uint]bool)
+	for id := range ids {
+		assert.NotZero(t, id)
+		assert.NotEqual(t, uint(2), id)
+		assert.False(t, seen[id], "id %d assigned twice", id)
+		seen[id] = true
+	}
+
+	voters, err := v.GetAllVoters()
+	require.NoError(t, err)
+	assert.Len(t, voters, numVoters+1)
+
+	//the counter is not a voter and survives deleting every voter
+	require.NoError(t, v.DeleteAll())
+	voter := Voter{Name: "After", Email: "after@example.com"}
+	require.NoError(t, v.AddVoter(&voter))
+	assert.Equal(t, uint(numVoters+2), voter.VoterId)
+}
+
+func TestAddVoterWithTTL(t *testing.T) {
+	v, mr := newTestVoterList(t)
+
+	expiring := Voter{VoterId: 1, Name: "Temp", Email: "temp@example.com"}
+	require.NoError(t, v.AddVoterWithTTL(&expiring, time.Minute))
+	forever := Voter{VoterId: 2, Name: "Keep", Email: "keep@example.com"}
+	require.NoError(t, v.AddVoterWithTTL(&forever, 0))
+
+	_, err := v.GetVoter(1)
+	require.NoError(t, err)
+
+	mr.FastForward(time.Minute)
+
+	_, err = v.GetVoter(1)
+	assert.Error(t, err, "voter should have expired")
+	_, err = v.GetVoter(2)
+	assert.NoError(t, err)
+
+	assert.Error(t, v.AddVoterWithTTL(&Voter{VoterId: 3, Name: "Bad", Email: "bad@example.com"}, -time.Second))
+
+	//the expiry is written along with the voter, also when the id is
+	//picked, and never given to a voter that already exists
+	auto := Voter{Name: "Auto", Email: "auto@example.com"}
+	require.NoError(t, v.AddVoterWithTTL(&auto, time.Minute))
+	assert.Equal(t, time.Minute, mr.TTL(v.redisKeyFromId(int(auto.VoterId))))
+	taken := Voter{VoterId: 2, Name: "Other", Email: "other@example.com"}
+	assert.ErrorIs(t, v.AddVoterWithTTL(&taken, time.Minute), ErrVoterExists)
+	assert.Zero(t, mr.TTL(v.redisKeyFromId(2)))
+}
+
+func TestCanceledContextStopsCommands(t *testing.T) {
+	v, _ := newTestVoterList(t)
+	seedVoters(t, v, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	canceled := v.WithContext(ctx)
+
+	start := time.Now()
+	_, err := canceled.GetVoter(1)
+	assert.ErrorIs(t, err, context.Canceled)
+	_, err = canceled.GetAllVoters()
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Less(t, time.Since(start), time.Second)
+
+	//the original list is not affected
+	_, err = v.GetVoter(1)
+	assert.NoError(t, err)
+}
+
+func TestGetInactiveVoters(t *testing.T) {
+	v, _ := newTestVoterList(t)
+
+	//1 never voted, 2 voted, 3 has an empty history and 4 had its only
+	//vote removed
+	require.NoError(t, v.AddVoter(&Voter{VoterId: 1, Name: "Nil", Email: "nil@example.com"}))
+	require.NoError(t, v.AddVoter(&Voter{VoterId: 2, Name: "Voted", Email: "voted@example.com",
+		VoteHistory: []VoterHistory{{PollId: 1, VoteId: 1}}}))
+	require.NoError(t, v.AddVoter(&Voter{VoterId: 3, Name: "Empty", Email: "empty@example.com",
+		VoteHistory: []VoterHistory{}}))
+	require.NoError(t, v.AddVoter(&Voter{VoterId: 4, Name: "Removed", Email: "removed@example.com",
+		VoteHistory: []VoterHistory{{PollId: 1, VoteId: 1}}}))
+	require.NoError(t, v.DeletePoll(4, 1))
+
+	inactive, err := v.GetInactiveVoters()
+	require.NoError(t, err)
+	assert.Equal(t, []uint{1, 3, 4}, voterIds(inactive))
+}
+
+func TestCountTotalVotes(t *testing.T) {
+	v, _ := newTestVoterList(t)
+
+	total, err := v.CountTotalVotes()
+	require.NoError(t, err)
+	assert.Equal(t, 0, total)
+
+	seedVoters(t, v, 3)
+	for _, pollId := range []uint{1, 2} {
+		_, err := v.AddPoll(1, VoterHistory{PollId: pollId, VoteId: 1}, PollOptions{})
+		require.NoError(t, err)
+	}
+	_, err = v.AddPoll(3, VoterHistory{PollId: 1, VoteId: 1}, PollOptions{})
+	require.NoError(t, err)
+
+	total, err = v.CountTotalVotes()
+	require.NoError(t, err)
+	assert.Equal(t, 3, total)
+}
+
+func TestVoteTotalTracksVotes(t *testing.T) {
+	v, mr := newTestVoterList(t)
+
+	assertTotal := func(want int) {
+		t.Helper()
+		total, err := v.GetVoteTotal()
+		require.NoError(t, err)
+		assert.Equal(t, want, total)
+		counted, err := v.CountTotalVotes()
+		require.NoError(t, err)
+		assert.Equal(t, counted, total, "the running total should match a recount")
+	}
+	assertTotal(0)
+
+	seedVoters(t, v, 3)
+	withVotes := Voter{VoterId: 4, Name: "Voter 4", Email: "voter4@example.com",
+		VoteHistory: []VoterHistory{{PollId: 1, VoteId: 1}, {PollId: 2, VoteId: 1}}}
+	require.NoError(t, v.AddVoter(&withVotes))
+	assertTotal(2)
+
+	for id := 1; id <= 3; id++ {
+		_, err := v.AddPoll(id, VoterHistory{PollId: 1, VoteId: 2}, PollOptions{})
+		require.NoError(t, err)
+	}
+	_, err := v.AddPoll(1, VoterHistory{PollId: 1, VoteId: 3}, PollOptions{})
+	assert.ErrorIs(t, err, ErrDuplicatePoll)
+	_, err = v.AddPoll(1, VoterHistory{PollId: 1, VoteId: 3}, PollOptions{Overwrite: true})
+	require.NoError(t, err)
+	created, err := v.UpsertPoll(1, VoterHistory{PollId: 2, VoteId: 1})
+	require.NoError(t, err)
+	assert.True(t, created)
+	assertTotal(6)
+
+	require.NoError(t, v.DeletePoll(2, 1))
+	assertTotal(5)
+	require.NoError(t, v.ClearVoteHistory(1))
+	assertTotal(3)
+
+	require.NoError(t, v.SoftDeleteVoter(4))
+	assertTotal(1)
+	//a soft deleted voter takes no votes, which would be counted again on
+	//restore, and changing its history directly leaves the total alone
+	_, err = v.AddPoll(4, VoterHistory{PollId: 3, VoteId: 1}, PollOptions{})
+	assert.ErrorIs(t, err, ErrVoterNotFound)
+	_, err = v.IncludeDeleted().AddPoll(4, VoterHistory{PollId: 3, VoteId: 1}, PollOptions{})
+	require.NoError(t, err)
+	require.NoError(t, v.IncludeDeleted().DeletePoll(4, 3))
+	assertTotal(1)
+	require.NoError(t, v.RestoreVoter(4))
+	assertTotal(3)
+
+	withVotes.VoteHistory = withVotes.VoteHistory[:1]
+	withVotes.Version = 0
+	require.NoError(t, v.UpdateVoter(&withVotes))
+	assertTotal(2)
+
+	require.NoError(t, v.DeleteVoter(3))
+	assertTotal(1)
+	_, err = v.DeleteVoters([]int{4})
+	require.NoError(t, err)
+	assertTotal(0)
+
+	//a total that drifted, here by writing redis directly, is put right
+	added, errs := v.AddVoters([]Voter{{VoterId: 5, Name: "Voter 5", Email: "voter5@example.com",
+		VoteHistory: []VoterHistory{{PollId: 1, VoteId: 1}}}})
+	require.Empty(t, errs)
+	require.Equal(t, 1, added)
+	assertTotal(1)
+	require.NoError(t, mr.Set(v.votesTotalKey(), "42"))
+	total, err := v.ReconcileVoteTotal()
+	require.NoError(t, err)
+	assert.Equal(t, 1, total)
+	assertTotal(1)
+
+	require.NoError(t, v.DeleteAll())
+	assertTotal(0)
+}
+
+func TestIdempotencyKeys(t *testing.T) {
+	v, mr := newTestVoterList(t)
+
+	stored, err := v.ClaimIdempotencyKey("k", "fp", time.Minute)
+	require.NoError(t, err)
+	assert.Nil(t, stored, "a new key is claimed")
+
+	//until the response is saved the key shows as in progress
+	stored, err = v.ClaimIdempotencyKey("k", "fp", time.Minute)
+	require.NoError(t, err)
+	require.NotNil(t, stored)
+	assert.Equal(t, "fp", stored.Fingerprint)
+	assert.Zero(t, stored.Status)
+
+	resp := IdempotentResponse{Fingerprint: "fp", Status: 201, Header: map[string]string{"Location": "/voter/1"}, Body: []byte(`{"VoterId":1}`)}
+	require.NoError(t, v.SaveIdempotentResponse("k", resp, time.Hour))
+	stored, err = v.ClaimIdempotencyKey("k", "other", time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, &resp, stored)
+
+	//the saved response outlives the claim's ttl, but not its own
+	mr.FastForward(30 * time.Minute)
+	stored, err = v.ClaimIdempotencyKey("k", "fp", time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, &resp, stored)
+	mr.FastForward(time.Hour)
+	stored, err = v.ClaimIdempotencyKey("k", "fp", time.Minute)
+	require.NoError(t, err)
+	assert.Nil(t, stored)
+
+	require.NoError(t, v.ReleaseIdempotencyKey("k"))
+	stored, err = v.ClaimIdempotencyKey("k", "fp", time.Minute)
+	require.NoError(t, err)
+	assert.Nil(t, stored, "a released key can be claimed again")
+}
+
+func TestVotesChannel(t *testing.T) {
+	v, mr := newTestVoterList(t)
+	seedVoters(t, v, 1)
+
+	//a second instance of the API, sharing the same redis
+	other, err := NewWithCacheInstance(mr.Addr())
+	require.NoError(t, err)
+	t.Cleanup(func() { other.Close() })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	assert.ErrorIs(t, other.SubscribeVotes(ctx, func(VoteEvent) {}), ErrNoVotesChannel)
+
+	v.SetVotesChannel("test:votes")
+	other.SetVotesChannel("test:votes")
+	votes := make(chan VoteEvent, 10)
+	require.NoError(t, other.SubscribeVotes(ctx, func(vote VoteEvent) { votes <- vote }))
+
+	voteDate := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	_, err = v.AddPoll(1, VoterHistory{PollId: 2, VoteId: 5, VoteDate: voteDate}, PollOptions{})
+	require.NoError(t, err)
+	//replacing a vote is not a new one
+	_, err = v.AddPoll(1, VoterHistory{PollId: 2, VoteId: 6}, PollOptions{Overwrite: true})
+	require.NoError(t, err)
+	_, err = v.AddPoll(1, VoterHistory{PollId: 3, VoteId: 7}, PollOptions{})
+	require.NoError(t, err)
+
+	next := func() VoteEvent {
+		t.Helper()
+		select {
+		case vote := <-votes:
+			return vote
+		case <-time.After(5 * time.Second):
+			t.Fatal("no vote was received")
+			return VoteEvent{}
+		}
+	}
+	assert.Equal(t, VoteEvent{VoterId: 1, PollId: 2, VoteId: 5, VoteDate: voteDate}, next())
+	assert.Equal(t, uint(3), next().PollId)
+
+	//cancelling ctx ends the subscription
+	cancel()
+	assert.Eventually(t, func() bool {
+		return mr.PubSubNumSub("test:votes")["test:votes"] == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestAuditLog(t *testing.T) {
+	v, mr := newTestVoterList(t)
+
+	entries, err := v.GetAuditEntries(10)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	for id := uint(1); id <= 4; id++ {
+		entry := AuditEntry{Method: "DELETE", Path: fmt.Sprintf("/voter/%d", id), VoterId: id, Time: at, Status: 200}
+		require.NoError(t, v.AddAuditEntry(entry, 3))
+	}
+	stored, err := mr.List("voter:audit")
+	require.NoError(t, err)
+	assert.Len(t, stored, 3, "trimmed to the newest 3")
+
+	entries, err = v.GetAuditEntries(2)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, AuditEntry{Method: "DELETE", Path: "/voter/4", VoterId: 4, Time: at, Status: 200}, entries[0])
+	assert.Equal(t, uint(3), entries[1].VoterId)
+
+	entries, err = v.GetAuditEntries(10)
+	require.NoError(t, err)
+	assert.Len(t, entries, 3)
+}
+
+func TestPollRegistry(t *testing.T) {
+	v, _ := newTestVoterList(t)
+	seedVoters(t, v, 1)
+
+	assertOpen := func(pollId uint, want bool) {
+		t.Helper()
+		open, err := v.PollOpen(pollId)
+		require.NoError(t, err)
+		assert.Equal(t, want, open)
+	}
+
+	//without a registry every poll is open
+	assertOpen(1, true)
+	_, err := v.AddPoll(1, VoterHistory{PollId: 1, VoteId: 1}, PollOptions{})
+	require.NoError(t, err)
+
+	require.NoError(t, v.OpenPoll(2))
+	assertOpen(2, true)
+	//polls that were never opened are not, now that there is a registry
+	assertOpen(1, false)
+	assertOpen(3, false)
+	_, err = v.AddPoll(1, VoterHistory{PollId: 3, VoteId: 1}, PollOptions{})
+	assert.ErrorIs(t, err, ErrPollClosed)
+	_, err = v.AddPoll(1, VoterHistory{PollId: 2, VoteId: 1}, PollOptions{})
+	require.NoError(t, err)
+
+	require.NoError(t, v.ClosePoll(2))
+	assertOpen(2, false)
+	_, err = v.AddPoll(1, VoterHistory{PollId: 2, VoteId: 2}, PollOptions{Overwrite: true})
+	assert.ErrorIs(t, err, ErrPollClosed)
+	_, err = v.UpsertPoll(1, VoterHistory{PollId: 2, VoteId: 2})
+	assert.ErrorIs(t, err, ErrPollClosed)
+
+	//the votes already cast are kept
+	voter, err := v.GetVoter(1)
+	require.NoError(t, err)
+	require.Len(t, voter.VoteHistory, 2)
+	assert.Equal(t, uint(1), voter.VoteHistory[1].VoteId)
+
+	require.NoError(t, v.OpenPoll(2))
+	assertOpen(2, true)
+}
+
+func TestDeleteVoters(t *testing.T) {
+	v, _ := newTestVoterList(t)
+	seedVoters(t, v, 3)
+	rec := recordCommands(v)
+
+	deleted, err := v.DeleteVoters([]int{1, 3, 42})
+	require.NoError(t, err)
+	assert.Equal(t, 2, deleted)
+	assert.Equal(t, 1, rec.count("unlink"), "all keys go in one UNLINK")
+
+	remaining, err := v.GetAllVoters()
+	require.NoError(t, err)
+	assert.Equal(t, []uint{2}, voterIds(remaining))
+
+	_, err = v.GetVoterByEmail("voter1@example.com")
+	assert.ErrorIs(t, err, ErrVoterNotFound)
+
+	deleted, err = v.DeleteVoters(nil)
+	require.NoError(t, err)
+	assert.Equal(t, 0, deleted)
+}
+
+func TestSoftDeletedVoterHidesVoteHistory(t *testing.T) {
+	v, _ := newTestVoterList(t)
+	seedVoters(t, v, 1)
+	_, err := v.AddPoll(1, VoterHistory{PollId: 1, VoteId: 1}, PollOptions{})
+	require.NoError(t, err)
+	require.NoError(t, v.SoftDeleteVoter(1))
+
+	_, err = v.GetVoteHistory(1)
+	assert.ErrorIs(t, err, ErrVoterNotFound)
+	_, err = v.GetSingleVoteHistory(1, 1)
+	assert.ErrorIs(t, err, ErrVoterNotFound)
+	_, err = v.GetVoteCount(1)
+	assert.ErrorIs(t, err, ErrVoterNotFound)
+	_, err = v.GetMissingPolls(1, []uint{2})
+	assert.ErrorIs(t, err, ErrVoterNotFound)
+	_, err = v.AddPoll(1, VoterHistory{PollId: 2, VoteId: 1}, PollOptions{})
+	assert.ErrorIs(t, err, ErrVoterNotFound)
+	_, err = v.UpsertPoll(1, VoterHistory{PollId: 1, VoteId: 2})
+	assert.ErrorIs(t, err, ErrVoterNotFound)
+	assert.ErrorIs(t, v.DeletePoll(1, 1), ErrVoterNotFound)
+	assert.ErrorIs(t, v.ClearVoteHistory(1), ErrVoterNotFound)
+
+	//The history is untouched and still there when asked for
+	history, err := v.IncludeDeleted().GetVoteHistory(1)
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	assert.Equal(t, uint(1), history[0].VoteId)
+	count, err := v.IncludeDeleted().GetVoteCount(1)
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+}
+
+func TestSoftDeleteVoter(t *testing.T) {
+	v, mr := newTestVoterList(t)
+	seedVoters(t, v, 3)
+
+	require.NoError(t, v.SoftDeleteVoter(2))
+	assert.ErrorIs(t, v.SoftDeleteVoter(2), ErrVoterNotFound, "a deleted voter can not be deleted again")
+	assert.ErrorIs(t, v.SoftDeleteVoter(42), ErrVoterNotFound)
+	assert.True(t, mr.Exists(v.redisKeyFromId(2)), "a soft delete keeps the voter in redis")
+
+	//lookups and every list leave the voter out
+	_, err := v.GetVoter(2)
+	assert.ErrorIs(t, err, ErrVoterNotFound)
+	_, err = v.GetVoterByEmail("voter2@example.com")
+	assert.ErrorIs(t, err, ErrVoterNotFound)
+	all, err := v.GetAllVoters()
+	require.NoError(t, err)
+	assert.Equal(t, []uint{1, 3}, voterIds(all))
+	page, total, err := v.GetVotersPaged(0, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []uint{1, 3}, voterIds(page))
+	assert.Equal(t, 2, total)
+	count, err := v.CountVoters()
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	//unless they are asked for
+	deleted, err := v.IncludeDeleted().GetVoter(2)
+	require.NoError(t, err)
+	assert.True(t, deleted.Deleted)
+	assert.WithinDuration(t, time.Now(), deleted.DeletedAt, time.Minute)
+	assert.Equal(t, uint(2), deleted.Version)
+	all, err = v.IncludeDeleted().GetAllVoters()
+	require.NoError(t, err)
+	assert.Equal(t, []uint{1, 2, 3}, voterIds(all))
+
+	//a deleted voter can not be updated, except through a list that
+	//includes deleted voters, and that update keeps it deleted
+	deleted.Name = "Renamed"
+	deleted.Deleted = false
+	assert.ErrorIs(t, v.UpdateVoter(&deleted), ErrVoterNotFound)
+	require.NoError(t, v.IncludeDeleted().UpdateVoter(&deleted))
+	_, err = v.GetVoter(2)
+	assert.ErrorIs(t, err, ErrVoterNotFound)
+
+	require.NoError(t, v.RestoreVoter(2))
+	require.NoError(t, v.RestoreVoter(2), "restoring a voter that is not deleted is fine")
+	assert.ErrorIs(t, v.RestoreVoter(42), ErrVoterNotFound)
+
+	restored, err := v.GetVoter(2)
+	require.NoError(t, err)
+	assert.Equal(t, "Renamed", restored.Name)
+	assert.False(t, restored.Deleted)
+	assert.True(t, restored.DeletedAt.IsZero())
+	byEmail, err := v.GetVoterByEmail("voter2@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, uint(2), byEmail.VoterId)
+	all, err = v.GetAllVoters()
+	require.NoError(t, err)
+	assert.Equal(t, []uint{1, 2, 3}, voterIds(all))
+}
+
+func TestMergeVoters(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2024, 3, d, 12, 0, 0, 0, time.UTC) }
+
+	t.Run("overlapping histories", func(t *testing.T) {
+		v, _ := newTestVoterList(t)
+		seedVoters(t, v, 3)
+		add := func(voterId int, pollId, voteId uint, d int) {
+			t.Helper()
+			_, err := v.AddPoll(voterId, VoterHistory{PollId: pollId, VoteId: voteId, VoteDate: day(d)}, PollOptions{})
+			require.NoError(t, err)
+		}
+		add(1, 1, 10, 1)
+		add(1, 2, 20, 5)
+		add(2, 2, 21, 2)
+		add(2, 1, 11, 3)
+		add(2, 3, 30, 4)
+		add(3, 1, 12, 1)
+
+		merged, err := v.MergeVoters(1, 2)
+		require.NoError(t, err)
+		assert.Equal(t, []VoterHistory{
+			{PollId: 1, VoteId: 11, VoteDate: day(3)},
+			{PollId: 2, VoteId: 20, VoteDate: day(5)},
+			{PollId: 3, VoteId: 30, VoteDate: day(4)},
+		}, merged.VoteHistory, "the later vote wins a poll both voted in")
+		assert.Equal(t, "Voter 1", merged.Name)
+
+		stored, err := v.GetVoter(1)
+		require.NoError(t, err)
+		assert.Equal(t, merged, stored)
+		_, err = v.GetVoter(2)
+		assert.ErrorIs(t, err, ErrVoterNotFound)
+		_, err = v.GetVoterByEmail("voter2@example.com")
+		assert.ErrorIs(t, err, ErrVoterNotFound, "the merged voter's email is free again")
+
+		total, err := v.GetVoteTotal()
+		require.NoError(t, err)
+		assert.Equal(t, 4, total)
+		counted, err := v.CountTotalVotes()
+		require.NoError(t, err)
+		assert.Equal(t, counted, total)
+	})
+
+	t.Run("disjoint histories", func(t *testing.T) {
+		v, _ := newTestVoterList(t)
+		seedVoters(t, v, 2)
+		for pollId := uint(1); pollId <= 2; pollId++ {
+			_, err := v.AddPoll(2, VoterHistory{PollId: pollId, VoteId: 1, VoteDate: day(int(pollId))}, PollOptions{})
+			require.NoError(t, err)
+		}
+		_, err := v.AddPoll(1, VoterHistory{PollId: 3, VoteId: 1, VoteDate: day(9)}, PollOptions{})
+		require.NoError(t, err)
+
+		merged, err := v.MergeVoters(1, 2)
+		require.NoError(t, err)
+		assert.Equal(t, []VoterHistory{
+			{PollId: 3, VoteId: 1, VoteDate: day(9)},
+			{PollId: 1, VoteId: 1, VoteDate: day(1)},
+			{PollId: 2, VoteId: 1, VoteDate: day(2)},
+		}, merged.VoteHistory, "the merged voter's votes come after the kept one's")
+		total, err := v.GetVoteTotal()
+		require.NoError(t, err)
+		assert.Equal(t, 3, total)
+	})
+
+	t.Run("missing voters", func(t *testing.T) {
+		v, _ := newTestVoterList(t)
+		seedVoters(t, v, 3)
+		require.NoError(t, v.SoftDeleteVoter(3))
+
+		_, err := v.MergeVoters(1, 42)
+		assert.ErrorIs(t, err, ErrVoterNotFound)
+		_, err = v.MergeVoters(42, 1)
+		assert.ErrorIs(t, err, ErrVoterNotFound)
+		_, err = v.MergeVoters(1, 3)
+		assert.ErrorIs(t, err, ErrVoterNotFound, "soft deleted voters are missing")
+		_, err = v.MergeVoters(1, 1)
+		assert.ErrorIs(t, err, ErrMergeSameVoter)
+
+		all, err := v.GetAllVoters()
+		require.NoError(t, err)
+		assert.Equal(t, []uint{1, 2}, voterIds(all), "nothing was deleted")
+	})
+}
+
+func TestHardDeleteOfSoftDeletedVoter(t *testing.T) {
+	v, mr := newTestVoterList(t)
+	seedVoters(t, v, 4)
+	require.NoError(t, v.SoftDeleteVoter(1))
+	require.NoError(t, v.SoftDeleteVoter(2))
+	require.NoError(t, v.SoftDeleteVoter(3))
+
+	require.NoError(t, v.DeleteVoter(1))
+	deleted, err := v.DeleteVoters([]int{2})
+	require.NoError(t, err)
+	assert.Equal(t, 1, deleted)
+	members, err := mr.Members(v.deletedKey())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"3"}, members)
+
+	//a new voter under a reused id starts out not deleted
+	voter := Voter{VoterId: 1, Name: "Voter 1", Email: "voter1@example.com", Deleted: true}
+	require.NoError(t, v.AddVoter(&voter))
+	got, err := v.GetVoter(1)
+	require.NoError(t, err)
+	assert.False(t, got.Deleted)
+
+	require.NoError(t, v.DeleteAll())
+	assert.False(t, mr.Exists(v.redisKeyFromId(3)), "DeleteAll removes soft deleted voters too")
+	assert.False(t, mr.Exists(v.deletedKey()))
+}
+
+func TestGetVoterIds(t *testing.T) {
+	v, _ := newTestVoterList(t)
+
+	ids, err := v.GetVoterIds()
+	require.NoError(t, err)
+	assert.Empty(t, ids)
+
+	seedVoters(t, v, 3)
+	require.NoError(t, v.DeleteVoter(2))
+	ids, err = v.GetVoterIds()
+	require.NoError(t, err)
+	assert.Equal(t, []uint{1, 3}, ids)
+}
+
+func TestDeleteAllEmpty(t *testing.T) {
+	v, _ := newTestVoterList(t)
+
+	assert.NoError(t, v.DeleteAll())
+	assert.NoError(t, v.DeleteAll())
+
+	seedVoters(t, v, 3)
+	assert.NoError(t, v.DeleteAll())
+	assert.NoError(t, v.DeleteAll())
+}
+
+func TestDeleteAllVoterGoneMeanwhile(t *testing.T) {
+	v, mr := newTestVoterList(t)
+	seedVoters(t, v, 3)
+
+	//voter 2 expires or is deleted between the scan and the unlink
+	rec := recordCommands(v)
+	rec.after = func(cmd redis.Cmder) {
+		if strings.EqualFold(cmd.Name(), "scan") {
+			mr.Del(v.redisKeyFromId(2))
+		}
+	}
+	require.NoError(t, v.DeleteAll())
+	rec.after = nil
+
+	ids, err := v.GetVoterIds()
+	require.NoError(t, err)
+	assert.Empty(t, ids)
+	for _, key := range []string{v.emailIndexKey(), v.votesTotalKey()} {
+		assert.False(t, mr.Exists(key), key)
+	}
+
+	//the index is cleared even when every voter has already gone
+	mr.HSet(v.emailIndexKey(), "gone@example.com", "9")
+	require.NoError(t, v.DeleteAll())
+	assert.False(t, mr.Exists(v.emailIndexKey()))
+}
+
+func TestAddVotersBatch(t *testing.T) {
+	v, _ := newTestVoterList(t)
+	seedVoters(t, v, 1)
+
+	rec := recordCommands(v)
+
+	voters := []Voter{
+		{VoterId: 1, Name: "Duplicate", Email: "dup@example.com"},
+		{VoterId: 2, Name: "Two", Email: "two@example.com"},
+		{Name: "Auto", Email: "auto@example.com"},
+		{VoterId: 4, Name: "Bad", Email: "not-an-email"},
+		{VoterId: 2, Name: "Two Again", Email: "two@example.com"},
+	}
+	added, errs := v.AddVoters(voters)
+	assert.Zero(t, rec.count("json.get"), "batch add should not read voters one by one")
+	assert.Equal(t, 2, added)
+	require.Len(t, errs, 3)
+
+	var batchErr *BatchError
+	require.ErrorAs(t, errs[0], &batchErr)
+	assert.Equal(t, 3, batchErr.Index)
+	assert.IsType(t, &ValidationError{}, batchErr.Err)
+
+	assert.ErrorIs(t, errs[1], ErrVoterExists)
+	require.ErrorAs(t, errs[1], &batchErr)
+	assert.Equal(t, 0, batchErr.Index)
+	assert.ErrorIs(t, errs[2], ErrVoterExists)
+	require.ErrorAs(t, errs[2], &batchErr)
+	assert.Equal(t, 4, batchErr.Index)
+
+	assert.NotZero(t, voters[2].VoterId)
+	_, err := v.GetVoter(int(voters[2].VoterId))
+	assert.NoError(t, err)
+
+	original, err := v.GetVoter(1)
+	require.NoError(t, err)
+	assert.Equal(t, "Voter 1", original.Name, "existing voter must not be overwritten")
+
+}
+
+func TestGetPollResults(t *testing.T) {
+	v, _ := newTestVoterList(t)
+	seedVoters(t, v, 4)
+
+	votes := map[int]VoterHistory{
+		1: {PollId: 5, VoteId: 1},
+		2: {PollId: 5, VoteId: 2},
+		3: {PollId: 5, VoteId: 1},
+		4: {PollId: 6, VoteId: 3},
+	}
+	for id, poll := range votes {
+		_, err := v.AddPoll(id, poll, PollOptions{})
+		require.NoError(t, err)
+	}
+
+	results, sampled, err := v.GetPollResultsSampled(5)
+	require.NoError(t, err)
+	assert.Equal(t, 4, sampled)
+	assert.Equal(t, map[uint]int{1: 2, 2: 1}, results)
+
+	results, err = v.GetPollResults(99)
+	require.NoError(t, err)
+	assert.NotNil(t, results)
+	assert.Empty(t, results)
+}
+
+func TestGetVotersInAllPolls(t *testing.T) {
+	v, _ := newTestVoterList(t)
+	seedVoters(t, v, 4)
+	//voter 1 voted in polls 1, 2 and 3, voter 2 in 1 and 2, voter 3 in 3,
+	//voter 4 in none
+	votes := map[int][]uint{1: {1, 2, 3}, 2: {1, 2}, 3: {3}}
+	for voterId, pollIds := range votes {
+		for _, pollId := range pollIds {
+			_, err := v.AddPoll(voterId, VoterHistory{PollId: pollId, VoteId: 1}, PollOptions{})
+			require.NoError(t, err)
+		}
+	}
+
+	ids, err := v.GetVotersInAllPolls([]uint{1, 2})
+	require.NoError(t, err)
+	assert.Equal(t, []uint{1, 2}, ids)
+
+	ids, err = v.GetVotersInAllPolls([]uint{1, 2, 3})
+	require.NoError(t, err)
+	assert.Equal(t, []uint{1}, ids)
+
+	ids, err = v.GetVotersInAllPolls([]uint{3, 3})
+	require.NoError(t, err)
+	assert.Equal(t, []uint{1, 3}, ids)
+
+	ids, err = v.GetVotersInAllPolls([]uint{2, 9})
+	require.NoError(t, err)
+	assert.NotNil(t, ids)
+	assert.Empty(t, ids)
+
+	_, err = v.GetVotersInAllPolls(nil)
+	assert.ErrorIs(t, err, ErrNoPolls)
+}
+
+func TestGetVotersForPoll(t *testing.T) {
+	v, _ := newTestVoterList(t)
+	seedVoters(t, v, 4)
+	for _, id := range []int{3, 1} {
+		_, err := v.AddPoll(id, VoterHistory{PollId: 7, VoteId: 1}, PollOptions{})
+		require.NoError(t, err)
+	}
+	_, err := v.AddPoll(2, VoterHistory{PollId: 8, VoteId: 1}, PollOptions{})
+	require.NoError(t, err)
+
+	ids, err := v.GetVotersForPoll(7)
+	require.NoError(t, err)
+	assert.Equal(t, []uint{1, 3}, ids)
+
+	ids, err = v.GetVotersForPoll(9)
+	require.NoError(t, err)
+	assert.NotNil(t, ids)
+	assert.Empty(t, ids)
+}
+
+func TestVoteDatesStoredInUTC(t *testing.T) {
+	v, _ := newTestVoterList(t)
+	seedVoters(t, v, 1)
+
+	berlin := time.FixedZone("CET", 3600)
+	voteDate := time.Date(2024, 3, 4, 10, 30, 0, 0, berlin)
+	_, err := v.AddPoll(1, VoterHistory{PollId: 1, VoteId: 1, VoteDate: voteDate}, PollOptions{})
+	require.NoError(t, err)
+	_, err = v.UpsertPoll(1, VoterHistory{PollId: 2, VoteId: 1, VoteDate: voteDate})
+	require.NoError(t, err)
+
+	raw, err := v.GetVoterField(1, ".VoteHistory[0].VoteDate")
+	require.NoError(t, err)
+	assert.JSONEq(t, `"2024-03-04T09:30:00Z"`, string(raw))
+
+	history, err := v.GetVoteHistory(1)
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+	for _, vote := range history {
+		assert.Equal(t, time.UTC, vote.VoteDate.Location())
+		assert.True(t, voteDate.Equal(vote.VoteDate))
+	}
+}
+
+func TestZeroVotesRejected(t *testing.T) {
+	v, _ := newTestVoterList(t)
+	seedVoters(t, v, 1)
+
+	var validationErr *ValidationError
+	_, err := v.AddPoll(1, VoterHistory{VoteId: 1}, PollOptions{})
+	require.ErrorAs(t, err, &validationErr)
+	assert.Equal(t, "PollId", validationErr.Field)
+
+	_, err = v.AddPoll(1, VoterHistory{PollId: 1}, PollOptions{})
+	require.ErrorAs(t, err, &validationErr)
+	assert.Equal(t, "VoteId", validationErr.Field)
+
+	_, err = v.UpsertPoll(1, VoterHistory{PollId: 1})
+	require.ErrorAs(t, err, &validationErr)
+	assert.Equal(t, "VoteId", validationErr.Field)
+
+	//nothing was stored
+	count, err := v.GetVoteCount(1)
+	require.NoError(t, err)
+	assert.Zero(t, count)
+}
+
+func TestVoterNotFound(t *testing.T) {
+	v, mr := newTestVoterList(t)
+	seedVoters(t, v, 1)
+
+	_, err := v.GetVoter(2)
+	assert.ErrorIs(t, err, ErrVoterNotFound)
+	assert.ErrorIs(t, v.DeleteVoter(2), ErrVoterNotFound)
+	_, err = v.AddPoll(2, VoterHistory{PollId: 1, VoteId: 1}, PollOptions{})
+	assert.ErrorIs(t, err, ErrVoterNotFound)
+
+	mr.Close()
+	_, err = v.GetVoter(1)
+	require.Error(t, err)
+	assert.NotErrorIs(t, err, ErrVoterNotFound)
+}
+
+func TestAddPollVoteDate(t *testing.T) {
+	v, _ := newTestVoterList(t)
+	seedVoters(t, v, 1)
+
+	clientTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.FixedZone("EST", -5*60*60))
+
+	tests := []struct {
+		name       string
+		pollId     uint
+		voteDate   time.Time
+		opts       PollOptions
+		serverTime bool
+	}{
+		{"zero date defaults to server time", 1, time.Time{}, PollOptions{}, true},
+		{"client date kept", 2, clientTime, PollOptions{}, false},
+		{"server time forced", 3, clientTime, PollOptions{ServerTime: true}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := time.Now().UTC()
+			_, err := v.AddPoll(1, VoterHistory{PollId: tt.pollId, VoteId: 1, VoteDate: tt.voteDate}, tt.opts)
+			require.NoError(t, err)
+			after := time.Now().UTC()
+
+			stored, err := v.GetSingleVoteHistory(1, tt.pollId)
+			require.NoError(t, err)
+			if !tt.serverTime {
+				assert.True(t, clientTime.Equal(stored.VoteDate))
+				return
+			}
+			assert.Equal(t, time.UTC, stored.VoteDate.Location())
+			assert.False(t, stored.VoteDate.Before(before.Truncate(time.Microsecond)))
+			assert.False(t, stored.VoteDate.After(after))
+		})
+	}
+}
+
+func TestGetAllVotersSorted(t *testing.T) {
+	v, _ := newTestVoterList(t)
+
+	voters := []Voter{
+		{VoterId: 1, Name: "Carol", Email: "carol@example.com", VoteHistory: []VoterHistory{{PollId: 1}}},
+		{VoterId: 2, Name: "Alice", Email: "alice@example.com", VoteHistory: []VoterHistory{{PollId: 1}, {PollId: 2}}},
+		{VoterId: 3, Name: "Bob", Email: "bob@example.com"},
+		{VoterId: 4, Name: "Alice", Email: "alice2@example.com", VoteHistory: []VoterHistory{{PollId: 1}}},
+	}
+	for i := range voters {
+		require.NoError(t, v.AddVoter(&voters[i]))
+	}
+
+	tests := []struct {
+		by   SortField
+		desc bool
+		ids  []uint
+	}{
+		{SortById, false, []uint{1, 2, 3, 4}},
+		{SortById, true, []uint{4, 3, 2, 1}},
+		{SortByName, false, []uint{2, 4, 3, 1}},
+		{SortByName, true, []uint{1, 3, 2, 4}},
+		{SortByPolls, false, []uint{3, 1, 4, 2}},
+		{SortByPolls, true, []uint{2, 1, 4, 3}},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s desc=%v", tt.by, tt.desc), func(t *testing.T) {
+			//Run it a few times, the order must not depend on redis
+			for i := 0; i < 3; i++ {
+				voterList, err := v.GetAllVotersSorted(tt.by, tt.desc)
+				require.NoError(t, err)
+				assert.Equal(t, tt.ids, voterIds(voterList))
+			}
+
+			page, total, err := v.GetVotersPagedSorted(1, 2, tt.by, tt.desc)
+			require.NoError(t, err)
+			assert.Equal(t, 4, total)
+			assert.Equal(t, tt.ids[1:3], voterIds(page))
+		})
+	}
+
+	_, err := v.GetAllVotersSorted("email", false)
+	assert.ErrorIs(t, err, ErrInvalidSort)
+}
+
+func voterIds(voterList []Voter) []uint {
+	ids := make([]uint, 0, len(voterList))
+	for _, voter := range voterList {
+		ids = append(ids, voter.VoterId)
+	}
+	return ids
+}
+
+func pollIdsOf(history []VoterHistory) []uint {
+	ids := make([]uint, 0, len(history))
+	for _, vote := range history {
+		ids = append(ids, vote.PollId)
+	}
+	return ids
+}
+
+func TestKeyPrefixIsolatesVoterLists(t *testing.T) {
+	tenantA, mr := newTestVoterList(t)
+	tenantA.SetKeyPrefix("tenant-a")
+	tenantB, err := NewWithCacheInstance(mr.Addr())
+	require.NoError(t, err)
+	t.Cleanup(func() { tenantB.Close() })
+	tenantB.SetKeyPrefix("tenant-a:b:")
+
+	seedVoters(t, tenantA, 2)
+	seedVoters(t, tenantB, 3)
+	assert.True(t, mr.Exists("tenant-a:1"))
+	assert.True(t, mr.Exists("tenant-a:b:1"))
+
+	//ids are counted per namespace
+	auto := Voter{Name: "Auto", Email: "auto@example.com"}
+	require.NoError(t, tenantB.AddVoter(&auto))
+	assert.Equal(t, uint(4), auto.VoterId)
+	assert.True(t, mr.Exists("tenant-a:b:id:seq"))
+	assert.False(t, mr.Exists("tenant-a:id:seq"))
+
+	//tenant-a's scan pattern would also match keys such as tenant-a:1b,
+	//those are not voters of tenant-a
+	require.NoError(t, mr.Set("tenant-a:1b", "x"))
+	countA, err := tenantA.CountVoters()
+	require.NoError(t, err)
+	assert.Equal(t, 2, countA)
+	countB, err := tenantB.CountVoters()
+	require.NoError(t, err)
+	assert.Equal(t, 4, countB)
+
+	_, err = tenantA.GetVoterByEmail("voter3@example.com")
+	assert.ErrorIs(t, err, ErrVoterNotFound)
+
+	require.NoError(t, tenantB.DeleteAll())
+	countB, err = tenantB.CountVoters()
+	require.NoError(t, err)
+	assert.Equal(t, 0, countB)
+
+	voters, err := tenantA.GetAllVoters()
+	require.NoError(t, err)
+	assert.Equal(t, []uint{1, 2}, voterIds(voters))
+	voter, err := tenantA.GetVoterByEmail("voter1@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, uint(1), voter.VoterId)
+
+	//an empty prefix restores the default
+	tenantA.SetKeyPrefix("")
+	assert.Equal(t, RedisKeyPrefix+"5", tenantA.redisKeyFromId(5))
+}
+
+func TestRedisOptionsFromEnv(t *testing.T) {
+	t.Run("defaults", func(t *testing.T) {
+		for _, env := range []string{"REDIS_USERNAME", "REDIS_PASSWORD", "REDIS_DB", "REDIS_TLS"} {
+			t.Setenv(env, "")
+		}
+		opts, err := redisOptions("localhost:6379")
+		require.NoError(t, err)
+		assert.Equal(t, "localhost:6379", opts.Addr)
+		assert.Empty(t, opts.Username)
+		assert.Empty(t, opts.Password)
+		assert.Zero(t, opts.DB)
+		assert.Nil(t, opts.TLSConfig)
+	})
+
+	t.Run("managed redis", func(t *testing.T) {
+		t.Setenv("REDIS_USERNAME", "voter")
+		t.Setenv("REDIS_PASSWORD", "s3cret")
+		t.Setenv("REDIS_DB", "2")
+		t.Setenv("REDIS_TLS", "true")
+
+		opts, err := redisOptions("redis.example.com:6380")
+		require.NoError(t, err)
+		assert.Equal(t, "voter", opts.Username)
+		assert.Equal(t, "s3cret", opts.Password)
+		assert.Equal(t, 2, opts.DB)
+		require.NotNil(t, opts.TLSConfig)
+		assert.Equal(t, "redis.example.com", opts.TLSConfig.ServerName)
+		assert.Equal(t, uint16(tls.VersionTLS12), opts.TLSConfig.MinVersion)
+	})
+
+	t.Run("tls off", func(t *testing.T) {
+		t.Setenv("REDIS_TLS", "false")
+		opts, err := redisOptions("localhost:6379")
+		require.NoError(t, err)
+		assert.Nil(t, opts.TLSConfig)
+	})
+
+	for env, value := range map[string]string{"REDIS_DB": "two", "REDIS_TLS": "maybe"} {
+		t.Run("invalid "+env, func(t *testing.T) {
+			t.Setenv(env, value)
+			_, err := redisOptions("localhost:6379")
+			assert.ErrorContains(t, err, env)
+		})
+	}
+}
+
+func TestPasswordProtectedRedis(t *testing.T) {
+	_, mr := newTestVoterList(t)
+	mr.RequireAuth("s3cret")
+
+	t.Setenv("REDIS_PASSWORD", "wrong")
+	_, err := NewWithCacheInstance(mr.Addr())
+	assert.Error(t, err)
+
+	t.Setenv("REDIS_PASSWORD", "s3cret")
+	v, err := NewWithCacheInstance(mr.Addr())
+	require.NoError(t, err)
+	v.Close()
+}
+
+func TestUnreachableRedis(t *testing.T) {
+	mr, err := memredis.Run()
+	require.NoError(t, err)
+	addr := mr.Addr()
+	mr.Close()
+
+	t.Setenv("REDIS_CONNECT_ATTEMPTS", "1")
+	_, err = NewWithCacheInstance(addr)
+	assert.ErrorIs(t, err, ErrUnreachable)
+
+	//a misconfiguration is not mistaken for redis being down
+	t.Setenv("REDIS_CONNECT_ATTEMPTS", "0")
+	_, err = NewWithCacheInstance(addr)
+	assert.NotErrorIs(t, err, ErrUnreachable)
+}
+
+// TestInMemory runs the basic operations against a voter list that is not
+// backed by a redis server
+func TestInMemory(t *testing.T) {
+	t.Setenv("REDIS_KEY_PREFIX", "demo:")
+	v, err := NewInMemory()
+	require.NoError(t, err)
+	t.Cleanup(func() { v.Close() })
+	assert.True(t, v.InMemory())
+	assert.True(t, v.WithContext(context.Background()).InMemory())
+	require.NoError(t, v.Ping())
+
+	voter := Voter{VoterId: 1, Name: "Ada", Email: "ada@example.com"}
+	require.NoError(t, v.AddVoter(&voter))
+	assert.ErrorIs(t, v.AddVoter(&voter), ErrVoterExists)
+
+	got, err := v.GetVoter(1)
+	require.NoError(t, err)
+	got.Name = "Ada Lovelace"
+	require.NoError(t, v.UpdateVoter(&got))
+	_, err = v.AddPoll(1, VoterHistory{PollId: 1, VoteId: 2}, PollOptions{})
+	require.NoError(t, err)
+
+	got, err = v.GetVoter(1)
+	require.NoError(t, err)
+	assert.Equal(t, "Ada Lovelace", got.Name)
+	require.Len(t, got.VoteHistory, 1)
+
+	require.NoError(t, v.DeleteVoter(1))
+	_, err = v.GetVoter(1)
+	assert.ErrorIs(t, err, ErrVoterNotFound)
+
+	seedVoters(t, v, 3)
+	voters, err := v.GetAllVoters()
+	require.NoError(t, err)
+	assert.Len(t, voters, 3)
+
+	//each one is its own store
+	other, err := NewInMemory()
+	require.NoError(t, err)
+	defer other.Close()
+	count, err := other.CountVoters()
+	require.NoError(t, err)
+	assert.Zero(t, count)
+
+	_, mr := newTestVoterList(t)
+	redisBacked, err := NewWithCacheInstance(mr.Addr())
+	require.NoError(t, err)
+	defer redisBacked.Close()
+	assert.False(t, redisBacked.InMemory())
+}
+
+func TestRedisPoolAndTimeoutOptions(t *testing.T) {
+	opts, err := redisOptions("localhost:6379")
+	require.NoError(t, err)
+	assert.Equal(t, DefaultRedisPoolSize*runtime.GOMAXPROCS(0), opts.PoolSize)
+	assert.Equal(t, DefaultRedisDialTimeout, opts.DialTimeout)
+	assert.Equal(t, DefaultRedisReadTimeout, opts.ReadTimeout)
+	assert.Equal(t, DefaultRedisWriteTimeout, opts.WriteTimeout)
+
+	t.Setenv("REDIS_POOL_SIZE", "42")
+	t.Setenv("REDIS_DIAL_TIMEOUT", "2s")
+	t.Setenv("REDIS_READ_TIMEOUT", "250ms")
+	t.Setenv("REDIS_WRITE_TIMEOUT", "1m")
+	opts, err = redisOptions("localhost:6379")
+	require.NoError(t, err)
+	assert.Equal(t, 42, opts.PoolSize)
+	assert.Equal(t, 2*time.Second, opts.DialTimeout)
+	assert.Equal(t, 250*time.Millisecond, opts.ReadTimeout)
+	assert.Equal(t, time.Minute, opts.WriteTimeout)
+
+	for env, value := range map[string]string{"REDIS_POOL_SIZE": "0", "REDIS_READ_TIMEOUT": "3"} {
+		t.Run("invalid "+env, func(t *testing.T) {
+			t.Setenv(env, value)
+			_, err := redisOptions("localhost:6379")
+			assert.ErrorContains(t, err, env)
+		})
+	}
+
+	retry, err := connectRetryFromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, retryPolicy{attempts: DefaultRedisConnectTries, backoff: DefaultRedisConnectBackoff}, retry)
+
+	t.Setenv("REDIS_CONNECT_ATTEMPTS", "9")
+	t.Setenv("REDIS_CONNECT_BACKOFF", "10ms")
+	retry, err = connectRetryFromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, retryPolicy{attempts: 9, backoff: 10 * time.Millisecond}, retry)
+
+	t.Setenv("REDIS_CONNECT_ATTEMPTS", "0")
+	_, err = connectRetryFromEnv()
+	assert.ErrorContains(t, err, "REDIS_CONNECT_ATTEMPTS")
+
+	retry, err = commandRetryFromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, retryPolicy{attempts: DefaultRedisRetryAttempts, backoff: DefaultRedisRetryBackoff}, retry)
+
+	t.Setenv("REDIS_RETRY_ATTEMPTS", "5")
+	t.Setenv("REDIS_RETRY_BACKOFF", "1ms")
+	retry, err = commandRetryFromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, retryPolicy{attempts: 5, backoff: time.Millisecond}, retry)
+
+	t.Setenv("REDIS_RETRY_BACKOFF", "soon")
+	_, err = commandRetryFromEnv()
+	assert.ErrorContains(t, err, "REDIS_RETRY_BACKOFF")
+}
+
+// flakyDialer refuses the first failures dials, the way a redis that is
+// still starting up would, and then connects for real
+type flakyDialer struct {
+	mu       sync.Mutex
+	failures int
+	dials    int
+}
+
+func (d *flakyDialer) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.mu.Lock()
+	d.dials++
+	fail := d.dials <= d.failures
+	d.mu.Unlock()
+
+	if fail {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: errors.New("connection refused")}
+	}
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, network, addr)
+}
+
+func (d *flakyDialer) count() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.dials
+}
+
+// flakyCommands is a go-redis hook that fails the first failures commands
+// with the given name, as a connection that drops now and then would
+type flakyCommands struct {
+	name     string
+	failures int
+
+	mu    sync.Mutex
+	calls int
+}
+
+func (f *flakyCommands) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (f *flakyCommands) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if strings.EqualFold(cmd.Name(), f.name) {
+			f.mu.Lock()
+			f.calls++
+			fail := f.calls <= f.failures
+			f.mu.Unlock()
+			if fail {
+				err := errors.New("read: connection reset by peer")
+				cmd.SetErr(err)
+				return err
+			}
+		}
+		return next(ctx, cmd)
+	}
+}
+
+func (f *flakyCommands) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
+func (f *flakyCommands) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls
+}
+
+func TestTransientErrorsAreRetried(t *testing.T) {
+	v, _ := newTestVoterList(t)
+	seedVoters(t, v, 1)
+	v.retry = retryPolicy{attempts: 3, backoff: time.Millisecond}
+
+	flaky := &flakyCommands{name: "json.get", failures: 2}
+	v.AddHook(flaky)
+	voter, err := v.GetVoter(1)
+	require.NoError(t, err)
+	assert.Equal(t, "Voter 1", voter.Name)
+	assert.Equal(t, 3, flaky.count())
+}
+
+func TestRetriesAreCapped(t *testing.T) {
+	v, _ := newTestVoterList(t)
+	seedVoters(t, v, 1)
+	v.retry = retryPolicy{attempts: 3, backoff: time.Millisecond}
+
+	flaky := &flakyCommands{name: "json.get", failures: 100}
+	v.AddHook(flaky)
+	_, err := v.GetVoter(1)
+	assert.ErrorContains(t, err, "connection reset")
+	assert.Equal(t, 3, flaky.count())
+}
+
+func TestMissingVoterIsNotRetried(t *testing.T) {
+	v, _ := newTestVoterList(t)
+	v.retry = retryPolicy{attempts: 3, backoff: time.Millisecond}
+
+	rec := recordCommands(v)
+	_, err := v.GetVoter(1)
+	assert.ErrorIs(t, err, ErrVoterNotFound)
+	assert.Equal(t, 1, rec.count("json.get"))
+}
+
+func TestConnectRetriesUntilRedisIsReady(t *testing.T) {
+	_, mr := newTestVoterList(t)
+	retry := retryPolicy{attempts: 5, backoff: time.Millisecond}
+
+	dialer := &flakyDialer{failures: 3}
+	opts, err := redisOptions(mr.Addr())
+	require.NoError(t, err)
+	opts.Dialer = dialer.dial
+	opts.MaxRetries = -1
+
+	v, err := newWithOptions(opts, retry)
+	require.NoError(t, err)
+	v.Close()
+	assert.Equal(t, 4, dialer.count())
+
+	//Redis never comes up
+	dialer = &flakyDialer{failures: 100}
+	opts.Dialer = dialer.dial
+	_, err = newWithOptions(opts, retry)
+	assert.ErrorContains(t, err, "unable to connect to redis")
+	//The pool may redial in the background, so only the minimum is known
+	assert.GreaterOrEqual(t, dialer.count(), retry.attempts)
+}
+
+func TestCountVotersOnlyScansKeys(t *testing.T) {
+	v, _ := newTestVoterList(t)
+	seedVoters(t, v, 7)
+
+	rec := recordCommands(v)
+	count, err := v.CountVoters()
+	require.NoError(t, err)
+	assert.Equal(t, 7, count)
+	assert.Positive(t, rec.count("scan"))
+	assert.Zero(t, rec.count("json.get"), "counting must not load any voters")
+	assert.Zero(t, rec.count("keys"))
+}
+
+func TestUpdateVoterPreventsLostUpdates(t *testing.T) {
+	v, _ := newTestVoterList(t)
+	seedVoters(t, v, 1)
+
+	//Two clients read the same voter
+	alice, err := v.GetVoter(1)
+	require.NoError(t, err)
+	bob, err := v.GetVoter(1)
+	require.NoError(t, err)
+	assert.Equal(t, uint(1), alice.Version)
+
+	alice.Name = "Changed by Alice"
+	require.NoError(t, v.UpdateVoter(&alice))
+	assert.Equal(t, uint(2), alice.Version)
+
+	//Bob still has version 1, his write would silently undo Alice's
+	bob.Email = "bob@example.com"
+	assert.ErrorIs(t, v.UpdateVoter(&bob), ErrVersionConflict)
+
+	stored, err := v.GetVoter(1)
+	require.NoError(t, err)
+	assert.Equal(t, "Changed by Alice", stored.Name)
+	assert.Equal(t, "voter1@example.com", stored.Email)
+	assert.Equal(t, uint(2), stored.Version)
+
+	//Reloading and retrying works
+	bob = stored
+	bob.Email = "bob@example.com"
+	require.NoError(t, v.UpdateVoter(&bob))
+	assert.Equal(t, uint(3), bob.Version)
+
+	//Poll writes bump the version too
+	_, err = v.AddPoll(1, VoterHistory{PollId: 1, VoteId: 1}, PollOptions{})
+	require.NoError(t, err)
+	assert.ErrorIs(t, v.UpdateVoter(&bob), ErrVersionConflict)
+
+	//Without a version the write is unconditional
+	bob.Version = 0
+	require.NoError(t, v.UpdateVoter(&bob))
+	assert.Equal(t, uint(5), bob.Version)
+
+	missing := Voter{VoterId: 9, Name: "Missing", Email: "missing@example.com"}
+	assert.ErrorIs(t, v.UpdateVoter(&missing), ErrVoterNotFound)
+}
+
+func TestUpdateVoterNilHistoryKeepsStoredHistory(t *testing.T) {
+	v, _ := newTestVoterList(t)
+	seedVoters(t, v, 1)
+	_, err := v.AddPoll(1, VoterHistory{PollId: 5, VoteId: 1}, PollOptions{})
+	require.NoError(t, err)
+
+	voter := Voter{VoterId: 1, Name: "Renamed", Email: "voter1@example.com"}
+	require.NoError(t, v.UpdateVoter(&voter))
+	require.Len(t, voter.VoteHistory, 1)
+
+	stored, err := v.GetVoter(1)
+	require.NoError(t, err)
+	assert.Equal(t, "Renamed", stored.Name)
+	require.Len(t, stored.VoteHistory, 1)
+	assert.Equal(t, uint(5), stored.VoteHistory[0].PollId)
+
+	voter.VoteHistory = []VoterHistory{}
+	require.NoError(t, v.UpdateVoter(&voter))
+	stored, err = v.GetVoter(1)
+	require.NoError(t, err)
+	assert.Empty(t, stored.VoteHistory)
+}
+
+func TestUpsertVoter(t *testing.T) {
+	v, _ := newTestVoterList(t)
+
+	voter := Voter{VoterId: 4, Name: "First", Email: "first@example.com",
+		VoteHistory: []VoterHistory{{PollId: 1, VoteId: 2}}}
+	created, err := v.UpsertVoter(&voter)
+	require.NoError(t, err)
+	assert.True(t, created)
+
+	again := Voter{VoterId: 4, Name: "Second", Email: "second@example.com"}
+	created, err = v.UpsertVoter(&again)
+	require.NoError(t, err)
+	assert.False(t, created)
+	assert.Equal(t, uint(2), again.Version)
+
+	stored, err := v.GetVoter(4)
+	require.NoError(t, err)
+	assert.Equal(t, "Second", stored.Name)
+	assert.Equal(t, voter.VoteHistory, stored.VoteHistory)
+
+	found, err := v.GetVoterByEmail("second@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, uint(4), found.VoterId)
+
+	_, err = v.UpsertVoter(&Voter{VoterId: 5, Name: "No Email"})
+	var validationErr *ValidationError
+	assert.ErrorAs(t, err, &validationErr)
+}
+
+func TestPatchVoter(t *testing.T) {
+	v, _ := newTestVoterList(t)
+	seedVoters(t, v, 1)
+	_, err := v.AddPoll(1, VoterHistory{PollId: 3, VoteId: 2}, PollOptions{})
+	require.NoError(t, err)
+	before, err := v.GetVoter(1)
+	require.NoError(t, err)
+
+	name := "Patched"
+	patched, err := v.PatchVoter(1, VoterPatch{Name: &name})
+	require.NoError(t, err)
+	assert.Equal(t, "Patched", patched.Name)
+	assert.Equal(t, before.Version+1, patched.Version)
+
+	stored, err := v.GetVoter(1)
+	require.NoError(t, err)
+	assert.Equal(t, "Patched", stored.Name)
+	assert.Equal(t, before.Email, stored.Email)
+	assert.Equal(t, before.VoteHistory, stored.VoteHistory)
+
+	email := "not an email"
+	_, err = v.PatchVoter(1, VoterPatch{Email: &email})
+	var validationErr *ValidationError
+	assert.ErrorAs(t, err, &validationErr)
+
+	_, err = v.PatchVoter(1, VoterPatch{Name: &name, Version: before.Version})
+	assert.ErrorIs(t, err, ErrVersionConflict)
+
+	_, err = v.PatchVoter(99, VoterPatch{Name: &name})
+	assert.ErrorIs(t, err, ErrVoterNotFound)
+}
+
+func TestUpdateVoterConflictsWithConcurrentWrite(t *testing.T) {
+	v, _ := newTestVoterList(t)
+	seedVoters(t, v, 1)
+	other, err := NewWithCacheInstance(v.cacheClient.Options().Addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { other.Close() })
+
+	//Another client writes the voter right after UpdateVoter has read it
+	//and checked the version, only WATCH can notice this
+	rec := recordCommands(v)
+	interfered := false
+	pollId := uint(6)
+	rec.after = func(cmd redis.Cmder) {
+		if interfered || strings.ToLower(cmd.Name()) != "json.get" {
+			return
+		}
+		interfered = true
+		pollId++
+		_, err := other.AddPoll(1, VoterHistory{PollId: pollId, VoteId: 1}, PollOptions{})
+		require.NoError(t, err)
+	}
+
+	voter := Voter{VoterId: 1, Name: "Renamed", Email: "voter1@example.com", Version: 1}
+	assert.ErrorIs(t, v.UpdateVoter(&voter), ErrVersionConflict)
+	require.True(t, interfered)
+
+	stored, err := v.GetVoter(1)
+	require.NoError(t, err)
+	assert.Equal(t, "Voter 1", stored.Name)
+	assert.Len(t, stored.VoteHistory, 1)
+
+	//Without a version nothing was asked to be checked, the update is
+	//simply tried again on top of the other write
+	interfered = false
+	voter = Voter{VoterId: 1, Name: "Renamed", Email: "voter1@example.com"}
+	require.NoError(t, v.UpdateVoter(&voter))
+	require.True(t, interfered)
+
+	stored, err = v.GetVoter(1)
+	require.NoError(t, err)
+	assert.Equal(t, "Renamed", stored.Name)
+	assert.Len(t, stored.VoteHistory, 2, "the other client's vote is kept")
+}
+
+func TestGetVoterByEmail(t *testing.T) {
+	v, mr := newTestVoterList(t)
+	seedVoters(t, v, 3)
+
+	rec := recordCommands(v)
+	voter, err := v.GetVoterByEmail("Voter2@Example.com")
+	require.NoError(t, err)
+	assert.Equal(t, uint(2), voter.VoterId)
+	assert.Zero(t, rec.count("scan"), "lookup must not scan the voters")
+
+	_, err = v.GetVoterByEmail("nobody@example.com")
+	assert.ErrorIs(t, err, ErrVoterNotFound)
+
+	//Changing the email moves the index entry
+	voter.Email = "new2@example.com"
+	require.NoError(t, v.UpdateVoter(&voter))
+	_, err = v.GetVoterByEmail("voter2@example.com")
+	assert.ErrorIs(t, err, ErrVoterNotFound)
+	voter, err = v.GetVoterByEmail("new2@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, uint(2), voter.VoterId)
+
+	//Deleting removes it
+	require.NoError(t, v.DeleteVoter(2))
+	_, err = v.GetVoterByEmail("new2@example.com")
+	assert.ErrorIs(t, err, ErrVoterNotFound)
+	assert.Empty(t, mr.HGet(v.emailIndexKey(), "new2@example.com"))
+
+	//Batch adds are indexed too
+	added, errs := v.AddVoters([]Voter{{Name: "Batch", Email: "batch@example.com"}})
+	require.Empty(t, errs)
+	require.Equal(t, 1, added)
+	voter, err = v.GetVoterByEmail("batch@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "Batch", voter.Name)
+
+	//An expired voter leaves a stale entry that is cleaned up on lookup
+	expiring := Voter{VoterId: 50, Name: "Expiring", Email: "expiring@example.com"}
+	require.NoError(t, v.AddVoterWithTTL(&expiring, time.Second))
+	mr.FastForward(2 * time.Second)
+	_, err = v.GetVoterByEmail("expiring@example.com")
+	assert.ErrorIs(t, err, ErrVoterNotFound)
+	assert.Empty(t, mr.HGet(v.emailIndexKey(), "expiring@example.com"))
+
+	require.NoError(t, v.DeleteAll())
+	assert.False(t, mr.Exists(v.emailIndexKey()))
+}
+
+func TestRebuildIndexes(t *testing.T) {
+	v, mr := newTestVoterList(t)
+	seedVoters(t, v, 3)
+	require.NoError(t, v.SoftDeleteVoter(3))
+
+	//Point one email at the wrong voter, lose another, leave a stale one
+	//and wind the counter back
+	index := v.emailIndexKey()
+	mr.HSet(index, "voter1@example.com", "2")
+	mr.HDel(index, "voter2@example.com")
+	mr.HSet(index, "ghost@example.com", "9")
+	require.NoError(t, mr.Set(v.idSeqKey(), "1"))
+	_, err := v.GetVoterByEmail("voter1@example.com")
+	require.ErrorIs(t, err, ErrVoterNotFound)
+
+	//Running it twice leaves the same indexes
+	for i := 0; i < 2; i++ {
+		require.NoError(t, v.RebuildIndexes())
+
+		for _, id := range []uint{1, 2} {
+			voter, err := v.GetVoterByEmail(fmt.Sprintf("voter%d@example.com", id))
+			require.NoError(t, err)
+			assert.Equal(t, id, voter.VoterId)
+		}
+		assert.Equal(t, "3", mr.HGet(index, "voter3@example.com"), "a soft deleted voter keeps its email")
+		assert.Empty(t, mr.HGet(index, "ghost@example.com"))
+		seq, err := mr.Get(v.idSeqKey())
+		require.NoError(t, err)
+		assert.Equal(t, "3", seq)
+	}
+
+	voter := Voter{Name: "New", Email: "new@example.com"}
+	require.NoError(t, v.AddVoter(&voter))
+	assert.Equal(t, uint(4), voter.VoterId)
+
+	//With no voters left both indexes are emptied
+	require.NoError(t, v.DeleteAll())
+	require.NoError(t, v.RebuildIndexes())
+	assert.False(t, mr.Exists(index))
+	seq, err := mr.Get(v.idSeqKey())
+	require.NoError(t, err)
+	assert.Equal(t, "0", seq)
+}
+
+func TestDuplicateEmails(t *testing.T) {
+	v, mr := newTestVoterList(t)
+	seedVoters(t, v, 2)
+
+	//emails are compared ignoring case, whether or not the id is picked
+	dup := Voter{VoterId: 3, Name: "Copy", Email: "VOTER1@example.com"}
+	assert.ErrorIs(t, v.AddVoter(&dup), ErrEmailTaken)
+	dup.VoterId = 0
+	assert.ErrorIs(t, v.AddVoter(&dup), ErrEmailTaken)
+	assert.Zero(t, dup.VoterId)
+
+	//the voter's own email is not a collision, the id is
+	same := Voter{VoterId: 1, Name: "Voter 1", Email: "voter1@example.com"}
+	assert.ErrorIs(t, v.AddVoter(&same), ErrVoterExists)
+
+	//a soft deleted voter keeps its email
+	require.NoError(t, v.SoftDeleteVoter(2))
+	dup = Voter{VoterId: 3, Name: "Copy", Email: "voter2@example.com"}
+	assert.ErrorIs(t, v.AddVoter(&dup), ErrEmailTaken)
+
+	//without the index every voter is read instead
+	mr.Del(v.emailIndexKey())
+	assert.ErrorIs(t, v.AddVoter(&dup), ErrEmailTaken)
+	dup.Email = "voter3@example.com"
+	require.NoError(t, v.AddVoter(&dup))
+
+	//updating a voter may keep its email but not take another voter's
+	voter, err := v.GetVoter(1)
+	require.NoError(t, err)
+	voter.Name = "Renamed"
+	require.NoError(t, v.UpdateVoter(&voter))
+	voter.Email = "Voter1@Example.com"
+	require.NoError(t, v.UpdateVoter(&voter))
+	voter.Email = "voter3@example.com"
+	assert.ErrorIs(t, v.UpdateVoter(&voter), ErrEmailTaken)
+	_, err = v.PatchVoter(1, VoterPatch{Email: &voter.Email})
+	assert.ErrorIs(t, err, ErrEmailTaken)
+
+	voter, err = v.GetVoter(1)
+	require.NoError(t, err)
+	assert.Equal(t, "Renamed", voter.Name)
+	assert.Equal(t, "voter1@example.com", voter.Email)
+}
+
+func TestAddVotersDuplicateEmails(t *testing.T) {
+	v, _ := newTestVoterList(t)
+	seedVoters(t, v, 1)
+
+	voters := []Voter{
+		{VoterId: 5, Name: "Copy", Email: "voter1@example.com"},
+		{VoterId: 6, Name: "Copy", Email: "VOTER1@example.com"},
+		{VoterId: 7, Name: "New", Email: "new@example.com"},
+		{VoterId: 8, Name: "New Again", Email: "New@Example.com"},
+	}
+	added, errs := v.AddVoters(voters)
+	assert.Equal(t, 1, added)
+	require.Len(t, errs, 3)
+	for n, index := range []int{0, 1, 3} {
+		var batchErr *BatchError
+		require.ErrorAs(t, errs[n], &batchErr)
+		assert.Equal(t, index, batchErr.Index)
+		assert.ErrorIs(t, errs[n], ErrEmailTaken)
+	}
+
+	for _, id := range []int{5, 6, 8} {
+		_, err := v.GetVoter(id)
+		assert.ErrorIs(t, err, ErrVoterNotFound, "voter %d", id)
+	}
+	owner, err := v.GetVoterByEmail("voter1@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, uint(1), owner.VoterId, "the index still points at the first owner")
+	owner, err = v.GetVoterByEmail("new@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, uint(7), owner.VoterId)
+}
+
+func TestIndexEmailsKeepsOtherOwners(t *testing.T) {
+	v, _ := newTestVoterList(t)
+	seedVoters(t, v, 1)
+
+	require.NoError(t, v.indexEmails(Voter{VoterId: 9, Email: "voter1@example.com"}))
+	owner, err := v.GetVoterByEmail("voter1@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, uint(1), owner.VoterId)
+}
+
+func TestEmailsAreNormalized(t *testing.T) {
+	v, _ := newTestVoterList(t)
+
+	voter := Voter{Name: "Mixed Case", Email: "  User@Example.COM "}
+	require.NoError(t, v.AddVoter(&voter))
+	assert.Equal(t, "user@example.com", voter.Email, "the stored email is written back")
+	stored, err := v.GetVoter(int(voter.VoterId))
+	require.NoError(t, err)
+	assert.Equal(t, "user@example.com", stored.Email)
+
+	for _, email := range []string{"user@example.com", "USER@EXAMPLE.COM", " User@Example.com"} {
+		found, err := v.GetVoterByEmail(email)
+		require.NoError(t, err, email)
+		assert.Equal(t, voter.VoterId, found.VoterId, email)
+	}
+
+	dup := Voter{Name: "Copy", Email: "user@EXAMPLE.com"}
+	assert.ErrorIs(t, v.AddVoter(&dup), ErrEmailTaken)
+
+	added, errs := v.AddVoters([]Voter{{Name: "Batch", Email: "Batch@Example.com"}})
+	require.Empty(t, errs)
+	require.Equal(t, 1, added)
+	found, err := v.GetVoterByEmail("batch@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "batch@example.com", found.Email)
+
+	stored.Email = "New@Example.com"
+	require.NoError(t, v.UpdateVoter(&stored))
+	assert.Equal(t, "new@example.com", stored.Email)
+	_, err = v.GetVoterByEmail("user@example.com")
+	assert.ErrorIs(t, err, ErrVoterNotFound)
+	found, err = v.GetVoterByEmail("NEW@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, voter.VoterId, found.VoterId)
+}
+
+func TestCorruptVoterSkipped(t *testing.T) {
+	v, mr := newTestVoterList(t)
+	seedVoters(t, v, 3)
+	mr.Set("voter:7", `{"VoterId":"seven"}`)
+	mr.HSet("voter:8", "Name", "not json")
+
+	voters, err := v.GetAllVoters()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []uint{1, 2, 3}, voterIds(voters), "corrupt voters are left out")
+	assert.Equal(t, 2, v.Skipped())
+
+	_, err = v.GetVoter(7)
+	assert.ErrorIs(t, err, ErrCorruptVoter)
+	_, err = v.GetVoter(8)
+	assert.ErrorIs(t, err, ErrCorruptVoter)
+
+	//writes that read the voter first say so too
+	assert.ErrorIs(t, v.UpdateVoter(&Voter{VoterId: 7, Name: "Seven", Email: "seven@example.com"}), ErrCorruptVoter)
+	assert.ErrorIs(t, v.SoftDeleteVoter(7), ErrCorruptVoter)
+
+	fresh := v.WithContext(context.Background())
+	voters, err = fresh.GetVotersByIds([]int{7, 2, 8})
+	require.NoError(t, err)
+	assert.Equal(t, []uint{2}, voterIds(voters))
+	assert.Equal(t, 2, fresh.Skipped(), "counted per request")
+}
+
+func TestGetVotersByIds(t *testing.T) {
+	v, _ := newTestVoterList(t)
+	seedVoters(t, v, 5)
+	require.NoError(t, v.SoftDeleteVoter(4))
+	rec := recordCommands(v)
+
+	voters, err := v.GetVotersByIds([]int{5, 42, 1, 3, 1, 4})
+	require.NoError(t, err)
+	assert.Equal(t, []uint{5, 1, 3}, voterIds(voters), "in the order asked for, missing and deleted ones left out")
+	assert.Equal(t, "Voter 5", voters[0].Name)
+	assert.Equal(t, 5, rec.count("json.get"), "one read per distinct id")
+
+	voters, err = v.IncludeDeleted().GetVotersByIds([]int{4})
+	require.NoError(t, err)
+	assert.Equal(t, []uint{4}, voterIds(voters))
+
+	voters, err = v.GetVotersByIds([]int{42, 43})
+	require.NoError(t, err)
+	assert.Empty(t, voters)
+	assert.NotNil(t, voters)
+	voters, err = v.GetVotersByIds(nil)
+	require.NoError(t, err)
+	assert.Empty(t, voters)
+}
@@ -0,0 +1,46 @@
+package db
+
+import (
+	"github.com/redis/go-redis/v9"
+)
+
+// RebuildIndexes repairs the email index and the id counter from the
+// voters themselves, for when they have drifted, say after editing redis by
+// hand.  Every voter is read, soft deleted ones included since they keep
+// their email, and the index is replaced in one transaction along with
+// setting the counter to the highest voter id.  When two voters share an
+// email the one with the lower id gets it.  Running it again changes
+// nothing.  Voters written while it runs may be missed until the next
+// rebuild.
+func (v *VoterList) RebuildIndexes() error {
+	var highest uint
+	owners := make(map[string]uint)
+	err := v.IncludeDeleted().EachVoter(func(voter Voter) error {
+		highest = max(highest, voter.VoterId)
+		field := NormalizeEmail(voter.Email)
+		if field == "" {
+			return nil
+		}
+		if owner, ok := owners[field]; !ok || voter.VoterId < owner {
+			owners[field] = voter.VoterId
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	fields := make([]any, 0, 2*len(owners))
+	for field, id := range owners {
+		fields = append(fields, field, id)
+	}
+	_, err = v.cacheClient.TxPipelined(v.context, func(pipe redis.Pipeliner) error {
+		pipe.Del(v.context, v.emailIndexKey())
+		if len(fields) > 0 {
+			pipe.HSet(v.context, v.emailIndexKey(), fields...)
+		}
+		pipe.Set(v.context, v.idSeqKey(), highest, 0)
+		return nil
+	})
+	return err
+}
@@ -0,0 +1,203 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrNoVotesChannel is returned by SubscribeVotes when no channel has been
+// set with SetVotesChannel
+var ErrNoVotesChannel = errors.New("no votes channel set")
+
+// SetVotesChannel has every new vote published to channel, a redis pub/sub
+// channel, as well as handed to the vote hook.  Every voter list using the
+// same redis and channel can then see it with SubscribeVotes.  The channel
+// is used as it is, it is not put under the key prefix.  An empty channel
+// stops publishing.
+func (v *VoterList) SetVotesChannel(channel string) {
+	v.votesChannel = channel
+}
+
+// publishVote sends vote to the votes channel, if there is one
+func (v *VoterList) publishVote(vote VoteEvent) {
+	if v.votesChannel == "" {
+		return
+	}
+	raw, err := json.Marshal(vote)
+	if err != nil {
+		return
+	}
+	//The vote is stored whether or not this works, so the error is only
+	//logged by errorLogHook.  It is sent even if the client has gone away.
+	v.cacheClient.Publish(context.WithoutCancel(v.context), v.votesChannel, raw)
+}
+
+// SubscribeVotes calls hook with every vote published to the votes
+// channel, by this voter list or any other, until ctx is cancelled.  It
+// returns once redis has confirmed the subscription, votes published after
+// that are not missed.  hook is called on a goroutine of its own, one vote
+// at a time.  The subscription is restored if the connection drops, votes
+// published while it is down are lost.
+func (v *VoterList) SubscribeVotes(ctx context.Context, hook func(VoteEvent)) error {
+	if v.votesChannel == "" {
+		return ErrNoVotesChannel
+	}
+
+	sub := v.cacheClient.Subscribe(ctx, v.votesChannel)
+	if _, err := sub.Receive(ctx); err != nil {
+		sub.Close()
+		return err
+	}
+
+	go func() {
+		defer sub.Close()
+		msgs := sub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-msgs:
+				if !ok {
+					return
+				}
+				var vote VoteEvent
+				if err := json.Unmarshal([]byte(msg.Payload), &vote); err != nil {
+					slog.Warn("Ignoring malformed vote", "channel", msg.Channel, "error", err)
+					continue
+				}
+				hook(vote)
+			}
+		}
+	}()
+	return nil
+}
+
+// PollBatchError describes why one vote of a batch was not added
+type PollBatchError struct {
+	Index  int
+	PollId uint
+	Err    error
+}
+
+func (e *PollBatchError) Error() string {
+	return fmt.Sprintf("poll %d (item %d): %v", e.PollId, e.Index, e.Err)
+}
+
+func (e *PollBatchError) Unwrap() error {
+	return e.Err
+}
+
+// AddPolls records many votes for the voter at once, such as a backfilled
+// history, writing the new history with a single JSON.SET.  Votes are
+// checked like AddPoll checks them, one for a poll the voter already voted
+// in, or that comes up earlier in the batch, is skipped with
+// ErrDuplicatePoll.  Invalid votes and votes in closed polls are skipped
+// too, as are votes past the cap set with SetMaxVoteHistory unless the
+// policy is EvictOldestVote, in which case the voter's oldest votes make
+// room.  Each skipped vote is reported as a *PollBatchError in errs, the
+// rest are appended in the order given.  The voter is read and written
+// under WATCH, which is tried again if it changes meanwhile,
+// ErrVersionConflict is returned if it keeps changing.  It returns the
+// voter as it was stored.
+func (v *VoterList) AddPolls(voterId int, polls []VoterHistory) (voter Voter, errs []error, err error) {
+	redisKey := v.redisKeyFromId(voterId)
+
+	//Every poll is checked once, before the transaction
+	open := make(map[uint]bool)
+	for _, poll := range polls {
+		if _, checked := open[poll.PollId]; checked || poll.Validate() != nil {
+			continue
+		}
+		if open[poll.PollId], err = v.PollOpen(poll.PollId); err != nil {
+			return Voter{}, nil, err
+		}
+	}
+
+	var added []VoterHistory
+	update := func(tx *redis.Tx) error {
+		existing, err := v.getVoterInTx(tx, redisKey)
+		if err != nil {
+			return err
+		}
+
+		voter, errs, added = existing, nil, nil
+		seen := make(map[uint]bool, len(existing.VoteHistory)+len(polls))
+		for _, vote := range existing.VoteHistory {
+			seen[vote.PollId] = true
+		}
+		//Past the cap RejectVote skips the rest of the batch, EvictOldestVote
+		//evicts existing votes to make room but never the batch's own
+		room := -1
+		if v.maxVoteHistory > 0 {
+			room = v.maxVoteHistory
+			if v.historyPolicy != EvictOldestVote {
+				room = max(v.maxVoteHistory-len(existing.VoteHistory), 0)
+			}
+		}
+		now := time.Now()
+		for i, poll := range polls {
+			err := poll.Validate()
+			switch {
+			case err != nil:
+			case !open[poll.PollId]:
+				err = ErrPollClosed
+			case seen[poll.PollId]:
+				err = ErrDuplicatePoll
+			case room >= 0 && len(added) >= room:
+				err = ErrVoteHistoryFull
+			}
+			if err != nil {
+				errs = append(errs, &PollBatchError{Index: i, PollId: poll.PollId, Err: err})
+				continue
+			}
+			seen[poll.PollId] = true
+			if poll.VoteDate.IsZero() {
+				poll.VoteDate = now
+			}
+			poll.VoteDate = poll.VoteDate.UTC()
+			added = append(added, poll)
+		}
+		if len(added) == 0 {
+			return nil
+		}
+
+		kept := existing.VoteHistory
+		if v.maxVoteHistory > 0 {
+			kept = evictOldest(kept, len(kept)+len(added)-v.maxVoteHistory)
+		}
+		voter.VoteHistory = append(slices.Clip(kept), added...)
+		voter.Version++
+		voterJson, err := json.Marshal(voter)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(v.context, func(pipe redis.Pipeliner) error {
+			pipe.Do(v.context, "JSON.SET", redisKey, ".", string(voterJson))
+			if delta := votesOf(voter) - votesOf(existing); delta != 0 {
+				pipe.IncrBy(v.context, v.votesTotalKey(), int64(delta))
+			}
+			return nil
+		})
+		return err
+	}
+
+	if err := v.watch(true, update, redisKey); err != nil {
+		return Voter{}, nil, err
+	}
+
+	for _, poll := range added {
+		vote := VoteEvent{VoterId: uint(voterId), PollId: poll.PollId, VoteId: poll.VoteId, VoteDate: poll.VoteDate}
+		if v.voteHook != nil {
+			v.voteHook(vote)
+		}
+		v.publishVote(vote)
+	}
+	return voter, errs, nil
+}
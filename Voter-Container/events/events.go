@@ -0,0 +1,142 @@
+package events
+
+import (
+	"sync"
+
+	"drexel.edu/voter/db"
+)
+
+// DefaultBuffer is how many votes may be waiting for a subscriber before
+// newer ones are dropped for it
+const DefaultBuffer = 64
+
+// DefaultHistory is how many of the latest votes are kept for subscribers
+// that reconnect
+const DefaultHistory = 256
+
+// Vote is a vote as it is sent to subscribers, ID numbers the votes the
+// broker has published starting from 1
+type Vote struct {
+	ID uint64
+	db.VoteEvent
+}
+
+// Broker fans votes out to every subscriber.  Each subscriber has its own
+// buffered channel, a subscriber that falls a full buffer behind misses
+// votes rather than holding up the one adding them or the other
+// subscribers.  The latest votes are kept so a subscriber that reconnects
+// can pick up where it left off.
+type Broker struct {
+	buffer int
+
+	mu      sync.Mutex
+	subs    map[chan Vote]struct{}
+	lastID  uint64
+	history []Vote
+	size    int
+	closed  bool
+}
+
+// New returns a broker giving each subscriber a buffer of size votes,
+// values less than 1 use DefaultBuffer
+func New(size int) *Broker {
+	if size < 1 {
+		size = DefaultBuffer
+	}
+	return &Broker{
+		buffer: size,
+		subs:   make(map[chan Vote]struct{}),
+		size:   DefaultHistory,
+	}
+}
+
+// Subscribe returns a channel receiving every vote published from now on,
+// it must be handed back to Unsubscribe once the caller is done with it.
+// The channel is closed when the broker is.
+func (b *Broker) Subscribe() chan Vote {
+	ch, _ := b.SubscribeSince(0)
+	return ch
+}
+
+// SubscribeSince is Subscribe for a subscriber that has already seen the
+// votes up to lastID, it also returns the later votes still kept.  Votes
+// that have been dropped from the history, or a lastID the broker never
+// handed out, are skipped.  A lastID of 0 returns no votes.
+func (b *Broker) SubscribeSince(lastID uint64) (chan Vote, []Vote) {
+	ch := make(chan Vote, b.buffer)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(ch)
+		return ch, nil
+	}
+	b.subs[ch] = struct{}{}
+
+	if lastID == 0 || lastID >= b.lastID {
+		return ch, nil
+	}
+	var missed []Vote
+	for _, vote := range b.history {
+		if vote.ID > lastID {
+			missed = append(missed, vote)
+		}
+	}
+	return ch, missed
+}
+
+// Unsubscribe stops sending votes to ch and closes it
+func (b *Broker) Unsubscribe(ch chan Vote) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subs[ch]; ok {
+		delete(b.subs, ch)
+		close(ch)
+	}
+}
+
+// Publish numbers the vote and sends it to every subscriber without
+// waiting, subscribers with a full buffer do not get it
+func (b *Broker) Publish(event db.VoteEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+
+	b.lastID++
+	vote := Vote{ID: b.lastID, VoteEvent: event}
+	if len(b.history) == b.size {
+		b.history = b.history[1:]
+	}
+	b.history = append(b.history, vote)
+
+	for ch := range b.subs {
+		select {
+		case ch <- vote:
+		default:
+		}
+	}
+}
+
+// Close closes every subscriber's channel and any later subscription's,
+// so the streams reading them end, e.g. when the server shuts down
+func (b *Broker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	b.closed = true
+	for ch := range b.subs {
+		delete(b.subs, ch)
+		close(ch)
+	}
+}
+
+// Subscribers is the number of channels currently subscribed
+func (b *Broker) Subscribers() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subs)
+}
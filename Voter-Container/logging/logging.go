@@ -0,0 +1,101 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RequestIDHeader carries the request id, an inbound value is kept so a
+// request can be followed across services
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength stops a client from stuffing arbitrary amounts of data
+// into every log line for its request
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+// NewJSONLogger returns a logger that writes one JSON object per line,
+// anything below level is dropped
+func NewJSONLogger(w io.Writer, level slog.Leveler) *slog.Logger {
+	return slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level}))
+}
+
+// ParseLevel turns debug, info, warn or error, in any case, into a level
+func ParseLevel(name string) (slog.Level, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("log level %q is not one of debug, info, warn or error", name)
+}
+
+// WithRequestID returns a copy of ctx carrying the request id
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request id stored in ctx, or "" if there is none
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// FromContext returns the default logger, tagged with the request id when
+// ctx belongs to a request
+func FromContext(ctx context.Context) *slog.Logger {
+	if id := RequestID(ctx); id != "" {
+		return slog.Default().With("request_id", id)
+	}
+	return slog.Default()
+}
+
+// Middleware gives every request an id, echoes it in the X-Request-ID
+// response header and stores it in the request context so that anything
+// logged while handling the request can be tied back to it.  Once the
+// request is done it is logged with its method, path, status and latency.
+func Middleware(c *gin.Context) {
+	start := time.Now()
+
+	id := c.GetHeader(RequestIDHeader)
+	if id == "" || len(id) > maxRequestIDLength {
+		id = newRequestID()
+	}
+	c.Header(RequestIDHeader, id)
+	c.Request = c.Request.WithContext(WithRequestID(c.Request.Context(), id))
+
+	c.Next()
+
+	FromContext(c.Request.Context()).Info("request",
+		"method", c.Request.Method,
+		"path", c.Request.URL.Path,
+		"route", c.FullPath(),
+		"status", c.Writer.Status(),
+		"latency_ms", float64(time.Since(start).Microseconds())/1000,
+		"client_ip", c.ClientIP(),
+	)
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		//crypto/rand does not fail on the platforms we run on, a time based
+		//id is still better than none
+		return time.Now().UTC().Format("20060102T150405.000000000")
+	}
+	return hex.EncodeToString(b)
+}
@@ -1,71 +1,542 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	//The run image has no time zone database, ?tz= needs one
+	_ "time/tzdata"
 
 	"drexel.edu/voter/api"
+	"drexel.edu/voter/auth"
+	"drexel.edu/voter/docs"
+	"drexel.edu/voter/logging"
+	"drexel.edu/voter/metrics"
+	"drexel.edu/voter/ratelimit"
 	"github.com/gin-contrib/cors"
+	"github.com/gin-contrib/gzip"
 	"github.com/gin-gonic/gin"
-	"github.com/redis/go-redis/v9"
+	swaggerFiles "github.com/swaggo/files"
+	ginSwagger "github.com/swaggo/gin-swagger"
 )
 
 // Global variables to hold the command line flags to drive the todo CLI
 // application
 var (
-	hostFlag string
-	portFlag uint
+	hostFlag            string
+	portFlag            uint
+	shutdownTimeoutFlag time.Duration
+	metricsFlag         bool
+	rateLimitFlag       float64
+	rateBurstFlag       int
+	trustedProxiesFlag  string
+	requestTimeoutFlag  time.Duration
+	gzipFlag            bool
+	gzipLevelFlag       int
+	maxBodyFlag         int64
+	maxBatchBodyFlag    int64
+	latencyFlag         time.Duration
+	idempotencyTTLFlag  time.Duration
+	logLevelFlag        string
+	votesChannelFlag    string
+	redisOnlyFlag       bool
+	auditMaxFlag        int64
+	configFlag          string
 )
 
 func processCmdLineFlags() {
 
 	flag.StringVar(&hostFlag, "h", "0.0.0.0", "Listen on all interfaces")
-	flag.UintVar(&portFlag, "p", 1080, "Default Port")
+	flag.UintVar(&portFlag, "p", 1080, "Port to listen on, the PORT environment variable is used when this is not set")
+	flag.DurationVar(&shutdownTimeoutFlag, "shutdown-timeout", 10*time.Second, "How long to wait for in-flight requests when shutting down")
+	flag.BoolVar(&metricsFlag, "metrics", false, "Serve prometheus metrics at /metrics")
+	flag.Float64Var(&rateLimitFlag, "rate-limit", 100, "Requests per second allowed from each client IP, 0 turns rate limiting off")
+	flag.IntVar(&rateBurstFlag, "rate-burst", 200, "Requests a client IP may make at once before the rate limit applies")
+	flag.StringVar(&trustedProxiesFlag, "trusted-proxies", "", "Comma separated IPs or CIDRs of the proxies whose X-Forwarded-For gives the client IP, by default no proxy is trusted")
+	flag.DurationVar(&requestTimeoutFlag, "request-timeout", 10*time.Second, "How long a request may spend waiting on redis, 0 means no limit")
+	flag.BoolVar(&gzipFlag, "gzip", false, "Compress responses for clients that send Accept-Encoding: gzip")
+	flag.IntVar(&gzipLevelFlag, "gzip-level", gzip.DefaultCompression, "gzip level from 1 (fastest) to 9 (smallest), -1 picks a balance of the two")
+	flag.Int64Var(&maxBodyFlag, "max-body", 1<<20, "Largest request body in bytes, 0 means no limit")
+	flag.Int64Var(&maxBatchBodyFlag, "max-batch-body", 10<<20, "Largest request body in bytes for the batch add and import routes, 0 means no limit")
+	flag.DurationVar(&latencyFlag, "health-latency-threshold", api.DefaultLatencyThreshold, "Redis PING latency above which /health reports degraded")
+	flag.StringVar(&logLevelFlag, "log-level", "info", "debug, info, warn or error, the LOG_LEVEL environment variable is used when this is not set")
+	flag.DurationVar(&idempotencyTTLFlag, "idempotency-ttl", 24*time.Hour, "How long responses to requests with an Idempotency-Key are kept, 0 ignores the header")
+	flag.BoolVar(&redisOnlyFlag, "redis-only", false, "Exit when redis cannot be reached instead of keeping voters in memory")
+	flag.StringVar(&configFlag, "config", "", "YAML or JSON file with the host, port, log level, allowed origins and redis settings, environment variables and flags take precedence")
+	flag.Int64Var(&auditMaxFlag, "audit-max", 0, "Keep the newest this many requests that change voters in redis for GET /audit, 0 turns auditing off")
+	flag.StringVar(&votesChannelFlag, "votes-channel", "", "Redis channel new votes are shared through so every instance can stream them, the VOTES_CHANNEL environment variable is used when this is not set")
 
 	flag.Parse()
 }
 
-var rdb *redis.Client
+// flagSet reports whether the named flag was given on the command line
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
 
-func main() {
+// ginMode is the gin mode for a log level, only debug gets gin's own
+// output such as the list of routes, everything else runs in release mode
+// and leaves logging to our structured logger
+func ginMode(level slog.Level) string {
+	if level <= slog.LevelDebug {
+		return gin.DebugMode
+	}
+	return gin.ReleaseMode
+}
 
-	rdb := redis.NewClient(&redis.Options{
-		Addr: "localhost:63789",
-	})
+// listenAddr checks the host and port the server is asked to listen on and
+// joins them into an address.  portEnv, the PORT variable many platforms
+// set, takes the place of port when it is not empty.
+func listenAddr(host string, port uint, portEnv string) (string, error) {
+	if portEnv != "" {
+		p, err := strconv.ParseUint(portEnv, 10, 0)
+		if err != nil {
+			return "", fmt.Errorf("PORT %q is not a number", portEnv)
+		}
+		port = uint(p)
+	}
+	if port < 1 || port > 65535 {
+		return "", fmt.Errorf("port %d is not between 1 and 65535", port)
+	}
 
-	processCmdLineFlags()
-	r := gin.Default()
-	r.Use(cors.Default())
+	//An empty host listens on every interface, like 0.0.0.0
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if host != "" && net.ParseIP(host) == nil && !validHostname(host) {
+		return "", fmt.Errorf("host %q is neither an IP address nor a hostname", host)
+	}
 
-	apiHandler, err := api.New()
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+	return net.JoinHostPort(host, strconv.FormatUint(uint64(port), 10)), nil
+}
+
+// validHostname checks host against the hostname rules of RFC 1123, dot
+// separated labels of letters, digits and hyphens
+func validHostname(host string) bool {
+	host = strings.TrimSuffix(host, ".")
+	if host == "" || len(host) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(host, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// routerOptions holds the optional parts of the router, the zero value
+// turns all of them off
+type routerOptions struct {
+	//metrics adds the metrics middleware and the /metrics route
+	metrics *metrics.Metrics
+
+	//rateLimiter limits how fast each client IP can make requests
+	rateLimiter *ratelimit.Limiter
+
+	//trustedProxies are the proxies allowed to name the client IP with
+	//X-Forwarded-For, when empty the client IP is the peer's address
+	trustedProxies []string
+
+	//apiKey, when set, has to be sent in the Authorization header of
+	//every request except the health and readiness checks
+	apiKey string
+
+	//requestTimeout is the deadline given to each request, zero means none
+	requestTimeout time.Duration
+
+	//allowedOrigins are the origins browsers may call the API from, when
+	//empty every origin is allowed
+	allowedOrigins []string
+
+	//gzip compresses responses at gzipLevel for clients that accept it
+	gzip      bool
+	gzipLevel int
+
+	//maxBody caps the size of request bodies, maxBatchBody is the cap for
+	//the routes that take many voters at once.  Zero means no limit.
+	maxBody      int64
+	maxBatchBody int64
+
+	//idempotencyTTL is how long responses to requests sent with an
+	//Idempotency-Key are kept, zero ignores the header
+	idempotencyTTL time.Duration
+
+	//auditMax is how many of the requests that change voters are kept in
+	//the audit log, zero turns auditing off
+	auditMax int64
+}
+
+// gzipExcludedPaths only ever answer with a few bytes, which gzip would
+// make bigger rather than smaller.  /metrics compresses its own output,
+// /ws/votes is a WebSocket, which takes over the connection, and gzip would
+// hold back the events sent on /events/votes.
+var gzipExcludedPaths = []string{"/health", "/readyz", "/metrics", "/voter/count", "/stats/votes", "/stats/errors", "/ws/votes", "/events/votes"}
+
+// gzipExcludedExtensions are files that are compressed already
+var gzipExcludedExtensions = []string{".png", ".gif", ".jpg", ".jpeg", ".webp", ".gz", ".zip", ".woff", ".woff2"}
+
+// corsConfig allows the given origins to use every route of the API, with
+// no origins every one of them is allowed
+func corsConfig(origins []string) cors.Config {
+	config := cors.DefaultConfig()
+	config.AllowOrigins = origins
+	config.AllowAllOrigins = len(origins) == 0
+	config.AllowMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE", "HEAD", "OPTIONS"}
+	config.AllowHeaders = []string{"Origin", "Content-Type", "Authorization", "If-None-Match", api.IdempotencyKeyHeader, api.LastEventIDHeader, logging.RequestIDHeader}
+	config.ExposeHeaders = []string{"ETag", "Location", "Retry-After", api.TotalCountHeader, api.MissingIdsHeader, api.SkippedVotersHeader, api.ServerTimeHeader, api.IdempotentReplayedHeader, logging.RequestIDHeader}
+	return config
+}
+
+// parseTrustedProxies splits the comma separated -trusted-proxies and checks
+// that each one is an IP or a CIDR, an empty list trusts no proxy
+func parseTrustedProxies(raw string) ([]string, error) {
+	proxies := trimmedOrigins(strings.Split(raw, ","))
+	for _, proxy := range proxies {
+		if net.ParseIP(proxy) != nil {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(proxy); err != nil {
+			return nil, fmt.Errorf("%q is neither an IP address nor a CIDR", proxy)
+		}
+	}
+	return proxies, nil
+}
+
+// allowedOriginsFromEnv reads the comma separated ALLOWED_ORIGINS
+func allowedOriginsFromEnv() []string {
+	return trimmedOrigins(strings.Split(os.Getenv("ALLOWED_ORIGINS"), ","))
+}
+
+// trimmedOrigins trims the space around each origin and drops blank ones
+func trimmedOrigins(origins []string) []string {
+	var trimmed []string
+	for _, origin := range origins {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			trimmed = append(trimmed, origin)
+		}
+	}
+	return trimmed
+}
+
+// setupRouter builds the gin engine with all of the middleware and routes
+// wired to the provided api handler
+func setupRouter(apiHandler *api.VoterAPI, opts routerOptions) *gin.Engine {
+	//This is what gin.Default() sets up, except requests are logged as
+	//JSON with a request id and the recovery middleware answers with JSON
+	//instead of an empty 500.  Logging, errors and metrics come ahead of
+	//recovery so that a recovered panic is seen too
+	r := gin.New()
+	//gin trusts X-Forwarded-For from anyone by default, which would let a
+	//client pick the IP it is rate limited and logged as.  The proxies were
+	//checked by parseTrustedProxies.
+	_ = r.SetTrustedProxies(opts.trustedProxies)
+	r.Use(logging.Middleware, apiHandler.CountErrors)
+	if opts.metrics != nil {
+		r.Use(opts.metrics.Middleware)
+		r.GET("/metrics", opts.metrics.Handler())
+	}
+	//Requests turned away by the rate limiter are still logged and counted
+	if opts.rateLimiter != nil {
+		r.Use(opts.rateLimiter.Middleware)
+	}
+	if opts.gzip {
+		r.Use(gzip.Gzip(opts.gzipLevel,
+			gzip.WithExcludedPaths(gzipExcludedPaths),
+			gzip.WithExcludedExtensions(gzipExcludedExtensions)))
+	}
+	//Any origin is fine for local development, anywhere else the origins
+	//should be listed in ALLOWED_ORIGINS.  CORS goes ahead of the API key
+	//check since browsers send preflight requests without credentials
+	r.Use(cors.New(corsConfig(opts.allowedOrigins)))
+	if opts.apiKey != "" {
+		r.Use(auth.APIKey(opts.apiKey, "/health", "/readyz"))
 	}
+	//The vote streams stay open for as long as the client wants them
+	r.Use(api.RequestTimeout(opts.requestTimeout, "/ws/votes", "/events/votes"))
+	r.Use(api.LimitBody(opts.maxBody, map[string]int64{
+		"/voter/batch":           opts.maxBatchBody,
+		"/voter/import":          opts.maxBatchBody,
+		"/voter/:id/polls/batch": opts.maxBatchBody,
+	}))
+	//Auditing goes ahead of recovery so a request that panicked is
+	//recorded with the 500 it got
+	r.Use(apiHandler.Audit(opts.auditMax))
+	r.Use(gin.CustomRecovery(api.Recover))
+
+	//Routing errors get the same JSON body as every other error, gin only
+	//tells a wrong method apart from an unknown path when asked to
+	r.HandleMethodNotAllowed = true
+	r.NoRoute(api.NoRoute)
+	r.NoMethod(api.NoMethod)
 
 	r.GET("/voter", apiHandler.ListAllVoters)
-	r.POST("/voter", apiHandler.AddVoter)
+	//Retrying these with the same Idempotency-Key does not add twice
+	idempotent := apiHandler.Idempotency(opts.idempotencyTTL)
+
+	r.POST("/voter", idempotent, apiHandler.AddVoter)
+	r.POST("/voter/batch", apiHandler.AddVoters)
+	r.POST("/voter/delete", apiHandler.DeleteVoters)
+	r.GET("/voter/count", apiHandler.GetVoterCount)
+	r.GET("/voter/by-email", apiHandler.GetVoterByEmail)
+	r.GET("/voter/inactive", apiHandler.ListInactiveVoters)
+	r.GET("/voter/export", apiHandler.ExportVoters)
+	r.POST("/voter/import", apiHandler.ImportVoters)
 	r.PUT("/voter/:id", apiHandler.UpdateVoter)
+	r.PATCH("/voter/:id", apiHandler.PatchVoter)
 	r.DELETE("/voter", apiHandler.DeleteAllVoters)
 	r.DELETE("/voter/:id", apiHandler.DeleteVoter)
 	r.GET("/voter/:id", apiHandler.GetVoter)
+	r.HEAD("/voter/:id", apiHandler.HeadVoter)
+	r.GET("/voter/:id/field/*path", apiHandler.GetVoterField)
+
+	r.POST("/voter/:id/restore", apiHandler.RestoreVoter)
+	r.POST("/voter/:id/merge/:otherid", apiHandler.MergeVoters)
 
 	r.GET("/voter/:id/polls", apiHandler.GetPollHistoryFromVoter)
+	r.DELETE("/voter/:id/polls", apiHandler.ClearPollsFromVoter)
+	r.POST("/voter/:id/polls/batch", apiHandler.AddPollsToVoter)
+	r.GET("/voter/:id/polls/count", apiHandler.GetVoteCount)
+	r.GET("/voter/:id/polls/missing", apiHandler.GetMissingPolls)
 	r.GET("/voter/:id/polls/:pollid", apiHandler.GetSinglePollFromVoter)
-	r.POST("/voter/:id", apiHandler.AddSinglePollToVoter)
+	r.HEAD("/voter/:id/polls/:pollid", apiHandler.HeadSinglePollFromVoter)
+	r.POST("/voter/:id", idempotent, apiHandler.AddSinglePollToVoter)
+	r.PUT("/voter/:id/polls/:pollid", apiHandler.UpdateSinglePollForVoter)
+	r.DELETE("/voter/:id/polls/:pollid", apiHandler.DeleteSinglePollFromVoter)
+
+	r.GET("/polls/:pollid/results", apiHandler.GetPollResults)
+	r.GET("/polls/:pollid/voters", apiHandler.GetPollVoters)
+	r.GET("/polls/intersection", apiHandler.GetVotersInAllPolls)
+	r.POST("/polls/:pollid/open", apiHandler.OpenPoll)
+	r.POST("/polls/:pollid/close", apiHandler.ClosePoll)
+	r.GET("/ws/votes", apiHandler.StreamVotes)
+	r.GET("/events/votes", apiHandler.StreamVoteEvents)
 
 	r.GET("/health", apiHandler.HealthCheck)
+	r.GET("/readyz", apiHandler.ReadinessCheck)
+	r.GET("/stats", apiHandler.GetStats)
+	r.GET("/stats/votes", apiHandler.GetVoteTotal)
+	r.GET("/stats/errors", apiHandler.GetErrorStats)
+	r.POST("/stats/votes/reconcile", apiHandler.ReconcileVoteTotal)
+	r.POST("/admin/reindex", apiHandler.RebuildIndexes)
+	r.GET("/audit", apiHandler.GetAuditLog)
+	r.GET("/crash", apiHandler.CrashSim)
+
+	//The spec in docs is generated from the annotations on the handlers,
+	//run go generate after changing them
+	r.GET("/openapi.json", func(c *gin.Context) {
+		c.Data(http.StatusOK, "application/json; charset=utf-8", []byte(docs.SwaggerInfo.ReadDoc()))
+	})
+	r.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler, ginSwagger.URL("/openapi.json")))
 
 	//We will now show a common way to version an API and add a new
-	//version of an API handler under /v2.  This new API will support
-	//a path parameter to search for todos based on a status
-	// v2 := r.Group("/v2")
-	// v2.GET("/voter", apiHandler.ListSelectVoters)
-
-	serverPath := fmt.Sprintf("%s:%d", hostFlag, portFlag)
-	r.Run(serverPath)
-	log.Println("Starting server on ", serverPath)
-	defer rdb.Close()
+	//version of an API handler under /v2.  This new API supports query
+	//parameters to filter the voters, v2 only adds routes so everything
+	//under v1 behaves as it did before
+	v2 := r.Group("/v2")
+	v2.GET("/voter", apiHandler.ListSelectVoters)
+
+	return r
+}
+
+// serve runs the server on the listener until ctx is cancelled, then stops
+// accepting connections and gives in-flight requests up to shutdownTimeout
+// to finish.
+func serve(ctx context.Context, srv *http.Server, ln net.Listener, shutdownTimeout time.Duration) error {
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.Serve(ln)
+	}()
+
+	select {
+	case err := <-serveErr:
+		//The server stopped on its own, there is nothing to drain
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("Shutdown requested, draining in-flight requests", "timeout", shutdownTimeout.String())
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("error draining requests: %w", err)
+	}
+	slog.Info("All requests drained")
+	return nil
+}
+
+//go:generate go run github.com/swaggo/swag/cmd/swag@v1.16.2 init --generalInfo main.go --output docs --exclude tests,vendor
+
+// @title                      Voter API
+// @version                    1.0
+// @description                Keeps track of voters and the polls they voted in.
+// @BasePath                   /
+// @securityDefinitions.apikey ApiKeyAuth
+// @in                         header
+// @name                       Authorization
+// @description                "Bearer <key>", only needed when the server runs with API_KEY set
+func main() {
+
+	processCmdLineFlags()
+
+	//Flags given on the command line win over the environment, which wins
+	//over the -config file
+	cfg, err := resolveConfig(configFlag, flag.CommandLine)
+	if err != nil {
+		slog.Error("Invalid configuration", "error", err)
+		os.Exit(1)
+	}
+	level, err := logging.ParseLevel(cfg.LogLevel)
+	if err != nil {
+		slog.Error("Invalid log level", "error", err)
+		os.Exit(1)
+	}
+	gin.SetMode(ginMode(level))
+
+	//Everything is logged as JSON, this includes the standard log package
+	//which slog takes over once it is the default
+	slog.SetDefault(logging.NewJSONLogger(os.Stdout, level))
+
+	//An explicit -p wins over PORT
+	portEnv := ""
+	if !flagSet("p") {
+		portEnv = os.Getenv("PORT")
+	}
+	serverPath, err := listenAddr(cfg.Host, cfg.Port, portEnv)
+	if err != nil {
+		slog.Error("Invalid listen address", "error", err)
+		os.Exit(1)
+	}
+
+	//Level 0 would wrap the responses in gzip without compressing them
+	validLevel := gzipLevelFlag == gzip.DefaultCompression ||
+		(gzipLevelFlag >= gzip.BestSpeed && gzipLevelFlag <= gzip.BestCompression)
+	if gzipFlag && !validLevel {
+		slog.Error("Invalid -gzip-level, it must be between 1 and 9 or -1", "level", gzipLevelFlag)
+		os.Exit(1)
+	}
+
+	//With no burst every request would be turned away, with a Retry-After
+	//that never comes
+	if rateLimitFlag > 0 && rateBurstFlag < 1 {
+		slog.Error("Invalid -rate-burst, it must be at least 1", "burst", rateBurstFlag)
+		os.Exit(1)
+	}
+
+	//The api handler owns the only redis client, its location comes from
+	//the REDIS_URL environment variable.  If redis cannot be reached the
+	//voters are kept in memory so the API can still be tried out, with
+	//-redis-only we stop right away instead
+	newAPI := api.NewWithFallback
+	if redisOnlyFlag {
+		newAPI = api.New
+	}
+	setRedisEnv(cfg.Redis)
+	apiHandler, err := newAPI()
+	if err != nil {
+		slog.Error("Unable to start the voter API", "error", err)
+		os.Exit(1)
+	}
+	apiHandler.SetLatencyThreshold(latencyFlag)
+
+	//Without a votes channel /ws/votes only streams the votes made through
+	//this instance
+	votesChannel := votesChannelFlag
+	if !flagSet("votes-channel") {
+		votesChannel = os.Getenv("VOTES_CHANNEL")
+	}
+	if err := apiHandler.SetVotesChannel(votesChannel); err != nil {
+		slog.Error("Unable to subscribe to the votes channel", "channel", votesChannel, "error", err)
+		os.Exit(1)
+	}
+
+	//Metrics are opt in with -metrics so the default build stays minimal
+	opts := routerOptions{
+		requestTimeout: requestTimeoutFlag,
+		gzip:           gzipFlag,
+		gzipLevel:      gzipLevelFlag,
+		maxBody:        maxBodyFlag,
+		maxBatchBody:   maxBatchBodyFlag,
+		idempotencyTTL: idempotencyTTLFlag,
+		auditMax:       auditMaxFlag,
+	}
+	if metricsFlag {
+		opts.metrics = metrics.New(apiHandler.CountVoters)
+		apiHandler.AddRedisHook(opts.metrics.RedisHook())
+	}
+	if rateLimitFlag > 0 {
+		opts.rateLimiter = ratelimit.New(rateLimitFlag, rateBurstFlag)
+	}
+	opts.trustedProxies, err = parseTrustedProxies(trustedProxiesFlag)
+	if err != nil {
+		slog.Error("Invalid -trusted-proxies", "error", err)
+		os.Exit(1)
+	}
+
+	//Without an API_KEY the API stays open, which is what you want when
+	//running it locally
+	opts.apiKey = os.Getenv("API_KEY")
+	if opts.apiKey == "" {
+		slog.Warn("API_KEY is not set, the API does not require authentication")
+	}
+
+	opts.allowedOrigins = cfg.AllowedOrigins
+	if len(opts.allowedOrigins) == 0 {
+		slog.Warn("No allowed origins are set, requests from any origin are allowed")
+	} else if err := corsConfig(opts.allowedOrigins).Validate(); err != nil {
+		slog.Error("Invalid allowed origins", "error", err)
+		os.Exit(1)
+	}
+
+	r := setupRouter(apiHandler, opts)
+
+	ln, err := net.Listen("tcp", serverPath)
+	if err != nil {
+		slog.Error("Unable to listen", "addr", serverPath, "error", err)
+		apiHandler.Close()
+		os.Exit(1)
+	}
+
+	//SIGTERM is what kubernetes sends before it removes a pod, SIGINT is
+	//ctrl-c when running locally
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if opts.rateLimiter != nil {
+		go opts.rateLimiter.RunCleanup(ctx, time.Minute, 10*time.Minute)
+	}
+
+	slog.Info("Starting server", "addr", serverPath)
+	srv := &http.Server{Handler: r}
+	//Shutdown waits for requests to finish, which a vote stream never does
+	srv.RegisterOnShutdown(apiHandler.EndStreams)
+	if err := serve(ctx, srv, ln, shutdownTimeoutFlag); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("Server stopped", "error", err)
+	}
+
+	slog.Info("Closing redis connection")
+	if err := apiHandler.Close(); err != nil {
+		slog.Error("Error closing redis connection", "error", err)
+	}
+	slog.Info("Shutdown complete")
 }
@@ -0,0 +1,2921 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"drexel.edu/voter/api"
+	"drexel.edu/voter/db"
+	"drexel.edu/voter/db/memredis"
+	"drexel.edu/voter/logging"
+	"drexel.edu/voter/metrics"
+	"drexel.edu/voter/ratelimit"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestRouter wires the real routes to an api handler backed by an
+// in-process redis so handlers can be exercised with httptest
+func newTestRouter(t *testing.T) (*gin.Engine, *memredis.Server) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	mr, err := memredis.Run()
+	require.NoError(t, err)
+	t.Cleanup(mr.Close)
+
+	apiHandler, err := api.NewWithCacheInstance(mr.Addr())
+	require.NoError(t, err)
+	t.Cleanup(func() { apiHandler.Close() })
+
+	return setupRouter(apiHandler, routerOptions{}), mr
+}
+
+func doRequest(r http.Handler, method, path string, body any) *httptest.ResponseRecorder {
+	var payload []byte
+	switch b := body.(type) {
+	case nil:
+	case string:
+		payload = []byte(b)
+	default:
+		payload, _ = json.Marshal(b)
+	}
+
+	req := httptest.NewRequest(method, path, bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func seedVoter(t *testing.T, r http.Handler, voter db.Voter) {
+	t.Helper()
+	w := doRequest(r, http.MethodPost, "/voter", voter)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+}
+
+func testVoter(id uint) db.Voter {
+	return db.Voter{
+		VoterId: id,
+		Name:    "Test Voter",
+		Email:   fmt.Sprintf("voter%d@example.com", id),
+		VoteHistory: []db.VoterHistory{
+			{PollId: 1, VoteId: 1},
+		},
+	}
+}
+
+func TestHandlersWriteSingleResponseOnError(t *testing.T) {
+	r, _ := newTestRouter(t)
+	seedVoter(t, r, testVoter(1))
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   any
+		status int
+	}{
+		{"poll history bad id", http.MethodGet, "/voter/abc/polls", nil, http.StatusBadRequest},
+		{"get missing voter", http.MethodGet, "/voter/99", nil, http.StatusNotFound},
+		{"poll history missing voter", http.MethodGet, "/voter/99/polls", nil, http.StatusNotFound},
+		{"single poll bad voter id", http.MethodGet, "/voter/abc/polls/1", nil, http.StatusBadRequest},
+		{"single poll bad poll id", http.MethodGet, "/voter/1/polls/abc", nil, http.StatusBadRequest},
+		{"single poll missing poll", http.MethodGet, "/voter/1/polls/42", nil, http.StatusNotFound},
+		{"add voter bad json", http.MethodPost, "/voter", "{not json", http.StatusBadRequest},
+		{"update voter bad json", http.MethodPut, "/voter/1", "{not json", http.StatusBadRequest},
+		{"update missing voter", http.MethodPut, "/voter/99", testVoter(99), http.StatusNotFound},
+		{"delete missing voter", http.MethodDelete, "/voter/99", nil, http.StatusNotFound},
+		{"add poll bad json", http.MethodPost, "/voter/1", "{not json", http.StatusBadRequest},
+		{"add poll missing voter", http.MethodPost, "/voter/99", db.VoterHistory{PollId: 2, VoteId: 2}, http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := doRequest(r, tt.method, tt.path, tt.body)
+			assert.Equal(t, tt.status, w.Code)
+
+			//exactly one error body follows an aborted request
+			dec := json.NewDecoder(w.Body)
+			var body api.ErrorBody
+			require.NoError(t, dec.Decode(&body))
+			assert.NotEmpty(t, body.Error.Code)
+			assert.False(t, dec.More(), "nothing should follow the error body")
+		})
+	}
+}
+
+func TestHandlersWriteSingleResponseOnSuccess(t *testing.T) {
+	r, _ := newTestRouter(t)
+	seedVoter(t, r, testVoter(1))
+
+	w := doRequest(r, http.MethodGet, "/voter/1", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var voter db.Voter
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &voter))
+	assert.Equal(t, uint(1), voter.VoterId)
+
+	w = doRequest(r, http.MethodGet, "/voter/1/polls/1", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var poll db.VoterHistory
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &poll))
+	assert.Equal(t, uint(1), poll.PollId)
+}
+
+func TestListVotersPaged(t *testing.T) {
+	r, _ := newTestRouter(t)
+	for i := uint(1); i <= 5; i++ {
+		seedVoter(t, r, testVoter(i))
+	}
+
+	w := doRequest(r, http.MethodGet, "/voter?offset=1&limit=2", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var page api.VoterPage
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+	assert.Equal(t, 5, page.Total)
+	assert.Equal(t, 1, page.Offset)
+	assert.Equal(t, 2, page.Limit)
+	assert.Equal(t, 2, page.Count)
+	require.Len(t, page.Voters, 2)
+	assert.Equal(t, uint(2), page.Voters[0].VoterId)
+
+	//without paging parameters the plain list is still returned
+	w = doRequest(r, http.MethodGet, "/voter", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var voters []db.Voter
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &voters))
+	assert.Len(t, voters, 5)
+
+	w = doRequest(r, http.MethodGet, "/voter?limit=0", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestListVotersTotalCount(t *testing.T) {
+	r, _ := newTestRouter(t)
+
+	w := doRequest(r, http.MethodGet, "/voter", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "0", w.Header().Get(api.TotalCountHeader))
+
+	for i := uint(1); i <= 5; i++ {
+		seedVoter(t, r, testVoter(i))
+	}
+
+	w = doRequest(r, http.MethodGet, "/voter", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "5", w.Header().Get(api.TotalCountHeader))
+
+	//a page carries the total of every voter, not of the page
+	w = doRequest(r, http.MethodGet, "/voter?offset=1&limit=2", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "5", w.Header().Get(api.TotalCountHeader))
+
+	w = doRequest(r, http.MethodGet, "/voter?offset=10", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "5", w.Header().Get(api.TotalCountHeader))
+
+	//browsers only let scripts read the header if CORS exposes it
+	req := httptest.NewRequest(http.MethodGet, "/voter", nil)
+	req.Header.Set("Origin", "https://voters.example.com")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Contains(t, w.Header().Get("Access-Control-Expose-Headers"), api.TotalCountHeader)
+}
+
+func TestAddVoterInvalidEmail(t *testing.T) {
+	r, _ := newTestRouter(t)
+
+	voter := testVoter(1)
+	voter.Email = "not-an-email"
+	w := doRequest(r, http.MethodPost, "/voter", voter)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	var body api.ErrorBody
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, api.CodeValidationFailed, body.Error.Code)
+	assert.Contains(t, body.Error.Fields, "Email")
+
+	seedVoter(t, r, testVoter(1))
+	w = doRequest(r, http.MethodPut, "/voter/1", voter)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+}
+
+func TestStrictJSONBinding(t *testing.T) {
+	r, _ := newTestRouter(t)
+
+	w := doRequest(r, http.MethodPost, "/voter", `{"Name":"Test Voter","Email":"voter@example.com","Nmae":"typo"}`)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), `unknown field \"Nmae\"`)
+
+	w = doRequest(r, http.MethodPost, "/voter", `{"Email":"voter@example.com"}`)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	var body api.ErrorBody
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, api.CodeInvalidBody, body.Error.Code)
+	assert.Equal(t, "is required", body.Error.Fields["Name"])
+	assert.NotContains(t, body.Error.Fields, "Email")
+
+	seedVoter(t, r, testVoter(1))
+	w = doRequest(r, http.MethodPost, "/voter/1", `{"VoteId":2}`)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), `"PollId":"is required"`)
+
+	//neither rejected request may have stored anything
+	w = doRequest(r, http.MethodGet, "/voter/count", nil)
+	assert.JSONEq(t, `{"count":1}`, w.Body.String())
+	w = doRequest(r, http.MethodGet, "/voter/1/polls", nil)
+	assert.NotContains(t, w.Body.String(), `"VoteId":2`)
+}
+
+func TestAddSinglePollToVoterResponse(t *testing.T) {
+	r, _ := newTestRouter(t)
+	seedVoter(t, r, testVoter(1))
+
+	voteDate := time.Date(2024, 3, 4, 5, 6, 7, 0, time.UTC)
+	w := doRequest(r, http.MethodPost, "/voter/1", db.VoterHistory{PollId: 2, VoteId: 3, VoteDate: voteDate})
+	require.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "/voter/1/polls/2", w.Header().Get("Location"))
+	var poll db.VoterHistory
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &poll))
+	assert.Equal(t, db.VoterHistory{PollId: 2, VoteId: 3, VoteDate: voteDate}, poll)
+
+	//a vote sent without a date comes back with the one it was given
+	w = doRequest(r, http.MethodPost, "/voter/1", db.VoterHistory{PollId: 3, VoteId: 1})
+	require.Equal(t, http.StatusCreated, w.Code)
+	poll = db.VoterHistory{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &poll))
+	assert.Equal(t, uint(3), poll.PollId)
+	assert.False(t, poll.VoteDate.IsZero())
+
+	w = doRequest(r, http.MethodPost, "/voter/99", db.VoterHistory{PollId: 2, VoteId: 3})
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Contains(t, w.Body.String(), `"code":"not_found"`)
+}
+
+func TestAddPollDuplicateConflict(t *testing.T) {
+	r, _ := newTestRouter(t)
+	seedVoter(t, r, testVoter(1))
+
+	w := doRequest(r, http.MethodPost, "/voter/1", db.VoterHistory{PollId: 1, VoteId: 5})
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	w = doRequest(r, http.MethodPost, "/voter/1?overwrite=true", db.VoterHistory{PollId: 1, VoteId: 5})
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	w = doRequest(r, http.MethodGet, "/voter/1/polls/1", nil)
+	var poll db.VoterHistory
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &poll))
+	assert.Equal(t, uint(5), poll.VoteId)
+}
+
+func TestDeleteSinglePollFromVoter(t *testing.T) {
+	r, _ := newTestRouter(t)
+	seedVoter(t, r, testVoter(1))
+
+	w := doRequest(r, http.MethodDelete, "/voter/1/polls/1", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = doRequest(r, http.MethodGet, "/voter/1/polls/1", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Contains(t, w.Body.String(), `"code":"not_found"`)
+
+	w = doRequest(r, http.MethodDelete, "/voter/1/polls/1", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = doRequest(r, http.MethodDelete, "/voter/99/polls/1", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	//a negative poll id is a bad request, not a poll that does not exist
+	for _, method := range []string{http.MethodDelete, http.MethodGet} {
+		w = doRequest(r, method, "/voter/1/polls/-1", nil)
+		assert.Equal(t, http.StatusBadRequest, w.Code, method)
+	}
+}
+
+func TestClearPollsFromVoter(t *testing.T) {
+	r, _ := newTestRouter(t)
+	seedVoter(t, r, testVoter(1))
+
+	w := doRequest(r, http.MethodDelete, "/voter/1/polls", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = doRequest(r, http.MethodGet, "/voter/1", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var voter db.Voter
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &voter))
+	assert.Empty(t, voter.VoteHistory)
+	assert.Equal(t, "Test Voter", voter.Name)
+	assert.Equal(t, "voter1@example.com", voter.Email)
+
+	w = doRequest(r, http.MethodDelete, "/voter/99/polls", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestUpdateSinglePollForVoter(t *testing.T) {
+	r, _ := newTestRouter(t)
+	seedVoter(t, r, testVoter(1))
+
+	w := doRequest(r, http.MethodPut, "/voter/1/polls/1", db.VoterHistory{PollId: 1, VoteId: 3})
+	require.Equal(t, http.StatusOK, w.Code)
+	//the response is the vote as stored, with the date the server gave it
+	var answered db.VoterHistory
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &answered))
+	assert.WithinDuration(t, time.Now(), answered.VoteDate, time.Minute)
+
+	w = doRequest(r, http.MethodGet, "/voter/1/polls/1", nil)
+	var poll db.VoterHistory
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &poll))
+	assert.Equal(t, uint(3), poll.VoteId)
+	assert.True(t, answered.VoteDate.Equal(poll.VoteDate))
+
+	//path and body poll ids must match
+	w = doRequest(r, http.MethodPut, "/voter/1/polls/1", db.VoterHistory{PollId: 2, VoteId: 3})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	//a negative poll id is refused rather than wrapped around to a huge one
+	w = doRequest(r, http.MethodPut, "/voter/1/polls/-1", `{"PollId":18446744073709551615,"VoteId":1}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	//a vote in a poll the voter has not voted in yet is recorded
+	w = doRequest(r, http.MethodPut, "/voter/1/polls/2", db.VoterHistory{PollId: 2, VoteId: 3})
+	assert.Equal(t, http.StatusCreated, w.Code)
+	w = doRequest(r, http.MethodPut, "/voter/1/polls/2", db.VoterHistory{PollId: 2, VoteId: 4})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = doRequest(r, http.MethodGet, "/voter/1/polls/2", nil)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &poll))
+	assert.Equal(t, uint(4), poll.VoteId)
+	w = doRequest(r, http.MethodGet, "/voter/1/polls", nil)
+	var history []db.VoterHistory
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &history))
+	assert.Len(t, history, 2)
+
+	w = doRequest(r, http.MethodPut, "/voter/99/polls/2", db.VoterHistory{PollId: 2, VoteId: 3})
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestAddVoterAssignsId(t *testing.T) {
+	r, _ := newTestRouter(t)
+
+	w := doRequest(r, http.MethodPost, "/voter", db.Voter{Name: "No Id", Email: "noid@example.com"})
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	var voter db.Voter
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &voter))
+	assert.Equal(t, uint(1), voter.VoterId)
+	assert.Equal(t, "/voter/1", w.Header().Get("Location"))
+
+	w = doRequest(r, http.MethodPost, "/voter", testVoter(7))
+	require.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "/voter/7", w.Header().Get("Location"))
+
+	w = doRequest(r, http.MethodGet, "/voter/1", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestAddVoterUpsert(t *testing.T) {
+	r, _ := newTestRouter(t)
+
+	w := doRequest(r, http.MethodPost, "/voter?upsert=true", testVoter(1))
+	require.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "/voter/1", w.Header().Get("Location"))
+
+	//Resending is fine and keeps the history when the body leaves it out
+	w = doRequest(r, http.MethodPost, "/voter?upsert=true", `{"VoterId":1,"Name":"Resent","Email":"voter1@example.com"}`)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = doRequest(r, http.MethodGet, "/voter/1", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var voter db.Voter
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &voter))
+	assert.Equal(t, "Resent", voter.Name)
+	assert.Len(t, voter.VoteHistory, 1)
+	assert.Equal(t, uint(2), voter.Version)
+
+	//Without upsert a resend is still a conflict
+	w = doRequest(r, http.MethodPost, "/voter", testVoter(1))
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	w = doRequest(r, http.MethodPost, "/voter?upsert=true&ttl=10", testVoter(2))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestAddVoterWithTTL(t *testing.T) {
+	r, mr := newTestRouter(t)
+
+	w := doRequest(r, http.MethodPost, "/voter?ttl=30", testVoter(1))
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	w = doRequest(r, http.MethodGet, "/voter/1", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	mr.FastForward(30 * time.Second)
+
+	w = doRequest(r, http.MethodGet, "/voter/1", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = doRequest(r, http.MethodPost, "/voter?ttl=-1", testVoter(2))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestDeleteAllVotersEmpty(t *testing.T) {
+	r, _ := newTestRouter(t)
+
+	w := doRequest(r, http.MethodDelete, "/voter", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = doRequest(r, http.MethodDelete, "/voter", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestDeleteAllVotersDryRun(t *testing.T) {
+	r, _ := newTestRouter(t)
+	seedVoter(t, r, testVoter(1))
+	seedVoter(t, r, testVoter(3))
+
+	w := doRequest(r, http.MethodDelete, "/voter?dryRun=true", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"dryRun":true,"count":2,"ids":[1,3]}`, w.Body.String())
+
+	w = doRequest(r, http.MethodGet, "/voter/count", nil)
+	assert.JSONEq(t, `{"count":2}`, w.Body.String(), "a dry run must not delete anything")
+
+	w = doRequest(r, http.MethodDelete, "/voter?dryRun=true&confirm=true", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = doRequest(r, http.MethodDelete, "/voter?dryRun=maybe", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = doRequest(r, http.MethodDelete, "/voter?confirm=true", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	w = doRequest(r, http.MethodGet, "/voter/count", nil)
+	assert.JSONEq(t, `{"count":0}`, w.Body.String())
+
+	w = doRequest(r, http.MethodDelete, "/voter?dryRun=true", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"dryRun":true,"count":0,"ids":[]}`, w.Body.String())
+}
+
+func TestDeleteVotersByIds(t *testing.T) {
+	r, _ := newTestRouter(t)
+	seedVoter(t, r, testVoter(1))
+	seedVoter(t, r, testVoter(2))
+	seedVoter(t, r, testVoter(3))
+
+	w := doRequest(r, http.MethodPost, "/voter/delete", `{"ids":[1,3,7]}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"deleted":2}`, w.Body.String())
+
+	assert.Equal(t, http.StatusNotFound, doRequest(r, http.MethodGet, "/voter/1", nil).Code)
+	assert.Equal(t, http.StatusOK, doRequest(r, http.MethodGet, "/voter/2", nil).Code)
+	assert.Equal(t, http.StatusNotFound, doRequest(r, http.MethodGet, "/voter/3", nil).Code)
+
+	w = doRequest(r, http.MethodPost, "/voter/delete", `{"ids":[]}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"deleted":0}`, w.Body.String())
+
+	w = doRequest(r, http.MethodPost, "/voter/delete", `{"ids":[-1]}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestInMemoryFallback(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mr, err := memredis.Run()
+	require.NoError(t, err)
+	addr := mr.Addr()
+	mr.Close()
+	t.Setenv("REDIS_URL", addr)
+	t.Setenv("REDIS_CONNECT_ATTEMPTS", "1")
+
+	_, err = api.New()
+	require.ErrorIs(t, err, db.ErrUnreachable)
+
+	apiHandler, err := api.NewWithFallback()
+	require.NoError(t, err)
+	t.Cleanup(func() { apiHandler.Close() })
+	assert.True(t, apiHandler.InMemory())
+	r := setupRouter(apiHandler, routerOptions{})
+
+	seedVoter(t, r, testVoter(1))
+	w := doRequest(r, http.MethodGet, "/voter/1", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var voter db.Voter
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &voter))
+	assert.Equal(t, testVoter(1).Name, voter.Name)
+
+	voter.Name = "Renamed Voter"
+	w = doRequest(r, http.MethodPut, "/voter/1", voter)
+	require.Equal(t, http.StatusOK, w.Code)
+	w = doRequest(r, http.MethodPost, "/voter/1", db.VoterHistory{PollId: 2, VoteId: 3})
+	require.Equal(t, http.StatusCreated, w.Code)
+	w = doRequest(r, http.MethodGet, "/voter/1", nil)
+	assert.Contains(t, w.Body.String(), "Renamed Voter")
+	assert.Contains(t, w.Body.String(), `"PollId":2`)
+
+	w = doRequest(r, http.MethodDelete, "/voter/1", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	w = doRequest(r, http.MethodGet, "/voter/1", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	var health map[string]any
+	w = doRequest(r, http.MethodGet, "/health", nil)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &health))
+	assert.Equal(t, "degraded", health["status"])
+	assert.Equal(t, "in-memory", health["redis"])
+
+	//a misconfigured redis is still an error
+	t.Setenv("REDIS_CONNECT_ATTEMPTS", "0")
+	_, err = api.NewWithFallback()
+	assert.Error(t, err)
+}
+
+func TestErrorEnvelope(t *testing.T) {
+	r, _ := newTestRouter(t)
+
+	w := doRequest(r, http.MethodGet, "/voter/99", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.JSONEq(t, `{"error":{"code":"not_found","message":"voter does not exist"}}`, w.Body.String())
+
+	w = doRequest(r, http.MethodGet, "/voter/abc", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.JSONEq(t, `{"error":{"code":"bad_request","message":"voter id must be a number that is not negative"}}`, w.Body.String())
+}
+
+func TestRoutingErrors(t *testing.T) {
+	r, _ := newTestRouter(t)
+
+	w := doRequest(r, http.MethodGet, "/nowhere", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, "application/json; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"error":{"code":"not_found","message":"no route for GET /nowhere"}}`, w.Body.String())
+
+	w = doRequest(r, http.MethodDelete, "/health", nil)
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	assert.JSONEq(t, `{"error":{"code":"method_not_allowed","message":"DELETE is not allowed on /health"}}`, w.Body.String())
+
+	//Preflight requests are still answered by the CORS middleware
+	req := httptest.NewRequest(http.MethodOptions, "/voter", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	w = doRequest(r, http.MethodGet, "/stats/errors", nil)
+	var stats api.ErrorStats
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &stats))
+	assert.Equal(t, int64(1), stats.NotFound)
+	assert.Equal(t, int64(1), stats.Validation)
+}
+
+func TestErrorStats(t *testing.T) {
+	r, mr := newTestRouter(t)
+	seedVoter(t, r, testVoter(1))
+
+	errorStats := func() api.ErrorStats {
+		t.Helper()
+		var stats api.ErrorStats
+		w := doRequest(r, http.MethodGet, "/stats/errors", nil)
+		require.Equal(t, http.StatusOK, w.Code)
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &stats))
+		return stats
+	}
+	assert.Equal(t, api.ErrorStats{}, errorStats())
+
+	w := doRequest(r, http.MethodPost, "/voter", testVoter(1))
+	require.Equal(t, http.StatusConflict, w.Code)
+	stats := errorStats()
+	assert.Equal(t, int64(1), stats.Conflict)
+	assert.Zero(t, stats.NotFound)
+
+	w = doRequest(r, http.MethodGet, "/voter/99", nil)
+	require.Equal(t, http.StatusNotFound, w.Code)
+	w = doRequest(r, http.MethodDelete, "/voter/99", nil)
+	require.Equal(t, http.StatusNotFound, w.Code)
+	w = doRequest(r, http.MethodGet, "/voter/abc", nil)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	doRequest(r, http.MethodGet, "/crash", nil)
+
+	assert.Equal(t, api.ErrorStats{Total: 5, NotFound: 2, Conflict: 1, Validation: 1, Other: 1}, errorStats())
+
+	//the health check reports the same total
+	var health map[string]any
+	w = doRequest(r, http.MethodGet, "/health", nil)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &health))
+	assert.Equal(t, float64(5), health["errors_encountered"])
+
+	mr.Close()
+	w = doRequest(r, http.MethodGet, "/voter/1", nil)
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, int64(1), errorStats().Redis)
+}
+
+func TestCrashSimRecovers(t *testing.T) {
+	r, _ := newTestRouter(t)
+
+	w := doRequest(r, http.MethodGet, "/crash", nil)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+
+	var body api.ErrorBody
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, api.CodeInternal, body.Error.Code)
+
+	//the server is still up and serving requests
+	w = doRequest(r, http.MethodGet, "/health", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestHealthCheck(t *testing.T) {
+	r, mr := newTestRouter(t)
+	seedVoter(t, r, testVoter(1))
+	seedVoter(t, r, testVoter(2))
+
+	doRequest(r, http.MethodGet, "/voter/abc/polls", nil)
+	doRequest(r, http.MethodGet, "/crash", nil)
+
+	var health map[string]any
+	w := doRequest(r, http.MethodGet, "/health", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &health))
+	assert.Equal(t, "ok", health["status"])
+	assert.Equal(t, float64(2), health["users_processed"])
+	assert.Equal(t, float64(2), health["errors_encountered"])
+	assert.Contains(t, health, "uptime")
+
+	//a probe soon after reuses the count rather than scanning the voters
+	//again, so a new voter only shows up in /stats
+	seedVoter(t, r, testVoter(3))
+	health = nil
+	w = doRequest(r, http.MethodGet, "/health", nil)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &health))
+	assert.Equal(t, float64(2), health["users_processed"])
+
+	//with redis gone the check still answers but reports it is degraded
+	mr.Close()
+	health = nil
+	w = doRequest(r, http.MethodGet, "/health", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &health))
+	assert.Equal(t, "degraded", health["status"])
+	assert.NotContains(t, health, "users_processed")
+	assert.Contains(t, health, "errors_encountered")
+}
+
+// slowPing is a go-redis hook that holds every PING back by delay, as a
+// redis that is overloaded or far away would
+type slowPing struct {
+	delay time.Duration
+}
+
+func (s slowPing) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (s slowPing) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if cmd.Name() == "ping" {
+			time.Sleep(s.delay)
+		}
+		return next(ctx, cmd)
+	}
+}
+
+func (s slowPing) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
+func TestHealthCheckReportsRedisLatency(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mr, err := memredis.Run()
+	require.NoError(t, err)
+	t.Cleanup(mr.Close)
+
+	apiHandler, err := api.NewWithCacheInstance(mr.Addr())
+	require.NoError(t, err)
+	t.Cleanup(func() { apiHandler.Close() })
+	r := setupRouter(apiHandler, routerOptions{})
+
+	health := func() map[string]any {
+		var health map[string]any
+		w := doRequest(r, http.MethodGet, "/health", nil)
+		require.Equal(t, http.StatusOK, w.Code)
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &health))
+		return health
+	}
+
+	//a fast redis is healthy and its latency is under the threshold
+	got := health()
+	assert.Equal(t, "ok", got["status"])
+	assert.Equal(t, "up", got["redis"])
+	require.Contains(t, got, "redis_latency_ms")
+	assert.Less(t, got["redis_latency_ms"], float64(api.DefaultLatencyThreshold.Milliseconds()))
+
+	//a PING slower than the threshold degrades the service but redis is
+	//still up and the voter count is still reported
+	apiHandler.SetLatencyThreshold(20 * time.Millisecond)
+	apiHandler.AddRedisHook(slowPing{delay: 50 * time.Millisecond})
+	got = health()
+	assert.Equal(t, "degraded", got["status"])
+	assert.Equal(t, "up", got["redis"])
+	assert.GreaterOrEqual(t, got["redis_latency_ms"], float64(50))
+	assert.Contains(t, got, "users_processed")
+
+	//raising the threshold makes the same latency acceptable
+	apiHandler.SetLatencyThreshold(time.Second)
+	assert.Equal(t, "ok", health()["status"])
+
+	//a PING that fails reports redis as down without a latency
+	mr.Close()
+	got = health()
+	assert.Equal(t, "degraded", got["status"])
+	assert.Equal(t, "down", got["redis"])
+	assert.NotContains(t, got, "redis_latency_ms")
+}
+
+func TestGetStats(t *testing.T) {
+	r, _ := newTestRouter(t)
+
+	w := doRequest(r, http.MethodGet, "/stats", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"voters":0,"totalVotes":0,"averageVotesPerVoter":0}`, w.Body.String())
+
+	seedVoter(t, r, testVoter(1))
+	seedVoter(t, r, testVoter(2))
+	seedVoter(t, r, db.Voter{VoterId: 3, Name: "No Votes", Email: "novotes@example.com"})
+	require.Equal(t, http.StatusCreated, doRequest(r, http.MethodPost, "/voter/1", db.VoterHistory{PollId: 2, VoteId: 1}).Code)
+
+	w = doRequest(r, http.MethodGet, "/stats", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"voters":3,"totalVotes":3,"averageVotesPerVoter":1}`, w.Body.String())
+}
+
+func TestVoteTotal(t *testing.T) {
+	r, mr := newTestRouter(t)
+
+	w := doRequest(r, http.MethodGet, "/stats/votes", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"totalVotes":0}`, w.Body.String())
+
+	seedVoter(t, r, testVoter(1))
+	seedVoter(t, r, testVoter(2))
+	require.Equal(t, http.StatusCreated, doRequest(r, http.MethodPost, "/voter/1", db.VoterHistory{PollId: 2, VoteId: 1}).Code)
+	require.Equal(t, http.StatusOK, doRequest(r, http.MethodDelete, "/voter/2/polls/1", nil).Code)
+
+	w = doRequest(r, http.MethodGet, "/stats/votes", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"totalVotes":2}`, w.Body.String())
+
+	//reconciling puts a total that drifted back in line with the voters
+	require.NoError(t, mr.Set("voter:votes:total", "7"))
+	w = doRequest(r, http.MethodPost, "/stats/votes/reconcile", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"totalVotes":2}`, w.Body.String())
+	assert.JSONEq(t, `{"totalVotes":2}`, doRequest(r, http.MethodGet, "/stats/votes", nil).Body.String())
+}
+
+func TestAuditLog(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mr, err := memredis.Run()
+	require.NoError(t, err)
+	t.Cleanup(mr.Close)
+
+	apiHandler, err := api.NewWithCacheInstance(mr.Addr())
+	require.NoError(t, err)
+	t.Cleanup(func() { apiHandler.Close() })
+	r := setupRouter(apiHandler, routerOptions{auditMax: 100})
+
+	before := time.Now().UTC()
+	seedVoter(t, r, testVoter(1))
+	require.Equal(t, http.StatusOK, doRequest(r, http.MethodGet, "/voter/1", nil).Code)
+	require.Equal(t, http.StatusNotFound, doRequest(r, http.MethodDelete, "/voter/9", nil).Code)
+
+	w := doRequest(r, http.MethodGet, "/audit", nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var entries []db.AuditEntry
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &entries))
+	require.Len(t, entries, 2, "reads are not audited")
+	assert.Equal(t, "DELETE", entries[0].Method)
+	assert.Equal(t, uint(9), entries[0].VoterId)
+	assert.Equal(t, http.StatusNotFound, entries[0].Status)
+
+	added := entries[1]
+	assert.Equal(t, "POST", added.Method)
+	assert.Equal(t, "/voter", added.Path)
+	assert.Equal(t, uint(1), added.VoterId, "taken from the Location of the new voter")
+	assert.Equal(t, http.StatusCreated, added.Status)
+	assert.False(t, added.Time.Before(before.Truncate(time.Second)))
+
+	w = doRequest(r, http.MethodGet, "/audit?limit=1", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &entries))
+	assert.Len(t, entries, 1)
+	for _, limit := range []string{"0", "x", "1001"} {
+		assert.Equal(t, http.StatusBadRequest, doRequest(r, http.MethodGet, "/audit?limit="+limit, nil).Code, limit)
+	}
+
+	//Off by default
+	r, _ = newTestRouter(t)
+	seedVoter(t, r, testVoter(1))
+	w = doRequest(r, http.MethodGet, "/audit", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `[]`, w.Body.String())
+}
+
+func TestIdempotencyKeyReleasedAfterPanic(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mr, err := memredis.Run()
+	require.NoError(t, err)
+	t.Cleanup(mr.Close)
+
+	apiHandler, err := api.NewWithCacheInstance(mr.Addr())
+	require.NoError(t, err)
+	t.Cleanup(func() { apiHandler.Close() })
+
+	//the first attempt panics, the recovery middleware answers with a 500
+	calls := 0
+	r := gin.New()
+	r.Use(gin.CustomRecovery(api.Recover))
+	r.POST("/flaky", apiHandler.Idempotency(time.Hour), func(c *gin.Context) {
+		calls++
+		if calls == 1 {
+			panic("boom")
+		}
+		c.Status(http.StatusCreated)
+	})
+
+	post := func() int {
+		req := httptest.NewRequest(http.MethodPost, "/flaky", nil)
+		req.Header.Set(api.IdempotencyKeyHeader, "flaky-1")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	assert.Equal(t, http.StatusInternalServerError, post())
+	assert.Equal(t, http.StatusCreated, post(), "the key must not be left pending")
+	assert.Equal(t, 2, calls)
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mr, err := memredis.Run()
+	require.NoError(t, err)
+	t.Cleanup(mr.Close)
+
+	apiHandler, err := api.NewWithCacheInstance(mr.Addr())
+	require.NoError(t, err)
+	t.Cleanup(func() { apiHandler.Close() })
+	r := setupRouter(apiHandler, routerOptions{idempotencyTTL: time.Hour})
+
+	post := func(path, key string, body any) *httptest.ResponseRecorder {
+		payload, _ := json.Marshal(body)
+		req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		if key != "" {
+			req.Header.Set(api.IdempotencyKeyHeader, key)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	voterCount := func() string {
+		return doRequest(r, http.MethodGet, "/voter/count", nil).Body.String()
+	}
+
+	//without an id every add makes a new voter, a retry with the same key
+	//gets the first answer back and adds nothing
+	first := post("/voter", "add-1", testVoter(0))
+	require.Equal(t, http.StatusCreated, first.Code)
+	retry := post("/voter", "add-1", testVoter(0))
+	assert.Equal(t, http.StatusCreated, retry.Code)
+	assert.Equal(t, first.Body.String(), retry.Body.String())
+	assert.Equal(t, first.Header().Get("Location"), retry.Header().Get("Location"))
+	assert.Equal(t, "true", retry.Header().Get(api.IdempotentReplayedHeader))
+	assert.Empty(t, first.Header().Get(api.IdempotentReplayedHeader))
+	assert.JSONEq(t, `{"count":1}`, voterCount())
+
+	var voter db.Voter
+	require.NoError(t, json.Unmarshal(first.Body.Bytes(), &voter))
+	pollPath := "/voter/" + strconv.Itoa(int(voter.VoterId))
+	vote := db.VoterHistory{PollId: 2, VoteId: 1}
+	require.Equal(t, http.StatusCreated, post(pollPath, "vote-1", vote).Code)
+	retry = post(pollPath, "vote-1", vote)
+	assert.Equal(t, http.StatusCreated, retry.Code, "the retry must not be refused as a duplicate vote")
+	assert.Equal(t, "true", retry.Header().Get(api.IdempotentReplayedHeader))
+	w := doRequest(r, http.MethodGet, pollPath+"/polls/count", nil)
+	assert.JSONEq(t, `{"count":2}`, w.Body.String())
+
+	//the same request without a key runs again
+	assert.Equal(t, http.StatusConflict, post(pollPath, "", vote).Code)
+
+	//a key belongs to one request
+	other := testVoter(0)
+	other.Name = "Someone Else"
+	w = post("/voter", "add-1", other)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	assert.JSONEq(t, `{"count":1}`, voterCount())
+	//and so does its query
+	w = post("/voter?ttl=60", "add-1", testVoter(0))
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	assert.JSONEq(t, `{"count":1}`, voterCount())
+
+	//kept responses expire with the ttl, the add then runs again and finds
+	//the email taken by the voter it added the first time
+	mr.FastForward(2 * time.Hour)
+	w = post("/voter", "add-1", testVoter(0))
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Empty(t, w.Header().Get(api.IdempotentReplayedHeader))
+	assert.JSONEq(t, `{"count":1}`, voterCount())
+}
+
+func TestReadinessCheck(t *testing.T) {
+	r, mr := newTestRouter(t)
+
+	w := doRequest(r, http.MethodGet, "/readyz", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"status":"ready"}`, w.Body.String())
+
+	//without redis the instance is not ready, but it is still alive
+	mr.Close()
+	w = doRequest(r, http.MethodGet, "/readyz", nil)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.JSONEq(t, `{"status":"unavailable"}`, w.Body.String())
+	assert.Equal(t, http.StatusOK, doRequest(r, http.MethodGet, "/health", nil).Code)
+}
+
+func TestServeDrainsInFlightRequests(t *testing.T) {
+	started := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- serve(ctx, &http.Server{Handler: mux}, ln, 5*time.Second)
+	}()
+
+	respCh := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String() + "/slow")
+		if assert.NoError(t, err) {
+			resp.Body.Close()
+		}
+		respCh <- resp
+	}()
+
+	<-started
+	cancel()
+
+	require.NoError(t, <-done)
+	resp := <-respCh
+	require.NotNil(t, resp)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "in-flight request should complete")
+
+	_, err = http.Get("http://" + ln.Addr().String() + "/slow")
+	assert.Error(t, err, "server should no longer accept connections")
+}
+
+func TestAddVotersBatch(t *testing.T) {
+	r, _ := newTestRouter(t)
+	seedVoter(t, r, testVoter(1))
+
+	batch := []db.Voter{testVoter(1), testVoter(2), testVoter(3)}
+	w := doRequest(r, http.MethodPost, "/voter/batch", batch)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var result api.BatchResult
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+	assert.Equal(t, 2, result.Added)
+	require.Len(t, result.Skipped, 1)
+	assert.Equal(t, 0, result.Skipped[0].Index)
+	assert.Equal(t, uint(1), result.Skipped[0].VoterId)
+	assert.Equal(t, db.ErrVoterExists.Error(), result.Skipped[0].Error)
+
+	w = doRequest(r, http.MethodPost, "/voter/batch", "{}")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestGetPollResults(t *testing.T) {
+	r, _ := newTestRouter(t)
+	seedVoter(t, r, testVoter(1))
+	seedVoter(t, r, testVoter(2))
+
+	w := doRequest(r, http.MethodGet, "/polls/1/results", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"pollId":1,"votes":{"1":2},"votersSampled":2}`, w.Body.String())
+
+	w = doRequest(r, http.MethodGet, "/polls/7/results", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"pollId":7,"votes":{},"votersSampled":2}`, w.Body.String())
+
+	w = doRequest(r, http.MethodGet, "/polls/abc/results", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestGetPollVoters(t *testing.T) {
+	r, _ := newTestRouter(t)
+	seedVoter(t, r, testVoter(1))
+	seedVoter(t, r, testVoter(2))
+	require.Equal(t, http.StatusCreated, doRequest(r, http.MethodPost, "/voter/2", db.VoterHistory{PollId: 5, VoteId: 1}).Code)
+
+	w := doRequest(r, http.MethodGet, "/polls/5/voters", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `[2]`, w.Body.String())
+
+	w = doRequest(r, http.MethodGet, "/polls/6/voters", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `[]`, w.Body.String())
+
+	w = doRequest(r, http.MethodGet, "/polls/abc/voters", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestGetPollHistoryPaged(t *testing.T) {
+	r, _ := newTestRouter(t)
+	voter := testVoter(1)
+	voter.VoteHistory = nil
+	for pollId := uint(1); pollId <= 120; pollId++ {
+		voter.VoteHistory = append(voter.VoteHistory, db.VoterHistory{PollId: pollId, VoteId: 1})
+	}
+	seedVoter(t, r, voter)
+
+	var seen []uint
+	for offset := 0; offset < 200; offset += 50 {
+		w := doRequest(r, http.MethodGet, fmt.Sprintf("/voter/1/polls?offset=%d", offset), nil)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Equal(t, "120", w.Header().Get(api.TotalCountHeader))
+		var page api.VotePage
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+		assert.Equal(t, 50, page.Limit, "the default page size")
+		assert.Equal(t, offset, page.Offset)
+		assert.Equal(t, 120, page.Total)
+		assert.Equal(t, len(page.Votes), page.Count)
+		for _, vote := range page.Votes {
+			seen = append(seen, vote.PollId)
+		}
+	}
+	require.Len(t, seen, 120)
+	assert.Equal(t, uint(1), seen[0])
+	assert.Equal(t, uint(120), seen[119])
+
+	w := doRequest(r, http.MethodGet, "/voter/1/polls?offset=500&limit=10", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"votes":[],"total":120,"offset":500,"limit":10,"count":0}`, w.Body.String())
+
+	//Without paging the whole history is a plain array as before
+	w = doRequest(r, http.MethodGet, "/voter/1/polls", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var all []db.VoterHistory
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &all))
+	assert.Len(t, all, 120)
+
+	assert.Equal(t, http.StatusNotFound, doRequest(r, http.MethodGet, "/voter/42/polls?limit=5", nil).Code)
+	for _, query := range []string{"?limit=0", "?limit=x", "?offset=-1", "?limit=5&since=2024-01-01T00:00:00Z", "?offset=1&from=2024-01-01T00:00:00Z"} {
+		assert.Equal(t, http.StatusBadRequest, doRequest(r, http.MethodGet, "/voter/1/polls"+query, nil).Code, query)
+	}
+}
+
+func TestGetPollHistorySorted(t *testing.T) {
+	r, _ := newTestRouter(t)
+	day := func(d int) time.Time { return time.Date(2024, 3, d, 12, 0, 0, 0, time.UTC) }
+	voter := testVoter(1)
+	voter.VoteHistory = []db.VoterHistory{
+		{PollId: 2, VoteId: 1, VoteDate: day(1)},
+		{PollId: 3, VoteId: 1, VoteDate: day(3)},
+		{PollId: 1, VoteId: 1, VoteDate: day(2)},
+	}
+	seedVoter(t, r, voter)
+
+	polls := func(query string) []uint {
+		t.Helper()
+		w := doRequest(r, http.MethodGet, "/voter/1/polls"+query, nil)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Equal(t, "3", w.Header().Get(api.TotalCountHeader))
+		var history []db.VoterHistory
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &history))
+		ids := make([]uint, len(history))
+		for i, vote := range history {
+			ids[i] = vote.PollId
+		}
+		return ids
+	}
+	assert.Equal(t, []uint{3, 1, 2}, polls(""), "newest first without sort or order")
+	assert.Equal(t, []uint{3, 1, 2}, polls("?sort=date"))
+	assert.Equal(t, []uint{2, 1, 3}, polls("?sort=date&order=asc"))
+	assert.Equal(t, []uint{3, 1, 2}, polls("?order=desc"))
+	assert.Equal(t, []uint{1, 2, 3}, polls("?sort=poll&order=asc"))
+	assert.Equal(t, []uint{3, 2, 1}, polls("?sort=poll"))
+
+	w := doRequest(r, http.MethodGet, "/voter/1/polls?sort=poll&order=asc&limit=2&offset=1", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var page api.VotePage
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+	require.Len(t, page.Votes, 2)
+	assert.Equal(t, uint(2), page.Votes[0].PollId)
+	assert.Equal(t, uint(3), page.Votes[1].PollId)
+
+	//pages are newest first too when nothing else is asked for
+	w = doRequest(r, http.MethodGet, "/voter/1/polls?limit=2", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	page = api.VotePage{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+	require.Len(t, page.Votes, 2)
+	assert.Equal(t, uint(3), page.Votes[0].PollId)
+	assert.Equal(t, uint(1), page.Votes[1].PollId)
+
+	for _, query := range []string{"?sort=name", "?order=up"} {
+		assert.Equal(t, http.StatusBadRequest, doRequest(r, http.MethodGet, "/voter/1/polls"+query, nil).Code, query)
+	}
+}
+
+func TestGetPollHistorySince(t *testing.T) {
+	r, _ := newTestRouter(t)
+	seedVoter(t, r, db.Voter{VoterId: 1, Name: "Test Voter", Email: "voter1@example.com"})
+	for pollId, date := range map[int]string{2: "2024-05-01T00:00:00Z", 3: "2024-05-02T00:00:00Z"} {
+		vote := fmt.Sprintf(`{"PollId":%d,"VoteId":1,"VoteDate":%q}`, pollId, date)
+		require.Equal(t, http.StatusCreated, doRequest(r, http.MethodPost, "/voter/1", vote).Code)
+	}
+
+	//a vote cast exactly at since has already been seen
+	w := doRequest(r, http.MethodGet, "/voter/1/polls?since=2024-05-01T00:00:00Z", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var history []db.VoterHistory
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &history))
+	require.Len(t, history, 1)
+	assert.Equal(t, uint(3), history[0].PollId)
+
+	w = doRequest(r, http.MethodGet, "/voter/1/polls?since=2024-04-30T23:59:59.999Z", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	history = nil
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &history))
+	assert.Len(t, history, 2)
+
+	//nothing new is an empty list, with a time for the next sync
+	before := time.Now()
+	w = doRequest(r, http.MethodGet, "/voter/1/polls?since=2024-05-02T00:00:00Z", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `[]`, w.Body.String())
+	serverTime, err := time.Parse(time.RFC3339Nano, w.Header().Get(api.ServerTimeHeader))
+	require.NoError(t, err)
+	assert.False(t, serverTime.Before(before.Truncate(time.Microsecond)))
+
+	//a vote recorded after that time shows up in the next sync
+	require.Equal(t, http.StatusCreated, doRequest(r, http.MethodPost, "/voter/1", db.VoterHistory{PollId: 4, VoteId: 1}).Code)
+	w = doRequest(r, http.MethodGet, "/voter/1/polls?since="+url.QueryEscape(serverTime.Format(time.RFC3339Nano)), nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	history = nil
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &history))
+	require.Len(t, history, 1)
+	assert.Equal(t, uint(4), history[0].PollId)
+
+	w = doRequest(r, http.MethodGet, "/voter/1/polls?since=yesterday", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = doRequest(r, http.MethodGet, "/voter/1/polls?since=2024-05-01T00:00:00Z&from=2024-05-01T00:00:00Z", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = doRequest(r, http.MethodGet, "/voter/99/polls?since=2024-05-01T00:00:00Z", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestGetVotersInAllPolls(t *testing.T) {
+	r, _ := newTestRouter(t)
+	//every test voter has voted in poll 1
+	seedVoter(t, r, testVoter(1))
+	seedVoter(t, r, testVoter(2))
+	seedVoter(t, r, testVoter(3))
+	for _, voterId := range []int{1, 2} {
+		path := fmt.Sprintf("/voter/%d", voterId)
+		require.Equal(t, http.StatusCreated, doRequest(r, http.MethodPost, path, db.VoterHistory{PollId: 2, VoteId: 1}).Code)
+	}
+	require.Equal(t, http.StatusCreated, doRequest(r, http.MethodPost, "/voter/1", db.VoterHistory{PollId: 3, VoteId: 1}).Code)
+
+	w := doRequest(r, http.MethodGet, "/polls/intersection?ids=1,2", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `[1,2]`, w.Body.String())
+
+	w = doRequest(r, http.MethodGet, "/polls/intersection?ids=1,2,3", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `[1]`, w.Body.String())
+
+	w = doRequest(r, http.MethodGet, "/polls/intersection?ids=3,4", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `[]`, w.Body.String())
+
+	for _, path := range []string{"/polls/intersection", "/polls/intersection?ids=", "/polls/intersection?ids=1,x"} {
+		w = doRequest(r, http.MethodGet, path, nil)
+		assert.Equal(t, http.StatusBadRequest, w.Code, path)
+	}
+
+	//the routes for a single poll still work next to it
+	w = doRequest(r, http.MethodGet, "/polls/3/voters", nil)
+	assert.JSONEq(t, `[1]`, w.Body.String())
+}
+
+func TestGetPollHistoryInRange(t *testing.T) {
+	r, _ := newTestRouter(t)
+	seedVoter(t, r, testVoter(1))
+	vote := `{"PollId":2,"VoteId":1,"VoteDate":"2024-05-02T00:00:00Z"}`
+	require.Equal(t, http.StatusCreated, doRequest(r, http.MethodPost, "/voter/1", vote).Code)
+
+	w := doRequest(r, http.MethodGet, "/voter/1/polls?from=2024-05-02T00:00:00Z", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var history []db.VoterHistory
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &history))
+	require.Len(t, history, 1)
+	assert.Equal(t, uint(2), history[0].PollId)
+
+	w = doRequest(r, http.MethodGet, "/voter/1/polls?to=2024-05-01T23:59:59Z", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &history))
+	for _, vote := range history {
+		assert.NotEqual(t, uint(2), vote.PollId)
+	}
+
+	w = doRequest(r, http.MethodGet, "/voter/1/polls?from=yesterday", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = doRequest(r, http.MethodGet, "/voter/99/polls?from=2024-05-02T00:00:00Z", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestListInactiveVoters(t *testing.T) {
+	r, _ := newTestRouter(t)
+
+	w := doRequest(r, http.MethodGet, "/voter/inactive", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `[]`, w.Body.String())
+
+	seedVoter(t, r, testVoter(1))
+	seedVoter(t, r, db.Voter{VoterId: 2, Name: "Inactive", Email: "inactive@example.com"})
+
+	w = doRequest(r, http.MethodGet, "/voter/inactive", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var voters []db.Voter
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &voters))
+	require.Len(t, voters, 1)
+	assert.Equal(t, uint(2), voters[0].VoterId)
+}
+
+func TestGetVoteCountEndpoint(t *testing.T) {
+	r, _ := newTestRouter(t)
+	seedVoter(t, r, testVoter(1))
+
+	w := doRequest(r, http.MethodGet, "/voter/1/polls/count", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"count":1}`, w.Body.String())
+
+	require.Equal(t, http.StatusCreated, doRequest(r, http.MethodPost, "/voter/1", db.VoterHistory{PollId: 2, VoteId: 1}).Code)
+	w = doRequest(r, http.MethodGet, "/voter/1/polls/count", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"count":2}`, w.Body.String())
+
+	w = doRequest(r, http.MethodGet, "/voter/99/polls/count", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestVoteDateTimeZone(t *testing.T) {
+	r, _ := newTestRouter(t)
+	seedVoter(t, r, testVoter(1))
+
+	w := doRequest(r, http.MethodPost, "/voter/1", `{"PollId":2,"VoteId":1,"VoteDate":"2024-03-04T10:00:00+02:00"}`)
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	//stored, and sent by default, in UTC
+	w = doRequest(r, http.MethodGet, "/voter/1/polls/2", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"VoteDate":"2024-03-04T08:00:00Z"`)
+
+	w = doRequest(r, http.MethodGet, "/voter/1/polls/2?tz=America/New_York", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"VoteDate":"2024-03-04T03:00:00-05:00"`)
+
+	for _, path := range []string{"/voter/1?tz=Asia/Tokyo", "/voter/1/polls?tz=Asia/Tokyo", "/voter?tz=Asia/Tokyo", "/voter?ids=1&tz=Asia/Tokyo", "/voter?limit=5&tz=Asia/Tokyo"} {
+		w = doRequest(r, http.MethodGet, path, nil)
+		require.Equal(t, http.StatusOK, w.Code, path)
+		assert.Contains(t, w.Body.String(), `"VoteDate":"2024-03-04T17:00:00+09:00"`, path)
+	}
+
+	//converting changes the body, so the ETag too
+	plain := doRequest(r, http.MethodGet, "/voter/1", nil)
+	tokyo := doRequest(r, http.MethodGet, "/voter/1?tz=Asia/Tokyo", nil)
+	assert.NotEqual(t, plain.Header().Get("ETag"), tokyo.Header().Get("ETag"))
+
+	w = doRequest(r, http.MethodGet, "/voter/1?tz=Mars/Olympus_Mons", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "unknown time zone")
+	w = doRequest(r, http.MethodGet, "/voter/1/polls?tz=nope", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestZeroVoteIds(t *testing.T) {
+	r, _ := newTestRouter(t)
+	seedVoter(t, r, testVoter(1))
+
+	w := doRequest(r, http.MethodPost, "/voter/1", `{"PollId":0,"VoteId":3}`)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	var body api.ErrorBody
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Contains(t, body.Error.Fields, "PollId")
+
+	w = doRequest(r, http.MethodPost, "/voter/1", `{"PollId":2,"VoteId":0}`)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	assert.JSONEq(t, `{"error":{"code":"invalid_body","message":"vote id must not be zero","fields":{"VoteId":"vote id must not be zero"}}}`, w.Body.String())
+
+	w = doRequest(r, http.MethodPost, "/voter/1", `{"PollId":2}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = doRequest(r, http.MethodPut, "/voter/1/polls/2", `{"PollId":2,"VoteId":0}`)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "vote id must not be zero")
+
+	//none of them were recorded
+	w = doRequest(r, http.MethodGet, "/voter/1/polls/count", nil)
+	assert.JSONEq(t, `{"count":1}`, w.Body.String())
+}
+
+func TestGetVoterField(t *testing.T) {
+	r, _ := newTestRouter(t)
+	seedVoter(t, r, testVoter(1))
+	require.Equal(t, http.StatusCreated, doRequest(r, http.MethodPost, "/voter/1", db.VoterHistory{PollId: 2, VoteId: 5}).Code)
+
+	w := doRequest(r, http.MethodGet, "/voter/1/field/.Email", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.JSONEq(t, `"voter1@example.com"`, w.Body.String())
+
+	//the leading dot is optional
+	w = doRequest(r, http.MethodGet, "/voter/1/field/Name", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `"Test Voter"`, w.Body.String())
+
+	w = doRequest(r, http.MethodGet, "/voter/1/field/.VoteHistory[1]", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var vote db.VoterHistory
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &vote))
+	assert.Equal(t, uint(2), vote.PollId)
+	assert.Equal(t, uint(5), vote.VoteId)
+
+	w = doRequest(r, http.MethodGet, "/voter/1/field/.VoteHistory[0].PollId", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "1", w.Body.String())
+
+	for _, path := range []string{"/voter/1/field/", "/voter/1/field/.Email.", "/voter/1/field/.VoteHistory[x]", "/voter/1/field/.Vote%20History"} {
+		w = doRequest(r, http.MethodGet, path, nil)
+		assert.Equal(t, http.StatusBadRequest, w.Code, path)
+	}
+
+	w = doRequest(r, http.MethodGet, "/voter/1/field/.Nope", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Contains(t, w.Body.String(), "path .Nope does not exist")
+	w = doRequest(r, http.MethodGet, "/voter/1/field/.VoteHistory[9]", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = doRequest(r, http.MethodGet, "/voter/99/field/.Email", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Contains(t, w.Body.String(), db.ErrVoterNotFound.Error())
+}
+
+func TestGetMissingPolls(t *testing.T) {
+	r, _ := newTestRouter(t)
+	seedVoter(t, r, testVoter(1))
+
+	w := doRequest(r, http.MethodGet, "/voter/1/polls/missing?active=1,2,3", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `[2,3]`, w.Body.String())
+
+	w = doRequest(r, http.MethodGet, "/voter/1/polls/missing", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `[]`, w.Body.String())
+
+	w = doRequest(r, http.MethodGet, "/voter/1/polls/missing?active=1,x", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = doRequest(r, http.MethodGet, "/voter/99/polls/missing?active=1", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	//the static route must not swallow the single poll lookup
+	w = doRequest(r, http.MethodGet, "/voter/1/polls/1", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestInvalidVoterIdParam(t *testing.T) {
+	r, _ := newTestRouter(t)
+	seedVoter(t, r, testVoter(1))
+
+	poll := db.VoterHistory{PollId: 2, VoteId: 2}
+	for _, id := range []string{"abc", "-5"} {
+		tests := []struct {
+			method string
+			path   string
+			body   any
+		}{
+			{http.MethodGet, "/voter/" + id, nil},
+			{http.MethodPut, "/voter/" + id, testVoter(1)},
+			{http.MethodDelete, "/voter/" + id, nil},
+			{http.MethodGet, "/voter/" + id + "/polls", nil},
+			{http.MethodGet, "/voter/" + id + "/polls/1", nil},
+			{http.MethodPost, "/voter/" + id, poll},
+			{http.MethodPut, "/voter/" + id + "/polls/2", poll},
+			{http.MethodDelete, "/voter/" + id + "/polls/1", nil},
+		}
+		for _, tt := range tests {
+			t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+				w := doRequest(r, tt.method, tt.path, tt.body)
+				assert.Equal(t, http.StatusBadRequest, w.Code)
+			})
+		}
+	}
+
+	//None of the rejected requests should have touched voter 1
+	w := doRequest(r, http.MethodGet, "/voter/1", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var voter db.Voter
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &voter))
+	assert.Equal(t, testVoter(1).VoteHistory[0].PollId, voter.VoteHistory[0].PollId)
+	assert.Len(t, voter.VoteHistory, 1)
+}
+
+func TestUpdateVoterIdMismatch(t *testing.T) {
+	r, _ := newTestRouter(t)
+	seedVoter(t, r, testVoter(1))
+	seedVoter(t, r, testVoter(2))
+
+	renamed := testVoter(2)
+	renamed.Name = "Should Not Stick"
+	w := doRequest(r, http.MethodPut, "/voter/1", renamed)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "does not match")
+
+	//neither voter may have been touched by the rejected request
+	for _, id := range []string{"1", "2"} {
+		w = doRequest(r, http.MethodGet, "/voter/"+id, nil)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `"Name":"Test Voter"`)
+	}
+
+	w = doRequest(r, http.MethodPut, "/voter/1", `{"Name":"Renamed","Email":"renamed@example.com"}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"VoterId":1`)
+}
+
+func TestUpdateVoterKeepsVoteHistory(t *testing.T) {
+	r, _ := newTestRouter(t)
+	seedVoter(t, r, testVoter(1))
+
+	w := doRequest(r, http.MethodPut, "/voter/1", `{"Name":"Renamed","Email":"voter1@example.com"}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"PollId":1`, "response shows the kept history")
+
+	w = doRequest(r, http.MethodGet, "/voter/1/polls", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var history []db.VoterHistory
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &history))
+	require.Len(t, history, 1)
+	assert.Equal(t, uint(1), history[0].PollId)
+
+	//An explicit empty array still clears the history
+	w = doRequest(r, http.MethodPut, "/voter/1", `{"Name":"Renamed","Email":"voter1@example.com","VoteHistory":[]}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	w = doRequest(r, http.MethodGet, "/voter/1/polls", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `[]`, w.Body.String())
+}
+
+func TestRedisOutageIsNotReportedAsNotFound(t *testing.T) {
+	r, mr := newTestRouter(t)
+	seedVoter(t, r, testVoter(1))
+
+	mr.Close()
+
+	for _, path := range []string{"/voter/1", "/voter/1/polls", "/voter", "/polls/1/results"} {
+		w := doRequest(r, http.MethodGet, path, nil)
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code, path)
+	}
+}
+
+func TestAddPollServerTime(t *testing.T) {
+	r, _ := newTestRouter(t)
+	seedVoter(t, r, testVoter(1))
+
+	clientTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	w := doRequest(r, http.MethodPost, "/voter/1?servertime=true", db.VoterHistory{PollId: 2, VoteId: 1, VoteDate: clientTime})
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	w = doRequest(r, http.MethodGet, "/voter/1/polls/2", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var poll db.VoterHistory
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &poll))
+	assert.True(t, poll.VoteDate.After(clientTime))
+	assert.Equal(t, time.UTC, poll.VoteDate.Location())
+
+	w = doRequest(r, http.MethodPost, "/voter/1?servertime=maybe", db.VoterHistory{PollId: 3, VoteId: 1})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestAddPollSorted(t *testing.T) {
+	r, _ := newTestRouter(t)
+	seedVoter(t, r, testVoter(1))
+
+	for pollId, month := range map[uint]time.Month{2: 2, 3: 1} {
+		vote := db.VoterHistory{PollId: pollId, VoteId: 1, VoteDate: time.Date(2024, month, 1, 0, 0, 0, 0, time.UTC)}
+		require.Equal(t, http.StatusCreated, doRequest(r, http.MethodPost, "/voter/1?sorted=true", vote).Code)
+	}
+
+	//GET /voter/:id/polls sorts on its own, the stored order is on the voter
+	w := doRequest(r, http.MethodGet, "/voter/1", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var voter db.Voter
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &voter))
+	history := voter.VoteHistory
+	require.Len(t, history, 3)
+	assert.Equal(t, []uint{1, 3, 2}, []uint{history[0].PollId, history[1].PollId, history[2].PollId})
+
+	w = doRequest(r, http.MethodPost, "/voter/1?sorted=maybe", db.VoterHistory{PollId: 4, VoteId: 1})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestListSelectVoters(t *testing.T) {
+	r, _ := newTestRouter(t)
+
+	voters := []db.Voter{
+		{VoterId: 1, Name: "Alice Smith", Email: "alice@example.com"},
+		{VoterId: 2, Name: "Bob Smith", Email: "bob@example.com", VoteHistory: []db.VoterHistory{{PollId: 1, VoteId: 1}}},
+		{VoterId: 3, Name: "Carol Jones", Email: "carol@example.com", VoteHistory: []db.VoterHistory{{PollId: 1, VoteId: 2}, {PollId: 2, VoteId: 1}}},
+	}
+	for _, voter := range voters {
+		seedVoter(t, r, voter)
+	}
+
+	tests := []struct {
+		query string
+		ids   []uint
+	}{
+		{"", []uint{1, 2, 3}},
+		{"?name=smith", []uint{1, 2}},
+		{"?name=JONES", []uint{3}},
+		{"?email=bob@example.com", []uint{2}},
+		{"?email=BOB@example.com", []uint{2}},
+		{"?email=%20Bob@Example.COM%20", []uint{2}},
+		{"?minPolls=1", []uint{2, 3}},
+		{"?minPolls=2", []uint{3}},
+		{"?name=smith&minPolls=1", []uint{2}},
+		{"?name=smith&email=alice@example.com", []uint{1}},
+		{"?email=carol@example.com&minPolls=2", []uint{3}},
+		{"?name=smith&email=carol@example.com&minPolls=2", []uint{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			w := doRequest(r, http.MethodGet, "/v2/voter"+tt.query, nil)
+			require.Equal(t, http.StatusOK, w.Code)
+
+			var got []db.Voter
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &got))
+			ids := make([]uint, 0, len(got))
+			for _, voter := range got {
+				ids = append(ids, voter.VoterId)
+			}
+			assert.ElementsMatch(t, tt.ids, ids)
+		})
+	}
+
+	for _, query := range []string{"?minPolls=abc", "?minPolls=-1"} {
+		w := doRequest(r, http.MethodGet, "/v2/voter"+query, nil)
+		assert.Equal(t, http.StatusBadRequest, w.Code, query)
+	}
+}
+
+func TestListVotersSorted(t *testing.T) {
+	r, _ := newTestRouter(t)
+	seedVoter(t, r, db.Voter{VoterId: 1, Name: "Bob", Email: "bob@example.com"})
+	seedVoter(t, r, db.Voter{VoterId: 2, Name: "Alice", Email: "alice@example.com"})
+
+	w := doRequest(r, http.MethodGet, "/voter?sort=name", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var voters []db.Voter
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &voters))
+	require.Len(t, voters, 2)
+	assert.Equal(t, "Alice", voters[0].Name)
+
+	w = doRequest(r, http.MethodGet, "/voter?order=desc&limit=1", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var page api.VoterPage
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+	require.Len(t, page.Voters, 1)
+	assert.Equal(t, uint(2), page.Voters[0].VoterId)
+
+	for _, query := range []string{"?sort=email", "?order=up"} {
+		w := doRequest(r, http.MethodGet, "/voter"+query, nil)
+		assert.Equal(t, http.StatusBadRequest, w.Code, query)
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mr, err := memredis.Run()
+	require.NoError(t, err)
+	t.Cleanup(mr.Close)
+
+	apiHandler, err := api.NewWithCacheInstance(mr.Addr())
+	require.NoError(t, err)
+	t.Cleanup(func() { apiHandler.Close() })
+
+	m := metrics.New(apiHandler.CountVoters)
+	apiHandler.AddRedisHook(m.RedisHook())
+	r := setupRouter(apiHandler, routerOptions{metrics: m})
+
+	seedVoter(t, r, testVoter(1))
+	doRequest(r, http.MethodGet, "/voter/1", nil)
+	doRequest(r, http.MethodGet, "/voter/2", nil)
+
+	w := doRequest(r, http.MethodGet, "/metrics", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	body := w.Body.String()
+	assert.Contains(t, body, `voter_api_requests_total{method="GET",path="/voter/:id",status="200"} 1`)
+	assert.Contains(t, body, `voter_api_requests_total{method="GET",path="/voter/:id",status="404"} 1`)
+	assert.Contains(t, body, `voter_api_request_duration_seconds_count{method="POST",path="/voter",status="201"} 1`)
+	assert.Contains(t, body, "voter_api_voters 1")
+	assert.Contains(t, body, "voter_api_redis_errors_total 0", "a missing voter is not a redis error")
+
+	mr.Close()
+	doRequest(r, http.MethodGet, "/voter/1", nil)
+	w = doRequest(r, http.MethodGet, "/metrics", nil)
+	assert.NotContains(t, w.Body.String(), "voter_api_redis_errors_total 0")
+
+	//Without metrics the route does not exist
+	r, _ = newTestRouter(t)
+	w = doRequest(r, http.MethodGet, "/metrics", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestLogLevel(t *testing.T) {
+	for name, want := range map[string]slog.Level{
+		"debug": slog.LevelDebug, "INFO": slog.LevelInfo, "warn": slog.LevelWarn, "Warning": slog.LevelWarn, "error": slog.LevelError,
+	} {
+		level, err := logging.ParseLevel(name)
+		require.NoError(t, err, name)
+		assert.Equal(t, want, level, name)
+	}
+	_, err := logging.ParseLevel("verbose")
+	assert.Error(t, err)
+
+	assert.Equal(t, gin.DebugMode, ginMode(slog.LevelDebug))
+	assert.Equal(t, gin.ReleaseMode, ginMode(slog.LevelInfo))
+	assert.Equal(t, gin.ReleaseMode, ginMode(slog.LevelError))
+
+	//at info the debug lines are dropped, the rest of the request log is
+	//still written
+	var buf bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(logging.NewJSONLogger(&buf, slog.LevelInfo))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+
+	r, _ := newTestRouter(t)
+	slog.Debug("debug detail")
+	doRequest(r, http.MethodGet, "/voter/7", nil)
+	assert.NotContains(t, buf.String(), "debug detail")
+	assert.Contains(t, buf.String(), `"msg":"request"`)
+
+	//at error only the failed lookup is logged, not the request itself
+	buf.Reset()
+	slog.SetDefault(logging.NewJSONLogger(&buf, slog.LevelError))
+	slog.Info("info detail")
+	doRequest(r, http.MethodGet, "/voter/7", nil)
+	assert.NotContains(t, buf.String(), "info detail")
+	assert.NotContains(t, buf.String(), `"msg":"request"`)
+	assert.Contains(t, buf.String(), `"level":"ERROR"`)
+
+	slog.SetDefault(logging.NewJSONLogger(&buf, slog.LevelDebug))
+	slog.Debug("debug detail")
+	assert.Contains(t, buf.String(), "debug detail")
+}
+
+func TestRequestIdLogging(t *testing.T) {
+	var buf bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(logging.NewJSONLogger(&buf, slog.LevelInfo))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+
+	r, mr := newTestRouter(t)
+
+	//A request id sent by the client is kept
+	req := httptest.NewRequest(http.MethodGet, "/voter/7", nil)
+	req.Header.Set(logging.RequestIDHeader, "client-id-1")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, "client-id-1", w.Header().Get(logging.RequestIDHeader))
+
+	//Otherwise one is made up
+	w = doRequest(r, http.MethodGet, "/voter/7", nil)
+	generated := w.Header().Get(logging.RequestIDHeader)
+	assert.NotEmpty(t, generated)
+	assert.NotEqual(t, "client-id-1", generated)
+
+	//redis failures are logged by the db layer with the request id
+	mr.Close()
+	req = httptest.NewRequest(http.MethodGet, "/voter/7", nil)
+	req.Header.Set(logging.RequestIDHeader, "client-id-2")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	var sawAccessLog, sawRedisError bool
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry map[string]any
+		require.NoError(t, json.Unmarshal([]byte(line), &entry), line)
+
+		switch {
+		case entry["msg"] == "request" && entry["request_id"] == "client-id-1":
+			sawAccessLog = true
+			assert.Equal(t, "GET", entry["method"])
+			assert.Equal(t, "/voter/7", entry["path"])
+			assert.Equal(t, "/voter/:id", entry["route"])
+			assert.Equal(t, float64(http.StatusNotFound), entry["status"])
+			assert.Contains(t, entry, "latency_ms")
+		case entry["msg"] == "redis command failed" && entry["request_id"] == "client-id-2":
+			sawRedisError = true
+		}
+	}
+	assert.True(t, sawAccessLog, "request was not logged")
+	assert.True(t, sawRedisError, "redis error was not logged with the request id")
+}
+
+func TestGetVoterCount(t *testing.T) {
+	r, _ := newTestRouter(t)
+
+	w := doRequest(r, http.MethodGet, "/voter/count", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"count":0}`, w.Body.String())
+
+	seedVoter(t, r, testVoter(1))
+	seedVoter(t, r, testVoter(2))
+	w = doRequest(r, http.MethodGet, "/voter/count", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"count":2}`, w.Body.String())
+}
+
+func TestHeadVoter(t *testing.T) {
+	r, _ := newTestRouter(t)
+	seedVoter(t, r, testVoter(1))
+
+	w := doRequest(r, http.MethodHead, "/voter/1", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "0", w.Header().Get("Content-Length"))
+	assert.Empty(t, w.Body.String())
+
+	w = doRequest(r, http.MethodHead, "/voter/2", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestMaxVoteHistoryEndpoints(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mr, err := memredis.Run()
+	require.NoError(t, err)
+	t.Cleanup(mr.Close)
+	apiHandler, err := api.NewWithCacheInstance(mr.Addr())
+	require.NoError(t, err)
+	t.Cleanup(func() { apiHandler.Close() })
+	require.NoError(t, apiHandler.SetMaxVoteHistory(1, db.RejectVote))
+	r := setupRouter(apiHandler, routerOptions{})
+	seedVoter(t, r, testVoter(1))
+
+	vote := db.VoterHistory{PollId: 2, VoteId: 1}
+	w := doRequest(r, http.MethodPost, "/voter/1", vote)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), `"code":"vote_history_full"`)
+	w = doRequest(r, http.MethodPut, "/voter/1/polls/2", vote)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	//Replacing the one vote is fine
+	w = doRequest(r, http.MethodPut, "/voter/1/polls/1", db.VoterHistory{PollId: 1, VoteId: 2})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	require.NoError(t, apiHandler.SetMaxVoteHistory(1, db.EvictOldestVote))
+	w = doRequest(r, http.MethodPost, "/voter/1", vote)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var history []db.VoterHistory
+	w = doRequest(r, http.MethodGet, "/voter/1/polls", nil)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &history))
+	require.Len(t, history, 1)
+	assert.Equal(t, uint(2), history[0].PollId)
+}
+
+func TestHeadSinglePollFromVoter(t *testing.T) {
+	r, _ := newTestRouter(t)
+	seedVoter(t, r, testVoter(1))
+
+	w := doRequest(r, http.MethodHead, "/voter/1/polls/1", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "0", w.Header().Get("Content-Length"))
+	assert.Empty(t, w.Body.String())
+
+	for path, status := range map[string]int{
+		"/voter/1/polls/2":  http.StatusNotFound,
+		"/voter/2/polls/1":  http.StatusNotFound,
+		"/voter/1/polls/x":  http.StatusBadRequest,
+		"/voter/1/polls/-1": http.StatusBadRequest,
+	} {
+		w = doRequest(r, http.MethodHead, path, nil)
+		assert.Equal(t, status, w.Code, path)
+		assert.Empty(t, w.Body.String(), path)
+	}
+}
+
+func TestMergeVotersEndpoint(t *testing.T) {
+	r, _ := newTestRouter(t)
+	seedVoter(t, r, testVoter(1))
+	other := testVoter(2)
+	other.VoteHistory = append(other.VoteHistory, db.VoterHistory{PollId: 2, VoteId: 3})
+	seedVoter(t, r, other)
+
+	w := doRequest(r, http.MethodPost, "/voter/1/merge/2", nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var merged db.Voter
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &merged))
+	assert.Equal(t, uint(1), merged.VoterId)
+	require.Len(t, merged.VoteHistory, 2)
+	assert.Equal(t, uint(2), merged.VoteHistory[1].PollId)
+
+	assert.Equal(t, http.StatusNotFound, doRequest(r, http.MethodGet, "/voter/2", nil).Code)
+	w = doRequest(r, http.MethodPost, "/voter/1/merge/2", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code, "the merged voter is gone")
+	assert.Contains(t, w.Body.String(), `"code":"not_found"`)
+
+	for _, path := range []string{"/voter/1/merge/1", "/voter/x/merge/1", "/voter/1/merge/-2"} {
+		assert.Equal(t, http.StatusBadRequest, doRequest(r, http.MethodPost, path, nil).Code, path)
+	}
+}
+
+func TestAddPollsBatchEndpoint(t *testing.T) {
+	r, _ := newTestRouter(t)
+	seedVoter(t, r, testVoter(1))
+
+	batch := []db.VoterHistory{{PollId: 2, VoteId: 1}, {PollId: 1, VoteId: 2}, {PollId: 3, VoteId: 1}, {PollId: 2, VoteId: 3}}
+	w := doRequest(r, http.MethodPost, "/voter/1/polls/batch", batch)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var result api.PollBatchResult
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+	assert.Equal(t, 2, result.Added)
+	require.Len(t, result.Skipped, 2)
+	assert.Equal(t, 1, result.Skipped[0].Index, "already voted in poll 1")
+	assert.Equal(t, 3, result.Skipped[1].Index, "poll 2 twice in the batch")
+	assert.Equal(t, uint(2), result.Skipped[1].PollId)
+	require.Len(t, result.Voter.VoteHistory, 3)
+
+	var history []db.VoterHistory
+	w = doRequest(r, http.MethodGet, "/voter/1/polls", nil)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &history))
+	assert.Len(t, history, 3)
+
+	assert.Equal(t, http.StatusBadRequest, doRequest(r, http.MethodPost, "/voter/1/polls/batch", "[]").Code)
+	assert.Equal(t, http.StatusBadRequest, doRequest(r, http.MethodPost, "/voter/1/polls/batch", "{").Code)
+	assert.Equal(t, http.StatusNotFound, doRequest(r, http.MethodPost, "/voter/9/polls/batch", batch).Code)
+}
+
+func TestSoftDeleteEndpoints(t *testing.T) {
+	r, _ := newTestRouter(t)
+	seedVoter(t, r, testVoter(1))
+	seedVoter(t, r, testVoter(2))
+
+	assert.Equal(t, http.StatusOK, doRequest(r, http.MethodDelete, "/voter/1?soft=true", nil).Code)
+	assert.Equal(t, http.StatusNotFound, doRequest(r, http.MethodDelete, "/voter/1?soft=true", nil).Code)
+	assert.Equal(t, http.StatusBadRequest, doRequest(r, http.MethodDelete, "/voter/1?soft=maybe", nil).Code)
+
+	//the voter is hidden by default, its votes as well
+	assert.Equal(t, http.StatusNotFound, doRequest(r, http.MethodGet, "/voter/1", nil).Code)
+	assert.Equal(t, http.StatusNotFound, doRequest(r, http.MethodGet, "/voter/1/polls", nil).Code)
+	assert.Equal(t, http.StatusNotFound, doRequest(r, http.MethodPost, "/voter/1", db.VoterHistory{PollId: 2, VoteId: 1}).Code)
+	assert.Equal(t, http.StatusNotFound, doRequest(r, http.MethodPut, "/voter/1", testVoter(1)).Code)
+	var voters []db.Voter
+	w := doRequest(r, http.MethodGet, "/voter", nil)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &voters))
+	require.Len(t, voters, 1)
+	assert.Equal(t, uint(2), voters[0].VoterId)
+
+	//and shown when asked for
+	var voter db.Voter
+	w = doRequest(r, http.MethodGet, "/voter/1?includeDeleted=true", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &voter))
+	assert.True(t, voter.Deleted)
+	assert.False(t, voter.DeletedAt.IsZero())
+	voters = nil
+	w = doRequest(r, http.MethodGet, "/voter?includeDeleted=true", nil)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &voters))
+	assert.Len(t, voters, 2)
+	var page api.VoterPage
+	w = doRequest(r, http.MethodGet, "/voter?includeDeleted=true&limit=10", nil)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+	assert.Equal(t, 2, page.Total)
+	assert.Equal(t, http.StatusBadRequest, doRequest(r, http.MethodGet, "/voter?includeDeleted=maybe", nil).Code)
+
+	voter = db.Voter{}
+	w = doRequest(r, http.MethodPost, "/voter/1/restore", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &voter))
+	assert.False(t, voter.Deleted)
+	assert.Equal(t, http.StatusOK, doRequest(r, http.MethodGet, "/voter/1", nil).Code)
+	assert.Equal(t, http.StatusNotFound, doRequest(r, http.MethodPost, "/voter/42/restore", nil).Code)
+
+	//without soft the voter is gone for good
+	assert.Equal(t, http.StatusOK, doRequest(r, http.MethodDelete, "/voter/1", nil).Code)
+	assert.Equal(t, http.StatusNotFound, doRequest(r, http.MethodGet, "/voter/1?includeDeleted=true", nil).Code)
+}
+
+func TestGetVoterIncludePollCount(t *testing.T) {
+	r, _ := newTestRouter(t)
+	seedVoter(t, r, testVoter(1))
+	require.Equal(t, http.StatusCreated, doRequest(r, http.MethodPost, "/voter/1", db.VoterHistory{PollId: 2, VoteId: 1}).Code)
+
+	var plain map[string]any
+	w := doRequest(r, http.MethodGet, "/voter/1", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &plain))
+	assert.NotContains(t, plain, "PollCount")
+
+	var withCount api.VoterWithPollCount
+	w = doRequest(r, http.MethodGet, "/voter/1?include=pollCount", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &withCount))
+	assert.Equal(t, 2, withCount.PollCount)
+	assert.Equal(t, "Test Voter", withCount.Name)
+	assert.Len(t, withCount.VoteHistory, 2)
+
+	//the count is only part of the response, the stored voter is unchanged
+	plain = nil
+	w = doRequest(r, http.MethodGet, "/voter/1", nil)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &plain))
+	assert.NotContains(t, plain, "PollCount")
+
+	assert.Equal(t, http.StatusBadRequest, doRequest(r, http.MethodGet, "/voter/1?include=everything", nil).Code)
+}
+
+func TestFieldsSelector(t *testing.T) {
+	r, _ := newTestRouter(t)
+	seedVoter(t, r, testVoter(1))
+	seedVoter(t, r, testVoter(2))
+
+	w := doRequest(r, http.MethodGet, "/voter/1?fields=VoterId,Name", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"VoterId":1,"Name":"Test Voter"}`, w.Body.String())
+
+	w = doRequest(r, http.MethodGet, "/voter/1?fields=PollCount&include=pollCount", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"PollCount":1}`, w.Body.String())
+
+	w = doRequest(r, http.MethodGet, "/voter?fields=VoterId&order=desc", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `[{"VoterId":2},{"VoterId":1}]`, w.Body.String())
+
+	w = doRequest(r, http.MethodGet, "/voter?fields=VoterId,Email&limit=1", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"voters":[{"VoterId":1,"Email":"voter1@example.com"}],"total":2,"offset":0,"limit":1,"count":1}`, w.Body.String())
+
+	for _, path := range []string{
+		"/voter/1?fields=VoterId,Nmae",
+		"/voter/1?fields=voterid",
+		"/voter/1?fields=PollCount",
+		"/voter/1?fields=VoterId,,Name",
+		"/voter?fields=Password",
+		"/voter?fields=Name,Password&limit=1",
+	} {
+		w = doRequest(r, http.MethodGet, path, nil)
+		assert.Equal(t, http.StatusBadRequest, w.Code, path)
+		assert.Contains(t, w.Body.String(), "unknown field", path)
+	}
+}
+
+func TestGetVoterETag(t *testing.T) {
+	r, _ := newTestRouter(t)
+	seedVoter(t, r, testVoter(1))
+
+	get := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/voter/1", nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("")
+	require.Equal(t, http.StatusOK, w.Code)
+	etag := w.Header().Get("ETag")
+	require.NotEmpty(t, etag)
+	assert.Equal(t, etag, get("").Header().Get("ETag"), "etag must be stable")
+
+	w = get(etag)
+	assert.Equal(t, http.StatusNotModified, w.Code)
+	assert.Empty(t, w.Body.String())
+	assert.Equal(t, etag, w.Header().Get("ETag"))
+
+	w = get(`"something-else", ` + etag)
+	assert.Equal(t, http.StatusNotModified, w.Code)
+
+	w = get(`"something-else"`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"VoterId":1`)
+
+	//Changing the voter changes the etag
+	updated := testVoter(1)
+	updated.Name = "Renamed"
+	require.Equal(t, http.StatusOK, doRequest(r, http.MethodPut, "/voter/1", updated).Code)
+	w = get(etag)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotEqual(t, etag, w.Header().Get("ETag"))
+}
+
+func TestPatchVoter(t *testing.T) {
+	r, _ := newTestRouter(t)
+	seedVoter(t, r, testVoter(1))
+
+	w := doRequest(r, http.MethodPatch, "/voter/1", `{"Name":"Only The Name"}`)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = doRequest(r, http.MethodGet, "/voter/1", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var voter db.Voter
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &voter))
+	assert.Equal(t, "Only The Name", voter.Name)
+	assert.Equal(t, testVoter(1).Email, voter.Email)
+	require.Len(t, voter.VoteHistory, 1)
+	assert.Equal(t, testVoter(1).VoteHistory[0].PollId, voter.VoteHistory[0].PollId)
+
+	w = doRequest(r, http.MethodPatch, "/voter/1", `{"Email":"bad"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	w = doRequest(r, http.MethodPatch, "/voter/2", `{"Name":"Nobody"}`)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestUpdateVoterVersionConflict(t *testing.T) {
+	r, _ := newTestRouter(t)
+	seedVoter(t, r, testVoter(1))
+
+	stale := testVoter(1)
+	stale.Version = 1
+	stale.Name = "First"
+	w := doRequest(r, http.MethodPut, "/voter/1", stale)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"Version":2`)
+
+	stale.Name = "Second"
+	w = doRequest(r, http.MethodPut, "/voter/1", stale)
+	assert.Equal(t, http.StatusConflict, w.Code)
+}
+
+func TestExportVotersCSV(t *testing.T) {
+	r, _ := newTestRouter(t)
+
+	w := doRequest(r, http.MethodGet, "/voter/export?format=csv", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	rows, err := csv.NewReader(w.Body).ReadAll()
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{{"VoterId", "Name", "Email", "PollCount"}}, rows)
+
+	seedVoter(t, r, testVoter(1))
+	seedVoter(t, r, db.Voter{VoterId: 2, Name: "Smith, Jane", Email: "jane@example.com"})
+	seedVoter(t, r, testVoter(3))
+
+	w = doRequest(r, http.MethodGet, "/voter/export?format=csv", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Header().Get("Content-Type"), "text/csv")
+
+	rows, err = csv.NewReader(w.Body).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, rows, 4)
+	assert.Equal(t, []string{"VoterId", "Name", "Email", "PollCount"}, rows[0])
+	assert.Equal(t, []string{"1", "Test Voter", "voter1@example.com", "1"}, rows[1])
+	assert.Equal(t, []string{"2", "Smith, Jane", "jane@example.com", "0"}, rows[2])
+
+	//No format is the normal JSON list
+	w = doRequest(r, http.MethodGet, "/voter/export", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var voters []db.Voter
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &voters))
+	assert.Len(t, voters, 3)
+
+	w = doRequest(r, http.MethodGet, "/voter/export?format=xml", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestImportVoters(t *testing.T) {
+	r, _ := newTestRouter(t)
+	seedVoter(t, r, testVoter(1))
+
+	importCSV := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/voter/import", strings.NewReader(body))
+		req.Header.Set("Content-Type", "text/csv")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	csvBody := strings.Join([]string{
+		"VoterId,Name,Email,PollCount",
+		"1,Duplicate,dup@example.com,0",
+		"2,Two,two@example.com,3",
+		"abc,Bad Id,bad@example.com,0",
+		"4,Bad Email,not-an-email,0",
+		",Auto,auto@example.com,0",
+		`5,"Unterminated,five@example.com,0`,
+	}, "\n")
+	w := importCSV(csvBody)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var result api.ImportResult
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+	assert.Equal(t, 2, result.Created)
+	assert.Equal(t, 1, result.Skipped)
+	assert.Equal(t, 3, result.Failed)
+	require.Len(t, result.Errors, 4)
+	indexes := []int{result.Errors[0].Index, result.Errors[1].Index, result.Errors[2].Index, result.Errors[3].Index}
+	assert.Equal(t, []int{0, 2, 3, 5}, indexes)
+
+	w = doRequest(r, http.MethodGet, "/voter/2", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"Name":"Two"`)
+
+	//What comes out of an export goes back in
+	w = doRequest(r, http.MethodGet, "/voter/export?format=csv", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	exported := w.Body.String()
+	require.Equal(t, http.StatusOK, doRequest(r, http.MethodDelete, "/voter", nil).Code)
+	w = importCSV(exported)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+	assert.Equal(t, 3, result.Created)
+	assert.Zero(t, result.Failed)
+
+	//JSON works the same way
+	w = doRequest(r, http.MethodPost, "/voter/import", []db.Voter{testVoter(1), testVoter(10)})
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+	assert.Equal(t, 1, result.Created)
+	assert.Equal(t, 1, result.Skipped)
+
+	w = importCSV("Name,Email\nNo Id,noid@example.com\n")
+	assert.Equal(t, http.StatusBadRequest, w.Code, "the VoterId column is required")
+
+	req := httptest.NewRequest(http.MethodPost, "/voter/import", strings.NewReader("<voters/>"))
+	req.Header.Set("Content-Type", "application/xml")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+}
+
+func TestGetVoterByEmailEndpoint(t *testing.T) {
+	r, _ := newTestRouter(t)
+	seedVoter(t, r, db.Voter{VoterId: 1, Name: "Alice", Email: "alice@example.com"})
+
+	w := doRequest(r, http.MethodGet, "/voter/by-email?email=alice@example.com", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"Name":"Alice"`)
+
+	w = doRequest(r, http.MethodGet, "/voter/by-email?email=bob@example.com", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = doRequest(r, http.MethodGet, "/voter/by-email", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestRebuildIndexesEndpoint(t *testing.T) {
+	r, mr := newTestRouter(t)
+	seedVoter(t, r, db.Voter{VoterId: 1, Name: "Alice", Email: "alice@example.com"})
+	mr.Del("voter:email")
+
+	w := doRequest(r, http.MethodGet, "/voter/by-email?email=alice@example.com", nil)
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	assert.Equal(t, http.StatusOK, doRequest(r, http.MethodPost, "/admin/reindex", nil).Code)
+	w = doRequest(r, http.MethodGet, "/voter/by-email?email=alice@example.com", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"Name":"Alice"`)
+}
+
+func TestRateLimit(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mr, err := memredis.Run()
+	require.NoError(t, err)
+	t.Cleanup(mr.Close)
+
+	apiHandler, err := api.NewWithCacheInstance(mr.Addr())
+	require.NoError(t, err)
+	t.Cleanup(func() { apiHandler.Close() })
+
+	//A very slow refill so the test does not depend on timing
+	const burst = 5
+	r := setupRouter(apiHandler, routerOptions{rateLimiter: ratelimit.New(0.01, burst)})
+
+	get := func(remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/voter/count", nil)
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	for i := 0; i < burst; i++ {
+		require.Equal(t, http.StatusOK, get("192.0.2.1:1234").Code, "request %d", i)
+	}
+	w := get("192.0.2.1:1234")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After"))
+	require.NoError(t, err)
+	assert.Positive(t, retryAfter)
+
+	//Other clients have their own bucket
+	assert.Equal(t, http.StatusOK, get("192.0.2.2:1234").Code)
+
+	//X-Forwarded-For from a client that is not a trusted proxy is ignored,
+	//so it can not be used to get a fresh bucket
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/voter/count", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("X-Forwarded-For", fmt.Sprintf("198.51.100.%d", i))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusTooManyRequests, w.Code, "spoofed request %d", i)
+	}
+}
+
+func TestRateLimitBehindTrustedProxy(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mr, err := memredis.Run()
+	require.NoError(t, err)
+	t.Cleanup(mr.Close)
+
+	apiHandler, err := api.NewWithCacheInstance(mr.Addr())
+	require.NoError(t, err)
+	t.Cleanup(func() { apiHandler.Close() })
+
+	proxies, err := parseTrustedProxies(" 10.0.0.0/8, 192.0.2.1 ")
+	require.NoError(t, err)
+	r := setupRouter(apiHandler, routerOptions{rateLimiter: ratelimit.New(0.01, 1), trustedProxies: proxies})
+
+	//Behind a trusted proxy each forwarded client has its own bucket
+	for _, client := range []string{"198.51.100.1", "198.51.100.2"} {
+		req := httptest.NewRequest(http.MethodGet, "/voter/count", nil)
+		req.RemoteAddr = "10.1.2.3:1234"
+		req.Header.Set("X-Forwarded-For", client)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code, client)
+	}
+
+	for _, bad := range []string{"proxy.example.com", "10.0.0.0/33"} {
+		_, err := parseTrustedProxies(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestOpenAPISpec(t *testing.T) {
+	r, _ := newTestRouter(t)
+
+	w := doRequest(r, http.MethodGet, "/openapi.json", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var spec struct {
+		Paths       map[string]map[string]any `json:"paths"`
+		Definitions map[string]any            `json:"definitions"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &spec))
+	assert.Contains(t, spec.Paths["/voter/{id}"], "get")
+	assert.Contains(t, spec.Paths["/voter/{id}/polls/{pollid}"], "put")
+	assert.Contains(t, spec.Definitions, "db.Voter")
+	assert.Contains(t, spec.Definitions, "db.VoterHistory")
+
+	w = doRequest(r, http.MethodGet, "/swagger/index.html", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	//the existing routes are untouched
+	assert.Equal(t, http.StatusOK, doRequest(r, http.MethodGet, "/voter", nil).Code)
+}
+
+func TestRequestTimeout(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mr, err := memredis.Run()
+	require.NoError(t, err)
+	t.Cleanup(mr.Close)
+
+	apiHandler, err := api.NewWithCacheInstance(mr.Addr())
+	require.NoError(t, err)
+	t.Cleanup(func() { apiHandler.Close() })
+
+	//A deadline that has passed before the handler runs
+	r := setupRouter(apiHandler, routerOptions{requestTimeout: time.Nanosecond})
+	w := doRequest(r, http.MethodGet, "/voter/1", nil)
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+
+	r = setupRouter(apiHandler, routerOptions{requestTimeout: time.Minute})
+	w = doRequest(r, http.MethodGet, "/voter/1", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestCORSAllowedOrigins(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mr, err := memredis.Run()
+	require.NoError(t, err)
+	t.Cleanup(mr.Close)
+
+	apiHandler, err := api.NewWithCacheInstance(mr.Addr())
+	require.NoError(t, err)
+	t.Cleanup(func() { apiHandler.Close() })
+
+	request := func(r http.Handler, method, origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/voter", nil)
+		req.Header.Set("Origin", origin)
+		if method == http.MethodOptions {
+			req.Header.Set("Access-Control-Request-Method", http.MethodPatch)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	r := setupRouter(apiHandler, routerOptions{allowedOrigins: []string{"https://voters.example.com"}})
+
+	w := request(r, http.MethodGet, "https://voters.example.com")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "https://voters.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+
+	w = request(r, http.MethodOptions, "https://voters.example.com")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Contains(t, w.Header().Get("Access-Control-Allow-Methods"), http.MethodPatch)
+
+	w = request(r, http.MethodGet, "https://evil.example.com")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+
+	//a preflight carries no credentials, it must not need the API key
+	r = setupRouter(apiHandler, routerOptions{apiKey: "s3cret", allowedOrigins: []string{"https://voters.example.com"}})
+	w = request(r, http.MethodOptions, "https://voters.example.com")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	//without a list every origin is allowed
+	r = setupRouter(apiHandler, routerOptions{})
+	w = request(r, http.MethodGet, "https://evil.example.com")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "*", w.Header().Get("Access-Control-Allow-Origin"))
+}
+
+func TestAllowedOriginsFromEnv(t *testing.T) {
+	t.Setenv("ALLOWED_ORIGINS", " https://a.example.com, ,https://b.example.com ")
+	assert.Equal(t, []string{"https://a.example.com", "https://b.example.com"}, allowedOriginsFromEnv())
+
+	t.Setenv("ALLOWED_ORIGINS", "")
+	assert.Empty(t, allowedOriginsFromEnv())
+}
+
+func TestGzipResponses(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mr, err := memredis.Run()
+	require.NoError(t, err)
+	t.Cleanup(mr.Close)
+	apiHandler, err := api.NewWithCacheInstance(mr.Addr())
+	require.NoError(t, err)
+	t.Cleanup(func() { apiHandler.Close() })
+	r := setupRouter(apiHandler, routerOptions{gzip: true, gzipLevel: gzip.DefaultCompression})
+
+	for id := uint(1); id <= 50; id++ {
+		seedVoter(t, r, testVoter(id))
+	}
+
+	get := func(path string, acceptGzip bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if acceptGzip {
+			req.Header.Set("Accept-Encoding", "gzip")
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("/voter", true)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	zr, err := gzip.NewReader(w.Body)
+	require.NoError(t, err)
+	body, err := io.ReadAll(zr)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), `"VoterId":50`)
+
+	//Without Accept-Encoding, or for the tiny responses, nothing changes
+	w = get("/voter", false)
+	assert.Empty(t, w.Header().Get("Content-Encoding"))
+	assert.Contains(t, w.Body.String(), `"VoterId":50`)
+	w = get("/health", true)
+	assert.Empty(t, w.Header().Get("Content-Encoding"))
+}
+
+func TestRequestBodyLimit(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mr, err := memredis.Run()
+	require.NoError(t, err)
+	t.Cleanup(mr.Close)
+	apiHandler, err := api.NewWithCacheInstance(mr.Addr())
+	require.NoError(t, err)
+	t.Cleanup(func() { apiHandler.Close() })
+	r := setupRouter(apiHandler, routerOptions{maxBody: 256, maxBatchBody: 4096})
+
+	bigName := strings.Repeat("x", 512)
+	w := doRequest(r, http.MethodPost, "/voter", `{"Name":"`+bigName+`","Email":"voter@example.com"}`)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+
+	//Without a Content-Length the body is cut off while it is read
+	req := httptest.NewRequest(http.MethodPost, "/voter", io.MultiReader(strings.NewReader(`{"Name":"`+bigName+`","Email":"voter@example.com"}`)))
+	req.ContentLength = -1
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+
+	//The batch route takes more, up to its own cap
+	batch := `[{"Name":"` + bigName + `","Email":"voter@example.com"}]`
+	w = doRequest(r, http.MethodPost, "/voter/batch", batch)
+	assert.Equal(t, http.StatusOK, w.Code)
+	batch = `[{"Name":"` + strings.Repeat("x", 5000) + `","Email":"voter@example.com"}]`
+	w = doRequest(r, http.MethodPost, "/voter/batch", batch)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+
+	w = doRequest(r, http.MethodGet, "/voter/count", nil)
+	assert.JSONEq(t, `{"count":1}`, w.Body.String())
+}
+
+// configFlags parses args with the flags resolveConfig looks at, with the
+// same defaults as the server's
+func configFlags(t *testing.T, args ...string) *flag.FlagSet {
+	t.Helper()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("h", "0.0.0.0", "")
+	fs.Uint("p", 1080, "")
+	fs.String("log-level", "info", "")
+	require.NoError(t, fs.Parse(args))
+	return fs
+}
+
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestResolveConfig(t *testing.T) {
+	for _, env := range []string{"LOG_LEVEL", "ALLOWED_ORIGINS", "REDIS_URL", "REDIS_POOL_SIZE", "REDIS_DIAL_TIMEOUT", "REDIS_READ_TIMEOUT", "REDIS_WRITE_TIMEOUT"} {
+		t.Setenv(env, "")
+	}
+	path := writeConfig(t, "config.yaml", `
+host: 127.0.0.1
+port: 8080
+logLevel: warn
+allowedOrigins: [" https://a.example.com", ""]
+redis:
+  url: redis.internal:6379
+  poolSize: 20
+  readTimeout: 2s
+`)
+
+	t.Run("file only", func(t *testing.T) {
+		cfg, err := resolveConfig(path, configFlags(t))
+		require.NoError(t, err)
+		assert.Equal(t, config{
+			Host:           "127.0.0.1",
+			Port:           8080,
+			LogLevel:       "warn",
+			AllowedOrigins: []string{"https://a.example.com"},
+			Redis:          redisConfig{URL: "redis.internal:6379", PoolSize: 20, ReadTimeout: 2 * time.Second},
+		}, cfg)
+	})
+
+	t.Run("env overrides file", func(t *testing.T) {
+		t.Setenv("LOG_LEVEL", "debug")
+		t.Setenv("REDIS_URL", "other:6379")
+		t.Setenv("REDIS_READ_TIMEOUT", "5s")
+		t.Setenv("ALLOWED_ORIGINS", "https://b.example.com")
+		cfg, err := resolveConfig(path, configFlags(t))
+		require.NoError(t, err)
+		assert.Equal(t, "debug", cfg.LogLevel)
+		assert.Equal(t, "other:6379", cfg.Redis.URL)
+		assert.Equal(t, 5*time.Second, cfg.Redis.ReadTimeout)
+		assert.Equal(t, 20, cfg.Redis.PoolSize, "not in the environment")
+		assert.Equal(t, []string{"https://b.example.com"}, cfg.AllowedOrigins)
+
+		t.Setenv("REDIS_POOL_SIZE", "none")
+		_, err = resolveConfig(path, configFlags(t))
+		assert.ErrorContains(t, err, "REDIS_POOL_SIZE")
+	})
+
+	t.Run("flags override env and file", func(t *testing.T) {
+		t.Setenv("LOG_LEVEL", "debug")
+		cfg, err := resolveConfig(path, configFlags(t, "-p", "9090", "-log-level", "error"))
+		require.NoError(t, err)
+		assert.Equal(t, uint(9090), cfg.Port)
+		assert.Equal(t, "error", cfg.LogLevel)
+		assert.Equal(t, "127.0.0.1", cfg.Host, "from the file, -h was not given")
+	})
+
+	t.Run("defaults without a file", func(t *testing.T) {
+		cfg, err := resolveConfig("", configFlags(t))
+		require.NoError(t, err)
+		assert.Equal(t, config{Host: "0.0.0.0", Port: 1080, LogLevel: "info"}, cfg)
+	})
+
+	t.Run("json file", func(t *testing.T) {
+		jsonPath := writeConfig(t, "config.json", `{"port": 7070, "redis": {"url": "json:6379", "dialTimeout": "1s"}}`)
+		cfg, err := resolveConfig(jsonPath, configFlags(t))
+		require.NoError(t, err)
+		assert.Equal(t, uint(7070), cfg.Port)
+		assert.Equal(t, redisConfig{URL: "json:6379", DialTimeout: time.Second}, cfg.Redis)
+	})
+
+	t.Run("bad file", func(t *testing.T) {
+		_, err := resolveConfig(writeConfig(t, "typo.yaml", "prot: 8080\n"), configFlags(t))
+		assert.ErrorContains(t, err, "prot")
+		_, err = resolveConfig(filepath.Join(t.TempDir(), "missing.yaml"), configFlags(t))
+		assert.Error(t, err)
+	})
+}
+
+func TestListenAddr(t *testing.T) {
+	tests := []struct {
+		name    string
+		host    string
+		port    uint
+		portEnv string
+		want    string
+		wantErr string
+	}{
+		{"defaults", "0.0.0.0", 1080, "", "0.0.0.0:1080", ""},
+		{"hostname", "voter-api.local", 8080, "", "voter-api.local:8080", ""},
+		{"every interface", "", 1080, "", ":1080", ""},
+		{"ipv6", "::1", 1080, "", "[::1]:1080", ""},
+		{"bracketed ipv6", "[::1]", 1080, "", "[::1]:1080", ""},
+		{"PORT overrides the default", "0.0.0.0", 1080, "9000", "0.0.0.0:9000", ""},
+		{"port zero", "0.0.0.0", 0, "", "", "between 1 and 65535"},
+		{"port too large", "0.0.0.0", 70000, "", "", "between 1 and 65535"},
+		{"PORT too large", "0.0.0.0", 1080, "65536", "", "between 1 and 65535"},
+		{"PORT not a number", "0.0.0.0", 1080, "http", "", "not a number"},
+		{"host with a space", "bad host", 1080, "", "", "neither an IP address nor a hostname"},
+		{"host with a leading hyphen", "-voter", 1080, "", "", "neither an IP address nor a hostname"},
+		{"host with a port", "localhost:80", 1080, "", "", "neither an IP address nor a hostname"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, err := listenAddr(tt.host, tt.port, tt.portEnv)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, addr)
+		})
+	}
+}
+
+func TestAPIKeyAuth(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mr, err := memredis.Run()
+	require.NoError(t, err)
+	t.Cleanup(mr.Close)
+
+	apiHandler, err := api.NewWithCacheInstance(mr.Addr())
+	require.NoError(t, err)
+	t.Cleanup(func() { apiHandler.Close() })
+
+	request := func(r http.Handler, path, authorization string) int {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	t.Run("authorized", func(t *testing.T) {
+		r := setupRouter(apiHandler, routerOptions{apiKey: "s3cret"})
+		assert.Equal(t, http.StatusOK, request(r, "/voter", "Bearer s3cret"))
+		assert.Equal(t, http.StatusOK, request(r, "/voter", "s3cret"))
+	})
+
+	t.Run("unauthorized", func(t *testing.T) {
+		r := setupRouter(apiHandler, routerOptions{apiKey: "s3cret"})
+		assert.Equal(t, http.StatusUnauthorized, request(r, "/voter", ""))
+		assert.Equal(t, http.StatusUnauthorized, request(r, "/voter", "Bearer wrong"))
+		assert.Equal(t, http.StatusUnauthorized, request(r, "/voter/1", "Bearer "))
+		assert.Equal(t, http.StatusOK, request(r, "/health", ""), "health check is exempt")
+		assert.Equal(t, http.StatusOK, request(r, "/readyz", ""), "readiness check is exempt")
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		r := setupRouter(apiHandler, routerOptions{})
+		assert.Equal(t, http.StatusOK, request(r, "/voter", ""))
+	})
+}
+
+func TestStreamVotes(t *testing.T) {
+	r, _ := newTestRouter(t)
+	seedVoter(t, r, testVoter(1))
+
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws/votes", nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	voteDate := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	w := doRequest(r, http.MethodPost, "/voter/1", db.VoterHistory{PollId: 2, VoteId: 5, VoteDate: voteDate})
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	//A vote that is turned away as a duplicate is not streamed, the next
+	//message has to be the one for poll 3
+	w = doRequest(r, http.MethodPost, "/voter/1", db.VoterHistory{PollId: 2, VoteId: 6})
+	require.Equal(t, http.StatusConflict, w.Code, w.Body.String())
+	w = doRequest(r, http.MethodPost, "/voter/1", db.VoterHistory{PollId: 3, VoteId: 7})
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var got db.VoteEvent
+	require.NoError(t, conn.ReadJSON(&got))
+	assert.Equal(t, db.VoteEvent{VoterId: 1, PollId: 2, VoteId: 5, VoteDate: voteDate}, got)
+	require.NoError(t, conn.ReadJSON(&got))
+	assert.Equal(t, uint(3), got.PollId)
+	assert.Equal(t, uint(7), got.VoteId)
+
+	//Plain requests are not upgraded
+	w = doRequest(r, http.MethodGet, "/ws/votes", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestStreamVotesAcrossInstances(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mr, err := memredis.Run()
+	require.NoError(t, err)
+	t.Cleanup(mr.Close)
+
+	//two instances of the API sharing a redis and a votes channel
+	routers := make([]*gin.Engine, 2)
+	for i := range routers {
+		apiHandler, err := api.NewWithCacheInstance(mr.Addr())
+		require.NoError(t, err)
+		t.Cleanup(func() { apiHandler.Close() })
+		require.NoError(t, apiHandler.SetVotesChannel("test:votes"))
+		routers[i] = setupRouter(apiHandler, routerOptions{})
+	}
+	seedVoter(t, routers[0], testVoter(1))
+
+	srv := httptest.NewServer(routers[1])
+	t.Cleanup(srv.Close)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws/votes", nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	w := doRequest(routers[0], http.MethodPost, "/voter/1", db.VoterHistory{PollId: 2, VoteId: 5})
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	//votes made on the instance the client is connected to are only sent
+	//once, through the channel
+	w = doRequest(routers[1], http.MethodPost, "/voter/1", db.VoterHistory{PollId: 3, VoteId: 7})
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var got db.VoteEvent
+	require.NoError(t, conn.ReadJSON(&got))
+	assert.Equal(t, uint(2), got.PollId)
+	require.NoError(t, conn.ReadJSON(&got))
+	assert.Equal(t, uint(3), got.PollId)
+
+	//nothing else follows
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	assert.Error(t, conn.ReadJSON(&got))
+}
+
+// readEvent reads the next server-sent event, skipping comments
+func readEvent(t *testing.T, r *bufio.Reader) (id string, vote db.VoteEvent) {
+	t.Helper()
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &vote))
+		case line == "" && id != "":
+			return id, vote
+		}
+	}
+}
+
+func TestStreamVoteEvents(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mr, err := memredis.Run()
+	require.NoError(t, err)
+	t.Cleanup(mr.Close)
+	apiHandler, err := api.NewWithCacheInstance(mr.Addr())
+	require.NoError(t, err)
+	t.Cleanup(func() { apiHandler.Close() })
+	r := setupRouter(apiHandler, routerOptions{requestTimeout: 50 * time.Millisecond})
+	seedVoter(t, r, testVoter(1))
+
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+	stream := func(lastEventID string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, srv.URL+"/events/votes", nil)
+		require.NoError(t, err)
+		if lastEventID != "" {
+			req.Header.Set(api.LastEventIDHeader, lastEventID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	resp := stream("")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	//the stream outlives the request timeout
+	time.Sleep(100 * time.Millisecond)
+	for _, poll := range []uint{2, 3} {
+		w := doRequest(r, http.MethodPost, "/voter/1", db.VoterHistory{PollId: poll, VoteId: 5})
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	}
+
+	events := bufio.NewReader(resp.Body)
+	id, vote := readEvent(t, events)
+	assert.Equal(t, "1", id)
+	assert.Equal(t, uint(1), vote.VoterId)
+	assert.Equal(t, uint(2), vote.PollId)
+	id, vote = readEvent(t, events)
+	assert.Equal(t, "2", id)
+	assert.Equal(t, uint(3), vote.PollId)
+
+	//a client reconnecting after the first vote gets the second one again
+	id, vote = readEvent(t, bufio.NewReader(stream("1").Body))
+	assert.Equal(t, "2", id)
+	assert.Equal(t, uint(3), vote.PollId)
+
+	assert.Equal(t, http.StatusBadRequest, stream("abc").StatusCode)
+
+	//shutting down ends the streams
+	apiHandler.EndStreams()
+	_, err = io.ReadAll(events)
+	assert.NoError(t, err)
+}
+
+func TestClosedPolls(t *testing.T) {
+	r, _ := newTestRouter(t)
+	seedVoter(t, r, testVoter(1))
+
+	vote := func(pollId uint) *httptest.ResponseRecorder {
+		return doRequest(r, http.MethodPost, "/voter/1", db.VoterHistory{PollId: pollId, VoteId: 1})
+	}
+
+	//until a poll is opened or closed any poll can be voted in
+	assert.Equal(t, http.StatusCreated, vote(2).Code)
+
+	w := doRequest(r, http.MethodPost, "/polls/3/open", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"pollId":3,"open":true}`, w.Body.String())
+	assert.Equal(t, http.StatusCreated, vote(3).Code)
+
+	//a poll that was never opened
+	w = vote(4)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.JSONEq(t, `{"error":{"code":"poll_closed","message":"poll 4 is not open"}}`, w.Body.String())
+
+	w = doRequest(r, http.MethodPost, "/polls/3/close", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"pollId":3,"open":false}`, w.Body.String())
+	w = doRequest(r, http.MethodPut, "/voter/1/polls/3", db.VoterHistory{PollId: 3, VoteId: 2})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.JSONEq(t, `{"error":{"code":"poll_closed","message":"poll 3 is not open"}}`, w.Body.String())
+
+	//closing a poll keeps the votes in it
+	w = doRequest(r, http.MethodGet, "/voter/1/polls/3", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	assert.Equal(t, http.StatusBadRequest, doRequest(r, http.MethodPost, "/polls/abc/open", nil).Code)
+}
+
+func TestDuplicateEmails(t *testing.T) {
+	r, _ := newTestRouter(t)
+	seedVoter(t, r, testVoter(1))
+	seedVoter(t, r, testVoter(2))
+
+	dup := testVoter(3)
+	dup.Email = "voter1@example.com"
+	w := doRequest(r, http.MethodPost, "/voter", dup)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.JSONEq(t, `{"error":{"code":"email_taken","message":"email already belongs to another voter"}}`, w.Body.String())
+
+	//keeping the voter's own email is fine
+	w = doRequest(r, http.MethodPut, "/voter/1", `{"Name":"Renamed","Email":"voter1@example.com"}`)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	w = doRequest(r, http.MethodPut, "/voter/1", `{"Name":"Renamed","Email":"voter2@example.com"}`)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.JSONEq(t, `{"error":{"code":"email_taken","message":"email already belongs to another voter"}}`, w.Body.String())
+	w = doRequest(r, http.MethodPatch, "/voter/1", `{"Email":"voter2@example.com"}`)
+	assert.Equal(t, http.StatusConflict, w.Code)
+}
+
+func TestEmailsAreNormalized(t *testing.T) {
+	r, _ := newTestRouter(t)
+
+	w := doRequest(r, http.MethodPost, "/voter", `{"VoterId":1,"Name":"Mixed Case","Email":"User@Example.com"}`)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var voter db.Voter
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &voter))
+	assert.Equal(t, "user@example.com", voter.Email)
+
+	w = doRequest(r, http.MethodGet, "/voter/by-email?email=USER@example.com", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = doRequest(r, http.MethodPost, "/voter", `{"VoterId":2,"Name":"Copy","Email":"user@EXAMPLE.com"}`)
+	assert.Equal(t, http.StatusConflict, w.Code)
+}
+
+func TestCorruptVoterSkipped(t *testing.T) {
+	r, mr := newTestRouter(t)
+	for id := uint(1); id <= 2; id++ {
+		seedVoter(t, r, testVoter(id))
+	}
+	mr.Set("voter:7", `{"VoterId":"seven"}`)
+
+	w := doRequest(r, http.MethodGet, "/voter", nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var voters []db.Voter
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &voters))
+	assert.Len(t, voters, 2)
+	assert.Equal(t, "1", w.Header().Get(api.SkippedVotersHeader))
+
+	w = doRequest(r, http.MethodGet, "/voter/1", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get(api.SkippedVotersHeader))
+
+	w = doRequest(r, http.MethodGet, "/voter/7", nil)
+	assert.Equal(t, http.StatusInternalServerError, w.Code, w.Body.String())
+	assert.Contains(t, w.Body.String(), `"code":"internal_error"`)
+}
+
+func TestListVotersByIds(t *testing.T) {
+	r, _ := newTestRouter(t)
+	for id := uint(1); id <= 3; id++ {
+		seedVoter(t, r, testVoter(id))
+	}
+
+	w := doRequest(r, http.MethodGet, "/voter?ids=3,42,1,7&fields=VoterId", nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.JSONEq(t, `[{"VoterId":3},{"VoterId":1}]`, w.Body.String())
+	assert.Equal(t, "42,7", w.Header().Get(api.MissingIdsHeader))
+	assert.Equal(t, "2", w.Header().Get(api.TotalCountHeader))
+
+	w = doRequest(r, http.MethodGet, "/voter?ids=2", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var voters []db.Voter
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &voters))
+	require.Len(t, voters, 1)
+	assert.Equal(t, testVoter(2).Email, voters[0].Email)
+	assert.Equal(t, testVoter(2).VoteHistory, voters[0].VoteHistory)
+	assert.Empty(t, w.Header().Get(api.MissingIdsHeader))
+
+	w = doRequest(r, http.MethodGet, "/voter?ids=42", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `[]`, w.Body.String())
+
+	for _, query := range []string{"?ids=", "?ids=1,x", "?ids=0", "?ids=1&sort=name", "?ids=1&limit=1"} {
+		w = doRequest(r, http.MethodGet, "/voter"+query, nil)
+		assert.Equal(t, http.StatusBadRequest, w.Code, query)
+	}
+	tooMany := strings.TrimSuffix(strings.Repeat("1,", 501), ",")
+	assert.Equal(t, http.StatusBadRequest, doRequest(r, http.MethodGet, "/voter?ids="+tooMany, nil).Code)
+}
@@ -0,0 +1,135 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/redis/go-redis/v9"
+)
+
+// Metrics holds the prometheus collectors for the voter api.  They live in
+// their own registry rather than the global default one so that more than
+// one instance can exist, which the tests rely on.
+type Metrics struct {
+	registry        *prometheus.Registry
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	redisErrors     prometheus.Counter
+}
+
+// New creates the collectors, countVoters is called on every scrape to
+// report the number of voters
+func New(countVoters func() (int, error)) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "voter_api_requests_total",
+			Help: "Number of HTTP requests handled",
+		}, []string{"method", "path", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "voter_api_request_duration_seconds",
+			Help:    "How long HTTP requests took to handle",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method", "path", "status"}),
+		redisErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "voter_api_redis_errors_total",
+			Help: "Number of redis commands that failed",
+		}),
+	}
+
+	voters := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "voter_api_voters",
+		Help: "Number of voters currently stored",
+	}, func() float64 {
+		n, err := countVoters()
+		if err != nil {
+			slog.Warn("Error counting voters for metrics", "error", err)
+			return 0
+		}
+		return float64(n)
+	})
+
+	m.registry.MustRegister(
+		m.requests,
+		m.requestDuration,
+		m.redisErrors,
+		voters,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// Middleware records the count and latency of every request.  Requests are
+// labelled with the route template, e.g. /voter/:id, rather than the actual
+// path so the number of label values stays small.
+func (m *Metrics) Middleware(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+
+	path := c.FullPath()
+	if path == "" {
+		path = "unmatched"
+	}
+	status := strconv.Itoa(c.Writer.Status())
+
+	m.requests.WithLabelValues(c.Request.Method, path, status).Inc()
+	m.requestDuration.WithLabelValues(c.Request.Method, path, status).Observe(time.Since(start).Seconds())
+}
+
+// Handler serves the metrics in the prometheus text format
+func (m *Metrics) Handler() gin.HandlerFunc {
+	return gin.WrapH(promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+}
+
+// RedisHook returns a go-redis hook that counts failed commands.  A nil
+// reply is how redis says a key does not exist, so it is not counted.
+func (m *Metrics) RedisHook() redis.Hook {
+	return redisErrorHook{counter: m.redisErrors}
+}
+
+type redisErrorHook struct {
+	counter prometheus.Counter
+}
+
+func (h redisErrorHook) DialHook(next redis.DialHook) redis.DialHook {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := next(ctx, network, addr)
+		if err != nil {
+			h.counter.Inc()
+		}
+		return conn, err
+	}
+}
+
+func (h redisErrorHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		err := next(ctx, cmd)
+		h.observe(err)
+		return err
+	}
+}
+
+func (h redisErrorHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		err := next(ctx, cmds)
+		for _, cmd := range cmds {
+			h.observe(cmd.Err())
+		}
+		return err
+	}
+}
+
+func (h redisErrorHook) observe(err error) {
+	if err != nil && !errors.Is(err, redis.Nil) {
+		h.counter.Inc()
+	}
+}
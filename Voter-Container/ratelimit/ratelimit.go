@@ -0,0 +1,102 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/time/rate"
+)
+
+// Limiter is a token bucket per client IP.  Each client may make rps
+// requests per second on average and up to burst at once, anything beyond
+// that is answered with 429 Too Many Requests.
+type Limiter struct {
+	rps   rate.Limit
+	burst int
+
+	mu      sync.Mutex
+	clients map[string]*client
+	now     func() time.Time
+}
+
+type client struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// New returns a limiter allowing rps requests per second with bursts of up
+// to burst requests from each client IP
+func New(rps float64, burst int) *Limiter {
+	return &Limiter{
+		rps:     rate.Limit(rps),
+		burst:   burst,
+		clients: make(map[string]*client),
+		now:     time.Now,
+	}
+}
+
+// Middleware rejects the request with 429 and a Retry-After header, in
+// whole seconds, when the client has used up its bucket
+func (l *Limiter) Middleware(c *gin.Context) {
+	now := l.now()
+	reservation := l.bucket(c.ClientIP(), now).ReserveN(now, 1)
+
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		//We are not going to wait, give the token back
+		reservation.CancelAt(now)
+		retryAfter := int(math.Ceil(delay.Seconds()))
+		c.Header("Retry-After", strconv.Itoa(retryAfter))
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": gin.H{"code": "rate_limited", "message": "rate limit exceeded"}})
+		return
+	}
+
+	c.Next()
+}
+
+func (l *Limiter) bucket(ip string, now time.Time) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	cl, ok := l.clients[ip]
+	if !ok {
+		cl = &client{limiter: rate.NewLimiter(l.rps, l.burst)}
+		l.clients[ip] = cl
+	}
+	cl.lastSeen = now
+	return cl.limiter
+}
+
+// RemoveIdle forgets clients that have not made a request for idle, a
+// forgotten client starts again with a full bucket
+func (l *Limiter) RemoveIdle(idle time.Duration) {
+	cutoff := l.now().Add(-idle)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for ip, cl := range l.clients {
+		if cl.lastSeen.Before(cutoff) {
+			delete(l.clients, ip)
+		}
+	}
+}
+
+// RunCleanup calls RemoveIdle every interval until ctx is cancelled, so the
+// buckets of clients that went away do not pile up
+func (l *Limiter) RunCleanup(ctx context.Context, interval, idle time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			l.RemoveIdle(idle)
+		}
+	}
+}
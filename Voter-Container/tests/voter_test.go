@@ -56,14 +56,14 @@ func newRandVoter(id uint) db.Voter {
 
 func Test_LoadDB(t *testing.T) {
 	numLoad := 3
-	for i := 0; i < numLoad; i++ {
+	for i := 1; i <= numLoad; i++ {
 		item := newRandVoter(uint(i))
 		rsp, err := cli.R().
 			SetBody(item).
 			Post(BASE_API + "/voter")
 
 		assert.Nil(t, err)
-		assert.Equal(t, 200, rsp.StatusCode())
+		assert.Equal(t, 201, rsp.StatusCode())
 	}
 }
 
@@ -120,7 +120,7 @@ func Test_AddPollToVoter(t *testing.T) {
 		Post(BASE_API + "/voter/2")
 
 	assert.Nil(t, err)
-	assert.Equal(t, 200, rsp.StatusCode())
+	assert.Equal(t, 201, rsp.StatusCode())
 
 }
 